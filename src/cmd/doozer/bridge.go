@@ -0,0 +1,50 @@
+package main
+
+import (
+	"doozer/bridge"
+	"doozer/client"
+	"flag"
+	"os"
+)
+
+
+var bridgeTo = flag.String("to", "", "bridge: send events to this TCP address (default: stdout)")
+
+
+func init() {
+	cmds["bridge"] = cmd{bridgeCmd, "<name> <glob>", "forward changes to another system"}
+	cmdHelp["bridge"] = `Sends each change to a file matching <glob> on, one line of JSON per
+change, to stdout or, with -to <addr>, a TCP connection to <addr>.
+Each line is an object of this form:
+
+  {"Rev":<rev>,"Path":<path>,"Body":<body>,"Op":"set" or "del"}
+
+The rev of the last change sent is saved in /consumers/<name>, so a
+bridge run again with the same <name> carries on from where the last
+one stopped. A change may be sent twice if the bridge stopped just
+after sending it. The first run with a new <name> starts with the
+changes made from now on.
+
+Runs until an error occurs.
+`
+}
+
+
+func bridgeCmd(name, glob string) {
+	c := client.New("<test>", *addr)
+
+	rev, err := c.Rev()
+	if err != nil {
+		bail(err)
+	}
+
+	var s bridge.Sink = bridge.Writer{os.Stdout}
+	if *bridgeTo != "" {
+		s = &bridge.TCP{Addr: *bridgeTo}
+	}
+
+	err = bridge.Run(c, name, glob, rev+1, s)
+	if err != nil {
+		bail(err)
+	}
+}
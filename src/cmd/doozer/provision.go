@@ -0,0 +1,57 @@
+package main
+
+import (
+	"doozer/client"
+	"doozer/manifest"
+	"doozer/proto"
+	"doozer/store"
+	"fmt"
+	"os"
+)
+
+
+func init() {
+	cmds["provision"] = cmd{provision, "<file>", "make the files a manifest lists"}
+	cmdHelp["provision"] = `Makes each file listed in the manifest <file> that is missing, leaving
+files that already exist as they are, so it is safe to run again.
+
+A manifest has one file per line, as <path>=<body>; blank lines and
+lines starting with # are skipped. A doozerd started with -manifest
+applies one when it starts a new cluster.
+
+Prints the number of files made on stdout.
+`
+}
+
+
+func provision(file string) {
+	f, err := os.Open(file, os.O_RDONLY, 0)
+	if err != nil {
+		bail(err)
+	}
+	defer f.Close()
+
+	es, err := manifest.Parse(f)
+	if err != nil {
+		bail(err)
+	}
+
+	c := client.New("<test>", *addr)
+
+	made := 0
+	for _, e := range es {
+		_, err := c.Set(e.Path, store.Missing, []byte(e.Body))
+		if r, ok := err.(*client.ResponseError); ok {
+			switch r.Code {
+			case proto.Response_REV_MISMATCH, proto.Response_ISDIR:
+				continue // already there
+			}
+		}
+		if err != nil {
+			bail(err)
+		}
+		made++
+	}
+
+	fmt.Println(made)
+}
@@ -3,8 +3,13 @@ package main
 
 import (
 	"doozer"
+	"doozer/manifest"
+	"doozer/server"
+	"doozer/store"
+	"doozer/web"
 	"flag"
 	"fmt"
+	"io/ioutil"
 	"net"
 	"os"
 	"log"
@@ -21,6 +26,27 @@ var (
 	pi          = flag.Float64("pulse", 1, "how often (in seconds) to set applied key")
 	fd          = flag.Float64("fill", .1, "delay (in seconds) to fill unowned seqns")
 	kt          = flag.Float64("timeout", 60, "timeout (in seconds) to kick inactive nodes")
+	faults      = flag.Bool("faults", false, "obey fault injection settings in /ctl/fault (testing only)")
+	bodySoft    = flag.Int64("body-soft", 0, "warn about set bodies larger than this many bytes (0 for no limit)")
+	bodyHard    = flag.Int64("body-hard", 0, "refuse set bodies larger than this many bytes (0 for no limit)")
+	watchSoft   = flag.Int64("watch-soft", 0, "warn when a client holds more than this many watches (0 for no limit)")
+	watchHard   = flag.Int64("watch-hard", 0, "refuse watches past this many per client (0 for no limit)")
+	bulkLoad    = flag.Bool("bulk-load", false, "accept BULK requests, for loading a dataset (operators only)")
+	allowClean  = flag.Bool("allow-clean", false, "let CLEAN requests discard history now (operators only)")
+	rateLimit   = flag.String("rate-limit", "", "limit writes per file, as glob=rate[/burst],... (rate in writes per second)")
+	webLog      = flag.Bool("web-log", false, "serve the mutation log, secret bodies included, at /log in the web view")
+	logKey      = flag.String("log-key", "", "sign the log served by the web view with the key in this file")
+	catchUpRate = flag.Float64("catchup-rate", 0, "send peers catching up from this one at most this many bytes per second (0 for no limit)")
+	compress    = flag.Int("compress-over", 0, "keep set bodies larger than this many bytes compressed in memory (0 to keep them as they are)")
+	foldCase    = flag.Bool("fold-case", false, "treat paths outside /ctl as case-insensitive (every peer must agree)")
+	protect     = flag.String("protect", "", "refuse dels and clobbers without force of files matching these globs, as glob,...")
+	provision   = flag.String("manifest", "", "when starting a new cluster, make the missing files listed in this manifest")
+	reserve     = flag.String("reserve", "", "refuse client writes under these paths, which the cluster itself may still write, as path,...")
+	trash       = flag.Float64("trash", 0, "keep deleted files in /trash for this many seconds (0 to delete outright)")
+	mcastAddr   = flag.String("multicast", "", "send changes to this UDP multicast group, as host:port")
+	mcastGlob   = flag.String("multicast-glob", "/**", "send changes only to files matching this glob")
+	shedBacklog = flag.String("shed-backlog", "", "when the apply backlog passes these sizes, refuse new watches, then bulk writes, then other client writes, as watches,bulk,writes (empty for no limit)")
+	shedHeap    = flag.String("shed-heap", "", "when heap in use passes these many bytes, refuse new watches, then bulk writes, then other client writes, as watches,bulk,writes (empty for no limit)")
 )
 
 
@@ -67,6 +93,68 @@ func main() {
 		}
 	}
 
+	doozer.AllowFaults = *faults
+	doozer.BodyLimit = server.Limit{*bodySoft, *bodyHard}
+	doozer.WatchLimit = server.Limit{*watchSoft, *watchHard}
+	doozer.AllowBulk = *bulkLoad
+	doozer.AllowClean = *allowClean
+	doozer.RateLimits, err = server.ParseRateLimits(*rateLimit)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	doozer.Trash = ns(*trash)
+	doozer.CatchUpRate = *catchUpRate
+	doozer.Shed, err = server.ParseShedPolicy(*shedBacklog, *shedHeap)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	doozer.FoldCase = *foldCase
+	doozer.CompressOver = *compress
+	if *mcastAddr != "" {
+		doozer.MulticastAddr, err = net.ResolveUDPAddr(*mcastAddr)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		doozer.MulticastGlob, err = store.CompileGlob(*mcastGlob)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+	}
+	doozer.Protect, err = server.ParseProtect(*protect)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	doozer.Reserve, err = server.ParseReserve(*reserve)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	if *provision != "" {
+		f, err := os.Open(*provision, os.O_RDONLY, 0)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		doozer.Manifest, err = manifest.Parse(f)
+		f.Close()
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+	}
+	web.ServeLog = *webLog
+	if *logKey != "" {
+		web.LogKey, err = ioutil.ReadFile(*logKey)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+	}
 	doozer.Main(*clusterName, *attachAddr, conn, listener, wl, ns(*pi), ns(*fd), ns(*kt))
 	panic("main exit")
 }
@@ -15,19 +15,27 @@ CMD_REQS="
 "
 
 PKGS="
+    gocount
     quiet
     store
+    store/bench
     consensus
     proto
+    client
+    bridge
     lock
     server
     web
-    client
     test
     session
+    ttl
+    sched
+    checksum
+    manifest
     member
     gc
     .
+    doozertest
 "
 
 CMDS="
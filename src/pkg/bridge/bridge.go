@@ -0,0 +1,102 @@
+// Package bridge forwards changes in doozer to some other message
+// system, so that programs that don't speak the doozer protocol can
+// follow them.
+package bridge
+
+import (
+	"doozer/client"
+	"io"
+	"json"
+	"net"
+	"os"
+)
+
+
+// A Sink hands a doozer event on to some other system. If Send returns
+// an error, the event may be sent again later.
+type Sink interface {
+	Send(ev *client.Event) os.Error
+}
+
+
+// How a Writer or TCP sink encodes each event: as a JSON object on a
+// line of its own.
+type Message struct {
+	Rev  int64
+	Path string
+	Body string
+	Op   string // "set" or "del"
+}
+
+
+func encode(ev *client.Event) ([]byte, os.Error) {
+	m := Message{Rev: ev.Rev, Path: ev.Path, Body: string(ev.Body), Op: "set"}
+	if ev.IsDel() {
+		m.Op = "del"
+	}
+
+	b, err := json.Marshal(m)
+	if err != nil {
+		return nil, err
+	}
+	return append(b, '\n'), nil
+}
+
+
+// Writes each event to W as a Message. Use os.Stdout to feed a pipeline.
+type Writer struct {
+	W io.Writer
+}
+
+
+func (s Writer) Send(ev *client.Event) os.Error {
+	b, err := encode(ev)
+	if err != nil {
+		return err
+	}
+
+	_, err = s.W.Write(b)
+	return err
+}
+
+
+// Writes each event as a Message to a TCP connection to Addr, dialing
+// it the first time and after any error.
+type TCP struct {
+	Addr string
+	c    net.Conn
+}
+
+
+func (s *TCP) Send(ev *client.Event) os.Error {
+	b, err := encode(ev)
+	if err != nil {
+		return err
+	}
+
+	if s.c == nil {
+		s.c, err = net.Dial("tcp", "", s.Addr)
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err = s.c.Write(b)
+	if err != nil {
+		s.c.Close()
+		s.c = nil
+	}
+	return err
+}
+
+
+// Sends each change to a file matching glob to s, until an error
+// occurs. Progress is saved under the consumer name, as with
+// client.Consume, so a bridge that is restarted with the same name
+// picks up where it left off, and sends each event at least once.
+// A new bridge starts with changes made at or after rev from.
+func Run(cl *client.Client, name, glob string, from int64, s Sink) os.Error {
+	return cl.Consume(name, glob, from, func(ev *client.Event) os.Error {
+		return s.Send(ev)
+	})
+}
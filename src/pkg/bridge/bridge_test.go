@@ -0,0 +1,54 @@
+package bridge
+
+import (
+	"bufio"
+	"bytes"
+	"doozer/client"
+	"github.com/bmizerany/assert"
+	"json"
+	"net"
+	"testing"
+)
+
+
+func TestWriter(t *testing.T) {
+	var b bytes.Buffer
+	s := Writer{&b}
+	assert.Equal(t, nil, s.Send(&client.Event{Rev: 3, Path: "/a", Body: []byte("x"), Flag: client.Set}))
+	assert.Equal(t, nil, s.Send(&client.Event{Rev: 4, Path: "/a", Flag: client.Del}))
+
+	var m Message
+	line, err := b.ReadBytes('\n')
+	assert.Equal(t, nil, err)
+	assert.Equal(t, nil, json.Unmarshal(line, &m))
+	assert.Equal(t, Message{3, "/a", "x", "set"}, m)
+
+	line, err = b.ReadBytes('\n')
+	assert.Equal(t, nil, err)
+	assert.Equal(t, nil, json.Unmarshal(line, &m))
+	assert.Equal(t, Message{4, "/a", "", "del"}, m)
+}
+
+
+func TestTCP(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		panic(err)
+	}
+	defer l.Close()
+
+	s := &TCP{Addr: l.Addr().String()}
+	assert.Equal(t, nil, s.Send(&client.Event{Rev: 3, Path: "/a", Body: []byte("x"), Flag: client.Set}))
+
+	c, err := l.Accept()
+	if err != nil {
+		panic(err)
+	}
+	defer c.Close()
+
+	var m Message
+	line, err := bufio.NewReader(c).ReadBytes('\n')
+	assert.Equal(t, nil, err)
+	assert.Equal(t, nil, json.Unmarshal(line, &m))
+	assert.Equal(t, Message{3, "/a", "x", "set"}, m)
+}
@@ -0,0 +1,115 @@
+package checksum
+
+import (
+	"crypto/sha1"
+	"doozer/consensus"
+	"doozer/store"
+	"fmt"
+	"strings"
+)
+
+// Each directory in Dir names a checksum. Its file "glob" holds a glob
+// pattern, and the cluster keeps its file "sum" up to date with the Sum
+// of the files that match. For example, once /ctl/checksums/app/glob
+// is set to /app/*/config/**, /ctl/checksums/app/sum changes whenever
+// any of those files does. Files in /ctl are never summed: they change
+// as the cluster runs, and a sum of them would change with each write
+// of a sum.
+const Dir = "/ctl/checksums"
+
+var globs = store.MustCompileGlob(Dir + "/*/glob")
+
+
+// Returns a hash, in hex, of the path and body of every file in g that
+// matches glob, except those in /ctl. It depends only on those paths and
+// bodies, not on revs, so a client can compute it over its own copy of
+// the files and compare it with the one the cluster publishes.
+//
+// The hash is the SHA-1 of, for each file in path order, its path, a
+// zero byte, its body, and another zero byte.
+func Sum(g store.Getter, glob *store.Glob) string {
+	h := sha1.New()
+	store.Walk(g, glob, func(path, body string, _ int64) bool {
+		if isCtl(path) {
+			return false
+		}
+		h.Write([]byte(path))
+		h.Write([]byte{0})
+		h.Write([]byte(body))
+		h.Write([]byte{0})
+		return false
+	})
+	return fmt.Sprintf("%x", h.Sum())
+}
+
+
+// Update receives nanosecond time values from t. For each time
+// received, if self leads the cluster (see consensus.Leads), Update
+// recomputes every checksum in Dir as of the seqn of st, and writes
+// each one that has changed. It skips the work if nothing outside /ctl,
+// and no checksum in Dir, has changed since it last did it.
+//
+// Parameter t can be the output chan of a time.Ticker.
+func Update(st *store.Store, p consensus.Proposer, self string, t <-chan int64) {
+	var last, lastDir int64
+	for _ = range t {
+		_, g := st.Snap()
+		if !consensus.Leads(g, self) {
+			last, lastDir = 0, 0
+			continue
+		}
+
+		rev, dirRev := treeRev(g), store.StatTree(g, Dir).Rev
+		if rev == last && dirRev == lastDir {
+			continue
+		}
+		last, lastDir = rev, dirRev
+
+		for path, sum := range stale(g) {
+			_, rev := g.Get(path)
+			consensus.Set(p, path, []byte(sum), rev)
+		}
+	}
+}
+
+
+// Returns the last seqn at which anything outside /ctl changed in g,
+// counting entries added to or removed from the root.
+func treeRev(g store.Getter) (rev int64) {
+	rev = store.DirRev(g, "/")
+	for _, ent := range store.Getdir(g, "/") {
+		if ent == "ctl" {
+			continue
+		}
+		if r := store.StatTree(g, "/"+ent).Rev; r > rev {
+			rev = r
+		}
+	}
+	return rev
+}
+
+
+func isCtl(path string) bool {
+	return path == "/ctl" || strings.HasPrefix(path, "/ctl/")
+}
+
+
+// Returns the new body of each sum file in g that is out of date, keyed
+// by its path. A checksum whose glob doesn't compile is skipped.
+func stale(g store.Getter) map[string]string {
+	sums := make(map[string]string)
+	store.Walk(g, globs, func(path, body string, _ int64) bool {
+		glob, err := store.CompileGlob(body)
+		if err != nil {
+			return false
+		}
+
+		sumPath := path[:len(path)-len("glob")] + "sum"
+		sum := Sum(g, glob)
+		if store.GetString(g, sumPath) != sum {
+			sums[sumPath] = sum
+		}
+		return false
+	})
+	return sums
+}
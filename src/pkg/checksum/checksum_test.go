@@ -0,0 +1,98 @@
+package checksum
+
+import (
+	"doozer/store"
+	"doozer/test"
+	"github.com/bmizerany/assert"
+	"testing"
+)
+
+func TestUpdate(t *testing.T) {
+	st := store.New()
+	defer close(st.Ops)
+	fp := &test.FakeProposer{Store: st}
+	tc := make(chan int64, 1)
+	defer close(tc)
+	go Update(st, fp, "a", tc)
+
+	fp.Propose([]byte(store.MustEncodeSet("/ctl/cal/0", "a", store.Clobber)))
+	fp.Propose([]byte(store.MustEncodeSet("/app/a/config/x", "1", store.Clobber)))
+	fp.Propose([]byte(store.MustEncodeSet(Dir+"/app/glob", "/app/*/config/**", store.Clobber)))
+
+	ch := st.Watch(store.MustCompileGlob(Dir + "/app/sum"))
+	tc <- 1
+
+	ev := <-ch
+	assert.Equal(t, Sum(ev, store.MustCompileGlob("/app/*/config/**")), ev.Body)
+}
+
+
+func TestUpdateNotLeader(t *testing.T) {
+	st := store.New()
+	defer close(st.Ops)
+	fp := &test.FakeProposer{Store: st}
+	tc := make(chan int64)
+	go Update(st, fp, "b", tc)
+
+	fp.Propose([]byte(store.MustEncodeSet("/ctl/cal/0", "a", store.Clobber)))
+	fp.Propose([]byte(store.MustEncodeSet(Dir+"/app/glob", "/**", store.Clobber)))
+	tc <- 1
+	tc <- 1 // the first tick has been handled
+	close(tc)
+
+	_, rev := st.Get(Dir + "/app/sum")
+	assert.Equal(t, store.Missing, rev)
+}
+
+
+func TestSumIgnoresCtl(t *testing.T) {
+	st := store.New()
+	defer close(st.Ops)
+	glob := store.MustCompileGlob("/**")
+
+	st.Ops <- store.Op{1, store.MustEncodeSet("/a", "1", store.Clobber)}
+	<-st.Seqns
+	before := Sum(st, glob)
+
+	st.Ops <- store.Op{2, store.MustEncodeSet("/ctl/err", "x", store.Clobber)}
+	st.Ops <- store.Op{3, store.MustEncodeSet("/ctl/node/a/addr", "x", store.Clobber)}
+	<-st.Seqns
+	assert.Equal(t, before, Sum(st, glob))
+}
+
+
+func TestSumIgnoresRevs(t *testing.T) {
+	st := store.New()
+	defer close(st.Ops)
+	glob := store.MustCompileGlob("/a/**")
+
+	st.Ops <- store.Op{1, store.MustEncodeSet("/a/x", "1", store.Clobber)}
+	st.Ops <- store.Op{2, store.MustEncodeSet("/b", "1", store.Clobber)}
+	<-st.Seqns
+	before := Sum(st, glob)
+
+	st.Ops <- store.Op{3, store.MustEncodeSet("/a/x", "1", store.Clobber)}
+	st.Ops <- store.Op{4, store.MustEncodeSet("/b", "2", store.Clobber)}
+	<-st.Seqns
+	assert.Equal(t, before, Sum(st, glob))
+
+	st.Ops <- store.Op{5, store.MustEncodeSet("/a/x", "2", store.Clobber)}
+	<-st.Seqns
+	assert.NotEqual(t, before, Sum(st, glob))
+}
+
+
+func TestStale(t *testing.T) {
+	st := store.New()
+	defer close(st.Ops)
+
+	st.Ops <- store.Op{1, store.MustEncodeSet("/a/x", "1", store.Clobber)}
+	st.Ops <- store.Op{2, store.MustEncodeSet(Dir+"/a/glob", "/a/**", store.Clobber)}
+	st.Ops <- store.Op{3, store.MustEncodeSet(Dir+"/b/glob", "/b/**", store.Clobber)}
+	st.Ops <- store.Op{4, store.MustEncodeSet(Dir+"/b/sum", Sum(st, store.MustCompileGlob("/b/**")), store.Clobber)}
+	st.Ops <- store.Op{5, store.MustEncodeSet(Dir+"/c/glob", "a", store.Clobber)}
+	<-st.Seqns
+
+	exp := map[string]string{Dir + "/a/sum": Sum(st, store.MustCompileGlob("/a/**"))}
+	assert.Equal(t, exp, stale(st))
+}
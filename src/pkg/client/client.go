@@ -4,19 +4,28 @@ import (
 	"doozer/proto"
 	"encoding/binary"
 	"fmt"
+	"hash/crc32"
 	"log"
 	"net"
 	"io"
 	"os"
 	pb "goprotobuf.googlecode.com/hg/proto"
+	"strconv"
 	"sync"
+	"time"
 )
 
+// How many times Update reads and tries to write a file before it
+// gives up.
+const UpdateTries = 10
+
 const (
 	Valid = 1 << iota
 	Done
-	Set
-	Del
+	Set = proto.EventSet
+	Del = proto.EventDel
+
+	Heartbeat = 1 << 4
 )
 
 
@@ -26,17 +35,24 @@ var (
 )
 
 var (
-	cancel  = proto.NewRequest_Verb(proto.Request_CANCEL)
-	checkin = proto.NewRequest_Verb(proto.Request_CHECKIN)
-	del     = proto.NewRequest_Verb(proto.Request_DEL)
-	get     = proto.NewRequest_Verb(proto.Request_GET)
-	nop     = proto.NewRequest_Verb(proto.Request_NOP)
-	rev     = proto.NewRequest_Verb(proto.Request_REV)
-	set     = proto.NewRequest_Verb(proto.Request_SET)
-	walk    = proto.NewRequest_Verb(proto.Request_WALK)
-	watch   = proto.NewRequest_Verb(proto.Request_WATCH)
-	stat    = proto.NewRequest_Verb(proto.Request_STAT)
-	getdir  = proto.NewRequest_Verb(proto.Request_GETDIR)
+	cancel   = proto.NewRequest_Verb(proto.Request_CANCEL)
+	checkin  = proto.NewRequest_Verb(proto.Request_CHECKIN)
+	del      = proto.NewRequest_Verb(proto.Request_DEL)
+	get      = proto.NewRequest_Verb(proto.Request_GET)
+	nop      = proto.NewRequest_Verb(proto.Request_NOP)
+	rev      = proto.NewRequest_Verb(proto.Request_REV)
+	set      = proto.NewRequest_Verb(proto.Request_SET)
+	walk     = proto.NewRequest_Verb(proto.Request_WALK)
+	watch    = proto.NewRequest_Verb(proto.Request_WATCH)
+	stat     = proto.NewRequest_Verb(proto.Request_STAT)
+	getdir   = proto.NewRequest_Verb(proto.Request_GETDIR)
+	backfill = proto.NewRequest_Verb(proto.Request_BACKFILL)
+	bulk     = proto.NewRequest_Verb(proto.Request_BULK)
+	pin      = proto.NewRequest_Verb(proto.Request_PIN)
+	limits   = proto.NewRequest_Verb(proto.Request_LIMITS)
+	clean    = proto.NewRequest_Verb(proto.Request_CLEAN)
+	ids      = proto.NewRequest_Verb(proto.Request_IDS)
+	snapshot = proto.NewRequest_Verb(proto.Request_SNAPSHOT)
 )
 
 
@@ -51,27 +67,77 @@ func (r *ResponseError) String() string {
 }
 
 
-// Response errors
+// Response errors. A response with one of these codes and no detail
+// yields the error itself, but servers may explain an error, so use
+// IsErr, not ==, to tell which one a request failed with. The client
+// itself returns ErrBadSum, and ErrNotTrash, which has the code of
+// ErrNoEnt.
 var (
 	ErrNotDir      = &ResponseError{proto.Response_NOTDIR, "not a directory"}
 	ErrIsDir       = &ResponseError{proto.Response_ISDIR, "is a directory"}
+	ErrNoEnt       = &ResponseError{proto.Response_NOENT, "no such file or directory"}
 	ErrRevMismatch = &ResponseError{proto.Response_REV_MISMATCH, "rev mismatch"}
 	ErrTooLate     = &ResponseError{proto.Response_TOO_LATE, "that rev is gone"}
+	ErrBadPath     = &ResponseError{proto.Response_BAD_PATH, "bad path"}
+	ErrBadValue    = &ResponseError{proto.Response_BAD_VALUE, "bad value"}
+	ErrProtected   = &ResponseError{proto.Response_PROTECTED, "protected path"}
+	ErrReserved    = &ResponseError{proto.Response_RESERVED, "reserved path"}
+	ErrOverLimit   = &ResponseError{proto.Response_OVER_LIMIT, "over limit"}
+	ErrOverloaded  = &ResponseError{proto.Response_OVERLOADED, "overloaded"}
+	ErrNoSession   = &ResponseError{proto.Response_NO_SESSION, "session has ended"}
+	ErrBadSum      = &ResponseError{proto.Response_BAD_SUM, "body does not match its checksum"}
+	ErrNotTrash    = &ResponseError{proto.Response_NOENT, "not in the trash"}
 	respErrors     = map[int32]*ResponseError{
 		proto.Response_NOTDIR:       ErrNotDir,
 		proto.Response_ISDIR:        ErrIsDir,
+		proto.Response_NOENT:        ErrNoEnt,
 		proto.Response_REV_MISMATCH: ErrRevMismatch,
 		proto.Response_TOO_LATE:     ErrTooLate,
+		proto.Response_BAD_PATH:     ErrBadPath,
+		proto.Response_BAD_VALUE:    ErrBadValue,
+		proto.Response_PROTECTED:    ErrProtected,
+		proto.Response_RESERVED:     ErrReserved,
+		proto.Response_OVER_LIMIT:   ErrOverLimit,
+		proto.Response_OVERLOADED:   ErrOverloaded,
+		proto.Response_NO_SESSION:   ErrNoSession,
+		proto.Response_BAD_SUM:      ErrBadSum,
 	}
 )
 
 
+// Reports whether err is a response error with the same code as
+// target, one of the response errors above, whatever detail the server
+// sent with it.
+func IsErr(err os.Error, target *ResponseError) bool {
+	e, ok := err.(*ResponseError)
+	return ok && e.Code == target.Code
+}
+
+
 type Event struct {
 	Rev  int64
 	Path string
 	Body []byte
 	Flag int32
 	Err  os.Error
+
+	// For a set, the CRC-32 (IEEE) of Body, as the server computed it;
+	// zero if the server didn't send one.
+	Sum uint32
+
+	// From WatchMutations, the mutation the server applied at Rev.
+	Mut []byte
+}
+
+
+// Returns the client's form of e, with the seqn as Rev.
+func eventOf(e *proto.Event) *Event {
+	return &Event{
+		Rev:  pb.GetInt64(e.Seqn),
+		Path: pb.GetString(e.Path),
+		Body: e.Body,
+		Flag: pb.GetInt32(e.Flags),
+	}
 }
 
 
@@ -85,6 +151,13 @@ func (e Event) IsDel() bool {
 }
 
 
+// Reports whether e is a heartbeat, as WatchHeartbeat asks for, rather
+// than a change. Only its Rev is set: the server's rev when it was sent.
+func (e Event) IsHeartbeat() bool {
+	return e.Flag&Heartbeat > 0
+}
+
+
 type T proto.Request
 
 type R proto.Response
@@ -112,6 +185,16 @@ func (r *R) err() os.Error {
 }
 
 
+// Checks the body in r against the checksum the server sent with it, if
+// any, so that a body damaged on the way is reported, not returned.
+func (r *R) checkSum() os.Error {
+	if r.Sum != nil && crc32.ChecksumIEEE(r.Value) != *r.Sum {
+		return ErrBadSum
+	}
+	return nil
+}
+
+
 func (r *R) String() string {
 	return fmt.Sprintf("%#v", r)
 }
@@ -132,6 +215,9 @@ type conn struct {
 	redirectAddr string
 	redirected   bool
 
+	own     map[int32]bool // tags of c's own calls; see sendOwn
+	retired bool           // see retire
+
 	closed chan bool
 }
 
@@ -166,6 +252,14 @@ func (c *conn) writeT(t *T) os.Error {
 
 
 func (c *conn) send(t *T) (chan *R, os.Error) {
+	return c.sendOwn(t, false)
+}
+
+
+// Like send, but if own is set, the call is one c makes for itself,
+// such as the watches of monitorAddrs, which doesn't keep a retired c
+// open.
+func (c *conn) sendOwn(t *T, own bool) (chan *R, os.Error) {
 	if c.err != nil {
 		return nil, c.err
 	}
@@ -180,6 +274,9 @@ func (c *conn) send(t *T) (chan *R, os.Error) {
 	}
 	tag := c.n
 	c.cb[tag] = ch
+	if own {
+		c.own[tag] = true
+	}
 	c.cblk.Unlock()
 
 	t.Tag = &tag
@@ -191,6 +288,7 @@ func (c *conn) send(t *T) (chan *R, os.Error) {
 	if err != nil {
 		c.cblk.Lock()
 		c.cb[tag] = nil, false
+		c.own[tag] = false, false
 		c.cblk.Unlock()
 		return nil, err
 	}
@@ -215,7 +313,13 @@ func (c *conn) call(t *T) (*R, os.Error) {
 
 
 func (c *conn) events(t *T) (*Watch, os.Error) {
-	cb, err := c.send(t)
+	return c.eventsOwn(t, false)
+}
+
+
+// Like events, but for c's own watches; see sendOwn.
+func (c *conn) eventsOwn(t *T, own bool) (*Watch, os.Error) {
+	cb, err := c.sendOwn(t, own)
 	if err != nil {
 		return nil, err
 	}
@@ -228,10 +332,9 @@ func (c *conn) events(t *T) (*Watch, os.Error) {
 			if err := r.err(); err != nil {
 				ev.Err = err
 			} else {
-				ev.Rev = pb.GetInt64(r.Rev)
-				ev.Path = pb.GetString(r.Path)
-				ev.Body = r.Value
-				ev.Flag = pb.GetInt32(r.Flags)
+				ev = *eventOf(proto.ResponseEvent((*proto.Response)(r)))
+				ev.Sum = pb.GetUint32(r.Sum)
+				ev.Mut = r.Mut
 			}
 			evs <- &ev
 		}
@@ -277,6 +380,42 @@ func (c *conn) close() {
 }
 
 
+// Has c take no more calls from its Client, and close once the calls,
+// watches and Pins already on it are done. Its own watches don't count.
+func (c *conn) retire() {
+	c.cblk.Lock()
+	c.retired = true
+	c.cblk.Unlock()
+	c.closeIfIdle()
+}
+
+
+// Closes c if it is retired and nothing but its own calls is using it.
+func (c *conn) closeIfIdle() {
+	c.cblk.Lock()
+	idle := c.retired && c.cb != nil
+	for tag, ch := range c.cb {
+		if ch == nil || !c.own[tag] {
+			idle = false
+			break
+		}
+	}
+	c.cblk.Unlock()
+
+	if idle {
+		c.c.Close()
+	}
+}
+
+
+// Returns the error that closed c.
+func (c *conn) cause() os.Error {
+	c.clk.Lock()
+	defer c.clk.Unlock()
+	return c.err
+}
+
+
 func (c *conn) readResponses() {
 	defer c.close()
 
@@ -307,6 +446,7 @@ func (c *conn) readResponses() {
 		}
 		if flags&Done != 0 {
 			c.cb[tag] = nil, false
+			c.own[tag] = false, false
 		}
 		c.cblk.Unlock()
 
@@ -332,6 +472,7 @@ func (c *conn) readResponses() {
 
 		if flags&Done != 0 {
 			close(ch)
+			c.closeIfIdle()
 		}
 	}
 }
@@ -361,9 +502,11 @@ func (c *conn) cancel(tag int32, cb chan *R) os.Error {
 	c.cblk.Lock()
 	// Remove our nil entry, freeing up this tag for reuse.
 	c.cb[tag] = nil, false
+	c.own[tag] = false, false
 	c.cblk.Unlock()
 
 	close(ch)
+	c.closeIfIdle()
 	return nil
 }
 
@@ -377,13 +520,13 @@ func (c *conn) monitorAddrs(cl *Client) {
 	}
 
 	addrGlob := pb.String("/ctl/node/*/addr")
-	watchAddr, err := c.events(&T{Verb: watch, Path: addrGlob})
+	watchAddr, err := c.eventsOwn(&T{Verb: watch, Path: addrGlob}, true)
 	if err != nil {
 		log.Println(err)
 		return
 	}
 
-	walkAddr, err := c.events(&T{Verb: walk, Path: addrGlob})
+	walkAddr, err := c.eventsOwn(&T{Verb: walk, Path: addrGlob}, true)
 	if err != nil {
 		log.Println(err)
 		return
@@ -398,19 +541,22 @@ init:
 			}
 			addAddr(ev.Path, string(ev.Body))
 		case ev := <-watchAddr.C:
+			if closed(watchAddr.C) {
+				return
+			}
 			addAddr(ev.Path, string(ev.Body))
 		}
 	}
 
 	glob := pb.String("/ctl/cal/*")
 
-	watch, err := c.events(&T{Verb: watch, Path: glob})
+	watch, err := c.eventsOwn(&T{Verb: watch, Path: glob}, true)
 	if err != nil {
 		log.Println(err)
 		return
 	}
 
-	walk, err := c.events(&T{Verb: walk, Path: glob})
+	walk, err := c.eventsOwn(&T{Verb: walk, Path: glob}, true)
 	if err != nil {
 		log.Println(err)
 		return
@@ -471,22 +617,60 @@ init:
 
 type Client struct {
 	Name string
-	c    chan *conn  // current connection
-	a    chan string // add address
-	r    chan string // remove address
-	Len  chan int
+
+	// If Bulk is set, sets and deletes made through this client yield
+	// to other writes when the cluster is busy. Use it for imports and
+	// restores that would otherwise hold up locks and sessions.
+	Bulk bool
+
+	// If CatchUp is set, walks and backfills made through this client
+	// are catch-up transfers, such as a new peer copying the store, which
+	// a server may slow down to spare its other clients. See
+	// -catchup-rate in doozerd.
+	CatchUp bool
+
+	c   chan *conn            // current connection
+	a   chan string           // add address
+	r   chan string           // remove address
+	rd  chan string           // switch to address, on a redirect
+	n   chan chan<- ConnEvent // add a Notify channel
+	Len chan int
+
+	notify []chan<- ConnEvent // owned by run
+
+	dialer Dialer
+}
+
+
+// A Dialer opens a connection to the doozer server at addr.
+type Dialer func(addr string) (net.Conn, os.Error)
+
+
+func dialTCP(addr string) (net.Conn, os.Error) {
+	return net.Dial("tcp", "", addr)
 }
 
 
 // Name is the name of this cluster.
 // Addr is an initial (writable) address to connect to.
 func New(name, addr string) *Client {
+	return NewDialer(name, addr, dialTCP)
+}
+
+
+// Like New, but uses d to open all connections, including those to
+// servers discovered after the first one.
+func NewDialer(name, addr string, d Dialer) *Client {
 	c := &Client{
 		Name: name,
 		c:    make(chan *conn),
 		a:    make(chan string),
 		r:    make(chan string),
+		rd:   make(chan string),
+		n:    make(chan chan<- ConnEvent),
 		Len:  make(chan int),
+
+		dialer: d,
 	}
 	go c.run(map[string]bool{addr: true})
 	return c
@@ -501,11 +685,17 @@ func (cl *Client) connect(a map[string]bool) *conn {
 		}
 		c, err := cl.dial(addr)
 		if err == nil {
+			cl.emit(ConnEvent{Kind: ConnUp, Addr: addr})
 			return c
 		}
 		log.Println(err)
+		cl.emit(ConnEvent{ConnDialFail, addr, err})
 		a[addr] = false, false
 	}
+	cl.emit(ConnEvent{Kind: ConnNoAddrs})
+	for _, ch := range cl.notify {
+		close(ch)
+	}
 	close(cl.c)
 	return nil
 }
@@ -527,12 +717,38 @@ func (cl *Client) run(a map[string]bool) {
 			a[add] = true
 		case rm := <-cl.r:
 			a[rm] = false, false
+		case ch := <-cl.n:
+			cl.notify = append(cl.notify, ch)
+			send(ch, ConnEvent{Kind: ConnUp, Addr: c.addr})
+		case addr := <-cl.rd:
+			if addr == c.addr {
+				break
+			}
+			nc, err := cl.dial(addr)
+			if err != nil {
+				log.Println(err)
+				cl.emit(ConnEvent{ConnDialFail, addr, err})
+				break
+			}
+			a[addr] = true
+
+			// Once the new connection is up, new calls go to it,
+			// and the old one closes when the calls, watches and
+			// Pins still on it are done, so that a redirect
+			// neither leaves a connection behind nor cuts off
+			// what is using it.
+			c.retire()
+			c = nc
+			cl.emit(ConnEvent{Kind: ConnUp, Addr: addr})
+			cl.emit(ConnEvent{Kind: ConnFailover, Addr: addr})
 		case <-c.closed:
+			cl.emit(ConnEvent{ConnDown, c.addr, c.cause()})
 			a[c.addr] = false, false
 			c = cl.connect(a)
 			if c == nil {
 				return
 			}
+			cl.emit(ConnEvent{Kind: ConnFailover, Addr: c.addr})
 		}
 	}
 }
@@ -543,12 +759,13 @@ func (cl *Client) dial(addr string) (*conn, os.Error) {
 	var err os.Error
 
 	c.addr = addr
-	c.c, err = net.Dial("tcp", "", addr)
+	c.c, err = cl.dialer(addr)
 	if err != nil {
 		return nil, err
 	}
 
 	c.cb = make(map[int32]chan *R)
+	c.own = make(map[int32]bool)
 	c.closed = make(chan bool, 1)
 	go c.readResponses()
 	go c.monitorAddrs(cl)
@@ -557,12 +774,29 @@ func (cl *Client) dial(addr string) (*conn, os.Error) {
 
 
 func (cl *Client) call(t *T) (r *R, err os.Error) {
+	if cl.Bulk && (t.Verb == set || t.Verb == del) {
+		t.Priority = pb.Int32(1)
+	}
+
 	c := <-cl.c
 	if c == nil {
 		return nil, ErrNoAddrs
 	}
 
-	return c.call(t)
+	r, err = c.call(t)
+
+	// A server that can't take writes redirects us to one that can.
+	// Switch to it for good, so later writes go straight there
+	// rather than costing a redirect each.
+	if e, ok := err.(*ResponseError); ok && e.Code == proto.Response_REDIRECT {
+		cl.rd <- e.Detail
+		c = <-cl.c
+		if c == nil {
+			return nil, ErrNoAddrs
+		}
+		r, err = c.call(t)
+	}
+	return r, err
 }
 
 
@@ -597,12 +831,344 @@ func (cl *Client) Set(path string, oldRev int64, body []byte) (newRev int64, err
 }
 
 
+// Sets path to body only if its current body is expect, whatever its
+// rev. Otherwise, fails with an error saying the body doesn't match.
+// It suits optimistic updates by a client that knows the value it
+// read, but not its rev.
+func (cl *Client) SetIfBody(path string, expect, body []byte) (newRev int64, err os.Error) {
+	clobber := int64(-1)
+	if expect == nil {
+		expect = []byte{}
+	}
+	r, err := cl.call(&T{Verb: set, Path: &path, Value: body, Rev: &clobber, Expect: expect})
+	if err != nil {
+		return 0, err
+	}
+
+	return pb.GetInt64(r.Rev), nil
+}
+
+
+// Makes the file at path a link to target, as long as oldRev is greater
+// than or equal to the file's rev. Get and Stat see the link itself,
+// whose body is target; GetFollow reads through it. A later Set or Del
+// of path replaces or removes the link.
+func (cl *Client) SetLink(path string, oldRev int64, target string) (newRev int64, err os.Error) {
+	link := true
+	r, err := cl.call(&T{Verb: set, Path: &path, Value: []byte(target), Rev: &oldRev, Link: &link})
+	if err != nil {
+		return 0, err
+	}
+
+	return pb.GetInt64(r.Rev), nil
+}
+
+
+// Appends data to the file at path, or creates it holding data, as long
+// as oldRev is greater than or equal to the file's rev. Appends by
+// several clients at once all take effect, in some order.
+func (cl *Client) Append(path string, oldRev int64, data []byte) (newRev int64, err os.Error) {
+	app := true
+	r, err := cl.call(&T{Verb: set, Path: &path, Value: data, Rev: &oldRev, Append: &app})
+	if err != nil {
+		return 0, err
+	}
+
+	return pb.GetInt64(r.Rev), nil
+}
+
+
+// Adds delta to the number held, in decimal, by the file at path, as
+// long as oldRev is greater than or equal to the file's rev. A missing
+// or empty file counts as 0. Returns the sum. Adds by several clients
+// at once all take effect, so path can serve as a counter.
+func (cl *Client) Add(path string, oldRev, delta int64) (sum, newRev int64, err os.Error) {
+	r, err := cl.call(&T{Verb: set, Path: &path, Rev: &oldRev, Delta: &delta})
+	if err != nil {
+		return 0, 0, err
+	}
+
+	sum, err = strconv.Atoi64(string(r.Value))
+	if err != nil {
+		return 0, 0, err
+	}
+	return sum, pb.GetInt64(r.Rev), nil
+}
+
+
+// Allocates n new IDs, unique across the cluster, from the sequence
+// called name, and returns the first; the rest follow it in order. A
+// new sequence starts at 1. See IDS in doc/proto.md.
+func (cl *Client) IDs(name string, n int64) (first int64, err os.Error) {
+	r, err := cl.call(&T{Verb: ids, Path: &name, Delta: &n})
+	if err != nil {
+		return 0, err
+	}
+
+	return strconv.Atoi64(string(r.Value))
+}
+
+
+// Sets the file at path to the body f makes from its current one. If
+// the file changes before the write lands, reads it again and calls f
+// again, at most UpdateTries times in all, then fails with
+// ErrRevMismatch. A missing file reads as nil and is made. If f
+// returns an error, nothing is written and that error is returned.
+func (cl *Client) Update(path string, f func(old []byte) ([]byte, os.Error)) (newRev int64, err os.Error) {
+	for i := 0; i < UpdateTries; i++ {
+		old, rev, err := cl.Get(path, nil)
+		if err != nil {
+			return 0, err
+		}
+		if rev == 0 {
+			old = nil
+		}
+
+		body, err := f(old)
+		if err != nil {
+			return 0, err
+		}
+
+		newRev, err = cl.Set(path, rev, body)
+		if e, ok := err.(*ResponseError); ok && e.Code == proto.Response_REV_MISMATCH {
+			continue
+		}
+		return newRev, err
+	}
+
+	return 0, ErrRevMismatch
+}
+
+
+// Puts back path, deleted on a server that keeps deleted files in the
+// trash (see -trash in doozerd), if it is missing. Fails with
+// ErrNotTrash if there is no copy of path in the trash, or with
+// ErrRevMismatch if path has been made again since.
+func (cl *Client) Undelete(path string) (newRev int64, err os.Error) {
+	body, rev, err := cl.Get("/trash"+path, nil)
+	if err != nil {
+		return 0, err
+	}
+	if rev == 0 {
+		return 0, ErrNotTrash
+	}
+
+	newRev, err = cl.Set(path, 0, body)
+	if err != nil {
+		return 0, err
+	}
+
+	return newRev, cl.Del("/trash"+path, rev)
+}
+
+
+// Like Set, but also clobbers a file the server protects. See -protect
+// in doozerd.
+func (cl *Client) SetForce(path string, oldRev int64, body []byte) (newRev int64, err os.Error) {
+	force := true
+	r, err := cl.call(&T{Verb: set, Path: &path, Value: body, Rev: &oldRev, Force: &force})
+	if err != nil {
+		return 0, err
+	}
+
+	return pb.GetInt64(r.Rev), nil
+}
+
+
+// Like Set, but fails with ErrRevMismatch if an entry has been added to
+// or removed from the parent directory of path since dirRev, as returned
+// by DirRev.
+func (cl *Client) SetInDir(path string, dirRev, oldRev int64, body []byte) (newRev int64, err os.Error) {
+	r, err := cl.call(&T{Verb: set, Path: &path, Value: body, Rev: &oldRev, DirRev: &dirRev})
+	if err != nil {
+		return 0, err
+	}
+
+	return pb.GetInt64(r.Rev), nil
+}
+
+
+// Like Del, but fails if an entry has been added to or removed from the
+// parent directory of path since dirRev.
+func (cl *Client) DelInDir(path string, dirRev, rev int64) os.Error {
+	_, err := cl.call(&T{Verb: del, Path: &path, Rev: &rev, DirRev: &dirRev})
+	return err
+}
+
+
+// Arranges for path to be deleted once the peers' clocks pass when (in
+// nanoseconds since the epoch), if it still has rev then.
+func (cl *Client) ExpireAt(path string, rev, when int64) os.Error {
+	body := strconv.Itoa64(when) + " " + strconv.Itoa64(rev)
+	_, err := cl.Set("/ctl/ttl"+path, -1, []byte(body))
+	return err
+}
+
+
+// Arranges for path to be deleted once the cluster reaches seqn, if it
+// still has rev then.
+func (cl *Client) ExpireAtSeqn(path string, rev, seqn int64) os.Error {
+	body := "@" + strconv.Itoa64(seqn) + " " + strconv.Itoa64(rev)
+	_, err := cl.Set("/ctl/ttl"+path, -1, []byte(body))
+	return err
+}
+
+
+// Arranges for the cluster to propose mutation, one made by package
+// store, once the peers' clocks pass when, in ns. Returns the path of
+// the file in /ctl/scheduled that holds the mutation until then;
+// deleting it cancels the change.
+func (cl *Client) Schedule(when int64, mutation string) (path string, err os.Error) {
+	body := strconv.Itoa64(when) + " " + mutation
+	path, _, err = cl.SetSequential("/ctl/scheduled/", []byte(body))
+	return path, err
+}
+
+
+// Like Set, but path is deleted about ttl nanoseconds later, unless it
+// has been written again. The file and its expiry are written at one
+// rev. The deadline is computed with this machine's clock, so clock
+// skew between it and the peers shifts it.
+func (cl *Client) SetTTL(path string, oldRev int64, body []byte, ttl int64) (newRev int64, err os.Error) {
+	when := time.Nanoseconds() + ttl
+	r, err := cl.call(&T{Verb: set, Path: &path, Value: body, Rev: &oldRev, Expires: &when})
+	if err != nil {
+		return 0, err
+	}
+
+	return pb.GetInt64(r.Rev), nil
+}
+
+
+// Like Set, but also links path to session sess, as started by
+// Checkin, so that a peer deletes path when the session ends. The file
+// and its link are written at one rev, and only if the session has not
+// ended; otherwise neither is, and the error is ErrNoSession. See
+// doc/files.md.
+func (cl *Client) SetEphemeral(path, sess string, oldRev int64, body []byte) (newRev int64, err os.Error) {
+	r, err := cl.call(&T{Verb: set, Path: &path, Value: body, Rev: &oldRev, Session: &sess})
+	if err != nil {
+		return 0, err
+	}
+
+	return pb.GetInt64(r.Rev), nil
+}
+
+
+// Sets path to body, whatever its rev, but only if path exists (when
+// exists is true) or doesn't (when exists is false). Otherwise, fails
+// with a NOENT response error, or an error saying the file exists.
+// It covers create-if-absent and replace-if-present without a read.
+func (cl *Client) SetIf(path string, exists bool, body []byte) (newRev int64, err os.Error) {
+	clobber := int64(-1)
+	r, err := cl.call(&T{Verb: set, Path: &path, Value: body, Rev: &clobber, Exists: &exists})
+	if err != nil {
+		return 0, err
+	}
+
+	return pb.GetInt64(r.Rev), nil
+}
+
+
+// Creates a file holding body at prefix followed by a suffix the cluster
+// chooses, greater than that of any file created this way before, and
+// returns the path chosen. Files created under the same prefix sort in
+// the order they were created, which suits queues and lock recipes.
+func (cl *Client) SetSequential(prefix string, body []byte) (path string, rev int64, err os.Error) {
+	seq := true
+	r, err := cl.call(&T{Verb: set, Path: &prefix, Value: body, Sequential: &seq})
+	if err != nil {
+		return "", 0, err
+	}
+
+	return pb.GetString(r.Path), pb.GetInt64(r.Rev), nil
+}
+
+
+// Deletes path, whatever its rev, but fails with a NOENT response error
+// if path does not exist.
+func (cl *Client) DelIfExists(path string) os.Error {
+	clobber, exists := int64(-1), true
+	_, err := cl.call(&T{Verb: del, Path: &path, Rev: &clobber, Exists: &exists})
+	return err
+}
+
+
+// Sends t as it is and returns the server's response, even if it is an
+// error, for a server relaying a request on behalf of its own client.
+// Follows a redirect, as call does. Overwrites t.Tag.
+func (cl *Client) Relay(t *T) (*R, os.Error) {
+	c := <-cl.c
+	if c == nil {
+		return nil, ErrNoAddrs
+	}
+
+	r, err := c.relay(t)
+	if err == nil && r.ErrCode != nil && *r.ErrCode == proto.Response_REDIRECT {
+		cl.rd <- pb.GetString(r.ErrDetail)
+		c = <-cl.c
+		if c == nil {
+			return nil, ErrNoAddrs
+		}
+		r, err = c.relay(t)
+	}
+	return r, err
+}
+
+
+func (c *conn) relay(t *T) (*R, os.Error) {
+	ch, err := c.send(t)
+	if err != nil {
+		return nil, err
+	}
+
+	r := <-ch
+	if r == nil {
+		return nil, os.EOF
+	}
+	return r, nil
+}
+
+
+// Returns the rev of the directory at path: the revision at which an
+// entry was last added to or removed from it. If path does not denote a
+// directory, returns 0.
+func (cl *Client) DirRev(path string, rev *int64) (int64, os.Error) {
+	r, err := cl.retry(&T{Verb: stat, Path: &path, Rev: rev})
+	if err != nil {
+		return 0, err
+	}
+
+	return pb.GetInt64(r.DirRev), nil
+}
+
+
 // Returns the body and revision of the file at path.
 // If rev is 0, uses the current state, otherwise,
 // rev must be a value previously returned buy an operation.
 // If path does not denote a file, returns an error.
+// If the body doesn't match the checksum sent with it, returns ErrBadSum.
 func (cl *Client) Get(path string, rev *int64) ([]byte, int64, os.Error) {
 	r, err := cl.retry(&T{Verb: get, Path: &path, Rev: rev})
+	if err == nil {
+		err = r.checkSum()
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return r.Value, pb.GetInt64(r.Rev), nil
+}
+
+
+// Like Get, but if path is a link (see SetLink), returns the body and
+// revision of the file it points to, following up to eight links.
+func (cl *Client) GetFollow(path string, rev *int64) ([]byte, int64, os.Error) {
+	follow := true
+	r, err := cl.retry(&T{Verb: get, Path: &path, Rev: rev, Follow: &follow})
+	if err == nil {
+		err = r.checkSum()
+	}
 	if err != nil {
 		return nil, 0, err
 	}
@@ -611,6 +1177,49 @@ func (cl *Client) Get(path string, rev *int64) ([]byte, int64, os.Error) {
 }
 
 
+// Returns the body of every file in the tree rooted at path, by path,
+// all at one rev, and that rev. If rev is nil, uses the current rev. If
+// path is a file, the result holds just it; if it is missing, the
+// result is empty.
+func (cl *Client) GetTree(path string, rev *int64) (map[string][]byte, int64, os.Error) {
+	if rev == nil {
+		r, err := cl.Rev()
+		if err != nil {
+			return nil, 0, err
+		}
+		rev = &r
+	}
+
+	files := make(map[string][]byte)
+	if err := cl.walkInto(files, path, rev); err != nil || len(files) > 0 {
+		return files, *rev, err
+	}
+
+	glob := path + "/**"
+	if path == "/" {
+		glob = "/**"
+	}
+	err := cl.walkInto(files, glob, rev)
+	return files, *rev, err
+}
+
+
+func (cl *Client) walkInto(files map[string][]byte, glob string, rev *int64) os.Error {
+	w, err := cl.Walk(glob, rev, nil, nil)
+	if err != nil {
+		return err
+	}
+
+	for ev := range w.C {
+		if ev.Err != nil {
+			return ev.Err
+		}
+		files[ev.Path] = ev.Body
+	}
+	return nil
+}
+
+
 func (cl *Client) Rev() (int64, os.Error) {
 	r, err := cl.retry(&T{Verb: rev})
 	if err != nil {
@@ -621,11 +1230,110 @@ func (cl *Client) Rev() (int64, os.Error) {
 }
 
 
+// Sets every file in files to its body, whatever its rev, packing the
+// writes into as few consensus instances as the server can. Watchers
+// see them as a handful of bulk events. The server must be started
+// with bulk loading allowed. Returns the rev of the last instance.
+func (cl *Client) BulkSet(files map[string][]byte) (rev int64, err os.Error) {
+	clobber := int64(-1)
+	t := &T{Verb: bulk}
+	for path, body := range files {
+		path := path
+		t.Writes = append(t.Writes, &proto.Write{Path: &path, Value: body, Rev: &clobber})
+	}
+
+	r, err := cl.call(t)
+	if err != nil {
+		return 0, err
+	}
+
+	return pb.GetInt64(r.Rev), nil
+}
+
+
+// Returns the limits the server applies to this client's connection,
+// and how much of each it has used, keyed by the names in doc/proto.md
+// under LIMITS. If path is not empty, includes the rate limit on
+// writes to that file, if any, and the writes left in its budget.
+func (cl *Client) Limits(path string) (map[string]float64, os.Error) {
+	c := <-cl.c
+	if c == nil {
+		return nil, ErrNoAddrs
+	}
+
+	t := &T{Verb: limits}
+	if path != "" {
+		t.Path = &path
+	}
+
+	w, err := c.events(t)
+	if err != nil {
+		return nil, err
+	}
+
+	m := make(map[string]float64)
+	for ev := range w.C {
+		if ev.Err != nil {
+			return nil, ev.Err
+		}
+
+		m[ev.Path], err = strconv.Atof64(string(ev.Body))
+		if err != nil {
+			return nil, err
+		}
+	}
+	return m, nil
+}
+
+
+// Asks the server to discard its history at and before rev, which it
+// does only if started with -allow-clean, then returns what history it
+// holds, keyed by the names in doc/proto.md under CLEAN. If rev is 0,
+// nothing is discarded.
+func (cl *Client) Clean(rev int64) (map[string]int64, os.Error) {
+	c := <-cl.c
+	if c == nil {
+		return nil, ErrNoAddrs
+	}
+
+	t := &T{Verb: clean}
+	if rev > 0 {
+		t.Rev = &rev
+	}
+
+	w, err := c.events(t)
+	if err != nil {
+		return nil, err
+	}
+
+	m := make(map[string]int64)
+	for ev := range w.C {
+		if ev.Err != nil {
+			return nil, ev.Err
+		}
+
+		m[ev.Path], err = strconv.Atoi64(string(ev.Body))
+		if err != nil {
+			return nil, err
+		}
+	}
+	return m, nil
+}
+
+
 func (cl *Client) Del(path string, rev int64) os.Error {
 	_, err := cl.call(&T{Verb: del, Path: &path, Rev: &rev})
 	return err
 }
 
+// Like Del, but also deletes a file the server protects. See -protect
+// in doozerd.
+func (cl *Client) DelForce(path string, rev int64) os.Error {
+	force := true
+	_, err := cl.call(&T{Verb: del, Path: &path, Rev: &rev, Force: &force})
+	return err
+}
+
 func (cl *Client) Stat(path string, rev *int64) (int32, int64, os.Error) {
 	r, err := cl.retry(&T{Verb: stat, Path: &path, Rev: rev})
 	if err != nil {
@@ -635,6 +1343,38 @@ func (cl *Client) Stat(path string, rev *int64) (int32, int64, os.Error) {
 	return pb.GetInt32(r.Len), pb.GetInt64(r.Rev), nil
 }
 
+// Describes a file or directory, as returned by StatInfo.
+type StatInfo struct {
+	Len     int32  // of a file's body, or a directory's entries
+	Rev     int64  // -2 for a directory, 0 if missing
+	Created int64  // the rev at which it was created
+	DirRev  int64  // for a directory, as from DirRev
+	Link    bool   // whether it is a link, as made by SetLink
+	Sum     uint32 // for a file, the CRC-32 (IEEE) of its body
+	Deleted int64  // if missing, the rev of its delete, if remembered
+}
+
+
+// Like Stat, but also returns the rev at which path was created and,
+// for a file, the checksum of its body, which a client holding a copy
+// can compare to skip reading the body again.
+func (cl *Client) StatInfo(path string, rev *int64) (*StatInfo, os.Error) {
+	r, err := cl.retry(&T{Verb: stat, Path: &path, Rev: rev})
+	if err != nil {
+		return nil, err
+	}
+
+	return &StatInfo{
+		Len:     pb.GetInt32(r.Len),
+		Rev:     pb.GetInt64(r.Rev),
+		Created: pb.GetInt64(r.Created),
+		DirRev:  pb.GetInt64(r.DirRev),
+		Link:    pb.GetBool(r.Link),
+		Sum:     pb.GetUint32(r.Sum),
+		Deleted: pb.GetInt64(r.Deleted),
+	}, nil
+}
+
 func (cl *Client) Nop() os.Error {
 	_, err := cl.call(&T{Verb: nop})
 	return err
@@ -653,7 +1393,59 @@ func (cl *Client) Watch(glob string, from int64) (*Watch, os.Error) {
 		return nil, ErrNoAddrs
 	}
 
-	return c.events(&T{Verb: watch, Path: &glob, Rev: &from})
+	return c.events(cl.catchUp(&T{Verb: watch, Path: &glob, Rev: &from}))
+}
+
+
+// WatchFilter is like Watch, but the server only sends sets whose
+// body matches filter. See doc/proto.md for the filter syntax.
+func (cl *Client) WatchFilter(glob string, from int64, filter string) (*Watch, os.Error) {
+	c := <-cl.c
+	if c == nil {
+		return nil, ErrNoAddrs
+	}
+
+	return c.events(cl.catchUp(&T{Verb: watch, Path: &glob, Rev: &from, Filter: &filter}))
+}
+
+
+// WatchSample is like Watch, but the server sends at most one change
+// to each file in each interval ns, always including the latest. For
+// dashboards on hot files that don't need every change.
+func (cl *Client) WatchSample(glob string, from, interval int64) (*Watch, os.Error) {
+	c := <-cl.c
+	if c == nil {
+		return nil, ErrNoAddrs
+	}
+
+	return c.events(cl.catchUp(&T{Verb: watch, Path: &glob, Rev: &from, Sample: &interval}))
+}
+
+// WatchHeartbeat is like Watch, but whenever interval ns pass with no
+// change sent, the server sends a heartbeat event (see IsHeartbeat), so
+// that a quiet watch can be told from one whose server or connection
+// has died: if no event of either kind arrives for twice interval, the
+// watch is no longer being served.
+func (cl *Client) WatchHeartbeat(glob string, from, interval int64) (*Watch, os.Error) {
+	c := <-cl.c
+	if c == nil {
+		return nil, ErrNoAddrs
+	}
+
+	return c.events(cl.catchUp(&T{Verb: watch, Path: &glob, Rev: &from, Heartbeat: &interval}))
+}
+
+
+// Backfill sends an event for each file matching glob as of one
+// snapshot, then an event with an empty Path whose Rev is the
+// snapshot's rev, then an event for each later change, as Watch does.
+func (cl *Client) Backfill(glob string) (*Watch, os.Error) {
+	c := <-cl.c
+	if c == nil {
+		return nil, ErrNoAddrs
+	}
+
+	return c.events(cl.catchUp(&T{Verb: backfill, Path: &glob}))
 }
 
 func (cl *Client) Getdir(path string, offset, limit int32, rev *int64) (*Watch, os.Error) {
@@ -678,13 +1470,23 @@ func (cl *Client) Walk(glob string, rev *int64, offset, limit *int32) (*Watch, o
 		return nil, ErrNoAddrs
 	}
 
-	return c.events(&T{
+	return c.events(cl.catchUp(&T{
 		Verb:   walk,
 		Path:   &glob,
 		Rev:    rev,
 		Offset: offset,
 		Limit:  limit,
-	})
+	}))
+}
+
+
+// Marks t, a walk or backfill, as a catch-up transfer if cl.CatchUp is
+// set.
+func (cl *Client) catchUp(t *T) *T {
+	if cl.CatchUp {
+		t.CatchUp = pb.Bool(true)
+	}
+	return t
 }
 
 
@@ -699,3 +1501,98 @@ type Watch struct {
 func (w *Watch) Cancel() os.Error {
 	return w.c.cancel(w.tag, w.cb)
 }
+
+
+// A Pin keeps one rev readable on one server, so that a sequence of
+// reads made through it sees a consistent view. See Client.Pin.
+type Pin struct {
+	Rev int64
+	w   *Watch
+}
+
+
+// Pins rev, or the current rev if rev is nil, on the server cl is
+// connected to. Reads made through the Pin go to that server at that
+// rev, and can't fail with ErrTooLate until the Pin is released or the
+// connection closes.
+//
+// A Pin is tied to the connection it was made on. If cl moves to
+// another server after a redirect, the Pin keeps that connection open
+// until it is released. If the connection fails, the Pin doesn't move
+// with cl: reads through it fail, and the caller must pin again.
+func (cl *Client) Pin(rev *int64) (*Pin, os.Error) {
+	c := <-cl.c
+	if c == nil {
+		return nil, ErrNoAddrs
+	}
+
+	w, err := c.events(&T{Verb: pin, Rev: rev})
+	if err != nil {
+		return nil, err
+	}
+
+	ev := <-w.C
+	if ev == nil {
+		return nil, os.EOF
+	}
+	if ev.Err != nil {
+		return nil, ev.Err
+	}
+
+	return &Pin{ev.Rev, w}, nil
+}
+
+
+// Releases p. Reads made through p after this may fail.
+func (p *Pin) Release() os.Error {
+	return p.w.Cancel()
+}
+
+
+// Like Client.Get, at p.Rev.
+func (p *Pin) Get(path string) ([]byte, int64, os.Error) {
+	r, err := p.w.c.call(&T{Verb: get, Path: &path, Rev: &p.Rev})
+	if err == nil {
+		err = r.checkSum()
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return r.Value, pb.GetInt64(r.Rev), nil
+}
+
+
+// Like Client.Stat, at p.Rev.
+func (p *Pin) Stat(path string) (int32, int64, os.Error) {
+	r, err := p.w.c.call(&T{Verb: stat, Path: &path, Rev: &p.Rev})
+	if err != nil {
+		return 0, 0, err
+	}
+
+	return pb.GetInt32(r.Len), pb.GetInt64(r.Rev), nil
+}
+
+
+// Like Client.Getdir, at p.Rev.
+func (p *Pin) Getdir(path string, offset, limit int32) (*Watch, os.Error) {
+	return p.w.c.events(&T{
+		Verb:   getdir,
+		Path:   &path,
+		Rev:    &p.Rev,
+		Offset: &offset,
+		Limit:  &limit,
+	})
+}
+
+
+// Like Client.Walk, at p.Rev.
+func (p *Pin) Walk(glob string, offset, limit *int32) (*Watch, os.Error) {
+	return p.w.c.events(&T{
+		Verb:   walk,
+		Path:   &glob,
+		Rev:    &p.Rev,
+		Offset: offset,
+		Limit:  limit,
+	})
+}
@@ -1,6 +1,106 @@
 package client
 
-import "testing"
+import (
+	"bytes"
+	"doozer/proto"
+	"encoding/binary"
+	"hash/crc32"
+	pb "goprotobuf.googlecode.com/hg/proto"
+	"net"
+	"os"
+	"testing"
+)
 
 func TestFoo(t *testing.T) {
 }
+
+func TestNotifyNoAddrs(t *testing.T) {
+	cl := NewDialer("test", "nowhere", func(string) (net.Conn, os.Error) {
+		return nil, os.EINVAL
+	})
+
+	ch := make(chan ConnEvent, 1)
+	cl.Notify(ch)
+	ev := <-ch
+	if ev.Kind != ConnNoAddrs {
+		t.Errorf("got %v, want no addresses", ev)
+	}
+	<-ch
+	if !closed(ch) {
+		t.Error("channel not closed")
+	}
+}
+
+func TestConnEventString(t *testing.T) {
+	ev := ConnEvent{ConnDown, "a:1", os.EOF}
+	if s := ev.String(); s != "down a:1: EOF" {
+		t.Errorf("got %q", s)
+	}
+}
+
+func TestIsErr(t *testing.T) {
+	detail := "rev 3 is past 2"
+	r := &R{ErrCode: proto.NewResponse_Err(proto.Response_REV_MISMATCH), ErrDetail: &detail}
+	detailed := r.err()
+	if !IsErr(detailed, ErrRevMismatch) {
+		t.Errorf("%v is not a rev mismatch", detailed)
+	}
+	if IsErr(detailed, ErrTooLate) || IsErr(os.EOF, ErrRevMismatch) {
+		t.Error("wrong match")
+	}
+}
+
+func TestIsErrProtected(t *testing.T) {
+	detail := "protected path: set force to override"
+	r := &R{ErrCode: proto.NewResponse_Err(proto.Response_PROTECTED), ErrDetail: &detail}
+	if err := r.err(); !IsErr(err, ErrProtected) {
+		t.Errorf("%v is not a protected path", err)
+	}
+	if !IsErr(ErrNotTrash, ErrNoEnt) {
+		t.Error("ErrNotTrash is not a missing file")
+	}
+}
+
+func TestCheckSum(t *testing.T) {
+	sum := crc32.ChecksumIEEE([]byte("a"))
+	if err := (&R{Value: []byte("a"), Sum: &sum}).checkSum(); err != nil {
+		t.Errorf("got %v", err)
+	}
+	if err := (&R{Value: []byte("b"), Sum: &sum}).checkSum(); err != ErrBadSum {
+		t.Errorf("got %v, want ErrBadSum", err)
+	}
+	if err := (&R{Value: []byte("b")}).checkSum(); err != nil {
+		t.Errorf("got %v", err)
+	}
+}
+
+// Returns a datagram holding one event, e.
+func oneEventDatagram(e *proto.Event) []byte {
+	var b bytes.Buffer
+	binary.Write(&b, binary.BigEndian, int64(1)) // prev
+	binary.Write(&b, binary.BigEndian, int64(2)) // seqn
+	binary.Write(&b, binary.BigEndian, int32(1)) // n
+	buf, _ := proto.MarshalEvent(e)
+	binary.Write(&b, binary.BigEndian, int32(len(buf)))
+	b.Write(buf)
+	return b.Bytes()
+}
+
+func TestParseDatagram(t *testing.T) {
+	d, err := parseDatagram(oneEventDatagram(&proto.Event{Seqn: pb.Int64(2), Path: pb.String("/x")}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(d.evs) != 1 || d.evs[0].Path != "/x" || d.evs[0].Flag != Valid {
+		t.Errorf("got %v", d.evs)
+	}
+
+	_, err = parseDatagram(oneEventDatagram(&proto.Event{Seqn: pb.Int64(2)}))
+	if err != ErrBadDatagram {
+		t.Errorf("got %v, want %v", err, ErrBadDatagram)
+	}
+	_, err = parseDatagram(oneEventDatagram(&proto.Event{Path: pb.String("/x")}))
+	if err != ErrBadDatagram {
+		t.Errorf("got %v, want %v", err, ErrBadDatagram)
+	}
+}
@@ -0,0 +1,72 @@
+package client
+
+import (
+	"os"
+	"strconv"
+)
+
+
+// Where Consume keeps, for each consumer, the rev of the last event
+// it has handled.
+const ConsumerDir = "/consumers"
+
+
+// Watches glob on behalf of the consumer called name, calling f with
+// each event, and saving under ConsumerDir the rev of each revision
+// once f has returned nil for every event in it. If the consumer has
+// saved a rev before, the watch resumes right after it; otherwise it
+// starts at from.
+//
+// A bulk write or batch gives several events at one rev, so a rev is
+// saved only when an event with a later one arrives, just before f is
+// called with it: by then the revision is known to be whole, and f has
+// handled all of it. So after a crash or an error from f, the next
+// Consume with the same name sees the last revision again, and any
+// events after it: each event is handled at least once. Returns the first
+// error from f or the watch. If two consumers with the same name run
+// at once, one of them fails with ErrRevMismatch.
+//
+// The checkpoints are themselves writes, so glob should not match
+// anything under ConsumerDir.
+func (cl *Client) Consume(name, glob string, from int64, f func(ev *Event) os.Error) os.Error {
+	path := ConsumerDir + "/" + name
+	body, rev, err := cl.Get(path, nil)
+	if err != nil {
+		return err
+	}
+	if rev != 0 {
+		last, err := strconv.Atoi64(string(body))
+		if err != nil {
+			return err
+		}
+		from = last + 1
+	}
+
+	w, err := cl.Watch(glob, from)
+	if err != nil {
+		return err
+	}
+	defer w.Cancel()
+
+	var cur int64 // the rev of the revision being handled, if any
+	for ev := range w.C {
+		if ev.Err != nil {
+			return ev.Err
+		}
+
+		if cur != 0 && ev.Rev > cur {
+			rev, err = cl.Set(path, rev, []byte(strconv.Itoa64(cur)))
+			if err != nil {
+				return err
+			}
+		}
+		cur = ev.Rev
+
+		err = f(ev)
+		if err != nil {
+			return err
+		}
+	}
+
+	return os.EOF
+}
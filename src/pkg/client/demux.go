@@ -0,0 +1,118 @@
+package client
+
+import (
+	"os"
+	"sync"
+)
+
+
+// A Demux shares one server-side watch per distinct glob among any
+// number of local subscribers, so an application that watches the same
+// glob from many places costs the server one watch, not hundreds.
+//
+// A subscriber sees the events that arrive after it subscribes. The
+// server-side watch is cancelled when its last subscriber cancels.
+type Demux struct {
+	cl *Client
+	lk sync.Mutex
+	gs map[string]*group
+}
+
+
+type group struct {
+	w    *Watch
+	subs map[*Sub]bool
+}
+
+
+// A Sub receives events from one glob of a Demux.
+type Sub struct {
+	C    <-chan *Event
+	c    chan *Event
+	done chan bool
+	glob string
+	d    *Demux
+}
+
+
+func NewDemux(cl *Client) *Demux {
+	return &Demux{cl: cl, gs: make(map[string]*group)}
+}
+
+
+// Subscribes to changes to files matching glob. Events are sent on the
+// returned Sub's C; a subscriber that stops reading holds up every
+// other subscriber to the same glob, so cancel a Sub when done with it.
+func (d *Demux) Watch(glob string) (*Sub, os.Error) {
+	d.lk.Lock()
+	defer d.lk.Unlock()
+
+	g, ok := d.gs[glob]
+	if !ok {
+		w, err := d.cl.Watch(glob, 0)
+		if err != nil {
+			return nil, err
+		}
+		g = &group{w, make(map[*Sub]bool)}
+		d.gs[glob] = g
+		go d.fanout(glob, g)
+	}
+
+	c := make(chan *Event)
+	s := &Sub{C: c, c: c, done: make(chan bool), glob: glob, d: d}
+	g.subs[s] = true
+	return s, nil
+}
+
+
+func (d *Demux) fanout(glob string, g *group) {
+	for ev := range g.w.C {
+		d.lk.Lock()
+		subs := make([]*Sub, 0, len(g.subs))
+		for s := range g.subs {
+			subs = append(subs, s)
+		}
+		d.lk.Unlock()
+
+		for _, s := range subs {
+			select {
+			case s.c <- ev:
+			case <-s.done:
+			}
+		}
+	}
+
+	// The server-side watch is over. Close every remaining
+	// subscriber, and let the next Watch start a new one.
+	d.lk.Lock()
+	defer d.lk.Unlock()
+	if d.gs[glob] == g {
+		d.gs[glob] = nil, false
+	}
+	for s := range g.subs {
+		close(s.c)
+	}
+}
+
+
+// Stops s from receiving events. C is not closed.
+func (s *Sub) Cancel() os.Error {
+	d := s.d
+	d.lk.Lock()
+	g, ok := d.gs[s.glob]
+	if !ok || !g.subs[s] {
+		d.lk.Unlock()
+		return nil
+	}
+
+	close(s.done)
+	g.subs[s] = false, false
+	if len(g.subs) > 0 {
+		d.lk.Unlock()
+		return nil
+	}
+
+	d.gs[s.glob] = nil, false
+	d.lk.Unlock()
+	return g.w.Cancel()
+}
@@ -0,0 +1,170 @@
+package client
+
+import (
+	"crypto/sha1"
+	"doozer/proto"
+	"fmt"
+	"io"
+	"os"
+	pb "goprotobuf.googlecode.com/hg/proto"
+)
+
+
+// How many files Fetch asks for in each checksummed chunk.
+const FetchChunk = 1000
+
+// How many times in a row Fetch tries to get a chunk before it gives
+// up.
+const FetchTries = 10
+
+
+var ErrChecksum = os.NewError("chunk checksum mismatch")
+
+
+// Calls f with each file matching glob at rev, as Walk would send it,
+// but in chunks of FetchChunk files, each checked against a checksum
+// the server sends with it. f sees the files of a chunk only once the
+// whole chunk has arrived and checked out.
+//
+// If the connection drops partway, or a chunk doesn't match its
+// checksum, Fetch walks again from the first file of that chunk, on a
+// new connection if need be, rather than from the start; so a peer
+// copying a large store loses at most one chunk to a network blip.
+// Gives up after FetchTries tries in a row without a good chunk, or at
+// once if the server refuses the walk, as with ErrTooLate once rev is
+// gone.
+func (cl *Client) Fetch(glob string, rev int64, f func(ev *Event)) os.Error {
+	var offset int32
+	tries := 0
+	for {
+		n, err := cl.fetchFrom(glob, rev, offset, f)
+		if err == nil {
+			return nil
+		}
+		if _, ok := err.(*ResponseError); ok || err == ErrNoAddrs {
+			return err
+		}
+
+		offset += n
+		if n > 0 {
+			tries = 0
+		}
+		tries++
+		if tries >= FetchTries {
+			return err
+		}
+	}
+
+	panic("not reached")
+}
+
+
+// Walks glob at rev in chunks, skipping the first offset files, and
+// calls f with the files of each chunk that checks out. Returns how
+// many files it passed to f.
+func (cl *Client) fetchFrom(glob string, rev int64, offset int32, f func(*Event)) (n int32, err os.Error) {
+	c := <-cl.c
+	if c == nil {
+		return 0, ErrNoAddrs
+	}
+
+	w, err := c.events(cl.catchUp(&T{
+		Verb:   walk,
+		Path:   &glob,
+		Rev:    &rev,
+		Offset: &offset,
+		Chunk:  pb.Int32(FetchChunk),
+	}))
+	if err != nil {
+		return 0, err
+	}
+
+	h := sha1.New()
+	var chunk []*Event
+	for ev := range w.C {
+		switch {
+		case ev.Err != nil:
+			return n, ev.Err
+		case ev.IsSet():
+			proto.SumFile(h, ev.Path, ev.Body, ev.Rev)
+			chunk = append(chunk, ev)
+			continue
+		}
+
+		if fmt.Sprintf("%x", h.Sum()) != string(ev.Body) {
+			// Drain the rest, so the cancel isn't stuck behind it.
+			go w.Cancel()
+			for _ = range w.C {
+			}
+			return n, ErrChecksum
+		}
+		for _, e := range chunk {
+			f(e)
+		}
+		n += int32(len(chunk))
+		if ev.Flag&Done != 0 {
+			return n, nil
+		}
+		h, chunk = sha1.New(), nil
+	}
+
+	// The connection closed before the walk was done.
+	return n, io.ErrUnexpectedEOF
+}
+
+
+// Writes a snapshot of the server's store to w, in the form
+// store.Store.WriteSnapshot writes, and returns its rev. Unlike a walk,
+// a snapshot holds empty directories and links, so a peer that loads
+// it with store.Store.LoadSnapshot, then applies what WatchMutations
+// sends from the rev after, holds exactly what the server does.
+func (cl *Client) Snapshot(w io.Writer) (rev int64, err os.Error) {
+	c := <-cl.c
+	if c == nil {
+		return 0, ErrNoAddrs
+	}
+
+	sw, err := c.events(&T{Verb: snapshot})
+	if err != nil {
+		return 0, err
+	}
+
+	for ev := range sw.C {
+		if ev.Err != nil {
+			return 0, ev.Err
+		}
+		if ev.Flag&Done != 0 {
+			return ev.Rev, nil
+		}
+
+		_, err = w.Write(ev.Body)
+		if err != nil {
+			go sw.Cancel()
+			for _ = range sw.C {
+			}
+			return 0, err
+		}
+	}
+
+	// The connection closed before the snapshot was done.
+	return 0, io.ErrUnexpectedEOF
+}
+
+
+// Watches every change from rev from on, as Watch("/**", from) does,
+// but sends each as the mutation the server applied, in the event's
+// Mut, with its Rev. A peer applies these to its own store to follow
+// the server's exactly; see Snapshot.
+func (cl *Client) WatchMutations(from int64) (*Watch, os.Error) {
+	c := <-cl.c
+	if c == nil {
+		return nil, ErrNoAddrs
+	}
+
+	return c.events(cl.catchUp(&T{
+		Verb: watch,
+		Path: pb.String("/**"),
+		Rev:  &from,
+		Mut:  pb.Bool(true),
+	}))
+}
@@ -0,0 +1,79 @@
+package client
+
+import (
+	"json"
+	"os"
+	"reflect"
+)
+
+
+// Reads the JSON document at path, as of rev (see Get), into v, and
+// returns its rev. If there is no file at path, leaves v alone and
+// returns 0.
+func (cl *Client) GetJSON(path string, rev *int64, v interface{}) (int64, os.Error) {
+	body, r, err := cl.Get(path, rev)
+	if err != nil {
+		return 0, err
+	}
+	if r == 0 {
+		return 0, nil
+	}
+
+	return r, json.Unmarshal(body, v)
+}
+
+
+// Sets path to v encoded as JSON. The rev rules are those of Set.
+func (cl *Client) SetJSON(path string, oldRev int64, v interface{}) (newRev int64, err os.Error) {
+	body, err := json.Marshal(v)
+	if err != nil {
+		return 0, err
+	}
+
+	return cl.Set(path, oldRev, body)
+}
+
+
+// Like Update, but decodes the JSON document at path into v, which
+// must be a pointer, calls f to change it, and writes v back. Before
+// each try, v is reset to its zero value, so if there is no file at
+// path, f sees the zero value and the file is made.
+func (cl *Client) UpdateJSON(path string, v interface{}, f func() os.Error) (newRev int64, err os.Error) {
+	return cl.Update(path, func(old []byte) ([]byte, os.Error) {
+		if pv, ok := reflect.NewValue(v).(*reflect.PtrValue); ok {
+			pv.Elem().SetValue(reflect.MakeZero(pv.Elem().Type()))
+		}
+
+		if old != nil {
+			err := json.Unmarshal(old, v)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		err := f()
+		if err != nil {
+			return nil, err
+		}
+
+		return json.Marshal(v)
+	})
+}
+
+
+// Sets the given fields of the JSON object at path, keeping its other
+// fields as they are, and making it if it's missing. It retries like
+// Update.
+func (cl *Client) MergeJSON(path string, fields map[string]interface{}) (newRev int64, err os.Error) {
+	var m map[string]interface{}
+	return cl.UpdateJSON(path, &m, func() os.Error {
+		if m == nil {
+			m = make(map[string]interface{})
+		}
+		for k, v := range fields {
+			m[k] = v
+		}
+		return nil
+	})
+}
+
@@ -0,0 +1,165 @@
+package client
+
+import (
+	"bytes"
+	"doozer/proto"
+	"encoding/binary"
+	"log"
+	"net"
+	"os"
+)
+
+
+var ErrBadDatagram = os.NewError("bad multicast datagram")
+
+
+// A MulticastWatch receives changes sent to a multicast group by a
+// peer, as well as any it missed, fetched with an ordinary watch.
+type MulticastWatch struct {
+	C  <-chan *Event // to caller
+	uc *net.UDPConn
+}
+
+
+// Stops w. Its channel is closed soon after.
+func (w *MulticastWatch) Cancel() os.Error {
+	return w.uc.Close()
+}
+
+
+// One datagram sent by a peer's Multicast; see doc/proto.md.
+type datagram struct {
+	prev int64
+	seqn int64
+	n    int32
+	evs  []*Event // nil if left out
+}
+
+
+// Joins the multicast group at addr and sends on the returned watch's
+// channel each change sent there, from rev from on. glob must be the
+// glob the sending peer was started with. If datagrams are lost or
+// arrive out of order, the changes they carried are fetched with an
+// ordinary watch on cl, so none is skipped or repeated. If that fails,
+// the watch sends an Event with Err set and stops.
+func (cl *Client) Multicast(addr, glob string, from int64) (*MulticastWatch, os.Error) {
+	ga, err := net.ResolveUDPAddr(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	uc, err := net.ListenUDP("udp", &net.UDPAddr{Port: ga.Port})
+	if err != nil {
+		return nil, err
+	}
+
+	err = uc.JoinGroup(ga.IP)
+	if err != nil {
+		uc.Close()
+		return nil, err
+	}
+
+	evs := make(chan *Event)
+	go cl.follow(uc, glob, from-1, evs)
+	return &MulticastWatch{evs, uc}, nil
+}
+
+
+func (cl *Client) follow(uc *net.UDPConn, glob string, last int64, evs chan<- *Event) {
+	defer close(evs)
+
+	buf := make([]byte, 65536)
+	for {
+		n, _, err := uc.ReadFrom(buf)
+		if err != nil {
+			return // closed by Cancel
+		}
+
+		d, err := parseDatagram(buf[:n])
+		if err != nil {
+			log.Println(err)
+			continue
+		}
+
+		if d.seqn <= last {
+			continue
+		}
+
+		if d.prev > last || d.evs == nil {
+			err = cl.repair(glob, last, d, evs)
+			if err != nil {
+				evs <- &Event{Err: err}
+				return
+			}
+		} else {
+			for _, ev := range d.evs {
+				evs <- ev
+			}
+		}
+		last = d.seqn
+	}
+}
+
+
+// Fetches with a watch the changes made after last, through the ones
+// carried by d, and sends them on evs.
+func (cl *Client) repair(glob string, last int64, d *datagram, evs chan<- *Event) os.Error {
+	w, err := cl.Watch(glob, last+1)
+	if err != nil {
+		return err
+	}
+	defer w.Cancel()
+
+	for got := int32(0); got < d.n; {
+		ev := <-w.C
+		if ev == nil {
+			return os.EOF
+		}
+		if ev.Err != nil {
+			return ev.Err
+		}
+		if ev.Rev == d.seqn {
+			got++
+		}
+		evs <- ev
+	}
+	return nil
+}
+
+
+func parseDatagram(buf []byte) (*datagram, os.Error) {
+	d := new(datagram)
+	r := bytes.NewBuffer(buf)
+	for _, v := range []interface{}{&d.prev, &d.seqn, &d.n} {
+		if binary.Read(r, binary.BigEndian, v) != nil {
+			return nil, ErrBadDatagram
+		}
+	}
+
+	if r.Len() == 0 {
+		return d, nil
+	}
+
+	d.evs = []*Event{}
+	for r.Len() > 0 {
+		var size int32
+		if binary.Read(r, binary.BigEndian, &size) != nil || size < 0 || int(size) > r.Len() {
+			return nil, ErrBadDatagram
+		}
+
+		e, err := proto.UnmarshalEvent(r.Next(int(size)))
+		if err != nil {
+			return nil, err
+		}
+		if e.Seqn == nil || e.Path == nil {
+			return nil, ErrBadDatagram
+		}
+		ev := eventOf(e)
+		ev.Flag |= Valid
+		d.evs = append(d.evs, ev)
+	}
+	if int32(len(d.evs)) != d.n {
+		return nil, ErrBadDatagram
+	}
+	return d, nil
+}
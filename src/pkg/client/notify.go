@@ -0,0 +1,91 @@
+package client
+
+import (
+	"os"
+)
+
+
+// Kinds of ConnEvent.
+//
+// TODO add a kind for a server refusing the client's credentials, once
+// the protocol has any notion of who a client is.
+const (
+	ConnUp       = iota // a connection to Addr is open
+	ConnDown            // the connection to Addr closed, because of Err
+	ConnFailover        // the client now sends new requests to Addr
+	ConnDialFail        // a connection to Addr couldn't be made, because of Err
+	ConnNoAddrs         // no known server is left; the client is done
+)
+
+
+var connKindNames = []string{
+	ConnUp:       "up",
+	ConnDown:     "down",
+	ConnFailover: "failover",
+	ConnDialFail: "dial failed",
+	ConnNoAddrs:  "no addresses",
+}
+
+
+// A change in a client's connections to the cluster, as sent to the
+// channels given to Client.Notify.
+type ConnEvent struct {
+	Kind int
+	Addr string
+	Err  os.Error
+}
+
+
+func (e ConnEvent) String() string {
+	s := connKindNames[e.Kind]
+	if e.Addr != "" {
+		s += " " + e.Addr
+	}
+	if e.Err != nil {
+		s += ": " + e.Err.String()
+	}
+	return s
+}
+
+
+// Arranges for ch to receive an event each time cl connects to a
+// server, loses a connection, switches to another server, or fails to
+// dial one, so that an application can log and alert on its
+// connectivity. The first event, sent at once, is a ConnUp for the
+// server cl is using. ch is closed after the ConnNoAddrs event, when
+// cl has no server left to try.
+//
+// Events are sent without waiting: if ch isn't ready, the event is
+// dropped, so give it a buffer and read it promptly.
+func (cl *Client) Notify(ch chan<- ConnEvent) {
+	for {
+		select {
+		case cl.n <- ch:
+			return
+		case c := <-cl.c:
+			if c == nil {
+				// cl is already done.
+				send(ch, ConnEvent{Kind: ConnNoAddrs})
+				close(ch)
+				return
+			}
+		}
+	}
+}
+
+
+// Sends e to each channel registered with Notify. Called only by the
+// run goroutine, which owns cl.notify.
+func (cl *Client) emit(e ConnEvent) {
+	for _, ch := range cl.notify {
+		send(ch, e)
+	}
+}
+
+
+func send(ch chan<- ConnEvent, e ConnEvent) {
+	select {
+	case ch <- e:
+	default:
+	}
+}
@@ -0,0 +1,192 @@
+package client
+
+import (
+	"bytes"
+	"exec"
+	"io/ioutil"
+	"log"
+	"os"
+	"sort"
+	"template"
+)
+
+
+// A Render keeps a local file up to date with a template executed on
+// files in doozer, in the manner of confd, so that a service can read
+// its config from disk without a separate daemon.
+type Render struct {
+	Globs    []string // the doozer files the template may use
+	Template *template.Template
+	Dest     string   // the local file to write
+	Reload   []string // if set, a command run after Dest changes
+}
+
+
+// The data a Render's template is executed on.
+type Tree struct {
+	Rev   int64
+	Files []File // every file matching a glob, in path order
+}
+
+
+type File struct {
+	Path string
+	Body string
+	Rev  int64
+}
+
+
+// Renders r's template from the files matching r.Globs at rev and
+// writes it to r.Dest, unless r.Dest already holds exactly that.
+// If r.Dest changed and r.Reload is set, runs it and waits for it to
+// exit; a reload command that fails is logged, not returned.
+func (r *Render) Once(cl *Client, rev int64) (changed bool, err os.Error) {
+	t := Tree{Rev: rev}
+	files := make(map[string]File)
+	for _, glob := range r.Globs {
+		w, err := cl.Walk(glob, &rev, nil, nil)
+		if err != nil {
+			return false, err
+		}
+
+		for ev := range w.C {
+			if ev.Err != nil {
+				return false, ev.Err
+			}
+			files[ev.Path] = File{ev.Path, string(ev.Body), ev.Rev}
+		}
+	}
+
+	var paths []string
+	for p := range files {
+		paths = append(paths, p)
+	}
+	sort.SortStrings(paths)
+	for _, p := range paths {
+		t.Files = append(t.Files, files[p])
+	}
+
+	var buf bytes.Buffer
+	err = r.Template.Execute(&buf, t)
+	if err != nil {
+		return false, err
+	}
+
+	old, err := ioutil.ReadFile(r.Dest)
+	if err == nil && bytes.Equal(old, buf.Bytes()) {
+		return false, nil
+	}
+
+	// Write a whole new file and rename it, so readers of r.Dest
+	// never see a partial one.
+	tmp := r.Dest + ".tmp"
+	err = ioutil.WriteFile(tmp, buf.Bytes(), 0644)
+	if err != nil {
+		return false, err
+	}
+
+	err = os.Rename(tmp, r.Dest)
+	if err != nil {
+		return false, err
+	}
+
+	if len(r.Reload) > 0 {
+		err = reload(r.Reload)
+		if err != nil {
+			log.Println("reload:", err)
+		}
+	}
+	return true, nil
+}
+
+
+// Calls r.Once at the current rev, then again each time a file matching
+// r.Globs changes, until an error occurs. A burst of changes may be
+// rendered at once.
+func (r *Render) Run(cl *Client) os.Error {
+	rev, err := cl.Rev()
+	if err != nil {
+		return err
+	}
+
+	for {
+		_, err = r.Once(cl, rev)
+		if err != nil {
+			return err
+		}
+
+		rev, err = r.wait(cl, rev+1)
+		if err != nil {
+			return err
+		}
+	}
+
+	panic("not reached")
+}
+
+
+// Waits for a change, at or after from, to a file matching one of
+// r.Globs. Returns the rev of the change.
+func (r *Render) wait(cl *Client, from int64) (int64, os.Error) {
+	ch := make(chan *Event, 1)
+	var ws []*Watch
+	defer func() {
+		for _, w := range ws {
+			w.Cancel()
+		}
+	}()
+
+	for _, glob := range r.Globs {
+		w, err := cl.Watch(glob, from)
+		if err != nil {
+			return 0, err
+		}
+		ws = append(ws, w)
+
+		go func() {
+			for ev := range w.C {
+				select {
+				case ch <- ev:
+				default:
+				}
+			}
+
+			// The watch ended; likely the connection closed.
+			select {
+			case ch <- nil:
+			default:
+			}
+		}()
+	}
+
+	ev := <-ch
+	if ev == nil {
+		return 0, os.EOF
+	}
+	if ev.Err != nil {
+		return 0, ev.Err
+	}
+	return ev.Rev, nil
+}
+
+
+func reload(argv []string) os.Error {
+	bin, err := exec.LookPath(argv[0])
+	if err != nil {
+		return err
+	}
+
+	p, err := exec.Run(bin, argv, os.Environ(), "", exec.DevNull, exec.PassThrough, exec.PassThrough)
+	if err != nil {
+		return err
+	}
+
+	msg, err := p.Wait(0)
+	if err != nil {
+		return err
+	}
+	if msg.ExitStatus() != 0 {
+		return os.NewError(msg.String())
+	}
+	return nil
+}
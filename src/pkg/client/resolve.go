@@ -0,0 +1,54 @@
+package client
+
+import (
+	"os"
+)
+
+
+// One key of effective configuration, as computed by Resolve.
+type Setting struct {
+	Value []byte
+	Rev   int64
+	Layer string // the layer that supplied Value
+}
+
+
+// Computes the effective configuration under dir by overlaying the
+// same directory in each of layers, in order, so later layers override
+// earlier ones. For example, with layers {"/defaults", "/apps/foo"} and
+// dir "/db", the file /apps/foo/db/host overrides /defaults/db/host,
+// and the result has key "host" with Layer "/apps/foo".
+//
+// Keys are file paths relative to dir. All layers are read at one rev,
+// so the result is consistent; if rev is nil, Resolve uses the current
+// rev. A layer without dir contributes nothing.
+func (cl *Client) Resolve(layers []string, dir string, rev *int64) (map[string]Setting, os.Error) {
+	if rev == nil {
+		r, err := cl.Rev()
+		if err != nil {
+			return nil, err
+		}
+		rev = &r
+	}
+
+	if dir == "/" {
+		dir = ""
+	}
+
+	m := make(map[string]Setting)
+	for _, layer := range layers {
+		base := layer + dir
+		w, err := cl.Walk(base+"/**", rev, nil, nil)
+		if err != nil {
+			return nil, err
+		}
+
+		for ev := range w.C {
+			if ev.Err != nil {
+				return nil, ev.Err
+			}
+			m[ev.Path[len(base)+1:]] = Setting{ev.Body, ev.Rev, layer}
+		}
+	}
+	return m, nil
+}
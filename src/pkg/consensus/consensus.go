@@ -1,11 +1,18 @@
 package consensus
 
 import (
+	"doozer/gocount"
 	"doozer/store"
+	"os"
 	"time"
 )
 
 
+// How many times Update reads and tries to write a file before it
+// gives up.
+const UpdateTries = 10
+
+
 // propSeqns must be buffered with capacity >= alpha
 func NewManager(self string, start int64, alpha int64, in <-chan Packet, out chan<- Packet, ops chan<- store.Op, propSeqns chan<- int64, props <-chan *Prop, w <-chan store.Event, fillDelay int64, st *store.Store) Manager {
 	runs := make(chan *run)
@@ -15,7 +22,7 @@ func NewManager(self string, start int64, alpha int64, in <-chan Packet, out cha
 		ops:   ops,
 		bound: initialWaitBound,
 	}
-	go generateRuns(alpha, w, runs, t)
+	gocount.Go("consensus", func() { generateRuns(alpha, w, runs, t) })
 	return newManager(self, start, propSeqns, in, runs, props, time.Tick(10e6), fillDelay, st, out)
 }
 
@@ -43,3 +50,236 @@ func Del(p Proposer, path string, rev int64) (e store.Event) {
 
 	return p.Propose([]byte(e.Mut))
 }
+
+
+// Like Set, but fails with store.ErrRevMismatch if an entry has been
+// added to or removed from the parent directory since dirRev.
+func SetInDir(p Proposer, dirRev int64, path string, body []byte, rev int64) (e store.Event) {
+	e.Mut, e.Err = store.EncodeSet(path, string(body), rev)
+	if e.Err != nil {
+		return
+	}
+
+	return p.Propose([]byte(store.EncodeInDir(dirRev, e.Mut)))
+}
+
+
+// Like Del, but fails with store.ErrRevMismatch if an entry has been
+// added to or removed from the parent directory since dirRev.
+func DelInDir(p Proposer, dirRev int64, path string, rev int64) (e store.Event) {
+	e.Mut, e.Err = store.EncodeDel(path, rev)
+	if e.Err != nil {
+		return
+	}
+
+	return p.Propose([]byte(store.EncodeInDir(dirRev, e.Mut)))
+}
+
+
+// Like Set, but if exists is true, fails with os.ENOENT unless path
+// exists, and if it is false, fails with os.EEXIST if path exists.
+func SetIf(p Proposer, exists bool, path string, body []byte, rev int64) (e store.Event) {
+	e.Mut, e.Err = store.EncodeSet(path, string(body), rev)
+	if e.Err != nil {
+		return
+	}
+
+	return p.Propose([]byte(ifExists(exists, e.Mut)))
+}
+
+
+// Like Del, but with the same condition as SetIf.
+func DelIf(p Proposer, exists bool, path string, rev int64) (e store.Event) {
+	e.Mut, e.Err = store.EncodeDel(path, rev)
+	if e.Err != nil {
+		return
+	}
+
+	return p.Propose([]byte(ifExists(exists, e.Mut)))
+}
+
+
+// Like Set, but fails with store.ErrBodyMismatch unless path is a file
+// whose body is expect.
+func SetIfBody(p Proposer, expect []byte, path string, body []byte, rev int64) (e store.Event) {
+	e.Mut, e.Err = store.EncodeSet(path, string(body), rev)
+	if e.Err != nil {
+		return
+	}
+
+	return p.Propose([]byte(store.EncodeIfBody(string(expect), e.Mut)))
+}
+
+
+// Appends data to the file at path, as with store.EncodeAppend.
+func Append(p Proposer, path string, data []byte, rev int64) (e store.Event) {
+	e.Mut, e.Err = store.EncodeAppend(path, string(data), rev)
+	if e.Err != nil {
+		return
+	}
+
+	return p.Propose([]byte(e.Mut))
+}
+
+
+// Like Append, but fails with store.ErrBodyLimit if the body it would
+// leave is longer than max, as with store.EncodeAppendMax.
+func AppendMax(p Proposer, path string, data []byte, rev, max int64) (e store.Event) {
+	e.Mut, e.Err = store.EncodeAppendMax(path, string(data), rev, max)
+	if e.Err != nil {
+		return
+	}
+
+	return p.Propose([]byte(e.Mut))
+}
+
+
+// Adds delta to the number in the file at path, as with
+// store.EncodeAdd. The event's Body is the sum.
+func Add(p Proposer, path string, delta, rev int64) (e store.Event) {
+	e.Mut, e.Err = store.EncodeAdd(path, delta, rev)
+	if e.Err != nil {
+		return
+	}
+
+	return p.Propose([]byte(e.Mut))
+}
+
+
+// Sets the file at path to the body f makes from its current one, as
+// read from g. If the file changes before the write lands, reads it
+// again and calls f again, at most UpdateTries times in all; after
+// that, the event's Err is store.ErrRevMismatch. A missing file reads
+// as nil and is made. If f returns an error, nothing is written and
+// that is the event's Err.
+func Update(p Proposer, g store.Getter, path string, f func(old []byte) ([]byte, os.Error)) (e store.Event) {
+	for i := 0; i < UpdateTries; i++ {
+		v, rev := g.Get(path)
+		if rev == store.Dir {
+			e.Err = os.EISDIR
+			return
+		}
+
+		var old []byte
+		if rev != store.Missing {
+			old = []byte(v[0])
+		}
+
+		body, err := f(old)
+		if err != nil {
+			e.Err = err
+			return
+		}
+
+		e = Set(p, path, body, rev)
+		if e.Err != store.ErrRevMismatch {
+			return
+		}
+	}
+	return
+}
+
+
+// Makes the file at path a link to target, as with store.EncodeLink.
+func Link(p Proposer, path, target string, rev int64) (e store.Event) {
+	e.Mut, e.Err = store.EncodeLink(path, target, rev)
+	if e.Err != nil {
+		return
+	}
+
+	return p.Propose([]byte(e.Mut))
+}
+
+
+// Sets the file at path and ties it to session sess, so that it is
+// deleted when the session ends, as with store.EncodeEphemeral.
+func SetEphemeral(p Proposer, path string, body []byte, rev int64, sess string) (e store.Event) {
+	e.Mut, e.Err = store.EncodeEphemeral(path, string(body), rev, sess)
+	if e.Err != nil {
+		return
+	}
+
+	return p.Propose([]byte(e.Mut))
+}
+
+
+// Sets the file at path and gives it an expiry at when, in ns, as with
+// store.EncodeExpiring.
+func SetExpiring(p Proposer, path string, body []byte, rev, when int64) (e store.Event) {
+	e.Mut, e.Err = store.EncodeExpiring(path, string(body), rev, when)
+	if e.Err != nil {
+		return
+	}
+
+	return p.Propose([]byte(e.Mut))
+}
+
+
+// Copies the file or directory at src to dst, as with store.EncodeCopy.
+func Copy(p Proposer, src, dst string, rev int64) (e store.Event) {
+	e.Mut, e.Err = store.EncodeCopy(src, dst, rev)
+	if e.Err != nil {
+		return
+	}
+
+	return p.Propose([]byte(e.Mut))
+}
+
+
+func ifExists(exists bool, mut string) string {
+	if exists {
+		return store.EncodeIfExists(mut)
+	}
+	return store.EncodeIfAbsent(mut)
+}
+
+
+// Publishes a cluster event of the given kind by writing body to
+// a file in store.EventDir, whatever its rev.
+func Publish(p Proposer, kind, body string) (e store.Event) {
+	return Set(p, store.EventDir+"/"+kind, []byte(body), store.Clobber)
+}
+
+
+// Creates a file holding body under a path made of prefix and a suffix
+// greater than that of any file created this way before, as with
+// store.EncodeSequential. The event's Path is the path chosen.
+func SetSequential(p Proposer, prefix string, body []byte) (e store.Event) {
+	e.Mut, e.Err = store.EncodeSequential(prefix, string(body))
+	if e.Err != nil {
+		return
+	}
+
+	return p.Propose([]byte(e.Mut))
+}
+
+
+// Applies sets and dels at one seqn, all or nothing, as with
+// store.EncodeTxn.
+func Txn(p Proposer, sets []store.SetOp, dels []store.DelOp) (e store.Event) {
+	e.Mut, e.Err = store.EncodeTxn(sets, dels)
+	if e.Err != nil {
+		return
+	}
+
+	return p.Propose([]byte(e.Mut))
+}
+
+
+var calGlob = store.MustCompileGlob("/ctl/cal/*")
+
+
+// Reports whether self holds the first taken CAL slot in g, in path
+// order. At any seqn exactly one peer does, so of the tasks every
+// coordinator runs, those that need only one proposer can leave it to
+// the peer for which this is true.
+func Leads(g store.Getter, self string) (leads bool) {
+	store.Walk(g, calGlob, func(_, body string, _ int64) bool {
+		if body == "" {
+			return false
+		}
+		leads = body == self
+		return true
+	})
+	return leads
+}
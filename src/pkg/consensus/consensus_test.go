@@ -50,7 +50,7 @@ func TestConsensusOne(t *testing.T) {
 		Body: "bad mutation",
 		Rev:  4,
 		Mut:  "foo",
-		Err:  os.NewError("bad mutation"),
+		Err:  store.ErrBadMutation,
 	}
 
 	e.Getter = nil
@@ -118,7 +118,7 @@ func TestConsensusTwo(t *testing.T) {
 		Body: "bad mutation",
 		Rev:  6,
 		Mut:  "foo",
-		Err:  os.NewError("bad mutation"),
+		Err:  store.ErrBadMutation,
 	}
 
 	e.Getter = nil
@@ -162,3 +162,80 @@ func TestLearnedValueIsLearned(t *testing.T) {
 
 	assert.Equal(t, exp, <-out)
 }
+
+
+// Proposes each value at the next seqn, first slipping in another
+// write to the same file if race is set.
+type racyProposer struct {
+	st   *store.Store
+	seqn int64
+	race bool
+}
+
+
+func (rp *racyProposer) Propose(v []byte) store.Event {
+	if rp.race {
+		rp.race = false
+		rp.propose([]byte(store.MustEncodeSet("/x", "9", store.Clobber)))
+	}
+	return rp.propose(v)
+}
+
+
+func (rp *racyProposer) propose(v []byte) store.Event {
+	rp.seqn++
+	ch, err := rp.st.Wait(rp.seqn)
+	if err != nil {
+		panic(err)
+	}
+	rp.st.Ops <- store.Op{rp.seqn, string(v)}
+	return <-ch
+}
+
+
+func incr(old []byte) ([]byte, os.Error) {
+	return append(old, '1'), nil
+}
+
+
+func TestUpdate(t *testing.T) {
+	st := store.New()
+	defer close(st.Ops)
+	p := &racyProposer{st: st}
+
+	e := Update(p, st, "/x", incr)
+	assert.Equal(t, nil, e.Err)
+	assert.Equal(t, "1", e.Body)
+
+	p.race = true
+	e = Update(p, st, "/x", incr)
+	assert.Equal(t, nil, e.Err)
+	assert.Equal(t, "91", e.Body)
+}
+
+
+func TestUpdateError(t *testing.T) {
+	st := store.New()
+	defer close(st.Ops)
+	p := &racyProposer{st: st}
+
+	e := Update(p, st, "/x", func([]byte) ([]byte, os.Error) {
+		return nil, os.EINVAL
+	})
+	assert.Equal(t, os.EINVAL, e.Err)
+	assert.Equal(t, int64(0), p.seqn)
+}
+
+
+func TestLeads(t *testing.T) {
+	st := store.New()
+	defer close(st.Ops)
+	assert.Equal(t, false, Leads(st, "a"))
+
+	st.Ops <- store.Op{1, store.MustEncodeSet("/ctl/cal/0", "", store.Clobber)}
+	st.Ops <- store.Op{2, store.MustEncodeSet("/ctl/cal/1", "b", store.Clobber)}
+	st.Ops <- store.Op{3, store.MustEncodeSet("/ctl/cal/2", "a", store.Clobber)}
+	<-st.Seqns
+	assert.Equal(t, false, Leads(st, "a"))
+	assert.Equal(t, true, Leads(st, "b"))
+}
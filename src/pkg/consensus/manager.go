@@ -4,6 +4,7 @@ package consensus
 import (
 	"container/heap"
 	"container/vector"
+	"doozer/gocount"
 	"doozer/store"
 	"goprotobuf.googlecode.com/hg/proto"
 	"log"
@@ -67,7 +68,7 @@ var fillTemplate = &M{Cmd: propose, Value: []byte(store.Nop)}
 func newManager(self string, nextFill int64, propSeqns chan<- int64, in <-chan Packet, runs <-chan *run, props <-chan *Prop, ticker <-chan int64, fillDelay int64, st *store.Store, out chan<- Packet) Manager {
 	statCh := make(chan Stats)
 
-	go func() {
+	gocount.Go("consensus", func() {
 		running := make(map[int64]*run)
 		packets := new(vector.Vector)
 		fills := new(vector.Vector)
@@ -127,7 +128,7 @@ func newManager(self string, nextFill int64, propSeqns chan<- int64, in <-chan P
 
 				r := running[seqn]
 				if r == nil {
-					go sendLearn(out, p, st)
+					gocount.Go("consensus.learn", func() { sendLearn(out, p, st) })
 					continue
 				}
 
@@ -137,7 +138,7 @@ func newManager(self string, nextFill int64, propSeqns chan<- int64, in <-chan P
 				}
 			}
 		}
-	}()
+	})
 
 	return statCh
 }
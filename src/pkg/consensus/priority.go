@@ -0,0 +1,86 @@
+package consensus
+
+import (
+	"doozer/store"
+)
+
+
+// The class of a proposal. When more proposals are waiting than there
+// are seqns to give them, lower values go first.
+type Priority int
+
+const (
+	High   Priority = iota // control plane: locks, sessions, membership
+	Normal                 // ordinary client writes
+	Bulk                   // imports and restores, which can wait
+	NPriority
+)
+
+
+// A Proposer that can schedule proposals by priority.
+type PriorityProposer interface {
+	Proposer
+	ProposeAt(v []byte, pri Priority) store.Event
+}
+
+
+// Proposes v at priority pri if p supports priorities, or proposes it
+// as usual otherwise.
+func ProposeAt(p Proposer, v []byte, pri Priority) store.Event {
+	if pp, ok := p.(PriorityProposer); ok {
+		return pp.ProposeAt(v, pri)
+	}
+	return p.Propose(v)
+}
+
+
+type atPriority struct {
+	p   Proposer
+	pri Priority
+}
+
+
+func (a atPriority) Propose(v []byte) store.Event {
+	return ProposeAt(a.p, v, a.pri)
+}
+
+
+// Returns a Proposer that proposes through p at priority pri. It can be
+// passed to Set, Del, and the rest.
+func WithPriority(p Proposer, pri Priority) Proposer {
+	return atPriority{p, pri}
+}
+
+
+// Hands out seqns from seqns to proposals waiting in wait, always to
+// one of the highest priority waiting. A proposer that supports
+// priorities runs this in its own goroutine; each proposal sends a
+// channel on wait[pri] and receives its seqn on it.
+func Schedule(seqns <-chan int64, wait [NPriority]chan chan int64) {
+	for n := range seqns {
+		c := nextWaiting(wait)
+		c <- n
+	}
+}
+
+
+func nextWaiting(wait [NPriority]chan chan int64) chan int64 {
+	for _, w := range wait {
+		select {
+		case c := <-w:
+			return c
+		default:
+		}
+	}
+
+	// Nobody is waiting; take the first to arrive.
+	select {
+	case c := <-wait[High]:
+		return c
+	case c := <-wait[Normal]:
+		return c
+	case c := <-wait[Bulk]:
+		return c
+	}
+	panic("unreachable")
+}
@@ -0,0 +1,52 @@
+package consensus
+
+import (
+	"doozer/store"
+	"github.com/bmizerany/assert"
+	"testing"
+)
+
+
+type recordingProposer struct {
+	pri Priority
+}
+
+
+func (r *recordingProposer) Propose(v []byte) store.Event {
+	r.pri = -1
+	return store.Event{}
+}
+
+
+func (r *recordingProposer) ProposeAt(v []byte, pri Priority) store.Event {
+	r.pri = pri
+	return store.Event{}
+}
+
+
+func TestWithPriority(t *testing.T) {
+	rp := &recordingProposer{}
+	Set(WithPriority(rp, Bulk), "/x", nil, store.Clobber)
+	assert.Equal(t, Bulk, rp.pri)
+}
+
+
+func TestScheduleHighFirst(t *testing.T) {
+	var wait [NPriority]chan chan int64
+	for i := range wait {
+		wait[i] = make(chan chan int64, 5)
+	}
+
+	bulk, high := make(chan int64, 1), make(chan int64, 1)
+	wait[Bulk] <- bulk
+	wait[High] <- high
+
+	seqns := make(chan int64, 2)
+	seqns <- 1
+	seqns <- 2
+	close(seqns)
+	Schedule(seqns, wait)
+
+	assert.Equal(t, int64(1), <-high)
+	assert.Equal(t, int64(2), <-bulk)
+}
@@ -1,19 +1,25 @@
 package doozer
 
 import (
+	"bytes"
 	"crypto/rand"
+	"doozer/checksum"
 	"doozer/client"
 	"doozer/consensus"
 	"doozer/gc"
 	"doozer/lock"
+	"doozer/manifest"
 	"doozer/member"
+	"doozer/sched"
 	"doozer/server"
 	"doozer/session"
 	"doozer/store"
+	"doozer/ttl"
 	"doozer/web"
 	"encoding/base32"
 	"net"
 	"os"
+	"strconv"
 	"time"
 	"log"
 )
@@ -22,23 +28,113 @@ const (
 	alpha               = 50
 	maxUDPLen           = 3000
 	sessionPollInterval = 1e9 // ns == 1s
+	ttlPollInterval     = 1e9 // ns == 1s
+	schedPollInterval   = 1e9 // ns == 1s
+	checksumInterval    = 1e9 // ns == 1s
 )
 
 const calDir = "/ctl/cal"
 
 var calGlob = store.MustCompileGlob(calDir + "/*")
 
+var featureLevel = strconv.Itoa64(store.FeatureLevel)
+
+// Limits applied to client requests. See server.Limit.
+var BodyLimit, WatchLimit server.Limit
+
+// Whether to accept BULK requests. See server.Server.AllowBulk.
+var AllowBulk bool
+
+// Whether CLEAN may discard history. See server.Server.AllowClean.
+var AllowClean bool
+
+// Limits on how often each file may be written. See server.RateLimit.
+var RateLimits []server.RateLimit
+
+// The most bytes per second sent to peers catching up from this one.
+// See server.Server.CatchUpRate.
+var CatchUpRate float64
+
+// When to refuse requests because this peer is overloaded. See
+// server.ShedPolicy.
+var Shed server.ShedPolicy
+
+// Files that need force to be deleted or clobbered. See
+// server.Server.Protect.
+var Protect []*store.Glob
+
+// Subtrees that clients may not write, though the cluster itself may.
+// See store.Store.Reserve.
+var Reserve []string
+
+// Whether paths are case-insensitive: /Foo and /foo name the same file.
+// Every peer in a cluster must agree. See store.NewFoldCase.
+var FoldCase bool
+
+// Bodies longer than this many bytes are kept compressed in the store,
+// if that saves space. Zero keeps every body as it is. Peers need not
+// agree. See store.Store.Compress.
+var CompressOver int
+
+// Checks the store makes of every write to files matching Glob,
+// whoever proposes it, as for store.Store.ReserveWith. Set these the
+// same way on every peer.
+type Reservation struct {
+	Glob      *store.Glob
+	Validator store.Validator
+}
+
+// Validators registered with the store before it applies anything.
+var Reservations []Reservation
+
+// Files to make, if they are missing, when a new cluster starts. See
+// package manifest.
+var Manifest []manifest.Entry
+
+// How long, in ns, deleted files are kept in the trash. See
+// server.Server.Trash.
+var Trash int64
+
+// If MulticastAddr is set, changes to files matching MulticastGlob are
+// sent there. See server.Server.Multicast.
+var (
+	MulticastAddr *net.UDPAddr
+	MulticastGlob *store.Glob
+)
+
 
 type proposer struct {
 	seqns chan int64
 	props chan *consensus.Prop
 	st    *store.Store
+	wait  [consensus.NPriority]chan chan int64
 }
 
 
-func (p *proposer) Propose(v []byte) (e store.Event) {
+func newProposer(st *store.Store) *proposer {
+	p := &proposer{
+		seqns: make(chan int64, alpha),
+		props: make(chan *consensus.Prop),
+		st:    st,
+	}
+	for i := range p.wait {
+		p.wait[i] = make(chan chan int64)
+	}
+	go consensus.Schedule(p.seqns, p.wait)
+	return p
+}
+
+
+func (p *proposer) Propose(v []byte) store.Event {
+	return p.ProposeAt(v, consensus.Normal)
+}
+
+
+func (p *proposer) ProposeAt(v []byte, pri consensus.Priority) (e store.Event) {
+	c := make(chan int64)
 	for e.Mut != string(v) {
-		n := <-p.seqns
+		p.wait[pri] <- c
+		n := <-c
 		w, err := p.st.Wait(n)
 		if err != nil {
 			panic(err) // can't happen
@@ -57,57 +153,114 @@ func Main(clusterName, attachAddr string, udpConn net.PacketConn, listener, webL
 	useSelf := make(chan bool, 1)
 
 	self := randId()
-	st := store.New()
-	pr := &proposer{
-		seqns: make(chan int64, alpha),
-		props: make(chan *consensus.Prop),
-		st:    st,
+	var st *store.Store
+	protect, rateLimits := Protect, RateLimits
+	if FoldCase {
+		st = store.NewFoldCase()
+		protect, rateLimits = foldGlobs(Protect, RateLimits)
+	} else {
+		st = store.New()
+	}
+	st.Compress(CompressOver)
+	for _, p := range Reserve {
+		err := st.Reserve(p)
+		if err != nil {
+			panic(err)
+		}
+	}
+	for _, r := range Reservations {
+		err := st.ReserveWith(r.Glob, r.Validator)
+		if err != nil {
+			panic(err)
+		}
+	}
+	pr := newProposer(st)
+	ctl := consensus.WithPriority(pr, consensus.High)
+
+	sv := &server.Server{
+		Addr:  listenAddr,
+		St:    st,
+		Mg:    pr,
+		Self:  self,
+		Alpha: alpha,
+
+		BodyLimit:   BodyLimit,
+		WatchLimit:  WatchLimit,
+		AllowBulk:   AllowBulk,
+		AllowClean:  AllowClean,
+		RateLimits:  rateLimits,
+		CatchUpRate: CatchUpRate,
+		Protect:     protect,
+		Trash:       Trash,
+		Shed:        Shed,
+	}
+	phasePath := "/ctl/node/" + self + "/phase"
+	phaseC := func(cl *client.Client, ph server.Phase) {
+		setC(cl, phasePath, ph.String(), store.Clobber)
+		publishC(cl, "phase", self+" "+ph.String())
 	}
 
 	calSrv := func() {
-		go lock.Clean(pr, st.Watch(lock.SessGlob))
-		go session.Clean(st, pr, time.Tick(sessionPollInterval))
-		go gc.Pulse(self, st.Seqns, pr, pulseInterval)
-		go gc.Clean(st, 360000, time.Tick(1e9))
+		go lock.Clean(ctl, st.Watch(lock.SessGlob))
+		go session.Clean(st, ctl, time.Tick(sessionPollInterval))
+		go ttl.Clean(st, ctl, time.Tick(ttlPollInterval), sv.CheckWrite)
+		go sched.Run(st, ctl, time.Tick(schedPollInterval), sv.CheckWrite)
+		go checksum.Update(st, ctl, self, time.Tick(checksumInterval))
+		go gc.Pulse(self, st.Seqns, ctl, pulseInterval)
+		go gc.Clean(st, ctl, self, 360000, time.Tick(1e9))
 	}
 
 	if attachAddr == "" { // we are the only node in a new cluster
 		set(st, "/ctl/node/"+self+"/addr", listenAddr, store.Missing)
 		set(st, "/ctl/node/"+self+"/hostname", os.Getenv("HOSTNAME"), store.Missing)
 		set(st, "/ctl/node/"+self+"/version", Version, store.Missing)
+		set(st, "/ctl/node/"+self+"/feature", featureLevel, store.Missing)
 		set(st, "/ctl/cal/0", self, store.Missing)
+		set(st, phasePath, server.Serving.String(), store.Missing)
+		set(st, store.EventDir+"/member", "add "+self, store.Missing)
+		set(st, store.EventDir+"/cal", "add "+self+" 0", store.Missing)
+		set(st, store.EventDir+"/phase", self+" "+server.Serving.String(), store.Missing)
 		calSrv()
+		sv.SetPhase(server.Serving)
 		close(useSelf)
 	} else {
-		cl := client.New("local", attachAddr) // TODO use real cluster name
+		cl := newClient(listener, attachAddr) // TODO use real cluster name
+		cl.CatchUp = true
+		sv.Fwd = cl
 		setC(cl, "/ctl/node/"+self+"/addr", listenAddr, store.Clobber)
 		setC(cl, "/ctl/node/"+self+"/hostname", os.Getenv("HOSTNAME"), store.Clobber)
 		setC(cl, "/ctl/node/"+self+"/version", Version, store.Clobber)
-
-		rev, err := cl.Rev()
+		setC(cl, "/ctl/node/"+self+"/feature", featureLevel, store.Clobber)
+		publishC(cl, "member", "add "+self)
+		phaseC(cl, server.Recovering)
+
+		// Load a snapshot rather than copying a walk, so that empty
+		// directories and links come across too, then apply the same
+		// mutations the other peers do from there on.
+		var snap bytes.Buffer
+		rev, err := cl.Snapshot(&snap)
 		if err != nil {
 			panic(err)
 		}
 
-		walk, err := cl.Walk("/**", &rev, nil, nil)
+		watch, err := cl.WatchMutations(rev + 1)
 		if err != nil {
 			panic(err)
 		}
 
-		watch, err := cl.Watch("/**", rev+1)
+		go follow(st.Ops, watch.C)
+		err = st.LoadSnapshot(&snap)
 		if err != nil {
 			panic(err)
 		}
-
-		go follow(st.Ops, watch.C)
-		follow(st.Ops, walk.C)
-		st.Flush()
 		ch, err := st.Wait(rev + 1)
 		if err == nil {
 			<-ch
 		}
 
 		go func() {
+			sv.SetPhase(server.CatchingUp)
+			phaseC(cl, server.CatchingUp)
 			activateSeqn = activate(st, self, cl)
 			calSrv()
 			advanceUntil(cl, st.Seqns, activateSeqn+alpha)
@@ -115,6 +268,8 @@ func Main(clusterName, attachAddr string, udpConn net.PacketConn, listener, webL
 			if err != nil {
 				panic(err)
 			}
+			phaseC(cl, server.Serving)
+			sv.SetPhase(server.Serving)
 			close(useSelf)
 		}()
 	}
@@ -136,33 +291,64 @@ func Main(clusterName, attachAddr string, udpConn net.PacketConn, listener, webL
 
 	shun := make(chan string, 3) // sufficient for a cluster of 7
 
-	go member.Clean(shun, st, pr)
-
-	sv := &server.Server{listenAddr, st, pr, self, alpha}
+	go member.Clean(shun, st, ctl)
 
 	go sv.Serve(listener, useSelf)
 
+	if MulticastAddr != nil {
+		go func() {
+			err := sv.Multicast(MulticastAddr, MulticastGlob)
+			if err != nil {
+				log.Println("multicast:", err)
+			}
+		}()
+	}
+
+	if attachAddr == "" && len(Manifest) > 0 {
+		go func() {
+			_, err := manifest.Apply(ctl, Manifest)
+			if err != nil {
+				log.Println("manifest:", err)
+			}
+		}()
+	}
+
 	if webListener != nil {
 		web.Store = st
+		web.Server = sv
 		web.ClusterName = clusterName
 		go web.Serve(webListener)
 	}
 
+	send := func(p consensus.Packet) {
+		addr, err := net.ResolveUDPAddr(p.Addr)
+		if err != nil {
+			log.Println(err)
+			return
+		}
+		n, err := udpConn.WriteTo(p.Data, addr)
+		if err != nil {
+			log.Println(err)
+			return
+		}
+		if n != len(p.Data) {
+			log.Println("packet len too long:", len(p.Data))
+			return
+		}
+	}
+
+	var fs *faults
+	if AllowFaults {
+		fs = newFaults()
+		go fs.follow(st)
+	}
+
 	go func() {
 		for p := range out {
-			addr, err := net.ResolveUDPAddr(p.Addr)
-			if err != nil {
-				log.Println(err)
-				continue
-			}
-			n, err := udpConn.WriteTo(p.Data, addr)
-			if err != nil {
-				log.Println(err)
-				continue
-			}
-			if n != len(p.Data) {
-				log.Println("packet len too long:", len(p.Data))
-				continue
+			if fs != nil {
+				fs.deliver(p, send)
+			} else {
+				send(p)
 			}
 		}
 	}()
@@ -180,6 +366,7 @@ func Main(clusterName, attachAddr string, udpConn net.PacketConn, listener, webL
 		buf := make([]byte, maxUDPLen)
 		n, addr, err := udpConn.ReadFrom(buf)
 		if err == os.EINVAL {
+			sv.SetPhase(server.Draining)
 			return
 		}
 		if err != nil {
@@ -211,6 +398,7 @@ func activate(st *store.Store, self string, c *client.Client) int64 {
 				continue
 			}
 
+			publishC(c, "cal", "add "+self+" "+base)
 			w.Stop()
 			return seqn
 		}
@@ -224,6 +412,7 @@ func activate(st *store.Store, self string, c *client.Client) int64 {
 				log.Println(err)
 				continue
 			}
+			publishC(c, "cal", "add "+self+" "+ev.Path[len(calDir)+1:])
 			w.Stop()
 			return seqn
 		}
@@ -250,13 +439,49 @@ func setC(cl *client.Client, path, body string, rev int64) {
 	}
 }
 
+// Publishes a cluster event through cl. See consensus.Publish.
+func publishC(cl *client.Client, kind, body string) {
+	setC(cl, store.EventDir+"/"+kind, body, store.Clobber)
+}
+
 func follow(ops chan<- store.Op, ch <-chan *client.Event) {
 	for ev := range ch {
-		// store.Clobber is okay here because the event
-		// has already passed through another store
-		mut := store.MustEncodeSet(ev.Path, string(ev.Body), store.Clobber)
-		ops <- store.Op{ev.Rev, mut}
+		ops <- store.Op{ev.Rev, string(ev.Mut)}
+	}
+}
+
+
+// A listener that can also open connections to other peers, such as
+// one on a simulated network.
+type dialer interface {
+	Dial(addr string) (net.Conn, os.Error)
+}
+
+
+func newClient(l net.Listener, addr string) *client.Client {
+	if d, ok := l.(dialer); ok {
+		return client.NewDialer("local", addr, func(a string) (net.Conn, os.Error) {
+			return d.Dial(a)
+		})
+	}
+	return client.New("local", addr)
+}
+
+
+// Returns copies of gs and ls whose globs ignore case, to match paths
+// as a store made by store.NewFoldCase does.
+func foldGlobs(gs []*store.Glob, ls []server.RateLimit) ([]*store.Glob, []server.RateLimit) {
+	fgs := make([]*store.Glob, len(gs))
+	for i, g := range gs {
+		fgs[i] = g.Fold()
+	}
+
+	fls := make([]server.RateLimit, len(ls))
+	for i, l := range ls {
+		l.Glob = l.Glob.Fold()
+		fls[i] = l
 	}
+	return fgs, fls
 }
 
 
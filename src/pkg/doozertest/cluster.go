@@ -0,0 +1,74 @@
+package doozertest
+
+import (
+	"doozer"
+	"doozer/client"
+	"doozer/store"
+	"net"
+	"os"
+	"strconv"
+	"time"
+)
+
+const (
+	pulseInterval = 1e9 // ns == 1s
+	fillDelay     = 2e8 // ns == 200ms
+	kickTimeout   = 3e9 // ns == 3s
+)
+
+// A Cluster is a set of doozer peers running in this process and
+// talking over a simulated Network.
+type Cluster struct {
+	Net   *Network
+	Addrs []string
+
+	lns []net.Listener
+	pcs []net.PacketConn
+}
+
+// Starts a cluster of n peers on nw, and waits for every peer to
+// occupy a CAL slot.
+func NewCluster(nw *Network, n int) *Cluster {
+	c := &Cluster{Net: nw}
+	c.start("")
+
+	cl := c.Client()
+	for i := 1; i < n; i++ {
+		_, err := cl.Set("/ctl/cal/"+strconv.Itoa(i), store.Missing, nil)
+		if err != nil {
+			panic(err)
+		}
+		c.start(c.Addrs[0])
+	}
+
+	for <-cl.Len < n {
+		time.Sleep(1e8)
+	}
+	return c
+}
+
+func (c *Cluster) start(attach string) {
+	a := "127.0.0.1:" + strconv.Itoa(10000+len(c.Addrs))
+	l := c.Net.Listen(a)
+	pc := c.Net.ListenPacket(a)
+	c.Addrs = append(c.Addrs, a)
+	c.lns = append(c.lns, l)
+	c.pcs = append(c.pcs, pc)
+
+	go doozer.Main("test", attach, pc, l, nil, pulseInterval, fillDelay, kickTimeout)
+}
+
+// Returns a new client connected to the first peer.
+func (c *Cluster) Client() *client.Client {
+	return client.NewDialer("test", c.Addrs[0], func(a string) (net.Conn, os.Error) {
+		return c.Net.Dial(a)
+	})
+}
+
+// Stops every peer.
+func (c *Cluster) Close() {
+	for i := range c.Addrs {
+		c.lns[i].Close()
+		c.pcs[i].Close()
+	}
+}
@@ -0,0 +1,746 @@
+package doozertest
+
+import (
+	"doozer"
+	"doozer/client"
+	"doozer/server"
+	"doozer/store"
+	_ "doozer/quiet"
+	"github.com/bmizerany/assert"
+	"hash/crc32"
+	"io/ioutil"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"template"
+	"testing"
+	"time"
+)
+
+func TestClusterSetGet(t *testing.T) {
+	c := NewCluster(NewNetwork(1), 1)
+	defer c.Close()
+
+	cl := c.Client()
+	rev, err := cl.Set("/x", store.Missing, []byte{'a'})
+	assert.Equal(t, nil, err)
+
+	v, got, err := cl.Get("/x", nil)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, rev, got)
+	assert.Equal(t, []byte{'a'}, v)
+}
+
+func TestClusterThreePeers(t *testing.T) {
+	c := NewCluster(NewNetwork(1), 3)
+	defer c.Close()
+
+	cl := c.Client()
+	_, err := cl.Set("/x", store.Clobber, []byte{'a'})
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 3, len(c.Addrs))
+}
+
+func TestNetworkPartitionDropsPackets(t *testing.T) {
+	n := NewNetwork(1)
+	a := n.ListenPacket("127.0.0.1:1")
+	b := n.ListenPacket("127.0.0.1:2")
+	defer a.Close()
+	defer b.Close()
+
+	n.Partition("127.0.0.1:1")
+	a.WriteTo([]byte("x"), addr("127.0.0.1:2"))
+	n.Heal()
+	a.WriteTo([]byte("y"), addr("127.0.0.1:2"))
+
+	buf := make([]byte, 10)
+	k, from, err := b.ReadFrom(buf)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "127.0.0.1:1", from.String())
+	assert.Equal(t, "y", string(buf[:k]))
+}
+
+func TestNetworkLoss(t *testing.T) {
+	n := NewNetwork(1)
+	a := n.ListenPacket("127.0.0.1:1")
+	b := n.ListenPacket("127.0.0.1:2").(*packetConn)
+	defer a.Close()
+	defer b.Close()
+
+	n.SetLoss(1)
+	a.WriteTo([]byte("x"), addr("127.0.0.1:2"))
+	assert.Equal(t, 0, len(b.in))
+}
+
+func TestNetworkDialRefused(t *testing.T) {
+	n := NewNetwork(1)
+	_, err := n.Dial("127.0.0.1:1")
+	assert.Equal(t, os.ECONNREFUSED, err)
+}
+
+func TestClusterBackfill(t *testing.T) {
+	c := NewCluster(NewNetwork(1), 1)
+	defer c.Close()
+
+	cl := c.Client()
+	_, err := cl.Set("/b/x", store.Clobber, []byte{'a'})
+	assert.Equal(t, nil, err)
+	snap, err := cl.Set("/b/y", store.Clobber, []byte{'b'})
+	assert.Equal(t, nil, err)
+
+	w, err := cl.Backfill("/b/*")
+	assert.Equal(t, nil, err)
+	defer w.Cancel()
+
+	ev := <-w.C
+	assert.Equal(t, "/b/x", ev.Path)
+	assert.T(t, ev.IsSet())
+	ev = <-w.C
+	assert.Equal(t, "/b/y", ev.Path)
+	assert.Equal(t, snap, ev.Rev)
+
+	ev = <-w.C
+	assert.Equal(t, "", ev.Path)
+	assert.T(t, ev.Rev >= snap)
+
+	rev, err := cl.Set("/b/z", store.Clobber, []byte{'c'})
+	assert.Equal(t, nil, err)
+	ev = <-w.C
+	assert.Equal(t, "/b/z", ev.Path)
+	assert.Equal(t, rev, ev.Rev)
+}
+
+func TestClusterSetInDir(t *testing.T) {
+	c := NewCluster(NewNetwork(1), 1)
+	defer c.Close()
+
+	cl := c.Client()
+	_, err := cl.Set("/g/a", store.Clobber, []byte{'a'})
+	assert.Equal(t, nil, err)
+
+	dr, err := cl.DirRev("/g", nil)
+	assert.Equal(t, nil, err)
+	assert.NotEqual(t, int64(0), dr)
+
+	_, err = cl.SetInDir("/g/b", dr, store.Missing, []byte{'b'})
+	assert.Equal(t, nil, err)
+
+	_, err = cl.SetInDir("/g/c", dr, store.Missing, []byte{'c'})
+	assert.Equal(t, client.ErrRevMismatch, err)
+}
+
+func TestClusterDemux(t *testing.T) {
+	c := NewCluster(NewNetwork(1), 1)
+	defer c.Close()
+
+	cl := c.Client()
+	d := client.NewDemux(cl)
+	a, err := d.Watch("/m/*")
+	assert.Equal(t, nil, err)
+	b, err := d.Watch("/m/*")
+	assert.Equal(t, nil, err)
+
+	rev, err := cl.Set("/m/x", store.Clobber, []byte{'a'})
+	assert.Equal(t, nil, err)
+
+	ev := <-a.C
+	assert.Equal(t, "/m/x", ev.Path)
+	assert.Equal(t, rev, ev.Rev)
+	ev = <-b.C
+	assert.Equal(t, "/m/x", ev.Path)
+
+	assert.Equal(t, nil, a.Cancel())
+
+	_, err = cl.Set("/m/y", store.Clobber, []byte{'b'})
+	assert.Equal(t, nil, err)
+	ev = <-b.C
+	assert.Equal(t, "/m/y", ev.Path)
+
+	assert.Equal(t, nil, b.Cancel())
+}
+
+func TestClusterBulkSet(t *testing.T) {
+	doozer.AllowBulk = true
+	defer func() { doozer.AllowBulk = false }()
+	c := NewCluster(NewNetwork(1), 1)
+	defer c.Close()
+
+	cl := c.Client()
+	w, err := cl.Watch("/bulk/*", 0)
+	assert.Equal(t, nil, err)
+
+	files := map[string][]byte{}
+	for i := 0; i < 100; i++ {
+		files["/bulk/"+strconv.Itoa(i)] = []byte("0123456789")
+	}
+	rev, err := cl.BulkSet(files)
+	assert.Equal(t, nil, err)
+
+	got := map[string]bool{}
+	for len(got) < len(files) {
+		ev := <-w.C
+		assert.T(t, ev.IsSet())
+		got[ev.Path] = true
+	}
+
+	v, _, err := cl.Get("/bulk/42", &rev)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, []byte("0123456789"), v)
+	w.Cancel()
+}
+
+func TestClusterBulkSetDisabled(t *testing.T) {
+	c := NewCluster(NewNetwork(1), 1)
+	defer c.Close()
+
+	_, err := c.Client().BulkSet(map[string][]byte{"/x": nil})
+	assert.NotEqual(t, nil, err)
+}
+
+func TestClusterSetIf(t *testing.T) {
+	c := NewCluster(NewNetwork(1), 1)
+	defer c.Close()
+
+	cl := c.Client()
+	_, err := cl.SetIf("/i/x", true, []byte{'a'})
+	assert.NotEqual(t, nil, err)
+
+	_, err = cl.SetIf("/i/x", false, []byte{'a'})
+	assert.Equal(t, nil, err)
+
+	_, err = cl.SetIf("/i/x", false, []byte{'b'})
+	assert.NotEqual(t, nil, err)
+
+	rev, err := cl.SetIf("/i/x", true, []byte{'c'})
+	assert.Equal(t, nil, err)
+	v, _, err := cl.Get("/i/x", &rev)
+	assert.Equal(t, []byte{'c'}, v)
+
+	assert.Equal(t, nil, cl.DelIfExists("/i/x"))
+	assert.NotEqual(t, nil, cl.DelIfExists("/i/x"))
+}
+
+func TestClusterSetIfBody(t *testing.T) {
+	c := NewCluster(NewNetwork(1), 1)
+	defer c.Close()
+
+	cl := c.Client()
+	_, err := cl.Set("/b/x", -1, []byte{'a'})
+	assert.Equal(t, nil, err)
+
+	_, err = cl.SetIfBody("/b/x", []byte{'b'}, []byte{'c'})
+	assert.NotEqual(t, nil, err)
+
+	rev, err := cl.SetIfBody("/b/x", []byte{'a'}, []byte{'c'})
+	assert.Equal(t, nil, err)
+	v, _, err := cl.Get("/b/x", &rev)
+	assert.Equal(t, []byte{'c'}, v)
+}
+
+func TestClusterAppend(t *testing.T) {
+	c := NewCluster(NewNetwork(1), 1)
+	defer c.Close()
+
+	cl := c.Client()
+	_, err := cl.Append("/a/log", -1, []byte("x\n"))
+	assert.Equal(t, nil, err)
+	rev, err := cl.Append("/a/log", -1, []byte("y\n"))
+	assert.Equal(t, nil, err)
+
+	v, _, err := cl.Get("/a/log", &rev)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "x\ny\n", string(v))
+}
+
+func TestClusterAppendOverBodyLimit(t *testing.T) {
+	doozer.BodyLimit = server.Limit{Hard: 3}
+	defer func() { doozer.BodyLimit = server.Limit{} }()
+	c := NewCluster(NewNetwork(1), 1)
+	defer c.Close()
+
+	cl := c.Client()
+	_, err := cl.Append("/a/log", -1, []byte("xy"))
+	assert.Equal(t, nil, err)
+	_, err = cl.Append("/a/log", -1, []byte("zw"))
+	assert.T(t, client.IsErr(err, client.ErrOverLimit))
+
+	v, _, err := cl.Get("/a/log", nil)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "xy", string(v))
+}
+
+func TestClusterAdd(t *testing.T) {
+	c := NewCluster(NewNetwork(1), 1)
+	defer c.Close()
+
+	cl := c.Client()
+	n, _, err := cl.Add("/a/n", -1, 3)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, int64(3), n)
+
+	n, rev, err := cl.Add("/a/n", -1, -1)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, int64(2), n)
+
+	v, _, err := cl.Get("/a/n", &rev)
+	assert.Equal(t, "2", string(v))
+}
+
+func TestClusterSchedule(t *testing.T) {
+	c := NewCluster(NewNetwork(1), 1)
+	defer c.Close()
+
+	cl := c.Client()
+	w, err := cl.Watch("/s/x", 0)
+	assert.Equal(t, nil, err)
+	defer w.Cancel()
+
+	path, err := cl.Schedule(time.Nanoseconds(), store.MustEncodeSet("/s/x", "a", store.Clobber))
+	assert.Equal(t, nil, err)
+
+	ev := <-w.C
+	assert.Equal(t, "/s/x", ev.Path)
+	assert.Equal(t, []byte{'a'}, ev.Body)
+
+	_, rev, _ := cl.Stat(path, nil)
+	assert.Equal(t, int64(0), rev)
+}
+
+func TestClusterStatInfo(t *testing.T) {
+	c := NewCluster(NewNetwork(1), 1)
+	defer c.Close()
+
+	cl := c.Client()
+	rev1, err := cl.Set("/si/x", -1, []byte{'a'})
+	assert.Equal(t, nil, err)
+	rev2, err := cl.Set("/si/x", -1, []byte{'b', 'c'})
+	assert.Equal(t, nil, err)
+
+	si, err := cl.StatInfo("/si/x", nil)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, &client.StatInfo{Len: 2, Rev: rev2, Created: rev1, Sum: crc32.ChecksumIEEE([]byte("bc"))}, si)
+}
+
+func TestClusterGetTree(t *testing.T) {
+	c := NewCluster(NewNetwork(1), 1)
+	defer c.Close()
+
+	cl := c.Client()
+	cl.Set("/cfg/a", -1, []byte{'1'})
+	rev1, _ := cl.Set("/cfg/d/b", -1, []byte{'2'})
+	cl.Set("/cfg/a", -1, []byte{'3'})
+
+	files, rev, err := cl.GetTree("/cfg", &rev1)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, rev1, rev)
+	assert.Equal(t, map[string][]byte{"/cfg/a": {'1'}, "/cfg/d/b": {'2'}}, files)
+
+	files, _, err = cl.GetTree("/cfg/a", nil)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, map[string][]byte{"/cfg/a": {'3'}}, files)
+}
+
+func TestClusterSetSequential(t *testing.T) {
+	c := NewCluster(NewNetwork(1), 1)
+	defer c.Close()
+
+	cl := c.Client()
+	p1, rev1, err := cl.SetSequential("/q/n-", []byte{'a'})
+	assert.Equal(t, nil, err)
+	p2, rev2, err := cl.SetSequential("/q/n-", []byte{'b'})
+	assert.Equal(t, nil, err)
+
+	assert.T(t, rev1 < rev2)
+	assert.T(t, p1 < p2)
+	assert.Equal(t, "/q/n-", p1[:5])
+
+	v, _, err := cl.Get(p2, &rev2)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, []byte{'b'}, v)
+}
+
+func TestClusterEvents(t *testing.T) {
+	c := NewCluster(NewNetwork(1), 1)
+	defer c.Close()
+
+	cl := c.Client()
+	v, _, err := cl.Get(store.EventDir+"/member", nil)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "add ", string(v[:4]))
+
+	v, _, err = cl.Get(store.EventDir+"/phase", nil)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, " serving", string(v[len(v)-8:]))
+}
+
+func TestClusterPin(t *testing.T) {
+	c := NewCluster(NewNetwork(1), 1)
+	defer c.Close()
+
+	cl := c.Client()
+	rev, err := cl.Set("/p/x", store.Missing, []byte{'a'})
+	assert.Equal(t, nil, err)
+
+	p, err := cl.Pin(&rev)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, rev, p.Rev)
+
+	_, err = cl.Set("/p/x", rev, []byte{'b'})
+	assert.Equal(t, nil, err)
+
+	v, got, err := p.Get("/p/x")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, rev, got)
+	assert.Equal(t, []byte{'a'}, v)
+
+	assert.Equal(t, nil, p.Release())
+}
+
+func TestClusterResolve(t *testing.T) {
+	c := NewCluster(NewNetwork(1), 1)
+	defer c.Close()
+
+	cl := c.Client()
+	cl.Set("/defaults/db/host", store.Missing, []byte("localhost"))
+	cl.Set("/defaults/db/port", store.Missing, []byte("5432"))
+	cl.Set("/apps/foo/db/host", store.Missing, []byte("db1"))
+	cl.Set("/apps/foo/web/port", store.Missing, []byte("80"))
+
+	m, err := cl.Resolve([]string{"/defaults", "/apps/foo", "/apps/bar"}, "/db", nil)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 2, len(m))
+	assert.Equal(t, "db1", string(m["host"].Value))
+	assert.Equal(t, "/apps/foo", m["host"].Layer)
+	assert.Equal(t, "5432", string(m["port"].Value))
+	assert.Equal(t, "/defaults", m["port"].Layer)
+}
+
+func TestClusterRender(t *testing.T) {
+	c := NewCluster(NewNetwork(1), 1)
+	defer c.Close()
+
+	cl := c.Client()
+	cl.Set("/r/b", store.Missing, []byte("2"))
+	rev, _ := cl.Set("/r/a", store.Missing, []byte("1"))
+
+	dest := os.TempDir() + "/doozertest-render-" + strconv.Itoa(os.Getpid())
+	defer os.Remove(dest)
+
+	r := &client.Render{
+		Globs:    []string{"/r/*"},
+		Template: template.MustParse("{.repeated section Files}{Path}={Body};{.end}", nil),
+		Dest:     dest,
+	}
+	changed, err := r.Once(cl, rev)
+	assert.Equal(t, nil, err)
+	assert.T(t, changed)
+
+	b, err := ioutil.ReadFile(dest)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "/r/a=1;/r/b=2;", string(b))
+
+	changed, err = r.Once(cl, rev)
+	assert.Equal(t, nil, err)
+	assert.T(t, !changed)
+}
+
+func TestClusterUpdate(t *testing.T) {
+	c := NewCluster(NewNetwork(1), 1)
+	defer c.Close()
+
+	cl := c.Client()
+	double := func(old []byte) ([]byte, os.Error) {
+		return append(old, old...), nil
+	}
+	_, err := cl.Set("/u", store.Missing, []byte("ab"))
+	assert.Equal(t, nil, err)
+
+	rev, err := cl.Update("/u", double)
+	assert.Equal(t, nil, err)
+
+	body, got, err := cl.Get("/u", nil)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, rev, got)
+	assert.Equal(t, "abab", string(body))
+
+	_, err = cl.Update("/u", func([]byte) ([]byte, os.Error) {
+		return nil, os.EINVAL
+	})
+	assert.Equal(t, os.EINVAL, err)
+}
+
+func TestClusterConsume(t *testing.T) {
+	c := NewCluster(NewNetwork(1), 1)
+	defer c.Close()
+
+	cl := c.Client()
+	rev, _ := cl.Set("/q/a", store.Missing, []byte("1"))
+	cl.Set("/q/b", store.Missing, []byte("2"))
+
+	// Fail on the second event, so only the first is saved.
+	var paths []string
+	err := cl.Consume("t", "/q/*", rev, func(ev *client.Event) os.Error {
+		paths = append(paths, ev.Path)
+		if len(paths) == 2 {
+			return os.EINVAL
+		}
+		return nil
+	})
+	assert.Equal(t, os.EINVAL, err)
+	assert.Equal(t, []string{"/q/a", "/q/b"}, paths)
+
+	body, _, err := cl.Get(client.ConsumerDir+"/t", nil)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, strconv.Itoa64(rev), string(body))
+
+	paths = nil
+	err = cl.Consume("t", "/q/*", 1, func(ev *client.Event) os.Error {
+		paths = append(paths, ev.Path)
+		return os.EINVAL
+	})
+	assert.Equal(t, os.EINVAL, err)
+	assert.Equal(t, []string{"/q/b"}, paths)
+}
+
+func TestClusterConsumeBulk(t *testing.T) {
+	doozer.AllowBulk = true
+	defer func() { doozer.AllowBulk = false }()
+	c := NewCluster(NewNetwork(1), 1)
+	defer c.Close()
+
+	cl := c.Client()
+	files := map[string][]byte{"/q/a": []byte("1"), "/q/b": []byte("2")}
+	rev, err := cl.BulkSet(files)
+	assert.Equal(t, nil, err)
+
+	// Fail on the second event of the revision, so none of it is saved.
+	var n int
+	err = cl.Consume("t", "/q/*", rev, func(ev *client.Event) os.Error {
+		if n++; n == 2 {
+			return os.EINVAL
+		}
+		return nil
+	})
+	assert.Equal(t, os.EINVAL, err)
+
+	_, crev, err := cl.Get(client.ConsumerDir+"/t", nil)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, int64(0), crev)
+}
+
+func TestClusterClean(t *testing.T) {
+	c := NewCluster(NewNetwork(1), 1)
+	defer c.Close()
+
+	cl := c.Client()
+	rev, err := cl.Set("/c", store.Missing, nil)
+	assert.Equal(t, nil, err)
+
+	m, err := cl.Clean(0)
+	assert.Equal(t, nil, err)
+	assert.T(t, m["events"] > 0)
+
+	_, err = cl.Clean(rev)
+	assert.NotEqual(t, nil, err)
+}
+
+func TestClusterIDs(t *testing.T) {
+	c := NewCluster(NewNetwork(1), 1)
+	defer c.Close()
+
+	cl := c.Client()
+	first, err := cl.IDs("job", 10)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, int64(1), first)
+
+	first, err = cl.IDs("job", 1)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, int64(11), first)
+
+	first, err = cl.IDs("other", 5)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, int64(1), first)
+
+	_, err = cl.IDs("job", 0)
+	assert.NotEqual(t, nil, err)
+}
+
+func TestClusterLink(t *testing.T) {
+	c := NewCluster(NewNetwork(1), 1)
+	defer c.Close()
+
+	cl := c.Client()
+	rev, err := cl.Set("/m/a", store.Missing, []byte("x"))
+	assert.Equal(t, nil, err)
+
+	_, err = cl.SetLink("/leader", store.Missing, "/m/a")
+	assert.Equal(t, nil, err)
+
+	body, _, err := cl.Get("/leader", nil)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, []byte("/m/a"), body)
+
+	body, r, err := cl.GetFollow("/leader", nil)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, []byte("x"), body)
+	assert.Equal(t, rev, r)
+
+	si, err := cl.StatInfo("/leader", nil)
+	assert.Equal(t, nil, err)
+	assert.T(t, si.Link)
+}
+
+func TestClusterSetEphemeral(t *testing.T) {
+	c := NewCluster(NewNetwork(1), 1)
+	defer c.Close()
+
+	cl := c.Client()
+	_, err := cl.SetEphemeral("/svc/a", "gone", store.Missing, []byte("x"))
+	assert.T(t, client.IsErr(err, client.ErrNoSession))
+	_, rev, err := cl.Get("/svc/a", nil)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, store.Missing, rev)
+
+	err = cl.Checkin("s", 0)
+	assert.Equal(t, nil, err)
+	rev, err = cl.SetEphemeral("/svc/a", "s", store.Missing, []byte("x"))
+	assert.Equal(t, nil, err)
+
+	body, lrev, err := cl.Get("/ctl/link/svc/a", nil)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, []byte("s"), body)
+	assert.Equal(t, rev, lrev)
+}
+
+func TestClusterSetTTL(t *testing.T) {
+	c := NewCluster(NewNetwork(1), 1)
+	defer c.Close()
+
+	cl := c.Client()
+	rev, err := cl.SetTTL("/a", store.Missing, []byte("x"), 60e9)
+	assert.Equal(t, nil, err)
+
+	body, erev, err := cl.Get("/ctl/ttl/a", nil)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, rev, erev)
+	assert.T(t, strings.HasSuffix(string(body), " "+strconv.Itoa64(rev)))
+}
+
+func TestClusterFetch(t *testing.T) {
+	c := NewCluster(NewNetwork(1), 1)
+	defer c.Close()
+
+	cl := c.Client()
+	_, err := cl.Set("/f/b", store.Clobber, []byte("2"))
+	assert.Equal(t, nil, err)
+	rev, err := cl.Set("/f/a", store.Clobber, []byte("1"))
+	assert.Equal(t, nil, err)
+	_, err = cl.Set("/f/c", store.Clobber, []byte("3"))
+	assert.Equal(t, nil, err)
+
+	var got []string
+	err = cl.Fetch("/f/*", rev, func(ev *client.Event) {
+		got = append(got, ev.Path+"="+string(ev.Body))
+	})
+	assert.Equal(t, nil, err)
+	assert.Equal(t, []string{"/f/a=1", "/f/b=2"}, got)
+}
+
+func TestClusterNotify(t *testing.T) {
+	c := NewCluster(NewNetwork(1), 1)
+	defer c.Close()
+
+	cl := c.Client()
+	ch := make(chan client.ConnEvent, 10)
+	cl.Notify(ch)
+	ev := <-ch
+	assert.Equal(t, client.ConnEvent{client.ConnUp, c.Addrs[0], nil}, ev)
+}
+
+type jsonConf struct {
+	Host string
+	Port int
+}
+
+func TestClusterJSON(t *testing.T) {
+	c := NewCluster(NewNetwork(1), 1)
+	defer c.Close()
+
+	cl := c.Client()
+	var conf jsonConf
+	rev, err := cl.GetJSON("/j", nil, &conf)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, int64(0), rev)
+
+	rev, err = cl.SetJSON("/j", store.Missing, jsonConf{"a", 1})
+	assert.Equal(t, nil, err)
+
+	_, err = cl.UpdateJSON("/j", &conf, func() os.Error {
+		conf.Port++
+		return nil
+	})
+	assert.Equal(t, nil, err)
+
+	rev, err = cl.MergeJSON("/j", map[string]interface{}{"Host": "b"})
+	assert.Equal(t, nil, err)
+
+	conf = jsonConf{}
+	got, err := cl.GetJSON("/j", nil, &conf)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, rev, got)
+	assert.Equal(t, jsonConf{"b", 2}, conf)
+}
+
+func TestClusterFollowsRedirect(t *testing.T) {
+	c := NewCluster(NewNetwork(1), 1)
+	defer c.Close()
+
+	// A second peer with no free CAL slot can't take writes.
+	c.start(c.Addrs[0])
+	var conns []net.Conn
+	cl := client.NewDialer("test", c.Addrs[1], func(a string) (net.Conn, os.Error) {
+		nc, err := c.Net.Dial(a)
+		conns = append(conns, nc)
+		return nc, err
+	})
+
+	_, err := cl.Set("/x", store.Clobber, []byte{'a'})
+	assert.Equal(t, nil, err)
+	_, err = cl.Set("/x", store.Clobber, []byte{'b'})
+	assert.Equal(t, nil, err)
+
+	// The connection to the peer that redirected us is closed.
+	_, err = conns[0].Write([]byte{0})
+	assert.NotEqual(t, nil, err)
+}
+
+func TestClusterRedirectKeepsWatch(t *testing.T) {
+	c := NewCluster(NewNetwork(1), 1)
+	defer c.Close()
+
+	c.start(c.Addrs[0])
+	var conns []net.Conn
+	cl := client.NewDialer("test", c.Addrs[1], func(a string) (net.Conn, os.Error) {
+		nc, err := c.Net.Dial(a)
+		conns = append(conns, nc)
+		return nc, err
+	})
+
+	rev, err := cl.Rev()
+	assert.Equal(t, nil, err)
+	w, err := cl.Watch("/x", rev+1)
+	assert.Equal(t, nil, err)
+
+	// The redirect doesn't end the watch on the old connection.
+	_, err = cl.Set("/x", store.Clobber, []byte{'a'})
+	assert.Equal(t, nil, err)
+	ev := <-w.C
+	assert.Equal(t, nil, ev.Err)
+	assert.Equal(t, []byte{'a'}, ev.Body)
+
+	// Once it is cancelled, the old connection closes.
+	assert.Equal(t, nil, w.Cancel())
+	_, err = conns[0].Write([]byte{0})
+	assert.NotEqual(t, nil, err)
+}
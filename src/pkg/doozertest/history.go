@@ -0,0 +1,86 @@
+package doozertest
+
+import (
+	"doozer/client"
+	"os"
+	"sync"
+)
+
+// Kinds of operation recorded in a History.
+const (
+	Get = iota
+	Set
+	Del
+)
+
+const never = 1<<63 - 1
+
+// One client operation, as observed by the client.
+type Op struct {
+	Kind  int
+	Path  string
+	Rev   int64  // rev given to Set or Del
+	Value string // body written by Set or read by Get
+	Out   int64  // rev returned by Set or Get
+	Err   os.Error
+
+	// Logical times at which the call began and returned. An
+	// operation only precedes another if it returned first.
+	Begin, End int64
+}
+
+// A History records concurrent operations issued through its methods,
+// so that Check can later decide whether they could have been
+// executed in some sequential order consistent with real time.
+type History struct {
+	lk    sync.Mutex
+	clock int64
+	ops   []*Op
+}
+
+func (h *History) begin(op *Op) *Op {
+	h.lk.Lock()
+	defer h.lk.Unlock()
+	h.clock++
+	op.Begin, op.End = h.clock, never
+	h.ops = append(h.ops, op)
+	return op
+}
+
+func (h *History) end(op *Op) {
+	h.lk.Lock()
+	defer h.lk.Unlock()
+	h.clock++
+	op.End = h.clock
+}
+
+func (h *History) Set(cl *client.Client, path string, rev int64, body []byte) (int64, os.Error) {
+	op := h.begin(&Op{Kind: Set, Path: path, Rev: rev, Value: string(body)})
+	op.Out, op.Err = cl.Set(path, rev, body)
+	h.end(op)
+	return op.Out, op.Err
+}
+
+func (h *History) Get(cl *client.Client, path string) ([]byte, int64, os.Error) {
+	op := h.begin(&Op{Kind: Get, Path: path})
+	v, rev, err := cl.Get(path, nil)
+	op.Value, op.Out, op.Err = string(v), rev, err
+	h.end(op)
+	return v, rev, err
+}
+
+func (h *History) Del(cl *client.Client, path string, rev int64) os.Error {
+	op := h.begin(&Op{Kind: Del, Path: path, Rev: rev})
+	op.Err = cl.Del(path, rev)
+	h.end(op)
+	return op.Err
+}
+
+// Returns a copy of the operations recorded so far.
+func (h *History) Ops() []*Op {
+	h.lk.Lock()
+	defer h.lk.Unlock()
+	ops := make([]*Op, len(h.ops))
+	copy(ops, h.ops)
+	return ops
+}
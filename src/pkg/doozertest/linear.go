@@ -0,0 +1,171 @@
+package doozertest
+
+import (
+	"doozer/client"
+	"doozer/store"
+	"fmt"
+)
+
+// Model state of one file. Rev 0 means the file is missing; anyRev
+// means it was written by an operation whose outcome is unknown, so its
+// rev could be anything.
+type file struct {
+	body string
+	rev  int64
+}
+
+const anyRev = -1
+
+func (f file) String() string {
+	return fmt.Sprintf("%d:%q", f.rev, f.body)
+}
+
+func definite(op *Op) bool {
+	return op.Err == nil || client.IsErr(op.Err, client.ErrRevMismatch)
+}
+
+func allowed(rev int64, f file) bool {
+	if f.rev == anyRev {
+		return rev != store.Missing
+	}
+	return rev == store.Clobber || rev >= f.rev
+}
+
+// Returns every state that could follow f once op takes effect.
+func (op *Op) step(f file) []file {
+	switch op.Kind {
+	case Get:
+		switch {
+		case op.Err != nil:
+			return []file{f}
+		case op.Value == f.body && op.Out == f.rev:
+			return []file{f}
+		case op.Value == f.body && f.rev == anyRev && op.Out > 0:
+			return []file{{f.body, op.Out}}
+		}
+	case Set:
+		switch {
+		case op.Err == nil:
+			if allowed(op.Rev, f) && op.Out > f.rev {
+				return []file{{op.Value, op.Out}}
+			}
+		case client.IsErr(op.Err, client.ErrRevMismatch):
+			if !allowed(op.Rev, f) {
+				return []file{f}
+			}
+		default:
+			// Unknown outcome. It might not have happened at all; if it
+			// did, its rev is unknown too.
+			next := []file{f}
+			if allowed(op.Rev, f) {
+				next = append(next, file{op.Value, anyRev})
+			}
+			return next
+		}
+	case Del:
+		switch {
+		case op.Err == nil:
+			if allowed(op.Rev, f) {
+				return []file{{}}
+			}
+		case client.IsErr(op.Err, client.ErrRevMismatch):
+			if !allowed(op.Rev, f) {
+				return []file{f}
+			}
+		default:
+			next := []file{f}
+			if allowed(op.Rev, f) {
+				next = append(next, file{})
+			}
+			return next
+		}
+	}
+	return nil
+}
+
+type search struct {
+	ops  []*Op
+	done []bool
+	seen map[string]bool // states already known to be dead ends
+}
+
+func (s *search) key(f file) string {
+	b := make([]byte, len(s.done))
+	for i, d := range s.done {
+		b[i] = '0'
+		if d {
+			b[i] = '1'
+		}
+	}
+	return string(b) + f.String()
+}
+
+func (s *search) run(f file, left int) bool {
+	if left == 0 {
+		return true
+	}
+
+	k := s.key(f)
+	if s.seen[k] {
+		return false
+	}
+
+	// Only an op that began before every pending op returned can go
+	// next.
+	var minEnd int64 = never
+	for i, op := range s.ops {
+		if !s.done[i] && op.End < minEnd {
+			minEnd = op.End
+		}
+	}
+
+	for i, op := range s.ops {
+		if s.done[i] || op.Begin > minEnd {
+			continue
+		}
+
+		s.done[i] = true
+		for _, g := range op.step(f) {
+			if s.run(g, left-1) {
+				return true
+			}
+		}
+		s.done[i] = false
+	}
+
+	s.seen[k] = true
+	return false
+}
+
+// Reports whether ops, all on one path, are linearizable with respect
+// to doozer's file semantics, starting from a missing file.
+func linearizable(ops []*Op) bool {
+	s := &search{
+		ops:  ops,
+		done: make([]bool, len(ops)),
+		seen: make(map[string]bool),
+	}
+	return s.run(file{}, len(ops))
+}
+
+// Checks every path touched by the operations in h. Paths are checked
+// independently, since linearizability is a local property. Returns
+// the first path whose history is not linearizable, or "" if there is
+// none.
+func (h *History) Check() (path string) {
+	byPath := make(map[string][]*Op)
+	var paths []string
+	for _, op := range h.Ops() {
+		if _, ok := byPath[op.Path]; !ok {
+			paths = append(paths, op.Path)
+		}
+		byPath[op.Path] = append(byPath[op.Path], op)
+	}
+
+	for _, p := range paths {
+		if !linearizable(byPath[p]) {
+			return p
+		}
+	}
+	return ""
+}
@@ -0,0 +1,94 @@
+package doozertest
+
+import (
+	"doozer/client"
+	"doozer/store"
+	"github.com/bmizerany/assert"
+	"os"
+	"strconv"
+	"testing"
+)
+
+func TestLinearSequential(t *testing.T) {
+	ops := []*Op{
+		&Op{Kind: Set, Path: "/x", Rev: store.Missing, Value: "a", Out: 5, Begin: 1, End: 2},
+		&Op{Kind: Get, Path: "/x", Value: "a", Out: 5, Begin: 3, End: 4},
+		&Op{Kind: Del, Path: "/x", Rev: 5, Begin: 5, End: 6},
+		&Op{Kind: Get, Path: "/x", Begin: 7, End: 8},
+	}
+	assert.T(t, linearizable(ops))
+}
+
+func TestLinearStaleRead(t *testing.T) {
+	ops := []*Op{
+		&Op{Kind: Set, Path: "/x", Rev: store.Clobber, Value: "a", Out: 5, Begin: 1, End: 2},
+		&Op{Kind: Set, Path: "/x", Rev: store.Clobber, Value: "b", Out: 6, Begin: 3, End: 4},
+		&Op{Kind: Get, Path: "/x", Value: "a", Out: 5, Begin: 5, End: 6},
+	}
+	assert.T(t, !linearizable(ops))
+}
+
+func TestLinearConcurrentRead(t *testing.T) {
+	// The read overlaps the second write, so it may see either value.
+	ops := []*Op{
+		&Op{Kind: Set, Path: "/x", Rev: store.Clobber, Value: "a", Out: 5, Begin: 1, End: 2},
+		&Op{Kind: Set, Path: "/x", Rev: store.Clobber, Value: "b", Out: 6, Begin: 3, End: 6},
+		&Op{Kind: Get, Path: "/x", Value: "a", Out: 5, Begin: 4, End: 5},
+	}
+	assert.T(t, linearizable(ops))
+}
+
+func TestLinearRevMismatch(t *testing.T) {
+	ops := []*Op{
+		&Op{Kind: Set, Path: "/x", Rev: store.Missing, Value: "a", Out: 5, Begin: 1, End: 2},
+		&Op{Kind: Set, Path: "/x", Rev: store.Missing, Value: "b", Err: client.ErrRevMismatch, Begin: 3, End: 4},
+	}
+	assert.T(t, linearizable(ops))
+
+	// Both cannot succeed against a missing file.
+	ops[1].Err, ops[1].Out = nil, 6
+	assert.T(t, !linearizable(ops))
+}
+
+func TestLinearUnknownOutcome(t *testing.T) {
+	ops := []*Op{
+		&Op{Kind: Set, Path: "/x", Rev: store.Clobber, Value: "a", Err: os.EINVAL, Begin: 1, End: never},
+		&Op{Kind: Get, Path: "/x", Begin: 2, End: 3},
+	}
+	assert.T(t, linearizable(ops))
+
+	ops[1].Value, ops[1].Out = "a", 17
+	assert.T(t, linearizable(ops))
+}
+
+func TestHistoryCheckNamesPath(t *testing.T) {
+	h := new(History)
+	h.ops = []*Op{
+		&Op{Kind: Get, Path: "/x", Begin: 1, End: 2},
+		&Op{Kind: Get, Path: "/y", Value: "a", Out: 3, Begin: 3, End: 4},
+	}
+	assert.Equal(t, "/y", h.Check())
+}
+
+func TestClusterLinearizable(t *testing.T) {
+	c := NewCluster(NewNetwork(1), 3)
+	defer c.Close()
+
+	h := new(History)
+	done := make(chan bool)
+	for i := 0; i < 3; i++ {
+		go func(i int) {
+			cl := c.Client()
+			for j := 0; j < 5; j++ {
+				h.Set(cl, "/x", store.Clobber, []byte(strconv.Itoa(i*10+j)))
+				h.Get(cl, "/x")
+			}
+			done <- true
+		}(i)
+	}
+	for i := 0; i < 3; i++ {
+		<-done
+	}
+
+	assert.Equal(t, "", h.Check())
+}
@@ -0,0 +1,286 @@
+package doozertest
+
+import (
+	"net"
+	"os"
+	"rand"
+	"sync"
+	"time"
+)
+
+const packetQueueLen = 1000
+
+type addr string
+
+func (a addr) Network() string {
+	return "sim"
+}
+
+func (a addr) String() string {
+	return string(a)
+}
+
+// A Network is a simulated network connecting any number of peers
+// inside one process. Packets between peers can be delayed, dropped,
+// or cut off entirely by a partition. No ports are bound.
+//
+// All randomness comes from a source seeded at creation, so a test
+// that sends the same packets sees the same losses.
+type Network struct {
+	lk      sync.Mutex
+	rnd     *rand.Rand
+	latency int64   // ns
+	loss    float64 // probability in [0, 1]
+	cut     map[string]bool
+	pcs     map[string]*packetConn
+	lns     map[string]*listener
+}
+
+func NewNetwork(seed int64) *Network {
+	return &Network{
+		rnd: rand.New(rand.NewSource(seed)),
+		cut: make(map[string]bool),
+		pcs: make(map[string]*packetConn),
+		lns: make(map[string]*listener),
+	}
+}
+
+// Delays every packet by ns nanoseconds.
+func (n *Network) SetLatency(ns int64) {
+	n.lk.Lock()
+	n.latency = ns
+	n.lk.Unlock()
+}
+
+// Drops each packet with probability p.
+func (n *Network) SetLoss(p float64) {
+	n.lk.Lock()
+	n.loss = p
+	n.lk.Unlock()
+}
+
+func link(a, b string) string {
+	if a > b {
+		a, b = b, a
+	}
+	return a + " " + b
+}
+
+// Cuts the link between a and b in both directions. Packets are
+// dropped and new connections are refused until Heal is called.
+func (n *Network) Cut(a, b string) {
+	n.lk.Lock()
+	n.cut[link(a, b)] = true
+	n.lk.Unlock()
+}
+
+// Cuts every link between a peer in side and a peer not in side.
+func (n *Network) Partition(side ...string) {
+	in := make(map[string]bool)
+	for _, a := range side {
+		in[a] = true
+	}
+
+	n.lk.Lock()
+	defer n.lk.Unlock()
+	for a := range n.pcs {
+		for b := range n.pcs {
+			if in[a] && !in[b] {
+				n.cut[link(a, b)] = true
+			}
+		}
+	}
+}
+
+// Restores all links.
+func (n *Network) Heal() {
+	n.lk.Lock()
+	n.cut = make(map[string]bool)
+	n.lk.Unlock()
+}
+
+func (n *Network) isCut(a, b string) bool {
+	return a != "" && n.cut[link(a, b)]
+}
+
+// Returns a packet conn bound to a on n. Address a must be of the form
+// "ip:port", so that it can be resolved as a UDP address, but it is
+// never bound on the host.
+func (n *Network) ListenPacket(a string) net.PacketConn {
+	pc := &packetConn{
+		n:  n,
+		a:  a,
+		in: make(chan packet, packetQueueLen),
+	}
+	n.lk.Lock()
+	n.pcs[a] = pc
+	n.lk.Unlock()
+	return pc
+}
+
+// Returns a stream listener bound to a on n.
+func (n *Network) Listen(a string) net.Listener {
+	l := &listener{
+		n:     n,
+		a:     a,
+		conns: make(chan net.Conn),
+		done:  make(chan bool),
+	}
+	n.lk.Lock()
+	n.lns[a] = l
+	n.lk.Unlock()
+	return l
+}
+
+// Connects to the listener bound to a. The connection is not subject
+// to partitions; use it for clients outside the cluster.
+func (n *Network) Dial(a string) (net.Conn, os.Error) {
+	return n.dial("", a)
+}
+
+func (n *Network) dial(from, to string) (net.Conn, os.Error) {
+	n.lk.Lock()
+	l := n.lns[to]
+	cut := n.isCut(from, to)
+	n.lk.Unlock()
+
+	if l == nil || cut {
+		return nil, os.ECONNREFUSED
+	}
+
+	c, s := net.Pipe()
+	select {
+	case l.conns <- s:
+		return c, nil
+	case <-l.done:
+	}
+	return nil, os.ECONNREFUSED
+}
+
+func (n *Network) send(from, to string, b []byte) {
+	n.lk.Lock()
+	pc := n.pcs[to]
+	drop := n.isCut(from, to) || n.rnd.Float64() < n.loss
+	delay := n.latency
+	n.lk.Unlock()
+
+	if pc == nil || drop {
+		return
+	}
+
+	p := packet{addr(from), make([]byte, len(b))}
+	copy(p.data, b)
+	if delay > 0 {
+		go func() {
+			time.Sleep(delay)
+			pc.deliver(p)
+		}()
+		return
+	}
+	pc.deliver(p)
+}
+
+type packet struct {
+	from addr
+	data []byte
+}
+
+type packetConn struct {
+	n  *Network
+	a  string
+	in chan packet
+
+	lk     sync.Mutex
+	closed bool
+}
+
+func (pc *packetConn) deliver(p packet) {
+	pc.lk.Lock()
+	defer pc.lk.Unlock()
+	if pc.closed {
+		return
+	}
+	select {
+	case pc.in <- p:
+	default:
+		// queue full; drop it, as a real network would
+	}
+}
+
+func (pc *packetConn) ReadFrom(b []byte) (int, net.Addr, os.Error) {
+	p := <-pc.in
+	if closed(pc.in) {
+		return 0, nil, os.EINVAL
+	}
+	return copy(b, p.data), p.from, nil
+}
+
+func (pc *packetConn) WriteTo(b []byte, a net.Addr) (int, os.Error) {
+	pc.n.send(pc.a, a.String(), b)
+	return len(b), nil
+}
+
+func (pc *packetConn) Close() os.Error {
+	pc.n.lk.Lock()
+	pc.n.pcs[pc.a] = nil, false
+	pc.n.lk.Unlock()
+
+	pc.lk.Lock()
+	defer pc.lk.Unlock()
+	if !pc.closed {
+		pc.closed = true
+		close(pc.in)
+	}
+	return nil
+}
+
+func (pc *packetConn) LocalAddr() net.Addr {
+	return addr(pc.a)
+}
+
+func (pc *packetConn) SetTimeout(nsec int64) os.Error {
+	return nil
+}
+
+func (pc *packetConn) SetReadTimeout(nsec int64) os.Error {
+	return nil
+}
+
+func (pc *packetConn) SetWriteTimeout(nsec int64) os.Error {
+	return nil
+}
+
+type listener struct {
+	n     *Network
+	a     string
+	conns chan net.Conn
+	done  chan bool
+	once  sync.Once
+}
+
+func (l *listener) Accept() (net.Conn, os.Error) {
+	select {
+	case c := <-l.conns:
+		return c, nil
+	case <-l.done:
+	}
+	return nil, os.EINVAL
+}
+
+func (l *listener) Close() os.Error {
+	l.n.lk.Lock()
+	l.n.lns[l.a] = nil, false
+	l.n.lk.Unlock()
+	l.once.Do(func() { close(l.done) })
+	return nil
+}
+
+func (l *listener) Addr() net.Addr {
+	return addr(l.a)
+}
+
+// Connects to another peer on the same network, as seen from l, so
+// that partitions apply.
+func (l *listener) Dial(a string) (net.Conn, os.Error) {
+	return l.n.dial(l.a, a)
+}
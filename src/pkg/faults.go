@@ -0,0 +1,154 @@
+package doozer
+
+import (
+	"doozer/consensus"
+	"doozer/store"
+	"log"
+	"os"
+	"rand"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const faultDir = "/ctl/fault"
+
+var faultGlob = store.MustCompileGlob(faultDir + "/*")
+
+// If true, peers obey fault descriptions written under /ctl/fault.
+// Packets are never perturbed otherwise. This is meant for reproducing
+// network trouble in test clusters; don't set it in production.
+var AllowFaults bool
+
+// Describes how packets sent to one peer are perturbed.
+type fault struct {
+	delay  int64   // ns added to every packet
+	jitter int64   // up to this many more ns, at random; reorders packets
+	dup    float64 // probability that a packet is sent twice
+	loss   float64 // probability that a packet is dropped
+}
+
+// Parses a fault description such as "delay=1e6 jitter=5e6 loss=0.1".
+// Unmentioned fields are zero.
+func parseFault(s string) (f fault, err os.Error) {
+	for _, kv := range strings.Fields(s) {
+		p := strings.Split(kv, "=", 2)
+		if len(p) != 2 {
+			return fault{}, os.NewError("bad fault: " + kv)
+		}
+
+		x, err := strconv.Atof64(p[1])
+		if err != nil {
+			return fault{}, err
+		}
+
+		switch p[0] {
+		case "delay":
+			f.delay = int64(x)
+		case "jitter":
+			f.jitter = int64(x)
+		case "dup":
+			f.dup = x
+		case "loss":
+			f.loss = x
+		default:
+			return fault{}, os.NewError("bad fault: " + kv)
+		}
+	}
+	return f, nil
+}
+
+type faults struct {
+	lk  sync.Mutex
+	m   map[string]fault // by peer addr
+	rnd *rand.Rand
+}
+
+func newFaults() *faults {
+	return &faults{
+		m:   make(map[string]fault),
+		rnd: rand.New(rand.NewSource(time.Nanoseconds())),
+	}
+}
+
+func (fs *faults) update(g store.Getter, p, body string, del bool) {
+	id := p[strings.LastIndex(p, "/")+1:]
+	addr := store.GetString(g, "/ctl/node/"+id+"/addr")
+	if addr == "" {
+		return
+	}
+
+	fs.lk.Lock()
+	defer fs.lk.Unlock()
+
+	if del {
+		fs.m[addr] = fault{}, false
+		return
+	}
+
+	f, err := parseFault(body)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	fs.m[addr] = f
+}
+
+// Keeps fs up to date with the contents of /ctl/fault in st.
+func (fs *faults) follow(st *store.Store) {
+	rev, g := st.Snap()
+	w, err := store.NewWatchFrom(st, faultGlob, rev+1)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	store.Walk(g, faultGlob, func(path, body string, _ int64) bool {
+		fs.update(g, path, body, false)
+		return false
+	})
+
+	for ev := range w.C {
+		for _, e := range store.Writes(faultGlob, ev) {
+			fs.update(e, e.Path, e.Body, e.IsDel())
+		}
+	}
+}
+
+// Passes p to send, zero or more times, possibly after a delay,
+// according to the fault registered for p.Addr.
+func (fs *faults) deliver(p consensus.Packet, send func(consensus.Packet)) {
+	fs.lk.Lock()
+	f, ok := fs.m[p.Addr]
+	var lost, dup bool
+	var delay int64
+	if ok {
+		lost = fs.rnd.Float64() < f.loss
+		dup = fs.rnd.Float64() < f.dup
+		delay = f.delay
+		if f.jitter > 0 {
+			delay += fs.rnd.Int63n(f.jitter)
+		}
+	}
+	fs.lk.Unlock()
+
+	switch {
+	case lost:
+		return
+	case delay > 0:
+		go func() {
+			time.Sleep(delay)
+			send(p)
+			if dup {
+				send(p)
+			}
+		}()
+		return
+	}
+
+	send(p)
+	if dup {
+		send(p)
+	}
+}
@@ -0,0 +1,53 @@
+package doozer
+
+import (
+	"doozer/consensus"
+	"github.com/bmizerany/assert"
+	"testing"
+)
+
+
+func TestParseFault(t *testing.T) {
+	f, err := parseFault("delay=1e6 jitter=5 dup=0.5 loss=0.25")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, fault{1e6, 5, 0.5, 0.25}, f)
+
+	f, err = parseFault("")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, fault{}, f)
+}
+
+
+func TestParseFaultBad(t *testing.T) {
+	_, err := parseFault("loss")
+	assert.NotEqual(t, nil, err)
+
+	_, err = parseFault("colour=blue")
+	assert.NotEqual(t, nil, err)
+}
+
+
+func TestFaultsDeliverNone(t *testing.T) {
+	fs := newFaults()
+	var n int
+	fs.deliver(consensus.Packet{"a", nil}, func(consensus.Packet) { n++ })
+	assert.Equal(t, 1, n)
+}
+
+
+func TestFaultsDeliverLoss(t *testing.T) {
+	fs := newFaults()
+	fs.m["a"] = fault{loss: 1}
+	var n int
+	fs.deliver(consensus.Packet{"a", nil}, func(consensus.Packet) { n++ })
+	assert.Equal(t, 0, n)
+}
+
+
+func TestFaultsDeliverDup(t *testing.T) {
+	fs := newFaults()
+	fs.m["a"] = fault{dup: 1}
+	var n int
+	fs.deliver(consensus.Packet{"a", nil}, func(consensus.Packet) { n++ })
+	assert.Equal(t, 2, n)
+}
@@ -1,12 +1,31 @@
 package gc
 
 import (
+	"doozer/consensus"
 	"doozer/store"
+	"strconv"
 )
 
-func Clean(st *store.Store, keep int64, ticker <-chan int64) {
+// Discards history older than keep seqns on each tick, if there is any
+// to discard. If node leads the cluster (see consensus.Leads), it also
+// publishes a "gc" cluster event naming node and the oldest seqn still
+// kept; every peer discards the same history, so one event speaks for
+// them all. A tick at which nothing has happened since that event
+// does neither, so the event doesn't keep itself going.
+func Clean(st *store.Store, p consensus.Proposer, node string, keep int64, ticker <-chan int64) {
+	var done int64 // the last seqn discarded
+	var pub int64  // the seqn of the last event published
 	for _ = range ticker {
-		last := (<-st.Seqns) - keep
+		ver, g := st.Snap()
+		last := ver - keep
+		if last <= done || ver == pub {
+			continue
+		}
+
 		st.Clean(last)
+		done = last
+		if consensus.Leads(g, node) {
+			pub = consensus.Publish(p, "gc", node+" "+strconv.Itoa64(last+1)).Seqn
+		}
 	}
 }
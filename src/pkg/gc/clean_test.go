@@ -13,9 +13,10 @@ func TestGcClean(t *testing.T) {
 	ticker := make(chan int64)
 	defer close(ticker)
 
-	go Clean(st, 3, ticker)
+	fs := make(FakeProposer, 2)
+	go Clean(st, fs, "test", 3, ticker)
 
-	st.Ops <- store.Op{1, store.Nop}
+	st.Ops <- store.Op{1, store.MustEncodeSet("/ctl/cal/0", "test", store.Clobber)}
 	st.Ops <- store.Op{2, store.Nop}
 	st.Ops <- store.Op{3, store.Nop}
 	st.Ops <- store.Op{4, store.Nop}
@@ -26,4 +27,29 @@ func TestGcClean(t *testing.T) {
 	ticker <- 1 // Extra tick to ensure the last st.Clean has completed
 	_, err = st.Wait(1)
 	assert.Equal(t, store.ErrTooLate, err)
+	assert.Equal(t, "-1:/ctl/events/gc=test 2", <-fs)
+}
+
+func TestGcCleanNotLeader(t *testing.T) {
+	st := store.New()
+	defer close(st.Ops)
+
+	ticker := make(chan int64)
+	defer close(ticker)
+
+	fs := make(FakeProposer, 2)
+	go Clean(st, fs, "test", 3, ticker)
+
+	st.Ops <- store.Op{1, store.MustEncodeSet("/ctl/cal/0", "other", store.Clobber)}
+	st.Ops <- store.Op{2, store.Nop}
+	st.Ops <- store.Op{3, store.Nop}
+	st.Ops <- store.Op{4, store.Nop}
+
+	_, err := st.Wait(1)
+	assert.Equal(t, nil, err)
+	ticker <- 1
+	ticker <- 1 // Extra tick to ensure the last st.Clean has completed
+	_, err = st.Wait(1)
+	assert.Equal(t, store.ErrTooLate, err)
+	assert.Equal(t, 0, len(fs))
 }
@@ -0,0 +1,91 @@
+// Package gocount keeps a running count of goroutines started by each
+// subsystem, so that slow growth in a long-running peer can be traced
+// to its source. The counts are published through expvar as
+// "goroutines".
+package gocount
+
+import (
+	"expvar"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	lk     sync.Mutex
+	counts = map[string]int64{}
+)
+
+type countsVar struct{}
+
+func (countsVar) String() string {
+	return format(Counts())
+}
+
+func format(m map[string]int64) string {
+	var names []string
+	for name := range m {
+		names = append(names, name)
+	}
+	sort.SortStrings(names)
+
+	parts := make([]string, len(names))
+	for i, name := range names {
+		parts[i] = fmt.Sprintf("%q: %d", name, m[name])
+	}
+	return "{" + strings.Join(parts, ", ") + "}"
+}
+
+func init() {
+	expvar.Publish("goroutines", countsVar{})
+}
+
+func add(name string, n int64) {
+	lk.Lock()
+	counts[name] += n
+	lk.Unlock()
+}
+
+// Runs f in a new goroutine, counted under name until f returns.
+func Go(name string, f func()) {
+	add(name, 1)
+	go func() {
+		defer add(name, -1)
+		f()
+	}()
+}
+
+// Returns the number of goroutines started under name that are still
+// running.
+func Count(name string) int64 {
+	lk.Lock()
+	defer lk.Unlock()
+	return counts[name]
+}
+
+// Returns a copy of all counts, keyed by name.
+func Counts() map[string]int64 {
+	lk.Lock()
+	defer lk.Unlock()
+	m := make(map[string]int64, len(counts))
+	for name, n := range counts {
+		m[name] = n
+	}
+	return m
+}
+
+// Waits up to timeout ns for the count under name to drop to n or
+// below. Returns false if it doesn't, which in a test means goroutines
+// have leaked.
+func Settle(name string, n int64, timeout int64) bool {
+	deadline := time.Nanoseconds() + timeout
+	for Count(name) > n {
+		if time.Nanoseconds() > deadline {
+			return false
+		}
+		time.Sleep(1e6)
+	}
+	return true
+}
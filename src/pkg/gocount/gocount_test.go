@@ -0,0 +1,38 @@
+package gocount
+
+import (
+	"github.com/bmizerany/assert"
+	"testing"
+)
+
+func TestGoCounts(t *testing.T) {
+	release := make(chan bool)
+	started := make(chan bool)
+	for i := 0; i < 3; i++ {
+		Go("test", func() {
+			started <- true
+			<-release
+		})
+	}
+	for i := 0; i < 3; i++ {
+		<-started
+	}
+	assert.Equal(t, int64(3), Count("test"))
+	assert.Equal(t, int64(3), Counts()["test"])
+
+	close(release)
+	assert.T(t, Settle("test", 0, 1e9))
+}
+
+func TestSettleTimesOut(t *testing.T) {
+	release := make(chan bool)
+	Go("stuck", func() { <-release })
+	assert.T(t, !Settle("stuck", 0, 1e7))
+	close(release)
+	assert.T(t, Settle("stuck", 0, 1e9))
+}
+
+func TestFormat(t *testing.T) {
+	assert.Equal(t, `{}`, format(map[string]int64{}))
+	assert.Equal(t, `{"a": 1, "b": 2}`, format(map[string]int64{"b": 2, "a": 1}))
+}
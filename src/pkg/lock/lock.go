@@ -7,9 +7,16 @@ import (
 
 const SessDir = "/ctl/sess"
 
+// A file in LinkDir links the file at the rest of its path to the
+// session named in its body, making that file ephemeral: when the
+// session ends, both are deleted. For example, /ctl/link/svc/a=abc
+// links /svc/a to session abc.
+const LinkDir = "/ctl/link"
+
 var (
 	SessGlob = store.MustCompileGlob(SessDir + "/*")
 	locks    = store.MustCompileGlob("/lock/**")
+	links    = store.MustCompileGlob(LinkDir + "/**")
 )
 
 func Clean(p consensus.Proposer, ch <-chan store.Event) {
@@ -23,6 +30,24 @@ func Clean(p consensus.Proposer, ch <-chan store.Event) {
 				}
 				return false
 			})
+
+			store.Walk(ev, links, func(path, body string, rev int64) bool {
+				if body == name {
+					go unlink(p, path, rev)
+				}
+				return false
+			})
 		}
 	}
 }
+
+// Deletes the link at path, then the file it links. If the link has
+// changed since rev, it now belongs to another session (and another
+// peer may already be cleaning it up), so the file is left alone.
+func unlink(p consensus.Proposer, path string, rev int64) {
+	e := consensus.Del(p, path, rev)
+	if e.Err != nil {
+		return
+	}
+	consensus.Del(p, path[len(LinkDir):], store.Clobber)
+}
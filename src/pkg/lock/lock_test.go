@@ -31,3 +31,29 @@ func TestLockSimple(t *testing.T) {
 	assert.Equal(t, "/lock/x", (<-ch).Path)
 	assert.Equal(t, "/lock/z", (<-ch).Path)
 }
+
+func TestLockLinks(t *testing.T) {
+	st := store.New()
+	defer close(st.Ops)
+	fp := &test.FakeProposer{Store: st}
+	go Clean(fp, st.Watch(SessGlob))
+
+	fp.Propose([]byte(store.MustEncodeSet("/ctl/sess/a", "1.2.3.4:55", store.Clobber)))
+	fp.Propose([]byte(store.MustEncodeSet("/ctl/link/svc/x", "a", store.Missing)))
+	fp.Propose([]byte(store.MustEncodeSet("/svc/x", "10.0.0.1:80", store.Missing)))
+	fp.Propose([]byte(store.MustEncodeSet("/ctl/link/svc/y", "b", store.Missing)))
+	fp.Propose([]byte(store.MustEncodeSet("/svc/y", "10.0.0.2:80", store.Missing)))
+
+	ch := fp.Watch(store.MustCompileGlob("/svc/*"))
+
+	fp.Propose([]byte(store.MustEncodeDel("/ctl/sess/a", store.Clobber)))
+
+	ev := <-ch
+	assert.T(t, ev.IsDel())
+	assert.Equal(t, "/svc/x", ev.Path)
+
+	_, rev := st.Get("/ctl/link/svc/x")
+	assert.Equal(t, store.Missing, rev)
+	_, rev = st.Get("/svc/y")
+	assert.NotEqual(t, store.Missing, rev)
+}
@@ -0,0 +1,105 @@
+// Package manifest provisions a cluster from a list of files that should
+// exist, each with the body it gets if it is missing.
+//
+// A manifest is text, one file per line, as <path>=<body>. The body runs
+// to the end of the line. Blank lines and lines starting with # are
+// skipped. Quotas, secrets and the like are ordinary files in /ctl, so
+// a manifest sets them up like any other:
+//
+//   # the app's own defaults
+//   /app/config/port=8080
+//   /ctl/quota/app=100 65536
+//
+// Applying a manifest only ever makes missing files, so applying it
+// again, or applying it to a cluster someone has since changed, is
+// harmless.
+//
+// TODO ACLs, once requests carry any notion of who sent them.
+package manifest
+
+import (
+	"bufio"
+	"doozer/consensus"
+	"doozer/store"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+
+// One file a manifest provides for.
+type Entry struct {
+	Path, Body string
+}
+
+
+// An error in the text of a manifest.
+type ParseError struct {
+	Line int
+	Err  os.Error
+}
+
+func (e *ParseError) String() string {
+	return "manifest line " + strconv.Itoa(e.Line) + ": " + e.Err.String()
+}
+
+
+// Returns the Code of the error on the line, for store.CodeOf.
+func (e *ParseError) ErrCode() store.Code {
+	return store.CodeOf(e.Err)
+}
+
+
+var ErrNoBody = &store.Error{store.CodeSyntax, "missing ="}
+
+
+// Reads a manifest from r.
+func Parse(r io.Reader) (es []Entry, err os.Error) {
+	br := bufio.NewReader(r)
+	for n := 1; ; n++ {
+		line, err := br.ReadString('\n')
+		if err == os.EOF && line == "" {
+			return es, nil
+		}
+		if err != nil && err != os.EOF {
+			return nil, err
+		}
+
+		line = strings.TrimRight(line, "\r\n")
+		if line == "" || line[0] == '#' {
+			continue
+		}
+
+		i := strings.Index(line, "=")
+		if i < 0 {
+			return nil, &ParseError{n, ErrNoBody}
+		}
+
+		e := Entry{line[:i], line[i+1:]}
+		// EncodeSet checks the path.
+		if _, err := store.EncodeSet(e.Path, e.Body, store.Missing); err != nil {
+			return nil, &ParseError{n, err}
+		}
+		es = append(es, e)
+	}
+	panic("unreachable")
+}
+
+
+// Makes each file in es that is missing, through p. Leaves files that
+// already exist as they are. Returns how many files it made.
+func Apply(p consensus.Proposer, es []Entry) (made int, err os.Error) {
+	for _, e := range es {
+		ev := consensus.Set(p, e.Path, []byte(e.Body), store.Missing)
+		switch ev.Err {
+		case nil:
+			made++
+		case store.ErrRevMismatch, os.EISDIR:
+			// already there
+		default:
+			return made, ev.Err
+		}
+	}
+	return made, nil
+}
@@ -0,0 +1,47 @@
+package manifest
+
+import (
+	"bytes"
+	"doozer/store"
+	"doozer/test"
+	"github.com/bmizerany/assert"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	es, err := Parse(bytes.NewBufferString("# c\n/a=1\n\n/ctl/quota/a=10 0\r\n/b="))
+	assert.Equal(t, nil, err)
+	exp := []Entry{{"/a", "1"}, {"/ctl/quota/a", "10 0"}, {"/b", ""}}
+	assert.Equal(t, exp, es)
+}
+
+
+func TestParseErrors(t *testing.T) {
+	_, err := Parse(bytes.NewBufferString("/a=1\n/b\n"))
+	assert.Equal(t, &ParseError{2, ErrNoBody}, err)
+	assert.Equal(t, store.CodeSyntax, store.CodeOf(err))
+
+	_, err = Parse(bytes.NewBufferString("a=1\n"))
+	assert.Equal(t, &ParseError{1, &store.BadPathError{"a"}}, err)
+	assert.Equal(t, store.CodeBadPath, store.CodeOf(err))
+}
+
+
+func TestApply(t *testing.T) {
+	st := store.New()
+	defer close(st.Ops)
+	fp := &test.FakeProposer{Store: st}
+	fp.Propose([]byte(store.MustEncodeSet("/a", "old", store.Clobber)))
+	fp.Propose([]byte(store.MustEncodeSet("/d/x", "", store.Clobber)))
+
+	es := []Entry{{"/a", "new"}, {"/b", "2"}, {"/d", "3"}}
+	made, err := Apply(fp, es)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 1, made)
+	assert.Equal(t, "old", store.GetString(st, "/a"))
+	assert.Equal(t, "2", store.GetString(st, "/b"))
+
+	made, err = Apply(fp, es)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 0, made)
+}
@@ -38,7 +38,11 @@ func getName(addr string, g store.Getter) string {
 func clearSlot(p consensus.Proposer, g store.Getter, name string) {
 	store.Walk(g, calGlob, func(path, body string, rev int64) bool {
 		if body == name {
-			consensus.Set(p, path, nil, rev)
+			e := consensus.Set(p, path, nil, rev)
+			if e.Err == nil {
+				slot := path[len("/ctl/cal/"):]
+				consensus.Publish(p, "cal", "del "+name+" "+slot)
+			}
 		}
 		return false
 	})
@@ -50,8 +54,12 @@ func removeInfo(p consensus.Proposer, g store.Getter, name string) {
 		log.Println(err)
 		return
 	}
+	addr := "/ctl/node/" + name + "/addr"
 	store.Walk(g, glob, func(path, _ string, rev int64) bool {
-		consensus.Del(p, path, rev)
+		e := consensus.Del(p, path, rev)
+		if e.Err == nil && path == addr {
+			consensus.Publish(p, "member", "del "+name)
+		}
 		return false
 	})
 }
@@ -0,0 +1,62 @@
+package proto
+
+import (
+	"doozer/store"
+	pb "goprotobuf.googlecode.com/hg/proto"
+	"os"
+)
+
+// Values for Event.Flags. They are the same bits as the set and del
+// response flags, so an event's flags can go in a Response as they are.
+const (
+	EventSet = 1 << 2
+	EventDel = 1 << 3
+)
+
+// Returns the wire form of ev.
+func NewEvent(ev store.Event) *Event {
+	e := &Event{
+		Seqn: pb.Int64(ev.Seqn),
+		Path: pb.String(ev.Path),
+		Body: []byte(ev.Body),
+		Rev:  pb.Int64(ev.Rev),
+	}
+
+	var flags int32
+	switch {
+	case ev.IsSet():
+		flags = EventSet
+	case ev.IsDel():
+		flags = EventDel
+	}
+	e.Flags = &flags
+	return e
+}
+
+// Returns the event a WATCH response carries: its path, value and flags,
+// with its rev as the seqn. The flags are the response's own, so they
+// may hold more than the set and del bits.
+func ResponseEvent(r *Response) *Event {
+	return &Event{
+		Seqn:  r.Rev,
+		Path:  r.Path,
+		Body:  r.Value,
+		Flags: r.Flags,
+	}
+}
+
+// Encodes e. Anything that writes events out of a peer, into
+// responses, files, or feeds, should use this encoding.
+func MarshalEvent(e *Event) ([]byte, os.Error) {
+	return pb.Marshal(e)
+}
+
+// Decodes an event encoded by MarshalEvent.
+func UnmarshalEvent(buf []byte) (*Event, os.Error) {
+	e := new(Event)
+	err := pb.Unmarshal(buf, e)
+	if err != nil {
+		return nil, err
+	}
+	return e, nil
+}
@@ -0,0 +1,46 @@
+package proto
+
+import (
+	"doozer/store"
+	"github.com/bmizerany/assert"
+	pb "goprotobuf.googlecode.com/hg/proto"
+	"testing"
+)
+
+func TestEventRoundTrip(t *testing.T) {
+	ev := store.Event{Seqn: 5, Path: "/x", Body: "a", Rev: 5}
+	buf, err := MarshalEvent(NewEvent(ev))
+	assert.Equal(t, nil, err)
+
+	e, err := UnmarshalEvent(buf)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, int64(5), *e.Seqn)
+	assert.Equal(t, "/x", *e.Path)
+	assert.Equal(t, []byte("a"), e.Body)
+	assert.Equal(t, int32(EventSet), *e.Flags)
+	assert.Equal(t, int64(5), *e.Rev)
+}
+
+func TestEventDel(t *testing.T) {
+	e := NewEvent(store.Event{Seqn: 6, Path: "/x", Rev: store.Missing})
+	assert.Equal(t, int32(EventDel), *e.Flags)
+}
+
+func TestEventNop(t *testing.T) {
+	e := NewEvent(store.Event{Seqn: 7, Path: "/", Rev: -3})
+	assert.Equal(t, int32(0), *e.Flags)
+}
+
+func TestUnmarshalEventMissingField(t *testing.T) {
+	_, err := UnmarshalEvent(nil)
+	assert.NotEqual(t, nil, err)
+}
+
+func TestResponseEvent(t *testing.T) {
+	r := &Response{Rev: pb.Int64(5), Path: pb.String("/x"), Value: []byte("a"), Flags: pb.Int32(1 | EventSet)}
+	e := ResponseEvent(r)
+	assert.Equal(t, int64(5), *e.Seqn)
+	assert.Equal(t, "/x", *e.Path)
+	assert.Equal(t, []byte("a"), e.Body)
+	assert.Equal(t, int32(1|EventSet), *e.Flags)
+}
@@ -0,0 +1,17 @@
+package proto
+
+import (
+	"hash"
+	"strconv"
+)
+
+// Adds a file to h, the checksum of a chunk of a chunked WALK. See
+// doc/proto.md.
+func SumFile(h hash.Hash, path string, body []byte, rev int64) {
+	h.Write([]byte(path))
+	h.Write([]byte{0})
+	h.Write(body)
+	h.Write([]byte{0})
+	h.Write([]byte(strconv.Itoa64(rev)))
+	h.Write([]byte{0})
+}
@@ -0,0 +1,140 @@
+package sched
+
+import (
+	"doozer/consensus"
+	"doozer/store"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// A file in Dir holds a mutation to be proposed later. Its body is
+// "<when> <mutation>", where when is a time in nanoseconds (by the
+// peers' clocks) and mutation is a set or del made by package store;
+// see store.DecodeWrite. Once when has passed, the file is deleted and
+// its mutation proposed. For example,
+// /ctl/scheduled/a="1300000000000000000 -1:/x=b" sets /x to b at that
+// time. Until then, the file shows the change is pending.
+const Dir = "/ctl/scheduled"
+
+var jobs = store.MustCompileGlob(Dir + "/**")
+
+
+type job struct {
+	path string // of the file in Dir
+	rev  int64  // of the file in Dir
+	when int64
+	mut  string
+}
+
+
+type byWhen []job
+
+func (js byWhen) Len() int      { return len(js) }
+func (js byWhen) Swap(i, j int) { js[i], js[j] = js[j], js[i] }
+
+func (js byWhen) Less(i, j int) bool {
+	if js[i].when != js[j].when {
+		return js[i].when < js[j].when
+	}
+	return js[i].path < js[j].path
+}
+
+
+// Checks a scheduled write before it is proposed, as a server checks a
+// client's; see server.Server.CheckWrite. keep is true for a set and
+// false for a del. If the error has a Temporary method that reports
+// true, the job is left to be tried again.
+type Check func(path, body string, rev int64, keep bool) os.Error
+
+
+// A scheduled mutation whose path is in /ctl, where the cluster keeps
+// its own state, is never proposed: the file holding it was written by
+// a client, and clients could otherwise write there through it.
+var ErrCtl = &store.Error{store.CodeCtl, "scheduled write to /ctl"}
+
+
+// Run receives nanosecond time values from t. For each time received,
+// Run proposes, in order of when, every mutation in Dir whose time has
+// passed as of that time, if check allows it.
+//
+// Each peer that runs Run first claims a job by deleting its file, only
+// if the file is still there with the rev it read, and proposes the
+// mutation only if its claim succeeds. So a mutation is proposed at
+// most once, even if several peers run Run; a peer that stops between
+// the two steps loses it. A job that isn't a set or del, that writes
+// to /ctl, or that check refuses for good, is claimed the same way, and
+// dropped.
+//
+// Parameter t can be the output chan of a time.Ticker.
+func Run(st *store.Store, p consensus.Proposer, t <-chan int64, check Check) {
+	for now := range t {
+		_, g := st.Snap()
+		for _, j := range due(g, now) {
+			err := validate(j.mut, check)
+			if isTemporary(err) {
+				continue
+			}
+
+			e := consensus.DelIf(p, true, j.path, j.rev)
+			if e.Err != nil {
+				continue
+			}
+			if err != nil {
+				log.Printf("sched: dropping %s: %v", j.path, err)
+				continue
+			}
+			p.Propose([]byte(j.mut))
+		}
+	}
+}
+
+
+func validate(mut string, check Check) os.Error {
+	path, body, rev, keep, err := store.DecodeWrite(mut)
+	if err != nil {
+		return err
+	}
+	if p := strings.ToLower(path); p == "/ctl" || strings.HasPrefix(p, "/ctl/") {
+		return ErrCtl
+	}
+	return check(path, body, rev, keep)
+}
+
+
+func isTemporary(err os.Error) bool {
+	t, ok := err.(interface {
+		Temporary() bool
+	})
+	return ok && t.Temporary()
+}
+
+
+// Returns the jobs in g whose time has passed as of now, in order of
+// when. Files whose bodies can't be parsed are left alone.
+func due(g store.Getter, now int64) (js []job) {
+	store.Walk(g, jobs, func(path, body string, rev int64) bool {
+		if when, mut, ok := parse(body); ok && when < now {
+			js = append(js, job{path, rev, when, mut})
+		}
+		return false
+	})
+	sort.Sort(byWhen(js))
+	return js
+}
+
+
+func parse(body string) (when int64, mut string, ok bool) {
+	parts := strings.Split(body, " ", 2)
+	if len(parts) != 2 || parts[1] == "" {
+		return 0, "", false
+	}
+
+	when, err := strconv.Atoi64(parts[0])
+	if err != nil {
+		return 0, "", false
+	}
+	return when, parts[1], true
+}
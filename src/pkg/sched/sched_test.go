@@ -0,0 +1,106 @@
+package sched
+
+import (
+	"doozer/store"
+	"doozer/test"
+	"github.com/bmizerany/assert"
+	"os"
+	"testing"
+)
+
+
+func allow(path, body string, rev int64, keep bool) os.Error {
+	return nil
+}
+
+
+func TestRun(t *testing.T) {
+	st := store.New()
+	defer close(st.Ops)
+	fp := &test.FakeProposer{Store: st}
+	tc := make(chan int64, 1)
+	defer close(tc)
+	go Run(st, fp, tc, allow)
+
+	fp.Propose([]byte(store.MustEncodeSet(Dir+"/a", "5 -1:/x=b", store.Clobber)))
+
+	ch := st.Watch(store.MustCompileGlob("/x"))
+	tc <- 10
+
+	ev := <-ch
+	assert.T(t, ev.IsSet())
+	assert.Equal(t, "b", ev.Body)
+	_, rev := st.Get(Dir + "/a")
+	assert.Equal(t, store.Missing, rev)
+}
+
+
+func TestDue(t *testing.T) {
+	st := store.New()
+	defer close(st.Ops)
+
+	st.Ops <- store.Op{1, store.MustEncodeSet(Dir+"/a", "7 -1:/x=1", 0)}
+	st.Ops <- store.Op{2, store.MustEncodeSet(Dir+"/b", "15 -1:/x=2", 0)}
+	st.Ops <- store.Op{3, store.MustEncodeSet(Dir+"/c", "5 -1:/y", 0)}
+	st.Ops <- store.Op{4, store.MustEncodeSet(Dir+"/d", "junk", 0)}
+	st.Ops <- store.Op{5, store.MustEncodeSet(Dir+"/e", "3", 0)}
+	for <-st.Seqns < 5 {
+	}
+
+	exp := []job{
+		{Dir + "/c", 3, 5, "-1:/y"},
+		{Dir + "/a", 1, 7, "-1:/x=1"},
+	}
+	assert.Equal(t, exp, due(st, 10))
+}
+
+
+type later string
+
+
+func (e later) String() string  { return string(e) }
+func (e later) Temporary() bool { return true }
+
+
+func TestRunRefuses(t *testing.T) {
+	st := store.New()
+	defer close(st.Ops)
+	fp := &test.FakeProposer{Store: st}
+	tc := make(chan int64)
+	defer close(tc)
+
+	busy := true
+	check := func(path, body string, rev int64, keep bool) os.Error {
+		switch {
+		case path == "/big":
+			return os.NewError("too big")
+		case busy:
+			return later("busy")
+		}
+		return nil
+	}
+	go Run(st, fp, tc, check)
+
+	fp.Propose([]byte(store.MustEncodeSet(Dir+"/a", "5 -1:/ctl/x=b", store.Clobber)))
+	fp.Propose([]byte(store.MustEncodeSet(Dir+"/b", "5 -1:/big=b", store.Clobber)))
+	fp.Propose([]byte(store.MustEncodeSet(Dir+"/c", "5 -1:/x=b", store.Clobber)))
+	fp.Propose([]byte(store.MustEncodeSet(Dir+"/d", "5 bulk:1", store.Clobber)))
+	tc <- 10
+	tc <- 10 // the first tick is done once Run takes the second
+
+	for _, p := range []string{"/a", "/b", "/d"} {
+		_, rev := st.Get(Dir + p)
+		assert.Equal(t, store.Missing, rev, p)
+	}
+	_, rev := st.Get(Dir + "/c")
+	assert.NotEqual(t, store.Missing, rev)
+
+	busy = false
+	ch := st.Watch(store.MustCompileGlob("/x"))
+	tc <- 10
+	ev := <-ch
+	assert.Equal(t, "b", ev.Body)
+
+	_, rev = st.Get("/ctl/x")
+	assert.Equal(t, store.Missing, rev)
+}
@@ -0,0 +1,59 @@
+package server
+
+import (
+	"doozer/store"
+	"os"
+	"strconv"
+)
+
+
+var (
+	ErrBodyLimit = &store.Error{store.CodeOverLimit, "over limit: body"}
+	ErrProtected = &store.Error{store.CodeProtected, "protected path"}
+	ErrReserved  = &store.Error{store.CodeReserved, "reserved path"}
+)
+
+
+// An error CheckWrite returns for a write that may be allowed later,
+// once the server's load or the file's rate of writes drops.
+type laterError struct {
+	code store.Code
+	msg  string
+}
+
+
+func (e *laterError) String() string { return e.msg }
+
+
+func (e *laterError) ErrCode() store.Code { return e.code }
+
+
+// Reports true: the write can be tried again later.
+func (e *laterError) Temporary() bool { return true }
+
+
+// Checks a write the cluster is to make on a client's behalf, but not
+// at its request, such as a scheduled one, the way SET and DEL check a
+// client's own: it is refused if sv is shedding client writes, if the
+// body is over sv.BodyLimit, if it needs force under sv.Protect, which
+// such a write never has, if path is over its rate limit, or if it is
+// reserved. keep is true for a set and false for a del. Errors for
+// shedding and rate limits have a Temporary method that reports true.
+func (sv *Server) CheckWrite(path, body string, rev int64, keep bool) os.Error {
+	if cl := writeClass(&T{}, path); cl >= 0 && sv.shedding(cl) {
+		return &laterError{store.CodeOverloaded, "overloaded: shedding " + cl.String()}
+	}
+	if keep && !sv.BodyLimit.check("body", int64(len(body))) {
+		return ErrBodyLimit
+	}
+	if needsForce(sv.Protect, path, rev, !keep) {
+		return ErrProtected
+	}
+	if !sv.rl.allow(sv.RateLimits, path) {
+		return &laterError{store.CodeOverLimit, "over limit: rate: " + strconv.Quote(path)}
+	}
+	if sv.St.Reserved(path) {
+		return ErrReserved
+	}
+	return nil
+}
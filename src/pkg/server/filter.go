@@ -0,0 +1,76 @@
+package server
+
+import (
+	"fmt"
+	"json"
+	"os"
+	"regexp"
+	"strings"
+)
+
+
+// Reports whether a watch should send an event that set a file to body.
+type filter func(body string) bool
+
+
+// Parses a watch's body filter, which is one of
+//
+//   prefix:<s>       the body begins with s
+//   re:<regexp>      the body matches regexp
+//   json:<f>=<v>     the body is a JSON object whose field f is v
+//
+// An empty filter matches everything, and parseFilter returns nil.
+func parseFilter(s string) (filter, os.Error) {
+	if s == "" {
+		return nil, nil
+	}
+
+	kv := strings.Split(s, ":", 2)
+	if len(kv) != 2 {
+		return nil, os.NewError("bad filter: " + s)
+	}
+
+	switch kv[0] {
+	case "prefix":
+		p := kv[1]
+		return func(body string) bool {
+			return strings.HasPrefix(body, p)
+		}, nil
+	case "re":
+		re, err := regexp.Compile(kv[1])
+		if err != nil {
+			return nil, err
+		}
+		return func(body string) bool {
+			return re.MatchString(body)
+		}, nil
+	case "json":
+		fv := strings.Split(kv[1], "=", 2)
+		if len(fv) != 2 {
+			return nil, os.NewError("bad filter: " + s)
+		}
+		return func(body string) bool {
+			return jsonField(body, fv[0]) == fv[1]
+		}, nil
+	}
+	return nil, os.NewError("bad filter: " + s)
+}
+
+
+// Returns field f of the JSON object in body, formatted as text, or ""
+// if body isn't an object or has no such field.
+func jsonField(body, f string) string {
+	var m map[string]interface{}
+	if json.Unmarshal([]byte(body), &m) != nil {
+		return ""
+	}
+
+	v, ok := m[f]
+	if !ok || v == nil {
+		return ""
+	}
+	if s, ok := v.(string); ok {
+		return s
+	}
+	return fmt.Sprint(v)
+}
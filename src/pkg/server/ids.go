@@ -0,0 +1,91 @@
+package server
+
+import (
+	"doozer/proto"
+	"doozer/store"
+	pb "goprotobuf.googlecode.com/hg/proto"
+	"strconv"
+)
+
+
+// Where IDS keeps its sequences, one file per name, each holding the
+// last ID handed out. Clients shouldn't write these files themselves.
+const IdsDir = "/ctl/ids"
+
+
+var badCount = &R{
+	ErrCode:   proto.NewResponse_Err(proto.Response_OTHER),
+	ErrDetail: pb.String("count must be positive"),
+}
+
+
+// Hands out a block of t.Delta new IDs, or one if it isn't set, from
+// the sequence named t.Path. Each block comes from one atomic add to
+// the sequence's file, so no two requests get the same ID, and later
+// blocks are greater. The response's Value is the first ID of the
+// block, in decimal; the first ever is 1.
+func (c *conn) ids(t *T, tx txn) {
+	if !c.cal {
+		c.forward(t, tx)
+		return
+	}
+
+	if t.Path == nil {
+		c.respond(t, Valid|Done, nil, missingArg)
+		return
+	}
+
+	n := int64(1)
+	if t.Delta != nil {
+		n = *t.Delta
+	}
+	if n < 1 {
+		c.respond(t, Valid|Done, nil, badCount)
+		return
+	}
+
+	// The file is in /ctl, but handing out IDs is a client's write,
+	// and is shed as one.
+	if c.shed(t, ShedWrites) {
+		return
+	}
+
+	if p := c.s.Phase(); p != Serving {
+		c.respond(t, Valid|Done, nil, notReady(p))
+		return
+	}
+
+	path := IdsDir + "/" + *t.Path
+	if !c.s.rl.allow(c.s.RateLimits, path) {
+		c.respond(t, Valid|Done, nil, overLimit("rate"))
+		return
+	}
+
+	evs := bgAdd(proposerFor(c.s.Mg, t), path, n, store.Clobber)
+
+	go func() {
+		select {
+		case <-tx.cancel:
+			c.closeTxn(*t.Tag)
+			return
+		case ev := <-evs:
+			if e, ok := ev.Err.(*store.BadPathError); ok {
+				c.respond(t, Valid|Done, nil, &R{ErrCode: badPath, ErrDetail: &e.Path})
+				return
+			}
+			if ev.Err != nil {
+				c.respond(t, Valid|Done, nil, errResponse(ev.Err))
+				return
+			}
+
+			last, err := strconv.Atoi64(ev.Body)
+			if err != nil {
+				c.respond(t, Valid|Done, nil, errResponse(err))
+				return
+			}
+
+			first := strconv.Itoa64(last - n + 1)
+			c.respond(t, Valid|Done, nil, &R{Rev: &ev.Seqn, Value: []byte(first)})
+		}
+	}()
+}
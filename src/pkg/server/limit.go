@@ -0,0 +1,48 @@
+package server
+
+import (
+	"doozer/proto"
+	"expvar"
+	"log"
+	pb "goprotobuf.googlecode.com/hg/proto"
+)
+
+
+// A Limit caps some quantity, such as the size of a body or the number
+// of watches held by one connection. Past Soft, an operation still
+// succeeds, but it is logged and counted in the "limits.soft" expvar so
+// that operators hear about it before clients start failing. Past Hard,
+// the operation is refused. Zero means no limit.
+type Limit struct {
+	Soft, Hard int64
+}
+
+
+var (
+	softHits = expvar.NewMap("limits.soft")
+	hardHits = expvar.NewMap("limits.hard")
+)
+
+
+// Reports whether n is within l's hard limit, recording a warning if
+// it is past the soft limit. Name identifies l in logs and stats.
+func (l Limit) check(name string, n int64) bool {
+	if l.Hard > 0 && n > l.Hard {
+		hardHits.Add(name, 1)
+		return false
+	}
+
+	if l.Soft > 0 && n > l.Soft {
+		softHits.Add(name, 1)
+		log.Printf("warning: %s %d is past soft limit %d (hard limit %d)", name, n, l.Soft, l.Hard)
+	}
+	return true
+}
+
+
+func overLimit(name string) *R {
+	return &R{
+		ErrCode:   proto.NewResponse_Err(proto.Response_OVER_LIMIT),
+		ErrDetail: pb.String("over limit: " + name),
+	}
+}
@@ -0,0 +1,74 @@
+package server
+
+import (
+	"bytes"
+	"doozer/proto"
+	"doozer/store"
+	"encoding/binary"
+	"log"
+	"net"
+	"os"
+)
+
+
+// Sends each change to a file matching glob to addr, usually a UDP
+// multicast group, so that any number of clients on the same LAN can
+// follow the changes without a watch apiece. Only one peer should
+// send to a group. See doc/proto.md for the datagram format.
+//
+// Returns only if the store closes or addr can't be dialed.
+func (s *Server) Multicast(addr *net.UDPAddr, glob *store.Glob) os.Error {
+	c, err := net.DialUDP("udp", nil, addr)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	if s.St.FoldsCase() {
+		glob = glob.Fold()
+	}
+
+	w := store.NewWatch(s.St, glob)
+	defer w.Stop()
+
+	var prev int64
+	for ev := range w.C {
+		if ev.Err == store.ErrClosed {
+			break
+		}
+
+		_, err := c.Write(datagram(prev, ev.Seqn, store.Writes(glob, ev)))
+		if err != nil {
+			log.Println("multicast:", err)
+		}
+		prev = ev.Seqn
+	}
+	return nil
+}
+
+
+// Returns the datagram that carries evs, all made at seqn, when the
+// datagram before it carried the events made at prev. If the events
+// don't fit in one packet, they are left out, and listeners fetch them
+// over a watch instead.
+func datagram(prev, seqn int64, evs []store.Event) []byte {
+	var b bytes.Buffer
+	binary.Write(&b, binary.BigEndian, prev)
+	binary.Write(&b, binary.BigEndian, seqn)
+	binary.Write(&b, binary.BigEndian, int32(len(evs)))
+	head := b.Len()
+
+	for _, ev := range evs {
+		buf, err := proto.MarshalEvent(proto.NewEvent(ev))
+		if err != nil {
+			panic(err)
+		}
+		binary.Write(&b, binary.BigEndian, int32(len(buf)))
+		b.Write(buf)
+	}
+
+	if b.Len() > packetSize {
+		b.Truncate(head)
+	}
+	return b.Bytes()
+}
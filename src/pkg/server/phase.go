@@ -0,0 +1,54 @@
+package server
+
+import (
+	"sync"
+)
+
+
+// Lifecycle phases of a server, in the order they normally occur.
+type Phase int
+
+const (
+	Recovering Phase = iota // loading a snapshot from another peer
+	CatchingUp              // following the log, waiting for a CAL slot
+	Serving                 // fully caught up; accepts mutations
+	Draining                // shutting down; refuses mutations
+)
+
+
+var phaseNames = []string{
+	Recovering: "recovering",
+	CatchingUp: "catching-up",
+	Serving:    "serving",
+	Draining:   "draining",
+}
+
+
+func (p Phase) String() string {
+	if p < 0 || int(p) >= len(phaseNames) {
+		return "unknown"
+	}
+	return phaseNames[p]
+}
+
+
+type phase struct {
+	lk sync.RWMutex
+	p  Phase
+}
+
+
+// SetPhase records the lifecycle phase of sv. Client mutations are
+// refused unless the phase is Serving.
+func (sv *Server) SetPhase(p Phase) {
+	sv.ph.lk.Lock()
+	sv.ph.p = p
+	sv.ph.lk.Unlock()
+}
+
+
+func (sv *Server) Phase() Phase {
+	sv.ph.lk.RLock()
+	defer sv.ph.lk.RUnlock()
+	return sv.ph.p
+}
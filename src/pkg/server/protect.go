@@ -0,0 +1,71 @@
+package server
+
+import (
+	"doozer/store"
+	"os"
+	"strings"
+)
+
+
+// Parses a comma-separated list of globs naming protected files, as
+// taken by Server.Protect. An empty string gives no globs.
+func ParseProtect(s string) (gs []*store.Glob, err os.Error) {
+	return ParseGlobs(s)
+}
+
+
+// Parses a comma-separated list of globs. An empty string gives no
+// globs.
+func ParseGlobs(s string) (gs []*store.Glob, err os.Error) {
+	if s == "" {
+		return nil, nil
+	}
+
+	for _, pat := range strings.Split(s, ",", -1) {
+		g, err := store.CompileGlob(pat)
+		if err != nil {
+			return nil, err
+		}
+		gs = append(gs, g)
+	}
+	return gs, nil
+}
+
+
+// Parses a comma-separated list of paths, each the root of a subtree
+// to reserve with store.Store.Reserve. An empty string gives no paths.
+func ParseReserve(s string) (ps []string, err os.Error) {
+	if s == "" {
+		return nil, nil
+	}
+
+	for _, p := range strings.Split(s, ",", -1) {
+		// Only to check the path.
+		_, err := store.EncodeDel(p, store.Clobber)
+		if err != nil {
+			return nil, err
+		}
+		ps = append(ps, p)
+	}
+	return ps, nil
+}
+
+
+// Reports whether a write to path at rev needs the force flag under gs:
+// if path matches any of gs, and the write is a del (isDel) or a set
+// that ignores the file's rev.
+//
+// TODO also require that the client be an administrator, once the
+// protocol has any notion of who a client is.
+func needsForce(gs []*store.Glob, path string, rev int64, isDel bool) bool {
+	if !isDel && rev != store.Clobber {
+		return false
+	}
+
+	for _, g := range gs {
+		if g.Match(path) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,177 @@
+package server
+
+import (
+	"doozer/store"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+
+// A RateLimit caps how often any one file matching Glob may be written.
+// Each such file has a bucket of Burst tokens, refilled at Rate tokens
+// per second; a set or del takes one token, and is refused if there are
+// none. This protects watchers from a writer flapping a key.
+type RateLimit struct {
+	Glob  *store.Glob
+	Rate  float64
+	Burst float64
+}
+
+
+// The most buckets kept before full ones are forgotten. A full bucket
+// is the same as one that was never made.
+const maxBuckets = 10000
+
+
+// Returns the time in ns. A variable so tests can control it.
+var now = time.Nanoseconds
+
+
+type bucket struct {
+	tokens float64
+	last   int64 // ns
+}
+
+
+type rateLimiter struct {
+	lk      sync.Mutex
+	buckets map[string]*bucket
+}
+
+
+// Returns the limit in ls that applies to path: the first whose glob
+// matches it. Returns nil if there is none.
+func limitFor(ls []RateLimit, path string) *RateLimit {
+	for i := range ls {
+		if ls[i].Glob.Match(path) {
+			return &ls[i]
+		}
+	}
+	return nil
+}
+
+
+// Reports whether a write to path is allowed under ls, taking a token
+// if so. Only the first limit whose glob matches path applies.
+func (rl *rateLimiter) allow(ls []RateLimit, path string) bool {
+	l := limitFor(ls, path)
+	if l == nil {
+		return true
+	}
+
+	rl.lk.Lock()
+	defer rl.lk.Unlock()
+
+	if rl.buckets == nil {
+		rl.buckets = make(map[string]*bucket)
+	}
+
+	t := now()
+	b, ok := rl.buckets[path]
+	if !ok {
+		if len(rl.buckets) >= maxBuckets {
+			rl.prune(ls, t)
+		}
+		b = &bucket{l.Burst, t}
+		rl.buckets[path] = b
+	}
+	b.refill(l, t)
+
+	if b.tokens < 1 {
+		hardHits.Add("rate", 1)
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+
+// Returns the limit in ls that applies to path, and the number of
+// tokens path has now, without taking one. Returns nil, 0 if no limit
+// applies.
+func (rl *rateLimiter) peek(ls []RateLimit, path string) (*RateLimit, float64) {
+	l := limitFor(ls, path)
+	if l == nil {
+		return nil, 0
+	}
+
+	rl.lk.Lock()
+	defer rl.lk.Unlock()
+
+	b, ok := rl.buckets[path]
+	if !ok {
+		return l, l.Burst
+	}
+	b.refill(l, now())
+	return l, b.tokens
+}
+
+
+func (b *bucket) refill(l *RateLimit, t int64) {
+	b.tokens += l.Rate * float64(t-b.last) / 1e9
+	if b.tokens > l.Burst {
+		b.tokens = l.Burst
+	}
+	b.last = t
+}
+
+
+// Forgets every bucket that would be full by time t.
+func (rl *rateLimiter) prune(ls []RateLimit, t int64) {
+	for path, b := range rl.buckets {
+		for _, l := range ls {
+			if l.Glob.Match(path) {
+				if b.tokens+l.Rate*float64(t-b.last)/1e9 >= l.Burst {
+					rl.buckets[path] = nil, false
+				}
+				break
+			}
+		}
+	}
+}
+
+
+// Parses a comma-separated list of limits, each of the form glob=rate
+// or glob=rate/burst, where rate is in writes per second. Burst
+// defaults to rate, or 1 if rate is less than 1.
+func ParseRateLimits(s string) (ls []RateLimit, err os.Error) {
+	if s == "" {
+		return nil, nil
+	}
+
+	for _, part := range strings.Split(s, ",", -1) {
+		kv := strings.Split(part, "=", 2)
+		if len(kv) != 2 {
+			return nil, os.NewError("bad rate limit: " + part)
+		}
+
+		var l RateLimit
+		l.Glob, err = store.CompileGlob(kv[0])
+		if err != nil {
+			return nil, err
+		}
+
+		rb := strings.Split(kv[1], "/", 2)
+		l.Rate, err = strconv.Atof64(rb[0])
+		if err != nil {
+			return nil, err
+		}
+
+		l.Burst = l.Rate
+		if len(rb) == 2 {
+			l.Burst, err = strconv.Atof64(rb[1])
+			if err != nil {
+				return nil, err
+			}
+		}
+		if l.Burst < 1 {
+			l.Burst = 1
+		}
+
+		ls = append(ls, l)
+	}
+	return ls, nil
+}
@@ -0,0 +1,151 @@
+package server
+
+import (
+	"doozer/gocount"
+	"doozer/store"
+	"sort"
+	"sync"
+	"time"
+)
+
+
+// The shortest interval, in ns, at which a watch is sampled or sent
+// heartbeats. Each such watch runs a ticker, and one that fired every
+// few ns would keep a core busy; a shorter interval is taken to be this.
+const minInterval = 10e6 // ns == 10ms
+
+
+// Returns interval, or minInterval if it is shorter.
+func floorInterval(interval int64) int64 {
+	if interval < minInterval {
+		return minInterval
+	}
+	return interval
+}
+
+
+// Returns a channel that carries the writes of the events on in that
+// match glob, but at most one per path in each interval ns (at least
+// minInterval), for a watch that asked for sampled delivery. The first
+// write to a path in an interval goes out at once; later ones in the
+// same interval are held, each replacing the last, and the one held
+// when the interval ends goes out then, so the latest change to every
+// path is always sent. Writes to different paths may go out in a
+// different order than they were made.
+//
+// The returned stop ends the sampling and calls stop.
+func sample(in <-chan store.Event, glob *store.Glob, interval int64, stop func()) (<-chan store.Event, func()) {
+	out := make(chan store.Event)
+	quit := make(chan bool)
+	s := &sampler{
+		out:      out,
+		quit:     quit,
+		interval: floorInterval(interval),
+		last:     make(map[string]int64),
+		held:     make(map[string]store.Event),
+	}
+	gocount.Go("server.sample", func() { s.run(in, glob) })
+
+	var once sync.Once
+	return out, func() {
+		once.Do(func() {
+			close(quit)
+			stop()
+		})
+	}
+}
+
+
+type sampler struct {
+	out      chan store.Event
+	quit     chan bool
+	interval int64
+	last     map[string]int64       // path -> when a write to it last went out, in ns
+	held     map[string]store.Event // path -> latest write not yet sent
+}
+
+
+func (s *sampler) run(in <-chan store.Event, glob *store.Glob) {
+	defer close(s.out)
+
+	tick := time.NewTicker(s.interval)
+	defer tick.Stop()
+
+	for {
+		select {
+		case ev := <-in:
+			if closed(in) || ev.Err == store.ErrClosed {
+				return
+			}
+			for _, e := range store.Writes(glob, ev) {
+				if !s.offer(e, now()) {
+					return
+				}
+			}
+		case <-tick.C:
+			if !s.flush(now()) {
+				return
+			}
+		case <-s.quit:
+			return
+		}
+	}
+}
+
+
+// Sends e at once if no write to its path went out in the last
+// interval, and holds it otherwise. Returns false if the sampling was
+// stopped.
+func (s *sampler) offer(e store.Event, t int64) bool {
+	if t-s.last[e.Path] < s.interval {
+		s.held[e.Path] = e
+		return true
+	}
+	s.last[e.Path] = t
+	return s.send(e)
+}
+
+
+// Sends, in the order they were made, the held writes whose interval
+// has ended, and forgets paths that have been quiet for an interval.
+// Returns false if the sampling was stopped.
+func (s *sampler) flush(t int64) bool {
+	var due eventsBySeqn
+	for path, e := range s.held {
+		if t-s.last[path] >= s.interval {
+			due = append(due, e)
+			s.held[path] = e, false
+		}
+	}
+	for path, u := range s.last {
+		if _, ok := s.held[path]; !ok && t-u >= s.interval {
+			s.last[path] = 0, false
+		}
+	}
+
+	sort.Sort(due)
+	for _, e := range due {
+		s.last[e.Path] = t
+		if !s.send(e) {
+			return false
+		}
+	}
+	return true
+}
+
+
+func (s *sampler) send(e store.Event) bool {
+	select {
+	case s.out <- e:
+		return true
+	case <-s.quit:
+	}
+	return false
+}
+
+
+type eventsBySeqn []store.Event
+
+func (a eventsBySeqn) Len() int           { return len(a) }
+func (a eventsBySeqn) Less(i, j int) bool { return a[i].Seqn < a[j].Seqn }
+func (a eventsBySeqn) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
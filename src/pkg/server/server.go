@@ -1,18 +1,24 @@
 package server
 
 import (
+	"crypto/sha1"
+	"doozer/client"
 	"doozer/consensus"
+	"doozer/gocount"
 	"doozer/proto"
 	"doozer/store"
 	"encoding/binary"
+	"expvar"
+	"fmt"
+	"hash"
 	"io"
 	"log"
-	"math"
 	"net"
 	"os"
 	"rand"
 	"strconv"
 	"sync"
+	"sync/atomic"
 	"time"
 	pb "goprotobuf.googlecode.com/hg/proto"
 )
@@ -49,13 +55,72 @@ var (
 		ErrCode:   proto.NewResponse_Err(proto.Response_OTHER),
 		ErrDetail: pb.String("unknown tag"),
 	}
+	bulkDisabled = &R{
+		ErrCode:   proto.NewResponse_Err(proto.Response_OTHER),
+		ErrDetail: pb.String("bulk load disabled"),
+	}
+	cleanDisabled = &R{
+		ErrCode:   proto.NewResponse_Err(proto.Response_OTHER),
+		ErrDetail: pb.String("clean disabled"),
+	}
+	condConflict = &R{
+		ErrCode:   proto.NewResponse_Err(proto.Response_OTHER),
+		ErrDetail: pb.String("only one of dir_rev, exists, sequential, expect, append, delta, link, session, and expires can be given"),
+	}
+	isProtected = &R{
+		ErrCode:   proto.NewResponse_Err(proto.Response_PROTECTED),
+		ErrDetail: pb.String("protected path: set force to override"),
+	}
+	isReserved = &R{
+		ErrCode:   proto.NewResponse_Err(proto.Response_RESERVED),
+		ErrDetail: pb.String("reserved path"),
+	}
 )
 
 
-func errResponse(e os.Error) *R {
+// The most bytes of mutations a BULK request proposes in one consensus
+// instance. Consensus messages must each fit in a UDP packet.
+const bulkLen = 2000
+
+
+func notReady(p Phase) *R {
 	return &R{
 		ErrCode:   proto.NewResponse_Err(proto.Response_OTHER),
-		ErrDetail: pb.String(e.String()),
+		ErrDetail: pb.String("not ready: " + p.String()),
+	}
+}
+
+
+// The response code for each store error code that has one. Errors of
+// any other code are sent as OTHER, with their text as the detail.
+var respCodes = map[store.Code]int32{
+	store.CodeTooLate:     proto.Response_TOO_LATE,
+	store.CodeRevMismatch: proto.Response_REV_MISMATCH,
+	store.CodeBadPath:     proto.Response_BAD_PATH,
+	store.CodeBadValue:    proto.Response_BAD_VALUE,
+	store.CodeNoEnt:       proto.Response_NOENT,
+	store.CodeIsDir:       proto.Response_ISDIR,
+	store.CodeNotDir:      proto.Response_NOTDIR,
+	store.CodeProtected:   proto.Response_PROTECTED,
+	store.CodeReserved:    proto.Response_RESERVED,
+	store.CodeOverLimit:   proto.Response_OVER_LIMIT,
+	store.CodeOverloaded:  proto.Response_OVERLOADED,
+	store.CodeNoSession:   proto.Response_NO_SESSION,
+}
+
+
+func errResponse(e os.Error) *R {
+	code, ok := respCodes[store.CodeOf(e)]
+	if !ok {
+		code = proto.Response_OTHER
+	}
+	detail := e.String()
+	if e, ok := e.(*store.BadPathError); ok {
+		detail = e.Path
+	}
+	return &R{
+		ErrCode:   proto.NewResponse_Err(code),
+		ErrDetail: pb.String(detail),
 	}
 }
 
@@ -64,14 +129,20 @@ func errResponse(e os.Error) *R {
 const (
 	Valid = 1 << iota
 	Done
-	Set
-	Del
+	Set = proto.EventSet
+	Del = proto.EventDel
+
+	Heartbeat = 1 << 4
 )
 
 
 var calGlob = store.MustCompileGlob("/ctl/cal/*")
 
 
+// Requests waiting for a future rev.
+var waits = expvar.NewInt("server.waits")
+
+
 type T proto.Request
 type R proto.Response
 
@@ -93,6 +164,51 @@ type Server struct {
 	Self string
 
 	Alpha int64
+
+	BodyLimit  Limit // bytes in a set request's body
+	WatchLimit Limit // open watches per connection
+
+	// Whether to accept BULK requests. Only an operator loading a
+	// dataset should turn this on.
+	AllowBulk bool
+
+	// Whether a CLEAN request may discard history. Without it, CLEAN
+	// only reports. Only for operators.
+	AllowClean bool
+
+	RateLimits []RateLimit // how often each file may be written
+	rl         rateLimiter
+
+	// If positive, the most bytes per second sent, all told, in
+	// snapshots, and in responses to walks and to the backfill of
+	// backfills whose request sets catch_up, as a peer catching up from
+	// this one does. Live changes on a watch are never slowed, nor are
+	// other clients' requests.
+	CatchUpRate float64
+	cu          throttle
+
+	// Files that can't be deleted, or set without regard to their rev,
+	// unless the request sets force. A guard against careless cleanup.
+	Protect []*store.Glob
+
+	// If positive, a del moves the file to TrashDir, and it is deleted
+	// from there after this many ns. Dels with dir_rev or exists, and
+	// of files under /ctl or TrashDir, are made outright.
+	Trash int64
+
+	// If set, a peer without a CAL slot relays sets and dels through
+	// Fwd rather than redirecting the client.
+	Fwd *client.Client
+	fwd chan bool // one per write being relayed
+
+	// When to refuse requests because this peer is overloaded, and
+	// which to refuse first.
+	Shed ShedPolicy
+	sd   shedder
+
+	ph phase
+
+	sh shared // live watches, one store watch per glob
 }
 
 
@@ -116,6 +232,13 @@ func (s *Server) accept(l net.Listener, ch chan net.Conn) {
 
 
 func (s *Server) Serve(l net.Listener, cal chan bool) {
+	s.fwd = make(chan bool, forwardLen)
+	if s.Shed.enabled() {
+		done := make(chan bool)
+		defer close(done)
+		go s.measureLoad(done)
+	}
+
 	var w bool
 	conns := make(chan net.Conn)
 	go s.accept(l, conns)
@@ -132,10 +255,10 @@ func (s *Server) Serve(l net.Listener, cal chan bool) {
 				cal:  w,
 				tx:   make(map[int32]txn),
 			}
-			go func() {
+			gocount.Go("server.conn", func() {
 				c.serve()
 				rw.Close()
-			}()
+			})
 		case <-cal:
 			cal = nil
 			w = true
@@ -171,24 +294,149 @@ func (sv *Server) AdvanceUntil(done chan int) {
 }
 
 
-func bgSet(p consensus.Proposer, k string, v []byte, c int64) chan store.Event {
+// If d is not nil, the set is conditioned on the rev of k's parent
+// directory. If e is not nil, it is conditioned on whether k exists.
+func bgSet(p consensus.Proposer, k string, v []byte, c int64, d *int64, e *bool) chan store.Event {
+	ch := make(chan store.Event)
+	go func() {
+		if d != nil {
+			ch <- consensus.SetInDir(p, *d, k, v, c)
+		} else if e != nil {
+			ch <- consensus.SetIf(p, *e, k, v, c)
+		} else {
+			ch <- consensus.Set(p, k, v, c)
+		}
+	}()
+	return ch
+}
+
+
+func bgSetSequential(p consensus.Proposer, prefix string, v []byte) chan store.Event {
+	ch := make(chan store.Event)
+	go func() {
+		ch <- consensus.SetSequential(p, prefix, v)
+	}()
+	return ch
+}
+
+
+func bgSetIfBody(p consensus.Proposer, x []byte, k string, v []byte, c int64) chan store.Event {
+	ch := make(chan store.Event)
+	go func() {
+		ch <- consensus.SetIfBody(p, x, k, v, c)
+	}()
+	return ch
+}
+
+
+func bgAppend(p consensus.Proposer, k string, v []byte, c, max int64) chan store.Event {
 	ch := make(chan store.Event)
 	go func() {
-		ch <- consensus.Set(p, k, v, c)
+		if max > 0 {
+			ch <- consensus.AppendMax(p, k, v, c, max)
+		} else {
+			ch <- consensus.Append(p, k, v, c)
+		}
 	}()
 	return ch
 }
 
 
-func bgDel(p consensus.Proposer, k string, c int64) chan store.Event {
+func bgSetEphemeral(p consensus.Proposer, k string, v []byte, c int64, s string) chan store.Event {
 	ch := make(chan store.Event)
 	go func() {
-		ch <- consensus.Del(p, k, c)
+		ch <- consensus.SetEphemeral(p, k, v, c, s)
 	}()
 	return ch
 }
 
 
+func bgSetExpiring(p consensus.Proposer, k string, v []byte, c, w int64) chan store.Event {
+	ch := make(chan store.Event)
+	go func() {
+		ch <- consensus.SetExpiring(p, k, v, c, w)
+	}()
+	return ch
+}
+
+
+func bgLink(p consensus.Proposer, k string, v []byte, c int64) chan store.Event {
+	ch := make(chan store.Event)
+	go func() {
+		ch <- consensus.Link(p, k, string(v), c)
+	}()
+	return ch
+}
+
+
+func bgAdd(p consensus.Proposer, k string, d, c int64) chan store.Event {
+	ch := make(chan store.Event)
+	go func() {
+		ch <- consensus.Add(p, k, d, c)
+	}()
+	return ch
+}
+
+
+// Returns how many of the conditions that can't be combined t gives.
+func nconds(t *T) (n int) {
+	if t.DirRev != nil {
+		n++
+	}
+	if t.Exists != nil {
+		n++
+	}
+	if pb.GetBool(t.Sequential) {
+		n++
+	}
+	if t.Expect != nil {
+		n++
+	}
+	if pb.GetBool(t.Append) {
+		n++
+	}
+	if t.Delta != nil {
+		n++
+	}
+	if pb.GetBool(t.Link) {
+		n++
+	}
+	if t.Session != nil {
+		n++
+	}
+	if t.Expires != nil {
+		n++
+	}
+	return n
+}
+
+
+func bgDel(p consensus.Proposer, k string, c int64, d *int64, e *bool) chan store.Event {
+	ch := make(chan store.Event)
+	go func() {
+		if d != nil {
+			ch <- consensus.DelInDir(p, *d, k, c)
+		} else if e != nil {
+			ch <- consensus.DelIf(p, *e, k, c)
+		} else {
+			ch <- consensus.Del(p, k, c)
+		}
+	}()
+	return ch
+}
+
+
+// Returns a Proposer for the write in t, at the priority it asks for.
+// Clients can only lower their priority, to Bulk; High is kept for the
+// peers' own bookkeeping.
+func proposerFor(p consensus.Proposer, t *T) consensus.Proposer {
+	if pb.GetInt32(t.Priority) > 0 {
+		return consensus.WithPriority(p, consensus.Bulk)
+	}
+	return p
+}
+
+
 func bgNop(p consensus.Proposer) chan store.Event {
 	ch := make(chan store.Event)
 	go func() {
@@ -209,21 +457,29 @@ type conn struct {
 	tx       map[int32]txn
 	tl       sync.Mutex // tx lock
 	poisoned bool
+	nwatch   int64 // open watches; use sync/atomic
 }
 
 
 var ops = map[int32]func(*conn, *T, txn){
-	proto.Request_CANCEL:  (*conn).cancel,
-	proto.Request_CHECKIN: (*conn).checkin,
-	proto.Request_DEL:     (*conn).del,
-	proto.Request_GET:     (*conn).get,
-	proto.Request_GETDIR:  (*conn).getdir,
-	proto.Request_NOP:     (*conn).nop,
-	proto.Request_REV:     (*conn).rev,
-	proto.Request_SET:     (*conn).set,
-	proto.Request_STAT:    (*conn).stat,
-	proto.Request_WALK:    (*conn).walk,
-	proto.Request_WATCH:   (*conn).watch,
+	proto.Request_BACKFILL: (*conn).backfill,
+	proto.Request_BULK:     (*conn).bulk,
+	proto.Request_CANCEL:   (*conn).cancel,
+	proto.Request_CHECKIN:  (*conn).checkin,
+	proto.Request_CLEAN:    (*conn).clean,
+	proto.Request_DEL:      (*conn).del,
+	proto.Request_GET:      (*conn).get,
+	proto.Request_GETDIR:   (*conn).getdir,
+	proto.Request_IDS:      (*conn).ids,
+	proto.Request_LIMITS:   (*conn).limits,
+	proto.Request_NOP:      (*conn).nop,
+	proto.Request_PIN:      (*conn).pin,
+	proto.Request_REV:      (*conn).rev,
+	proto.Request_SET:      (*conn).set,
+	proto.Request_SNAPSHOT: (*conn).snapshot,
+	proto.Request_STAT:     (*conn).stat,
+	proto.Request_WALK:     (*conn).walk,
+	proto.Request_WATCH:    (*conn).watch,
 }
 
 
@@ -373,31 +629,58 @@ func (c *conn) redirect(t *T) {
 }
 
 
-func (c *conn) getterFor(t *T) store.Getter {
+// Calls f with the state as of t.Rev, or the current state if t.Rev is
+// not set. If the state at t.Rev isn't there yet, waits for it in the
+// background, and gives up if tx is cancelled, which happens when the
+// client cancels the request or disconnects.
+func (c *conn) getterFor(t *T, tx txn, f func(g store.Getter)) {
 	if t.Rev == nil {
 		_, g := c.s.St.Snap()
-		return g
+		f(g)
+		return
 	}
 
-	ch, err := c.s.St.Wait(*t.Rev)
+	w, err := store.NewWait(c.s.St, *t.Rev)
 	switch err {
-	default:
-		c.respond(t, Valid|Done, nil, errResponse(err))
-		return nil
+	case nil:
+		// nothing
 	case store.ErrTooLate:
 		c.respond(t, Valid|Done, nil, tooLate)
-		return nil
-	case nil:
-		return (<-ch).Getter
+		return
+	default:
+		c.respond(t, Valid|Done, nil, errResponse(err))
+		return
 	}
 
-	panic("unreachable")
+	waits.Add(1)
+	gocount.Go("server.wait", func() {
+		defer waits.Add(-1)
+		defer w.Stop()
+
+		select {
+		case ev := <-w.C:
+			if closed(w.C) || ev.Err == store.ErrClosed {
+				c.respond(t, Valid|Done, nil, errResponse(store.ErrClosed))
+				return
+			}
+			f(ev.Getter)
+		case <-tx.cancel:
+			c.closeTxn(*t.Tag)
+		}
+	})
 }
 
 
 func (c *conn) get(t *T, tx txn) {
-	if g := c.getterFor(t); g != nil {
-		v, rev := g.Get(pb.GetString(t.Path))
+	c.getterFor(t, tx, func(g store.Getter) {
+		path := pb.GetString(t.Path)
+		var v []string
+		var rev int64
+		if pb.GetBool(t.Follow) {
+			v, rev = store.Follow(g, path)
+		} else {
+			v, rev = g.Get(path)
+		}
 		if rev == store.Dir {
 			c.respond(t, Valid|Done, nil, isDir)
 			return
@@ -406,30 +689,135 @@ func (c *conn) get(t *T, tx txn) {
 		var r R
 		r.Rev = &rev
 		if len(v) == 1 { // not missing
+			if pb.GetBool(t.Follow) {
+				path, _ = store.Resolve(g, path)
+			}
 			r.Value = []byte(v[0])
+			// The tree keeps each file's sum; don't make one.
+			r.Sum = pb.Uint32(store.StatOf(g, path).Sum)
 		}
 		c.respond(t, Valid|Done, nil, &r)
+	})
+}
+
+
+// The most writes a peer without a CAL slot relays at once. Past that,
+// it redirects them, so a flood of writes can't make it buffer without
+// bound.
+const forwardLen = 64
+
+
+// Relays t through c.s.Fwd to a peer that can take writes, and sends
+// the client that peer's response, whatever it is. Redirects t instead
+// if there is no Fwd or too many writes are already being relayed.
+func (c *conn) forward(t *T, tx txn) {
+	if c.s.Fwd == nil {
+		c.redirect(t)
+		return
+	}
+
+	select {
+	case c.s.fwd <- true:
+	default:
+		c.redirect(t)
+		return
 	}
+
+	go func() {
+		defer func() { <-c.s.fwd }()
+
+		ft := *t // Relay overwrites the tag
+		r, err := c.s.Fwd.Relay((*client.T)(&ft))
+
+		select {
+		case <-tx.cancel:
+			c.closeTxn(*t.Tag)
+			return
+		default:
+		}
+
+		if err != nil {
+			c.respond(t, Valid|Done, nil, errResponse(err))
+			return
+		}
+		c.respond(t, Valid|Done, nil, (*R)(r))
+	}()
 }
 
 
 func (c *conn) set(t *T, tx txn) {
 	if !c.cal {
-		c.redirect(t)
+		c.forward(t, tx)
 		return
 	}
 
-	if t.Path == nil || t.Rev == nil {
+	seq := pb.GetBool(t.Sequential)
+	if t.Path == nil || t.Rev == nil && !seq {
 		c.respond(t, Valid|Done, nil, missingArg)
 		return
 	}
 
+	if nconds(t) > 1 {
+		c.respond(t, Valid|Done, nil, condConflict)
+		return
+	}
+
+	if c.shed(t, writeClass(t, *t.Path)) {
+		return
+	}
+
+	if p := c.s.Phase(); p != Serving {
+		c.respond(t, Valid|Done, nil, notReady(p))
+		return
+	}
+
+	// An append is also held to the hard limit by the body it leaves,
+	// which only the store knows as it applies the append.
+	if !c.s.BodyLimit.check("body", int64(len(t.Value))) {
+		c.respond(t, Valid|Done, nil, overLimit("body"))
+		return
+	}
+
+	if !seq && !pb.GetBool(t.Force) && needsForce(c.s.Protect, *t.Path, *t.Rev, false) {
+		c.respond(t, Valid|Done, nil, isProtected)
+		return
+	}
+
+	if !c.s.rl.allow(c.s.RateLimits, *t.Path) {
+		c.respond(t, Valid|Done, nil, overLimit("rate"))
+		return
+	}
+
+	if c.s.St.Reserved(*t.Path) {
+		c.respond(t, Valid|Done, nil, isReserved)
+		return
+	}
+
+	var evs chan store.Event
+	if seq {
+		evs = bgSetSequential(proposerFor(c.s.Mg, t), *t.Path, t.Value)
+	} else if t.Expect != nil {
+		evs = bgSetIfBody(proposerFor(c.s.Mg, t), t.Expect, *t.Path, t.Value, *t.Rev)
+	} else if pb.GetBool(t.Append) {
+		evs = bgAppend(proposerFor(c.s.Mg, t), *t.Path, t.Value, *t.Rev, c.s.BodyLimit.Hard)
+	} else if t.Delta != nil {
+		evs = bgAdd(proposerFor(c.s.Mg, t), *t.Path, *t.Delta, *t.Rev)
+	} else if pb.GetBool(t.Link) {
+		evs = bgLink(proposerFor(c.s.Mg, t), *t.Path, t.Value, *t.Rev)
+	} else if t.Session != nil {
+		evs = bgSetEphemeral(proposerFor(c.s.Mg, t), *t.Path, t.Value, *t.Rev, *t.Session)
+	} else if t.Expires != nil {
+		evs = bgSetExpiring(proposerFor(c.s.Mg, t), *t.Path, t.Value, *t.Rev, *t.Expires)
+	} else {
+		evs = bgSet(proposerFor(c.s.Mg, t), *t.Path, t.Value, *t.Rev, t.DirRev, t.Exists)
+	}
+
 	go func() {
 		select {
 		case <-tx.cancel:
 			c.closeTxn(*t.Tag)
 			return
-		case ev := <-bgSet(c.s.Mg, *t.Path, t.Value, *t.Rev):
+		case ev := <-evs:
 			switch e := ev.Err.(type) {
 			case *store.BadPathError:
 				c.respond(t, Valid|Done, nil, &R{ErrCode: badPath, ErrDetail: &e.Path})
@@ -443,8 +831,22 @@ func (c *conn) set(t *T, tx txn) {
 			case store.ErrRevMismatch:
 				c.respond(t, Valid|Done, nil, revMismatch)
 				return
+			case os.ENOENT:
+				c.respond(t, Valid|Done, nil, noEnt)
+				return
+			case store.ErrBodyLimit:
+				hardHits.Add("body", 1)
+				c.respond(t, Valid|Done, nil, overLimit("body"))
+				return
 			case nil:
-				c.respond(t, Valid|Done, nil, &R{Rev: &ev.Seqn})
+				r := &R{Rev: &ev.Seqn}
+				if seq {
+					r.Path = &ev.Path
+				}
+				if t.Delta != nil {
+					r.Value = []byte(ev.Body)
+				}
+				c.respond(t, Valid|Done, nil, r)
 				return
 			}
 		}
@@ -454,23 +856,148 @@ func (c *conn) set(t *T, tx txn) {
 }
 
 
-func (c *conn) del(t *T, tx txn) {
+// Writes many files with as few consensus instances as will hold them.
+// Watches see one event per instance rather than one per file; see
+// store.EncodeBulk.
+func (c *conn) bulk(t *T, tx txn) {
 	if !c.cal {
 		c.redirect(t)
 		return
 	}
 
+	if !c.s.AllowBulk {
+		c.respond(t, Valid|Done, nil, bulkDisabled)
+		return
+	}
+
+	if len(t.Writes) == 0 {
+		c.respond(t, Valid|Done, nil, missingArg)
+		return
+	}
+
+	if c.shed(t, ShedBulk) {
+		return
+	}
+
+	if p := c.s.Phase(); p != Serving {
+		c.respond(t, Valid|Done, nil, notReady(p))
+		return
+	}
+
+	muts := make([]string, len(t.Writes))
+	for i, w := range t.Writes {
+		if w.Path == nil || w.Rev == nil {
+			c.respond(t, Valid|Done, nil, missingArg)
+			return
+		}
+
+		if !c.s.BodyLimit.check("body", int64(len(w.Value))) {
+			c.respond(t, Valid|Done, nil, overLimit("body"))
+			return
+		}
+
+		if c.s.St.Reserved(*w.Path) {
+			c.respond(t, Valid|Done, nil, isReserved)
+			return
+		}
+
+		if !pb.GetBool(t.Force) && needsForce(c.s.Protect, *w.Path, *w.Rev, false) {
+			c.respond(t, Valid|Done, nil, isProtected)
+			return
+		}
+
+		m, err := store.EncodeSet(*w.Path, string(w.Value), *w.Rev)
+		if e, ok := err.(*store.BadPathError); ok {
+			c.respond(t, Valid|Done, nil, &R{ErrCode: badPath, ErrDetail: &e.Path})
+			return
+		}
+		muts[i] = m
+	}
+
+	go func() {
+		var seqn int64
+		for _, m := range store.PackBulk(muts, bulkLen) {
+			select {
+			case <-tx.cancel:
+				c.closeTxn(*t.Tag)
+				return
+			default:
+			}
+
+			ev := consensus.ProposeAt(c.s.Mg, []byte(m), consensus.Bulk)
+			switch ev.Err {
+			case nil:
+				seqn = ev.Seqn
+			case store.ErrRevMismatch:
+				c.respond(t, Valid|Done, nil, revMismatch)
+				return
+			default:
+				c.respond(t, Valid|Done, nil, errResponse(ev.Err))
+				return
+			}
+		}
+		c.respond(t, Valid|Done, nil, &R{Rev: &seqn})
+	}()
+}
+
+
+func (c *conn) del(t *T, tx txn) {
+	if !c.cal {
+		c.forward(t, tx)
+		return
+	}
+
 	if t.Path == nil || t.Rev == nil {
 		c.respond(t, Valid|Done, nil, missingArg)
 		return
 	}
 
+	if t.DirRev != nil && t.Exists != nil {
+		c.respond(t, Valid|Done, nil, condConflict)
+		return
+	}
+
+	if c.shed(t, writeClass(t, *t.Path)) {
+		return
+	}
+
+	if p := c.s.Phase(); p != Serving {
+		c.respond(t, Valid|Done, nil, notReady(p))
+		return
+	}
+
+	if !pb.GetBool(t.Force) && needsForce(c.s.Protect, *t.Path, *t.Rev, true) {
+		c.respond(t, Valid|Done, nil, isProtected)
+		return
+	}
+
+	if !c.s.rl.allow(c.s.RateLimits, *t.Path) {
+		c.respond(t, Valid|Done, nil, overLimit("rate"))
+		return
+	}
+
+	if c.s.St.Reserved(*t.Path) {
+		c.respond(t, Valid|Done, nil, isReserved)
+		return
+	}
+
+	var evs chan store.Event
+	if c.s.Trash > 0 && t.DirRev == nil && t.Exists == nil && trashable(*t.Path) {
+		evs = c.s.bgTrash(proposerFor(c.s.Mg, t), *t.Path, *t.Rev)
+	} else {
+		evs = bgDel(proposerFor(c.s.Mg, t), *t.Path, *t.Rev, t.DirRev, t.Exists)
+	}
+
 	go func() {
 		select {
 		case <-tx.cancel:
 			c.closeTxn(*t.Tag)
 			return
-		case ev := <-bgDel(c.s.Mg, *t.Path, *t.Rev):
+		case ev := <-evs:
+			if ev.Err == os.ENOENT {
+				c.respond(t, Valid|Done, nil, noEnt)
+				return
+			}
 			if ev.Err != nil {
 				c.respond(t, Valid|Done, nil, errResponse(ev.Err))
 				return
@@ -487,6 +1014,11 @@ func (c *conn) nop(t *T, tx txn) {
 		return
 	}
 
+	if p := c.s.Phase(); p != Serving {
+		c.respond(t, Valid|Done, nil, notReady(p))
+		return
+	}
+
 	go func() {
 		select {
 		case <-tx.cancel:
@@ -506,6 +1038,36 @@ func (c *conn) rev(t *T, tx txn) {
 }
 
 
+// Keeps the state at t.Rev, or the current state if t.Rev is not set,
+// on this server until the request is cancelled or the connection
+// closes, so that reads at that rev can't fail with TOO_LATE meanwhile.
+func (c *conn) pin(t *T, tx txn) {
+	rev := pb.GetInt64(t.Rev)
+	if t.Rev == nil {
+		rev = <-c.s.St.Seqns
+	}
+
+	p, err := c.s.St.Pin(rev)
+	switch err {
+	case nil:
+		// nothing
+	case store.ErrTooLate:
+		c.respond(t, Valid|Done, nil, tooLate)
+		return
+	default:
+		c.respond(t, Valid|Done, nil, errResponse(err))
+		return
+	}
+
+	c.respond(t, Valid, tx.cancel, &R{Rev: &rev})
+	gocount.Go("server.pin", func() {
+		defer p.Release()
+		<-tx.cancel
+		c.closeTxn(*t.Tag)
+	})
+}
+
+
 func (c *conn) checkin(t *T, tx txn) {
 	if !c.cal {
 		c.redirect(t)
@@ -517,6 +1079,11 @@ func (c *conn) checkin(t *T, tx txn) {
 		return
 	}
 
+	if p := c.s.Phase(); p != Serving {
+		c.respond(t, Valid|Done, nil, notReady(p))
+		return
+	}
+
 	go func() {
 		deadline := time.Nanoseconds() + sessionLease
 		body := strconv.Itoa64(deadline)
@@ -533,7 +1100,7 @@ func (c *conn) checkin(t *T, tx txn) {
 		case <-tx.cancel:
 			c.closeTxn(*t.Tag)
 			return
-		case ev := <-bgSet(c.s.Mg, path, []byte(body), rev):
+		case ev := <-bgSet(c.s.Mg, path, []byte(body), rev, nil, nil):
 			switch {
 			case ev.Err == store.ErrRevMismatch:
 				c.respond(t, Valid|Done, nil, revMismatch)
@@ -560,60 +1127,144 @@ func (c *conn) checkin(t *T, tx txn) {
 
 
 func (c *conn) stat(t *T, tx txn) {
-	if g := c.getterFor(t); g != nil {
-		ln, rev := g.Stat(pb.GetString(t.Path))
-		c.respond(t, Valid|Done, nil, &R{Len: &ln, Rev: &rev})
-	}
+	c.getterFor(t, tx, func(g store.Getter) {
+		path := pb.GetString(t.Path)
+		si := store.StatOf(g, path)
+		r := &R{Len: &si.Len, Rev: &si.Rev}
+		if si.Rev == store.Dir {
+			r.DirRev = pb.Int64(si.Modified)
+		}
+		if si.Created > 0 {
+			r.Created = &si.Created
+		}
+		if si.Rev > store.Missing {
+			r.Sum = &si.Sum
+		}
+		if _, ok := store.Readlink(g, path); ok {
+			r.Link = pb.Bool(true)
+		}
+		if si.Rev == store.Missing {
+			// A delete after the rev asked for says nothing of it.
+			d := c.s.St.Deleted(path)
+			if d > 0 && (t.Rev == nil || d <= *t.Rev) {
+				r.Deleted = &d
+			}
+		}
+		c.respond(t, Valid|Done, nil, r)
+	})
 }
 
 
 func (c *conn) getdir(t *T, tx txn) {
 	path := pb.GetString(t.Path)
 
-	if g := c.getterFor(t); g != nil {
+	c.getterFor(t, tx, func(g store.Getter) {
 		go func() {
-			ents, rev := g.Get(path)
-
-			if rev == store.Missing {
-				c.respond(t, Valid|Done, nil, noEnt)
-				return
-			}
-
-			if rev != store.Dir {
-				c.respond(t, Valid|Done, nil, notDir)
-				return
-			}
-
 			offset := int(pb.GetInt32(t.Offset))
 			limit := int(pb.GetInt32(t.Limit))
 
-			if limit <= 0 {
-				limit = len(ents)
-			}
-
 			if offset < 0 {
 				offset = 0
 			}
 
-			end := offset + limit
-			if end > len(ents) {
-				end = len(ents)
-			}
+			// Entries are sent straight from the tree, so listing a
+			// big directory doesn't first copy out all its names.
+			i, cancelled := 0, false
+			rev := store.VisitDir(g, path, func(e string) bool {
+				if limit > 0 && i >= offset+limit {
+					return true
+				}
+				i++
+				if i <= offset {
+					return false
+				}
 
-			for _, e := range ents[offset:end] {
 				select {
 				case <-tx.cancel:
-					c.closeTxn(*t.Tag)
-					return
+					cancelled = true
+					return true
 				default:
 				}
 
 				c.respond(t, Valid, tx.cancel, &R{Path: &e})
-			}
+				return false
+			})
 
-			c.respond(t, Done, nil, &R{})
+			switch {
+			case rev == store.Missing:
+				c.respond(t, Valid|Done, nil, noEnt)
+			case rev != store.Dir:
+				c.respond(t, Valid|Done, nil, notDir)
+			case cancelled:
+				c.closeTxn(*t.Tag)
+			default:
+				c.respond(t, Done, nil, &R{})
+			}
 		}()
+	})
+}
+
+
+// Reports the limits that apply to c, and how much of each c has used,
+// as a sequence of responses each naming one quantity in Path, with its
+// decimal value in Value. If t.Path is set, also reports the rate limit
+// on writes to that file, if any.
+func (c *conn) limits(t *T, tx txn) {
+	report := func(name string, v string) {
+		c.respond(t, Valid, nil, &R{Path: &name, Value: []byte(v)})
+	}
+	num := func(name string, n int64) {
+		report(name, strconv.Itoa64(n))
+	}
+
+	num("body-soft", c.s.BodyLimit.Soft)
+	num("body-hard", c.s.BodyLimit.Hard)
+	num("watch-soft", c.s.WatchLimit.Soft)
+	num("watch-hard", c.s.WatchLimit.Hard)
+	num("watches", atomic.AddInt64(&c.nwatch, 0))
+	if c.s.AllowBulk {
+		num("bulk", 1)
+	} else {
+		num("bulk", 0)
+	}
+	num("shed", int64(c.s.nshed()))
+
+	if t.Path != nil {
+		l, tokens := c.s.rl.peek(c.s.RateLimits, *t.Path)
+		if l != nil {
+			report("rate", strconv.Ftoa64(l.Rate, 'g', -1))
+			report("burst", strconv.Ftoa64(l.Burst, 'g', -1))
+			report("tokens", strconv.Ftoa64(tokens, 'g', -1))
+		}
+	}
+
+	c.respond(t, Done, nil, &R{})
+}
+
+
+// Discards this peer's history at and before t.Rev, if given, as the
+// periodic cleaner does, then reports the history it holds as a
+// sequence of responses in the manner of limits.
+func (c *conn) clean(t *T, tx txn) {
+	if rev := pb.GetInt64(t.Rev); rev > 0 {
+		if !c.s.AllowClean {
+			c.respond(t, Valid|Done, nil, cleanDisabled)
+			return
+		}
+		c.s.St.Clean(rev)
 	}
+
+	num := func(name string, n int64) {
+		c.respond(t, Valid, nil, &R{Path: &name, Value: []byte(strconv.Itoa64(n))})
+	}
+
+	cs := c.s.St.CleanStats()
+	num("head", cs.Head)
+	num("events", cs.Events)
+	num("bytes", cs.Bytes)
+	num("dead", cs.Dead)
+	num("last-clean", cs.LastClean)
+	c.respond(t, Done, nil, &R{})
 }
 
 
@@ -647,111 +1298,298 @@ func (c *conn) cancel(t *T, tx txn) {
 }
 
 
+// Compiles pat to match paths in s.St: ignoring case, as Glob.Fold
+// does, if the store folds case.
+func (s *Server) compileGlob(pat string) (*store.Glob, os.Error) {
+	g, err := store.CompileGlob(pat)
+	if err == nil && s.St.FoldsCase() {
+		g = g.Fold()
+	}
+	return g, err
+}
+
+
 func (c *conn) watch(t *T, tx txn) {
 	pat := pb.GetString(t.Path)
-	glob, err := store.CompileGlob(pat)
+	glob, err := c.s.compileGlob(pat)
 	if err != nil {
 		c.respond(t, Valid|Done, nil, errResponse(err))
 		return
 	}
 
-	var w *store.Watch
+	f, err := parseFilter(pb.GetString(t.Filter))
+	if err != nil {
+		c.respond(t, Valid|Done, nil, errResponse(err))
+		return
+	}
+
+	if c.shed(t, ShedWatches) {
+		return
+	}
+
+	if !c.addWatch() {
+		c.respond(t, Valid|Done, nil, overLimit("watches"))
+		return
+	}
+
+	var ch <-chan store.Event
+	var stop func()
 	rev := pb.GetInt64(t.Rev)
 	if rev == 0 {
-		w, err = store.NewWatch(c.s.St, glob), nil
+		sub := c.s.sh.watch(c.s.St, glob)
+		ch, stop = sub.C, sub.Stop
 	} else {
-		w, err = store.NewWatchFrom(c.s.St, glob, rev)
+		w, err := store.NewWatchFrom(c.s.St, glob, rev)
+		switch err {
+		case nil:
+			// nothing
+		case store.ErrTooLate:
+			atomic.AddInt64(&c.nwatch, -1)
+			c.respond(t, Valid|Done, nil, tooLate)
+			return
+		default:
+			atomic.AddInt64(&c.nwatch, -1)
+			c.respond(t, Valid|Done, nil, errResponse(err))
+			return
+		}
+		ch, stop = w.C, w.Stop
 	}
 
-	switch err {
-	case nil:
-		// nothing
-	case store.ErrTooLate:
-		c.respond(t, Valid|Done, nil, tooLate)
-	default:
-		c.respond(t, Valid|Done, nil, errResponse(err))
+	if n := pb.GetInt64(t.Sample); n > 0 && !pb.GetBool(t.Mut) {
+		ch, stop = sample(ch, glob, n, stop)
 	}
 
-	go func() {
-		defer w.Stop()
+	gocount.Go("server.watch", func() {
+		c.stream(t, tx, glob, f, ch, stop)
+	})
+}
 
-		// TODO buffer (and possibly discard) events
-		for {
-			select {
-			case ev := <-w.C:
-				if closed(w.C) {
-					return
-				}
 
-				r := R{
-					Path:  &ev.Path,
-					Value: []byte(ev.Body),
-					Rev:   &ev.Seqn,
-				}
+func (c *conn) backfill(t *T, tx txn) {
+	pat := pb.GetString(t.Path)
+	glob, err := c.s.compileGlob(pat)
+	if err != nil {
+		c.respond(t, Valid|Done, nil, errResponse(err))
+		return
+	}
 
-				var flag int32
-				switch {
-				case ev.IsSet():
-					flag = Set
-				case ev.IsDel():
-					flag = Del
-				}
+	f, err := parseFilter(pb.GetString(t.Filter))
+	if err != nil {
+		c.respond(t, Valid|Done, nil, errResponse(err))
+		return
+	}
 
-				c.respond(t, Valid|flag, tx.cancel, &r)
+	if c.shed(t, ShedWatches) {
+		return
+	}
 
+	if !c.addWatch() {
+		c.respond(t, Valid|Done, nil, overLimit("watches"))
+		return
+	}
+
+	// The watch picks up exactly where the snapshot leaves off, even
+	// if mutations are applied in between.
+	ver, g := c.s.St.Snap()
+	w, err := store.NewWatchFrom(c.s.St, glob, ver+1)
+	if err != nil {
+		atomic.AddInt64(&c.nwatch, -1)
+		c.respond(t, Valid|Done, nil, errResponse(err))
+		return
+	}
+
+	gocount.Go("server.watch", func() {
+		stopped := store.Walk(g, glob, func(path, body string, rev int64) bool {
+			select {
 			case <-tx.cancel:
 				c.closeTxn(*t.Tag)
+				return true
+			default:
+			}
+
+			if f != nil && !f(body) {
+				return false
+			}
+
+			var r R
+			r.Path = &path
+			r.Value = []byte(body)
+			r.Rev = &rev
+			c.throttle(t, len(path)+len(body))
+			c.respond(t, Valid|Set, tx.cancel, &r)
+			return false
+		})
+		if stopped {
+			atomic.AddInt64(&c.nwatch, -1)
+			w.Stop()
+			return
+		}
+
+		c.respond(t, Valid, tx.cancel, &R{Rev: &ver})
+		c.stream(t, tx, glob, f, w.C, w.Stop)
+	})
+}
+
+
+// TODO enforce read access on watch and backfill registration, and
+// re-check open watches when access changes, ending any that are no
+// longer allowed with a distinct event. There are no ACLs to check
+// against yet; this is the single place both verbs pass through.
+//
+// Counts a new watch against c's limit. Returns false, without counting
+// it, if c already has as many as it may.
+func (c *conn) addWatch() bool {
+	n := atomic.AddInt64(&c.nwatch, 1)
+	if !c.s.WatchLimit.check("watches", n) {
+		atomic.AddInt64(&c.nwatch, -1)
+		return false
+	}
+	return true
+}
+
+
+// Sends a response for each event on ch, from a store watch or a shared
+// one, until the store closes or the transaction is cancelled, and then
+// calls stop. Releases the watch counted by addWatch. Each write of a
+// bulk event that matches glob goes out as its own response, so clients
+// still see every file that changed. If f is not nil, sets whose body f
+// rejects are not sent; dels always are. If t sets mut, each event goes
+// out whole instead, as the mutation that made it, unfiltered, for a
+// peer to apply to its own store.
+func (c *conn) stream(t *T, tx txn, glob *store.Glob, f filter, ch <-chan store.Event, stop func()) {
+	defer atomic.AddInt64(&c.nwatch, -1)
+	defer stop()
+
+	// If t asks for heartbeats, each tick with nothing sent since the
+	// last one sends the current rev, marked as a heartbeat. Otherwise
+	// beat stays nil and never fires.
+	var beat <-chan int64
+	if n := pb.GetInt64(t.Heartbeat); n > 0 {
+		tick := time.NewTicker(floorInterval(n))
+		defer tick.Stop()
+		beat = tick.C
+	}
+	idle := true
+
+	// TODO buffer (and possibly discard) events
+	for {
+		select {
+		case ev := <-ch:
+			if closed(ch) || ev.Err == store.ErrClosed {
 				return
 			}
+
+			if pb.GetBool(t.Mut) {
+				r := R{Path: &ev.Path, Rev: &ev.Seqn, Mut: []byte(ev.Mut)}
+				c.respond(t, Valid, tx.cancel, &r)
+				idle = false
+				continue
+			}
+
+			for _, ev := range store.Writes(glob, ev) {
+				if f != nil && ev.IsSet() && !f(ev.Body) {
+					continue
+				}
+
+				e := proto.NewEvent(ev)
+				r := R{Path: e.Path, Value: e.Body, Rev: e.Seqn}
+				if ev.IsSet() {
+					r.Sum = pb.Uint32(ev.Sum())
+				}
+				c.respond(t, Valid|*e.Flags, tx.cancel, &r)
+				idle = false
+			}
+
+		case <-beat:
+			if idle {
+				ver, _ := c.s.St.Snap()
+				c.respond(t, Valid|Heartbeat, tx.cancel, &R{Rev: &ver})
+			}
+			idle = true
+
+		case <-tx.cancel:
+			c.closeTxn(*t.Tag)
+			return
 		}
-	}()
+	}
+}
+
+
+// Waits, if t is a catch-up transfer, until n more bytes of it may be
+// sent. See Server.CatchUpRate. Only walks, and the walk that starts a
+// backfill, are throttled: store events reach every watch through one
+// queue, so a stream that waited here would hold up all the others.
+func (c *conn) throttle(t *T, n int) {
+	if pb.GetBool(t.CatchUp) {
+		c.s.cu.wait(c.s.CatchUpRate, n)
+	}
+}
+
+
+// Returns the response that ends a chunk of a chunked walk, whose files
+// were summed into h.
+func chunkSum(h hash.Hash) *R {
+	return &R{Value: []byte(fmt.Sprintf("%x", h.Sum()))}
 }
 
 
 func (c *conn) walk(t *T, tx txn) {
 	pat := pb.GetString(t.Path)
-	glob, err := store.CompileGlob(pat)
+	glob, err := c.s.compileGlob(pat)
 	if err != nil {
 		c.respond(t, Valid|Done, nil, errResponse(err))
 		return
 	}
 
-	offset := pb.GetInt32(t.Offset)
+	offset := int(pb.GetInt32(t.Offset))
 
-	var limit int32 = math.MaxInt32
+	limit := -1
 	if t.Limit != nil {
-		limit = pb.GetInt32(t.Limit)
+		limit = int(pb.GetInt32(t.Limit))
+		if limit < 0 {
+			limit = 0
+		}
 	}
 
-	if g := c.getterFor(t); g != nil {
+	chunk := pb.GetInt32(t.Chunk)
+
+	c.getterFor(t, tx, func(g store.Getter) {
 		go func() {
+			h, n := sha1.New(), int32(0)
+			var cancelled bool
 			f := func(path, body string, rev int64) (stop bool) {
 				select {
 				case <-tx.cancel:
 					c.closeTxn(*t.Tag)
+					cancelled = true
 					return true
 				default:
 				}
 
-				if offset <= 0 && limit > 0 {
-					var r R
-					r.Path = &path
-					r.Value = []byte(body)
-					r.Rev = &rev
-					c.respond(t, Valid|Set, tx.cancel, &r)
-
-					limit--
+				var r R
+				r.Path = &path
+				r.Value = []byte(body)
+				r.Rev = &rev
+				c.throttle(t, len(path)+len(body))
+				c.respond(t, Valid|Set, tx.cancel, &r)
+
+				if chunk > 0 {
+					proto.SumFile(h, path, r.Value, rev)
+					if n++; n == chunk {
+						c.respond(t, Valid, tx.cancel, chunkSum(h))
+						h, n = sha1.New(), 0
+					}
 				}
-
-				offset--
 				return false
 			}
 
-			stopped := store.Walk(g, glob, f)
+			store.WalkPage(g, glob, offset, limit, f)
 
-			if !stopped {
+			if !cancelled && chunk > 0 {
+				c.respond(t, Valid|Done, nil, chunkSum(h))
+			} else if !cancelled {
 				c.respond(t, Done, nil, &R{})
 			}
 		}()
-	}
+	})
 }
@@ -2,9 +2,13 @@ package server
 
 import (
 	"bytes"
+	"doozer/gocount"
+	"doozer/store"
+	"encoding/binary"
 	"github.com/bmizerany/assert"
 	"goprotobuf.googlecode.com/hg/proto"
 	"testing"
+	"time"
 )
 
 
@@ -111,3 +115,777 @@ func TestServerCancel(t *testing.T) {
 	}
 	assert.Equal(t, exp, mustUnmarshal(b[4:]))
 }
+
+
+func TestSetNotReady(t *testing.T) {
+	c := &conn{
+		c:   &bytes.Buffer{},
+		s:   &Server{},
+		cal: true,
+		tx:  make(map[int32]txn),
+	}
+	c.s.SetPhase(CatchingUp)
+	c.set(&T{Tag: proto.Int32(1), Path: proto.String("/x"), Rev: proto.Int64(0)}, newTxn())
+	exp := notReady(CatchingUp)
+	exp.Tag = proto.Int32(1)
+	exp.Flags = proto.Int32(Valid | Done)
+	assertResponse(t, exp, c)
+}
+
+
+func TestPhaseString(t *testing.T) {
+	assert.Equal(t, "serving", Serving.String())
+	assert.Equal(t, "unknown", Phase(99).String())
+}
+
+
+func TestSetOverBodyLimit(t *testing.T) {
+	c := &conn{
+		c:   &bytes.Buffer{},
+		s:   &Server{BodyLimit: Limit{Soft: 1, Hard: 2}},
+		cal: true,
+		tx:  make(map[int32]txn),
+	}
+	c.s.SetPhase(Serving)
+	c.set(&T{Tag: proto.Int32(1), Path: proto.String("/x"), Rev: proto.Int64(0), Value: []byte("abc")}, newTxn())
+	exp := overLimit("body")
+	exp.Tag = proto.Int32(1)
+	exp.Flags = proto.Int32(Valid | Done)
+	assertResponse(t, exp, c)
+}
+
+
+func TestWatchOverLimit(t *testing.T) {
+	c := &conn{
+		c:      &bytes.Buffer{},
+		s:      &Server{WatchLimit: Limit{Hard: 1}},
+		tx:     make(map[int32]txn),
+		nwatch: 1,
+	}
+	c.watch(&T{Tag: proto.Int32(1), Path: proto.String("/**")}, newTxn())
+	exp := overLimit("watches")
+	exp.Tag = proto.Int32(1)
+	exp.Flags = proto.Int32(Valid | Done)
+	assertResponse(t, exp, c)
+	assert.Equal(t, int64(1), c.nwatch)
+}
+
+
+func TestLimitCheck(t *testing.T) {
+	assert.T(t, Limit{}.check("test", 1e9))
+	assert.T(t, Limit{Soft: 1, Hard: 2}.check("test", 2))
+	assert.T(t, !Limit{Soft: 1, Hard: 2}.check("test", 3))
+	assert.T(t, Limit{Soft: 1}.check("test", 3))
+}
+
+
+func TestGetWaitCancelled(t *testing.T) {
+	st := store.New()
+	defer st.Close()
+
+	c := &conn{
+		c:  &bytes.Buffer{},
+		s:  &Server{St: st},
+		tx: make(map[int32]txn),
+	}
+	tx := newTxn()
+	c.tx[1] = tx
+
+	c.get(&T{Tag: proto.Int32(1), Path: proto.String("/x"), Rev: proto.Int64(5)}, tx)
+	assert.Equal(t, 1, <-st.Watches)
+
+	// As on disconnect, via cancelAll.
+	c.cancelAll()
+	<-tx.done
+	assert.T(t, gocount.Settle("server.wait", 0, 1e9))
+	assert.Equal(t, 0, c.c.(*bytes.Buffer).Len())
+}
+
+
+func TestErrResponse(t *testing.T) {
+	r := errResponse(store.ErrTooLate)
+	assert.Equal(t, tooLate.ErrCode, r.ErrCode)
+	assert.Equal(t, "too late", proto.GetString(r.ErrDetail))
+
+	r = errResponse(&store.BadPathError{"x"})
+	assert.Equal(t, badPath, r.ErrCode)
+	assert.Equal(t, "x", proto.GetString(r.ErrDetail))
+
+	r = errResponse(store.ErrBodyMismatch)
+	assert.Equal(t, readonly.ErrCode, r.ErrCode)
+	assert.Equal(t, "body mismatch", proto.GetString(r.ErrDetail))
+
+	r = errResponse(ErrProtected)
+	assert.Equal(t, isProtected.ErrCode, r.ErrCode)
+
+	r = errResponse(&laterError{store.CodeOverloaded, "overloaded: shedding writes"})
+	assert.Equal(t, overloaded(ShedWrites).ErrCode, r.ErrCode)
+}
+
+
+func TestStatSum(t *testing.T) {
+	st := store.New()
+	defer st.Close()
+	st.Ops <- store.Op{1, store.MustEncodeSet("/x", "abc", store.Clobber)}
+	<-mustWait(st, 1)
+
+	c := &conn{
+		c:  &bytes.Buffer{},
+		s:  &Server{St: st},
+		tx: make(map[int32]txn),
+	}
+	c.stat(&T{Tag: proto.Int32(1), Path: proto.String("/x")}, newTxn())
+
+	exp := &R{
+		Tag:     proto.Int32(1),
+		Flags:   proto.Int32(Valid | Done),
+		Rev:     proto.Int64(1),
+		Len:     proto.Int32(3),
+		Created: proto.Int64(1),
+		Sum:     proto.Uint32(0x352441c2),
+	}
+	assertResponse(t, exp, c)
+}
+
+
+func TestRateLimit(t *testing.T) {
+	defer func(f func() int64) { now = f }(now)
+	var clock int64
+	now = func() int64 { return clock }
+
+	var rl rateLimiter
+	ls := []RateLimit{{store.MustCompileGlob("/x/*"), 1, 2}}
+
+	assert.T(t, rl.allow(ls, "/x/a"))
+	assert.T(t, rl.allow(ls, "/x/a"))
+	assert.T(t, !rl.allow(ls, "/x/a"))
+	assert.T(t, rl.allow(ls, "/x/b"))
+	assert.T(t, rl.allow(ls, "/y"))
+
+	clock += 1e9
+	assert.T(t, rl.allow(ls, "/x/a"))
+	assert.T(t, !rl.allow(ls, "/x/a"))
+}
+
+
+func TestRateLimitPrune(t *testing.T) {
+	defer func(f func() int64) { now = f }(now)
+	var clock int64
+	now = func() int64 { return clock }
+
+	var rl rateLimiter
+	ls := []RateLimit{{store.MustCompileGlob("/**"), 1, 1}}
+	rl.allow(ls, "/a")
+	clock += 2e9
+	rl.prune(ls, clock)
+	assert.Equal(t, 0, len(rl.buckets))
+}
+
+
+func TestParseRateLimits(t *testing.T) {
+	ls, err := ParseRateLimits("/x/*=10,/y/**=0.5/3")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 2, len(ls))
+	assert.Equal(t, "/x/*", ls[0].Glob.Pattern)
+	assert.Equal(t, 10.0, ls[0].Rate)
+	assert.Equal(t, 10.0, ls[0].Burst)
+	assert.Equal(t, 0.5, ls[1].Rate)
+	assert.Equal(t, 3.0, ls[1].Burst)
+
+	_, err = ParseRateLimits("/x")
+	assert.NotEqual(t, nil, err)
+}
+
+
+func TestSetOverRateLimit(t *testing.T) {
+	c := &conn{
+		c:   &bytes.Buffer{},
+		s:   &Server{RateLimits: []RateLimit{{store.MustCompileGlob("/x"), 0, 0}}},
+		cal: true,
+		tx:  make(map[int32]txn),
+	}
+	c.s.SetPhase(Serving)
+	c.s.rl.buckets = map[string]*bucket{"/x": &bucket{0, now()}}
+	c.set(&T{Tag: proto.Int32(1), Path: proto.String("/x"), Rev: proto.Int64(0)}, newTxn())
+	exp := overLimit("rate")
+	exp.Tag = proto.Int32(1)
+	exp.Flags = proto.Int32(Valid | Done)
+	assertResponse(t, exp, c)
+}
+
+
+func TestIdsOverRateLimit(t *testing.T) {
+	c := &conn{
+		c:   &bytes.Buffer{},
+		s:   &Server{RateLimits: []RateLimit{{store.MustCompileGlob(IdsDir + "/x"), 0, 0}}},
+		cal: true,
+		tx:  make(map[int32]txn),
+	}
+	c.s.SetPhase(Serving)
+	c.s.rl.buckets = map[string]*bucket{IdsDir + "/x": &bucket{0, now()}}
+	c.ids(&T{Tag: proto.Int32(1), Path: proto.String("x")}, newTxn())
+	exp := overLimit("rate")
+	exp.Tag = proto.Int32(1)
+	exp.Flags = proto.Int32(Valid | Done)
+	assertResponse(t, exp, c)
+}
+
+
+func TestIdsShed(t *testing.T) {
+	c := &conn{
+		c:   &bytes.Buffer{},
+		s:   &Server{},
+		cal: true,
+		tx:  make(map[int32]txn),
+	}
+	c.s.SetPhase(Serving)
+	c.s.setShed(3, Overload{})
+	c.ids(&T{Tag: proto.Int32(1), Path: proto.String("x")}, newTxn())
+	exp := overloaded(ShedWrites)
+	exp.Tag = proto.Int32(1)
+	exp.Flags = proto.Int32(Valid | Done)
+	assertResponse(t, exp, c)
+}
+
+func TestLimits(t *testing.T) {
+	var buf bytes.Buffer
+	c := &conn{
+		c: &buf,
+		s: &Server{
+			BodyLimit:  Limit{Soft: 1, Hard: 2},
+			RateLimits: []RateLimit{{store.MustCompileGlob("/x"), 1, 3}},
+		},
+		tx:     make(map[int32]txn),
+		nwatch: 2,
+	}
+	c.limits(&T{Tag: proto.Int32(1), Path: proto.String("/x")}, newTxn())
+
+	got := make(map[string]string)
+	for b := buf.Bytes(); len(b) > 4; {
+		n := int(binary.BigEndian.Uint32(b))
+		r := mustUnmarshal(b[4 : 4+n])
+		b = b[4+n:]
+		if r.Path != nil {
+			got[*r.Path] = string(r.Value)
+		}
+	}
+
+	assert.Equal(t, "2", got["body-hard"])
+	assert.Equal(t, "2", got["watches"])
+	assert.Equal(t, "0", got["bulk"])
+	assert.Equal(t, "0", got["shed"])
+	assert.Equal(t, "3", got["tokens"])
+}
+
+
+func TestParseFilter(t *testing.T) {
+	f, err := parseFilter("")
+	assert.Equal(t, nil, err)
+	assert.T(t, f == nil)
+
+	f, err = parseFilter("prefix:ab")
+	assert.Equal(t, nil, err)
+	assert.T(t, f("abc"))
+	assert.T(t, !f("xabc"))
+
+	f, err = parseFilter("re:^a+$")
+	assert.Equal(t, nil, err)
+	assert.T(t, f("aaa"))
+	assert.T(t, !f("aab"))
+
+	f, err = parseFilter("json:state=up")
+	assert.Equal(t, nil, err)
+	assert.T(t, f(`{"state":"up"}`))
+	assert.T(t, !f(`{"state":"down"}`))
+	assert.T(t, !f("up"))
+
+	f, err = parseFilter("json:n=3")
+	assert.Equal(t, nil, err)
+	assert.T(t, f(`{"n":3}`))
+
+	_, err = parseFilter("glob:*")
+	assert.NotEqual(t, nil, err)
+	_, err = parseFilter("re:(")
+	assert.NotEqual(t, nil, err)
+}
+
+
+func TestThrottle(t *testing.T) {
+	defer func(f func() int64) { now = f }(now)
+	now = func() int64 { return 5e9 }
+
+	var th throttle
+	th.wait(100, 60)
+	assert.Equal(t, float64(40), th.b.tokens)
+
+	th.wait(0, 1000)
+	assert.Equal(t, float64(40), th.b.tokens)
+}
+
+
+func TestParseProtect(t *testing.T) {
+	gs, err := ParseProtect("/ctl/**,/lock/*")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 2, len(gs))
+	assert.Equal(t, "/lock/*", gs[1].Pattern)
+
+	gs, err = ParseProtect("")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 0, len(gs))
+}
+
+
+func TestParseReserve(t *testing.T) {
+	ps, err := ParseReserve("/ops,/app/sys")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, []string{"/ops", "/app/sys"}, ps)
+
+	_, err = ParseReserve("/ops,app")
+	assert.Equal(t, &store.BadPathError{"app"}, err)
+}
+
+
+func TestNeedsForce(t *testing.T) {
+	gs := []*store.Glob{store.MustCompileGlob("/lock/*")}
+	assert.T(t, needsForce(gs, "/lock/a", 5, true))
+	assert.T(t, needsForce(gs, "/lock/a", store.Clobber, false))
+	assert.T(t, !needsForce(gs, "/lock/a", 5, false))
+	assert.T(t, !needsForce(gs, "/x", store.Clobber, true))
+}
+
+
+func TestDelProtected(t *testing.T) {
+	c := &conn{
+		c:   &bytes.Buffer{},
+		s:   &Server{Protect: []*store.Glob{store.MustCompileGlob("/lock/*")}},
+		cal: true,
+		tx:  make(map[int32]txn),
+	}
+	c.s.SetPhase(Serving)
+	c.del(&T{Tag: proto.Int32(1), Path: proto.String("/lock/a"), Rev: proto.Int64(3)}, newTxn())
+	assertResponse(t, isProtected, c)
+}
+
+
+func TestSetReserved(t *testing.T) {
+	st := store.New()
+	defer st.Close()
+	st.Reserve("/ops")
+	c := &conn{
+		c:   &bytes.Buffer{},
+		s:   &Server{St: st},
+		cal: true,
+		tx:  make(map[int32]txn),
+	}
+	c.s.SetPhase(Serving)
+	c.set(&T{Tag: proto.Int32(1), Path: proto.String("/ops/a"), Rev: proto.Int64(0)}, newTxn())
+	assertResponse(t, isReserved, c)
+}
+
+
+func TestTrashMut(t *testing.T) {
+	st := store.New()
+	defer st.Close()
+	st.Ops <- store.Op{1, store.MustEncodeSet("/x", "a", store.Clobber)}
+	<-mustWait(st, 1)
+	_, g := st.Snap()
+
+	m, moved, err := trashMut(g, "/x", store.Clobber)
+	assert.Equal(t, nil, err)
+	assert.T(t, moved)
+	exp, _ := store.EncodeTxn(
+		[]store.SetOp{{"/trash/x", "a", store.Clobber}},
+		[]store.DelOp{{"/x", 1}},
+	)
+	assert.Equal(t, exp, m)
+
+	_, _, err = trashMut(g, "/x", 0)
+	assert.Equal(t, store.ErrRevMismatch, err)
+
+	m, moved, err = trashMut(g, "/y", 0)
+	assert.Equal(t, nil, err)
+	assert.T(t, !moved)
+	assert.Equal(t, store.MustEncodeDel("/y", 0), m)
+}
+
+
+func TestTrashable(t *testing.T) {
+	assert.T(t, trashable("/x"))
+	assert.T(t, trashable("/ctlx"))
+	assert.T(t, !trashable("/ctl/sess/a"))
+	assert.T(t, !trashable("/trash/x"))
+}
+
+
+func mustWait(st *store.Store, seqn int64) <-chan store.Event {
+	ch, err := st.Wait(seqn)
+	if err != nil {
+		panic(err)
+	}
+	return ch
+}
+
+
+func TestDatagram(t *testing.T) {
+	ev := store.Event{Seqn: 5, Path: "/x", Body: "a", Rev: 5}
+	b := datagram(3, 5, []store.Event{ev})
+
+	var prev, seqn int64
+	var n int32
+	r := bytes.NewBuffer(b)
+	binary.Read(r, binary.BigEndian, &prev)
+	binary.Read(r, binary.BigEndian, &seqn)
+	binary.Read(r, binary.BigEndian, &n)
+	assert.Equal(t, int64(3), prev)
+	assert.Equal(t, int64(5), seqn)
+	assert.Equal(t, int32(1), n)
+	assert.NotEqual(t, 0, r.Len())
+
+	big := store.Event{Seqn: 6, Path: "/x", Body: string(make([]byte, packetSize)), Rev: 6}
+	assert.Equal(t, 20, len(datagram(5, 6, []store.Event{big})))
+}
+
+
+func TestSharedWatch(t *testing.T) {
+	st := store.New()
+	defer st.Close()
+	glob := store.MustCompileGlob("/x/*")
+
+	var sh shared
+	a := sh.watch(st, glob)
+	b := sh.watch(st, glob)
+	assert.Equal(t, 1, len(sh.m))
+	assert.Equal(t, 2, len(sh.m["/x/*"].subs))
+
+	st.Ops <- store.Op{1, store.MustEncodeSet("/y", "a", store.Clobber)}
+	st.Ops <- store.Op{2, store.MustEncodeSet("/x/y", "b", store.Clobber)}
+	assert.Equal(t, "/x/y", (<-a.C).Path)
+	assert.Equal(t, "/x/y", (<-b.C).Path)
+
+	a.Stop()
+	assert.Equal(t, 1, len(sh.m["/x/*"].subs))
+	b.Stop()
+	assert.Equal(t, 0, len(sh.m))
+}
+
+
+func TestSharedWatchExpands(t *testing.T) {
+	st := store.New()
+	defer st.Close()
+
+	var sh shared
+	s := sh.watch(st, store.MustCompileGlob("/x/*"))
+	defer s.Stop()
+
+	m := store.EncodeBulk([]string{
+		store.MustEncodeSet("/y", "a", store.Clobber),
+		store.MustEncodeSet("/x/z", "b", store.Clobber),
+	})
+	st.Ops <- store.Op{1, m}
+	ev := <-s.C
+	assert.Equal(t, "/x/z", ev.Path)
+	assert.Equal(t, "b", ev.Body)
+}
+
+
+func TestSharedWatchClose(t *testing.T) {
+	st := store.New()
+	var sh shared
+	s := sh.watch(st, store.MustCompileGlob("/x/*"))
+	st.Close()
+
+	<-s.C
+	assert.T(t, closed(s.C))
+	s.Stop()
+	assert.Equal(t, 0, len(sh.m))
+}
+
+
+func newTestSampler(interval int64) *sampler {
+	return &sampler{
+		out:      make(chan store.Event, 10),
+		quit:     make(chan bool),
+		interval: interval,
+		last:     make(map[string]int64),
+		held:     make(map[string]store.Event),
+	}
+}
+
+
+func TestSamplerOffer(t *testing.T) {
+	s := newTestSampler(10)
+	assert.T(t, s.offer(store.Event{Seqn: 1, Path: "/x", Body: "a"}, 100))
+	assert.T(t, s.offer(store.Event{Seqn: 2, Path: "/x", Body: "b"}, 101))
+	assert.T(t, s.offer(store.Event{Seqn: 3, Path: "/x", Body: "c"}, 102))
+	assert.T(t, s.offer(store.Event{Seqn: 4, Path: "/y", Body: "d"}, 103))
+
+	assert.Equal(t, "a", (<-s.out).Body)
+	assert.Equal(t, "d", (<-s.out).Body)
+	assert.Equal(t, 0, len(s.out))
+
+	assert.T(t, s.flush(105))
+	assert.Equal(t, 0, len(s.out))
+
+	assert.T(t, s.flush(110))
+	ev := <-s.out
+	assert.Equal(t, int64(3), ev.Seqn)
+	assert.Equal(t, 0, len(s.held))
+}
+
+
+func TestSamplerFlushOrder(t *testing.T) {
+	s := newTestSampler(10)
+	s.offer(store.Event{Seqn: 1, Path: "/x"}, 100)
+	s.offer(store.Event{Seqn: 2, Path: "/y"}, 100)
+	s.offer(store.Event{Seqn: 4, Path: "/x"}, 101)
+	s.offer(store.Event{Seqn: 3, Path: "/y"}, 101)
+	<-s.out
+	<-s.out
+
+	s.flush(110)
+	assert.Equal(t, int64(3), (<-s.out).Seqn)
+	assert.Equal(t, int64(4), (<-s.out).Seqn)
+}
+
+
+func TestSamplerForgets(t *testing.T) {
+	s := newTestSampler(10)
+	s.offer(store.Event{Seqn: 1, Path: "/x"}, 100)
+	s.flush(110)
+	assert.Equal(t, 0, len(s.last))
+}
+
+
+func TestFloorInterval(t *testing.T) {
+	assert.Equal(t, int64(minInterval), floorInterval(1))
+	assert.Equal(t, int64(minInterval), floorInterval(minInterval))
+	assert.Equal(t, int64(5e9), floorInterval(5e9))
+}
+
+
+func TestSample(t *testing.T) {
+	st := store.New()
+	defer st.Close()
+	w := store.NewWatch(st, store.Any)
+	ch, stop := sample(w.C, store.MustCompileGlob("/x"), 1e6, w.Stop)
+	defer stop()
+
+	st.Ops <- store.Op{1, store.MustEncodeSet("/y", "a", store.Clobber)}
+	st.Ops <- store.Op{2, store.MustEncodeSet("/x", "b", store.Clobber)}
+	st.Ops <- store.Op{3, store.MustEncodeSet("/x", "c", store.Clobber)}
+	assert.Equal(t, "b", (<-ch).Body)
+	assert.Equal(t, "c", (<-ch).Body)
+}
+
+
+func TestStreamHeartbeat(t *testing.T) {
+	st := store.New()
+	defer st.Close()
+	st.Ops <- store.Op{1, store.MustEncodeSet("/x", "a", store.Clobber)}
+	<-mustWait(st, 1)
+
+	c := &conn{
+		c:  &bytes.Buffer{},
+		s:  &Server{St: st},
+		tx: make(map[int32]txn),
+	}
+	tx := newTxn()
+	c.tx[1] = tx
+	c.nwatch = 1
+
+	ch := make(chan store.Event) // never sends: the watch is idle
+	tr := &T{Tag: proto.Int32(1), Path: proto.String("/**"), Heartbeat: proto.Int64(minInterval)}
+	go c.stream(tr, tx, store.Any, nil, ch, func() {})
+	time.Sleep(3 * minInterval)
+	tx.cancel <- true
+	<-tx.done
+
+	exp := &R{
+		Tag:   proto.Int32(1),
+		Flags: proto.Int32(Valid | Heartbeat),
+		Rev:   proto.Int64(1),
+	}
+	assertResponse(t, exp, c)
+}
+
+
+func TestShedPolicyLevel(t *testing.T) {
+	p := ShedPolicy{
+		Watches: Overload{Backlog: 10},
+		Bulk:    Overload{Heap: 100},
+		Writes:  Overload{Backlog: 30, Heap: 300},
+	}
+	assert.T(t, p.enabled())
+	assert.T(t, !ShedPolicy{}.enabled())
+
+	assert.Equal(t, 0, p.level(Overload{10, 100}))
+	assert.Equal(t, 1, p.level(Overload{11, 0}))
+	assert.Equal(t, 2, p.level(Overload{0, 101}))
+	assert.Equal(t, 3, p.level(Overload{31, 0}))
+	assert.Equal(t, 3, p.level(Overload{0, 301}))
+}
+
+
+func TestParseShedPolicy(t *testing.T) {
+	p, err := ParseShedPolicy("100,,400", "1000")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, ShedPolicy{
+		Watches: Overload{100, 1000},
+		Writes:  Overload{Backlog: 400},
+	}, p)
+
+	p, err = ParseShedPolicy("", "")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, ShedPolicy{}, p)
+
+	_, err = ParseShedPolicy("1,2,3,4", "")
+	assert.NotEqual(t, nil, err)
+	_, err = ParseShedPolicy("", "x")
+	assert.NotEqual(t, nil, err)
+}
+
+
+func TestShed(t *testing.T) {
+	st := store.New()
+	defer st.Close()
+
+	c := &conn{
+		c:   &bytes.Buffer{},
+		s:   &Server{St: st},
+		cal: true,
+		tx:  make(map[int32]txn),
+	}
+	c.s.SetPhase(Serving)
+	c.s.setShed(2, Overload{})
+	assert.T(t, c.s.shedding(ShedWatches))
+	assert.T(t, c.s.shedding(ShedBulk))
+	assert.T(t, !c.s.shedding(ShedWrites))
+
+	c.watch(&T{Tag: proto.Int32(1), Path: proto.String("/**")}, newTxn())
+	exp := overloaded(ShedWatches)
+	exp.Tag = proto.Int32(1)
+	exp.Flags = proto.Int32(Valid | Done)
+	assertResponse(t, exp, c)
+	assert.Equal(t, int64(0), c.nwatch)
+
+	assert.Equal(t, ShedBulk, writeClass(&T{Priority: proto.Int32(1)}, "/x"))
+	assert.Equal(t, ShedWrites, writeClass(&T{}, "/x"))
+	assert.Equal(t, ShedClass(-1), writeClass(&T{}, "/lock/x"))
+	assert.Equal(t, ShedClass(-1), writeClass(&T{}, "/ctl/sess/x"))
+}
+
+
+// Reads every response c has written, in order.
+func responses(c *conn) (rs []*R) {
+	buf := c.c.(*bytes.Buffer)
+	for buf.Len() > 0 {
+		var n int32
+		binary.Read(buf, binary.BigEndian, &n)
+		rs = append(rs, mustUnmarshal(buf.Next(int(n))))
+	}
+	return rs
+}
+
+
+func TestSnapshot(t *testing.T) {
+	st := store.New()
+	defer st.Close()
+	mkdir, _ := store.EncodeMkdir("/e", store.Missing)
+	st.Ops <- store.Op{1, store.MustEncodeSet("/x", "a", store.Clobber)}
+	st.Ops <- store.Op{2, mkdir}
+	<-mustWait(st, 2)
+
+	c := &conn{
+		c:  &bytes.Buffer{},
+		s:  &Server{St: st},
+		tx: make(map[int32]txn),
+	}
+	tx := newTxn()
+	c.tx[1] = tx
+	c.snapshot(&T{Tag: proto.Int32(1)}, tx)
+	<-tx.done
+
+	rs := responses(c)
+	assert.Equal(t, 2, len(rs))
+	assert.Equal(t, int32(Valid), proto.GetInt32(rs[0].Flags))
+	assert.Equal(t, int32(Valid|Done), proto.GetInt32(rs[1].Flags))
+	assert.Equal(t, int64(2), proto.GetInt64(rs[1].Rev))
+
+	st2 := store.New()
+	defer st2.Close()
+	err := st2.LoadSnapshot(bytes.NewBuffer(rs[0].Value))
+	assert.Equal(t, nil, err)
+	_, g := st.Snap()
+	_, g2 := st2.Snap()
+	assert.Equal(t, g, g2)
+}
+
+
+func TestStreamMut(t *testing.T) {
+	st := store.New()
+	defer st.Close()
+	mkdir, _ := store.EncodeMkdir("/e", store.Missing)
+	st.Ops <- store.Op{1, mkdir}
+	ev := <-mustWait(st, 1)
+
+	c := &conn{
+		c:  &bytes.Buffer{},
+		s:  &Server{St: st},
+		tx: make(map[int32]txn),
+	}
+	tx := newTxn()
+	c.tx[1] = tx
+	c.nwatch = 1
+
+	ch := make(chan store.Event, 1)
+	ch <- ev
+	tr := &T{Tag: proto.Int32(1), Path: proto.String("/**"), Mut: proto.Bool(true)}
+	go c.stream(tr, tx, store.Any, nil, ch, func() {})
+	time.Sleep(20e6)
+	tx.cancel <- true
+	<-tx.done
+
+	exp := &R{
+		Tag:   proto.Int32(1),
+		Flags: proto.Int32(Valid),
+		Path:  proto.String("/e"),
+		Rev:   proto.Int64(1),
+		Mut:   []byte(mkdir),
+	}
+	assertResponse(t, exp, c)
+}
+
+
+func TestStreamNotThrottled(t *testing.T) {
+	st := store.New()
+	defer st.Close()
+	st.Ops <- store.Op{1, store.MustEncodeSet("/x", "0123456789", store.Clobber)}
+	ev := <-mustWait(st, 1)
+
+	c := &conn{
+		c:  &bytes.Buffer{},
+		s:  &Server{St: st, CatchUpRate: 1},
+		tx: make(map[int32]txn),
+	}
+	tx := newTxn()
+	c.tx[1] = tx
+	c.nwatch = 1
+
+	ch := make(chan store.Event, 1)
+	ch <- ev
+	tr := &T{Tag: proto.Int32(1), Path: proto.String("/**"), CatchUp: proto.Bool(true)}
+	go c.stream(tr, tx, store.Any, nil, ch, func() {})
+	time.Sleep(20e6)
+	tx.cancel <- true
+	<-tx.done
+
+	exp := &R{
+		Tag:   proto.Int32(1),
+		Flags: proto.Int32(Valid | Set),
+		Path:  proto.String("/x"),
+		Value: []byte("0123456789"),
+		Rev:   proto.Int64(1),
+		Sum:   proto.Uint32(store.BodySum("0123456789")),
+	}
+	assertResponse(t, exp, c)
+}
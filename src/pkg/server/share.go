@@ -0,0 +1,157 @@
+package server
+
+import (
+	"doozer/gocount"
+	"doozer/store"
+	"expvar"
+	"sync"
+)
+
+
+var sharedWatches = expvar.NewInt("server.shared_watches")
+
+
+// Live watches of the same glob share one store watch, so that when
+// thousands of clients watch one glob, the store matches and sends each
+// event once, and it is expanded and matched against the glob once,
+// rather than once per client. A relay goroutine then hands each
+// matching write to every subscriber in turn, waiting for each as the
+// store would for its own watch, so a slow subscriber holds up the
+// others on its glob just as it would hold up the store.
+//
+// Only watches from the current rev share; one from a past rev gets a
+// store watch of its own.
+type shared struct {
+	lk sync.Mutex
+	m  map[string]*relay // by glob pattern
+}
+
+
+type relay struct {
+	w    *store.Watch
+	quit chan bool // closed when the last subscriber leaves
+	subs []*sub    // replaced, never changed in place; guarded by shared.lk
+}
+
+
+// One client's watch on a relay.
+type sub struct {
+	C    <-chan store.Event
+	c    chan store.Event
+	from int64     // the first seqn this subscriber sees
+	stop chan bool // closed by Stop
+	once sync.Once
+
+	leave func()
+}
+
+
+// Returns a subscription to the writes matching glob from now on, as
+// stream sends them, sharing a store watch with any other subscription
+// to the same glob.
+func (sh *shared) watch(st *store.Store, glob *store.Glob) *sub {
+	ver, _ := st.Snap()
+	c := make(chan store.Event)
+	s := &sub{C: c, c: c, from: ver + 1, stop: make(chan bool)}
+
+	sh.lk.Lock()
+	defer sh.lk.Unlock()
+
+	if sh.m == nil {
+		sh.m = make(map[string]*relay)
+	}
+	key := glob.Pattern
+	r := sh.m[key]
+	if r == nil {
+		r = &relay{w: store.NewWatch(st, glob), quit: make(chan bool)}
+		sh.m[key] = r
+		sharedWatches.Add(1)
+		gocount.Go("server.relay", func() { sh.run(key, glob, r) })
+	}
+	subs := make([]*sub, len(r.subs), len(r.subs)+1)
+	copy(subs, r.subs)
+	r.subs = append(subs, s)
+	s.leave = func() { sh.leave(key, r, s) }
+	return s
+}
+
+
+// Ends the subscription. Writes already taken from s.C are unaffected;
+// no more will be sent.
+func (s *sub) Stop() {
+	s.once.Do(func() {
+		close(s.stop)
+		s.leave()
+	})
+}
+
+
+func (sh *shared) leave(key string, r *relay, s *sub) {
+	sh.lk.Lock()
+	defer sh.lk.Unlock()
+
+	var subs []*sub
+	for _, t := range r.subs {
+		if t != s {
+			subs = append(subs, t)
+		}
+	}
+	r.subs = subs
+
+	if len(subs) == 0 && sh.m[key] == r {
+		sh.m[key] = nil, false
+		sharedWatches.Add(-1)
+		r.w.Stop()
+		close(r.quit)
+	}
+}
+
+
+func (sh *shared) run(key string, glob *store.Glob, r *relay) {
+	for {
+		var ev store.Event
+		select {
+		case ev = <-r.w.C:
+		case <-r.quit:
+			return
+		}
+		if closed(r.w.C) || ev.Err == store.ErrClosed {
+			break
+		}
+
+		sh.lk.Lock()
+		subs := r.subs
+		sh.lk.Unlock()
+
+		for _, e := range store.Writes(glob, ev) {
+			for _, s := range subs {
+				if ev.Seqn >= s.from {
+					s.send(e)
+				}
+			}
+		}
+	}
+
+	// The store is closed. Later watches of this glob get a relay of
+	// their own, which ends at once.
+	sh.lk.Lock()
+	if sh.m[key] == r {
+		sh.m[key] = nil, false
+		sharedWatches.Add(-1)
+	}
+	subs := r.subs
+	r.subs = nil
+	sh.lk.Unlock()
+
+	for _, s := range subs {
+		close(s.c)
+	}
+}
+
+
+func (s *sub) send(e store.Event) {
+	select {
+	case s.c <- e:
+	case <-s.stop:
+	}
+}
@@ -0,0 +1,240 @@
+package server
+
+import (
+	"doozer/proto"
+	"doozer/store"
+	"expvar"
+	"log"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	pb "goprotobuf.googlecode.com/hg/proto"
+)
+
+
+// The classes of request a peer refuses when it is overloaded, in the
+// order it starts refusing them. Reads, checkins, and writes to the
+// cluster's own coordination files (see coordGlobs) are never refused.
+// See ShedPolicy.
+type ShedClass int
+
+const (
+	ShedWatches ShedClass = iota // new WATCH and BACKFILL requests
+	ShedBulk                     // BULK, and writes at bulk priority
+	ShedWrites                   // other client writes
+	nShedClasses
+)
+
+
+var shedNames = []string{
+	ShedWatches: "watches",
+	ShedBulk:    "bulk",
+	ShedWrites:  "writes",
+}
+
+
+func (c ShedClass) String() string {
+	if c < 0 || int(c) >= len(shedNames) {
+		return "unknown"
+	}
+	return shedNames[c]
+}
+
+
+// Measures of load past which a class of request is shed. Zero means no
+// limit.
+type Overload struct {
+	Backlog int64  // mutations the store can't apply yet; see store.Store.Backlog
+	Heap    uint64 // bytes of heap in use
+}
+
+
+// A ShedPolicy says when an overloaded peer starts refusing requests,
+// so that it sheds the cheapest work first instead of slowing down
+// everything alike until it falls over. Once load is past the Overload
+// for a class, that class is refused, and so is every class before it:
+// past Writes, watches and bulk writes are refused too, whatever their
+// own limits are. A zero ShedPolicy sheds nothing.
+type ShedPolicy struct {
+	Watches, Bulk, Writes Overload
+}
+
+
+// How often, in ns, a server measures its load.
+const shedInterval = 1e8 // ns == 100ms
+
+
+// Files that hold the cluster's sessions, membership, and locks. Shedding
+// writes to them would make an overload worse, by letting sessions and
+// locks lapse.
+var coordGlobs = []*store.Glob{
+	store.MustCompileGlob("/ctl/**"),
+	store.MustCompileGlob("/lock/**"),
+}
+
+
+var (
+	shedHits  = expvar.NewMap("server.shed")     // requests refused, by class
+	shedLevel = expvar.NewInt("server.shedding") // classes being shed now
+)
+
+
+type shedder struct {
+	lk sync.RWMutex
+	n  int // classes being shed now
+}
+
+
+// Returns how many classes p sheds under load o: the number up to and
+// including the last class whose limits o is past.
+func (p ShedPolicy) level(o Overload) int {
+	for i, l := range [...]Overload{p.Writes, p.Bulk, p.Watches} {
+		if l.Backlog > 0 && o.Backlog > l.Backlog || l.Heap > 0 && o.Heap > l.Heap {
+			return int(nShedClasses) - i
+		}
+	}
+	return 0
+}
+
+
+func (p ShedPolicy) enabled() bool {
+	for _, l := range [...]Overload{p.Watches, p.Bulk, p.Writes} {
+		if l.Backlog > 0 || l.Heap > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+
+// Measures the load on sv every shedInterval ns, until done is closed,
+// and sheds what sv.Shed says to.
+func (sv *Server) measureLoad(done chan bool) {
+	tick := time.NewTicker(shedInterval)
+	defer tick.Stop()
+
+	for {
+		select {
+		case <-tick.C:
+			o := Overload{int64(sv.St.Backlog()), runtime.MemStats.Alloc}
+			sv.setShed(sv.Shed.level(o), o)
+		case <-done:
+			return
+		}
+	}
+}
+
+
+func (sv *Server) setShed(n int, o Overload) {
+	sv.sd.lk.Lock()
+	was := sv.sd.n
+	sv.sd.n = n
+	sv.sd.lk.Unlock()
+
+	if n != was {
+		shedLevel.Set(int64(n))
+		log.Printf("shedding %d of %d request classes (backlog %d, heap %d bytes)", n, nShedClasses, o.Backlog, o.Heap)
+	}
+}
+
+
+// Returns how many classes of request sv is shedding now.
+func (sv *Server) nshed() int {
+	sv.sd.lk.RLock()
+	defer sv.sd.lk.RUnlock()
+	return sv.sd.n
+}
+
+
+// Reports whether sv is shedding requests of class c.
+func (sv *Server) shedding(c ShedClass) bool {
+	return int(c) < sv.nshed()
+}
+
+
+// Returns the class of a write to path at the priority t asks for:
+// ShedBulk or ShedWrites, or -1 if it is never shed.
+func writeClass(t *T, path string) ShedClass {
+	if pb.GetInt32(t.Priority) > 0 {
+		return ShedBulk
+	}
+	for _, g := range coordGlobs {
+		if g.Match(path) {
+			return -1
+		}
+	}
+	return ShedWrites
+}
+
+
+// Refuses t, and reports true, if c's server is shedding class cl.
+func (c *conn) shed(t *T, cl ShedClass) bool {
+	if cl < 0 || !c.s.shedding(cl) {
+		return false
+	}
+	shedHits.Add(cl.String(), 1)
+	c.respond(t, Valid|Done, nil, overloaded(cl))
+	return true
+}
+
+
+func overloaded(cl ShedClass) *R {
+	return &R{
+		ErrCode:   proto.NewResponse_Err(proto.Response_OVERLOADED),
+		ErrDetail: pb.String("overloaded: shedding " + cl.String()),
+	}
+}
+
+
+// Parses a ShedPolicy from two comma-separated lists, one of backlogs
+// and one of heap sizes in bytes, each giving the limits for watches,
+// bulk writes, and other writes, in that order. Missing or empty
+// entries are zero: "100,,400" sheds watches past a backlog of 100, and
+// everything it can past 400.
+func ParseShedPolicy(backlog, heap string) (p ShedPolicy, err os.Error) {
+	ls := []*Overload{&p.Watches, &p.Bulk, &p.Writes}
+
+	bs, err := parseShedList(backlog, len(ls))
+	if err != nil {
+		return p, err
+	}
+	hs, err := parseShedList(heap, len(ls))
+	if err != nil {
+		return p, err
+	}
+
+	for i, l := range ls {
+		l.Backlog, l.Heap = bs[i], uint64(hs[i])
+	}
+	return p, nil
+}
+
+
+func parseShedList(s string, n int) ([]int64, os.Error) {
+	xs := make([]int64, n)
+	if s == "" {
+		return xs, nil
+	}
+
+	parts := strings.Split(s, ",", -1)
+	if len(parts) > n {
+		return nil, os.NewError("too many shed limits: " + s)
+	}
+	for i, part := range parts {
+		if part == "" {
+			continue
+		}
+		x, err := strconv.Atoi64(part)
+		if err != nil {
+			return nil, err
+		}
+		if x < 0 {
+			return nil, os.NewError("bad shed limit: " + part)
+		}
+		xs[i] = x
+	}
+	return xs, nil
+}
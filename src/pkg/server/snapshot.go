@@ -0,0 +1,85 @@
+package server
+
+import (
+	"os"
+)
+
+
+// How many bytes of a snapshot go in each response.
+const snapChunk = 32 * 1024
+
+
+var errCancelled = os.NewError("cancelled")
+
+
+// Sends the store as one snapshot, written by store.Store.WriteSnapshot,
+// in pieces of up to snapChunk bytes, each the Value of a response. The
+// done response carries the snapshot's rev. A joining peer loads it with
+// store.Store.LoadSnapshot, which, unlike copying a walk, keeps empty
+// directories and links. Snapshots are catch-up transfers, throttled as
+// Server.CatchUpRate says.
+func (c *conn) snapshot(t *T, tx txn) {
+	go func() {
+		w := &snapWriter{c: c, t: t, tx: tx}
+		ver, err := c.s.St.WriteSnapshot(w)
+		if err == nil {
+			err = w.flush()
+		}
+
+		switch err {
+		case nil:
+			c.respond(t, Valid|Done, nil, &R{Rev: &ver})
+		case errCancelled:
+			c.closeTxn(*t.Tag)
+		default:
+			c.respond(t, Valid|Done, nil, errResponse(err))
+		}
+	}()
+}
+
+
+// Buffers a snapshot into responses of snapChunk bytes.
+type snapWriter struct {
+	c   *conn
+	t   *T
+	tx  txn
+	buf []byte
+}
+
+
+func (w *snapWriter) Write(p []byte) (int, os.Error) {
+	n := len(p)
+	for len(p) > 0 {
+		m := snapChunk - len(w.buf)
+		if m > len(p) {
+			m = len(p)
+		}
+		w.buf = append(w.buf, p[:m]...)
+		p = p[m:]
+
+		if len(w.buf) == snapChunk {
+			if err := w.flush(); err != nil {
+				return n - len(p), err
+			}
+		}
+	}
+	return n, nil
+}
+
+
+func (w *snapWriter) flush() os.Error {
+	select {
+	case <-w.tx.cancel:
+		return errCancelled
+	default:
+	}
+
+	if len(w.buf) == 0 {
+		return nil
+	}
+
+	w.c.s.cu.wait(w.c.s.CatchUpRate, len(w.buf))
+	w.c.respond(w.t, Valid, w.tx.cancel, &R{Value: w.buf})
+	w.buf = nil
+	return nil
+}
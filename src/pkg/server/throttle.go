@@ -0,0 +1,39 @@
+package server
+
+import (
+	"sync"
+	"time"
+)
+
+
+// Shares a budget of bytes per second among the catch-up transfers on a
+// server: snapshots, and walks and backfills whose request sets
+// catch_up, as a peer copying the store from this one does. See
+// Server.CatchUpRate.
+type throttle struct {
+	lk sync.Mutex
+	b  bucket
+}
+
+
+// Takes n bytes from the budget, at rate bytes per second, sleeping
+// until there are enough. Up to a second's worth may be sent at once.
+// If rate isn't positive, returns at once.
+func (th *throttle) wait(rate float64, n int) {
+	if rate <= 0 {
+		return
+	}
+
+	th.lk.Lock()
+	th.b.refill(&RateLimit{Rate: rate, Burst: rate}, now())
+	th.b.tokens -= float64(n)
+	var d int64
+	if th.b.tokens < 0 {
+		d = int64(-th.b.tokens / rate * 1e9)
+	}
+	th.lk.Unlock()
+
+	if d > 0 {
+		time.Sleep(d)
+	}
+}
@@ -0,0 +1,92 @@
+package server
+
+import (
+	"doozer/consensus"
+	"doozer/store"
+	"os"
+	"strconv"
+	"strings"
+)
+
+
+// Where a server started with Trash set keeps the files it deletes.
+// The file /a/b goes to /trash/a/b.
+const TrashDir = "/trash"
+
+
+// How many times a del of a file at any rev is retried when another
+// write to the file gets in between reading and moving it.
+const trashTries = 3
+
+
+// Reports whether a del of path may be moved to the trash. Files under
+// /ctl belong to the cluster, and a del in the trash is for good.
+func trashable(path string) bool {
+	for _, d := range []string{"/ctl", TrashDir} {
+		if path == d || strings.HasPrefix(path, d+"/") {
+			return false
+		}
+	}
+	return true
+}
+
+
+// Returns a mutation that deletes path if rev allows it, as EncodeDel
+// would, and keeps a copy of path's body in g under TrashDir, all at
+// once. The del is made at path's rev in g, so if path has changed
+// since, the mutation fails with store.ErrRevMismatch; it returns the
+// same error at once if rev is already too old. A missing path or a
+// directory has no body to keep, so then the del is an ordinary one,
+// and moved is false.
+func trashMut(g store.Getter, path string, rev int64) (mut string, moved bool, err os.Error) {
+	body, cur := g.Get(path)
+	if cur == store.Missing || cur == store.Dir {
+		mut, err = store.EncodeDel(path, rev)
+		return mut, false, err
+	}
+
+	if rev != store.Clobber && rev < cur {
+		return "", false, store.ErrRevMismatch
+	}
+
+	sets := []store.SetOp{{TrashDir + path, body[0], store.Clobber}}
+	dels := []store.DelOp{{path, cur}}
+	mut, err = store.EncodeTxn(sets, dels)
+	return mut, true, err
+}
+
+
+// Deletes path at rev through p, moving it to the trash, and sends the
+// resulting event. Once the move is made, proposes the file's expiry
+// from the trash.
+func (s *Server) bgTrash(p consensus.Proposer, path string, rev int64) chan store.Event {
+	ch := make(chan store.Event)
+	go func() {
+		var ev store.Event
+		var moved bool
+		for i := 0; i < trashTries; i++ {
+			_, g := s.St.Snap()
+			ev.Mut, moved, ev.Err = trashMut(g, path, rev)
+			if ev.Err == nil {
+				ev = p.Propose([]byte(ev.Mut))
+			}
+			if ev.Err != store.ErrRevMismatch || rev != store.Clobber {
+				break
+			}
+		}
+
+		if ev.Err == nil && moved {
+			exp := s.trashExpiry(ev.Seqn)
+			consensus.Set(p, "/ctl/ttl"+TrashDir+path, []byte(exp), store.Clobber)
+		}
+		ch <- ev
+	}()
+	return ch
+}
+
+
+// Returns the expiry body that has the ttl cleaner empty a file put in
+// the trash at seqn, once the server's Trash duration has passed.
+func (s *Server) trashExpiry(seqn int64) string {
+	return strconv.Itoa64(now()+s.Trash) + " " + strconv.Itoa64(seqn)
+}
@@ -0,0 +1,119 @@
+package store
+
+import (
+	"os"
+	"strings"
+)
+
+// Kind prefix of mutations returned by EncodeBatch.
+const batchKind = "batch"
+
+// Returns a mutation that applies each of `muts`, mutations returned by
+// EncodeSet or EncodeDel, in order at a single seqn, so that one round
+// of consensus can carry many small writes. Unlike a bulk mutation,
+// each one takes effect or fails on its own, just as if it had been
+// applied alone: one that fails writes its error to ErrorPath, and the
+// rest go ahead. Writes under /ctl fail with ErrBulkCtl.
+//
+// The mutation produces one event, as a bulk mutation does (see
+// EncodeBulk), except that its Body has one line for each of `muts`:
+// empty if it took effect, or its error if not. Expand returns one
+// event for each of `muts`, in order: the event it would have had on
+// its own, with Err set if it failed. Watches and waits receive the
+// batch's own event, so that peers can apply its mutation as it is;
+// everything that reports events to clients, here and in the server
+// and web view, reports them one per mutation, through Writes.
+//
+// If any of `muts` is not a set or del, returns ErrBadMutation.
+//
+// Gated by the cluster feature level; see mutFeatures.
+func EncodeBatch(muts []string) (string, os.Error) {
+	for _, m := range muts {
+		if kindOf(m) != "" {
+			return "", ErrBadMutation
+		}
+		if _, _, _, _, err := decode(m); err != nil {
+			return "", err
+		}
+	}
+	return batchKind + EncodeBulk(muts)[len(bulkKind):], nil
+}
+
+// Applies the batch mut to n. If check is not nil, it is given the
+// event of each write that takes effect; if it returns an error, that
+// write fails with it, as one with a rev mismatch would, and the rest
+// go ahead.
+func (n node) applyBatch(seqn int64, mut string, bodies *packer, check func(Event) os.Error) (rep node, ev Event) {
+	muts, err := decodeBulk(mut)
+	if err != nil {
+		rep = n.setp(ErrorPath, err.String(), seqn, seqn, true)
+		return rep, Event{seqn, ErrorPath, err.String(), seqn, mut, err, rep}
+	}
+
+	rep = n
+	dir := ""
+	errs := make([]string, len(muts))
+	for i, m := range muts {
+		var e Event
+		if path, _, _, _, err := decode(m); kindOf(m) != "" || err != nil {
+			e.Err = ErrBadMutation
+		} else if isCtl(n.fold(path)) {
+			e.Err = ErrBulkCtl
+		}
+
+		if e.Err == nil {
+			prev := rep
+			rep, e = rep.applyIn(seqn, m, bodies)
+			if e.Err == nil && check != nil {
+				if err := check(e); err != nil {
+					rep, e = prev, Event{Err: err}
+				}
+			}
+		}
+		if e.Err != nil && e.Path != ErrorPath {
+			rep = rep.setp(ErrorPath, e.Err.String(), seqn, seqn, true)
+		}
+
+		switch {
+		case e.Err != nil:
+			errs[i] = strings.Replace(e.Err.String(), "\n", " ", -1)
+		case dir == "":
+			dir = parent(e.Path)
+		default:
+			dir = commonDir(dir, e.Path)
+		}
+	}
+
+	if dir == "" {
+		dir = "/"
+	}
+	return rep, Event{seqn, dir, strings.Join(errs, "\n"), nop, mut, nil, rep}
+}
+
+func isBatch(ev Event) bool {
+	return ev.Err == nil && kindOf(ev.Mut) == batchKind
+}
+
+// Returns the event of each write in the batch event ev. See
+// EncodeBatch.
+func expandBatch(ev Event) []Event {
+	muts, _ := decodeBulk(ev.Mut)
+	errs := strings.Split(ev.Body, "\n", -1)
+	evs := make([]Event, len(muts))
+	for i, m := range muts {
+		if i < len(errs) && errs[i] != "" {
+			err := errorOf(errs[i])
+			evs[i] = Event{ev.Seqn, ErrorPath, errs[i], ev.Seqn, m, err, ev.Getter}
+			continue
+		}
+
+		path, body, _, keep, _ := decode(m)
+		path = foldIn(ev.Getter, path)
+		rev := ev.Seqn
+		if !keep {
+			rev = Missing
+		}
+		evs[i] = Event{ev.Seqn, path, body, rev, m, nil, ev.Getter}
+	}
+	return evs
+}
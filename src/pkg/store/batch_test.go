@@ -0,0 +1,93 @@
+package store
+
+import (
+	"github.com/bmizerany/assert"
+	"testing"
+)
+
+func TestEncodeBatch(t *testing.T) {
+	muts := []string{MustEncodeSet("/a", "1", Clobber), MustEncodeDel("/b", Clobber)}
+	m, err := EncodeBatch(muts)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, batchKind, kindOf(m))
+	got, err := decodeBulk(m)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, muts, got)
+
+	_, err = EncodeBatch([]string{EncodeIfExists(muts[0])})
+	assert.Equal(t, ErrBadMutation, err)
+	_, err = EncodeBatch([]string{"-1:x=a"})
+	assert.Equal(t, &BadPathError{"x"}, err)
+}
+
+func TestNodeApplyBatch(t *testing.T) {
+	r, _ := emptyDir.apply(1, MustEncodeSet("/x", "a", Clobber))
+	m, _ := EncodeBatch([]string{
+		MustEncodeSet("/d/y", "b", Clobber),
+		MustEncodeSet("/x", "c", 0),
+		MustEncodeSet("/ctl/z", "d", Clobber),
+		MustEncodeDel("/x", Clobber),
+	})
+	n, e := r.apply(2, m)
+	assert.Equal(t, nil, e.Err)
+	assert.T(t, e.IsNop())
+	assert.Equal(t, "/", e.Path)
+	assert.Equal(t, "\n"+ErrRevMismatch.String()+"\n"+ErrBulkCtl.String()+"\n", e.Body)
+	assert.Equal(t, "b", GetString(n, "/d/y"))
+	assert.Equal(t, ErrBulkCtl.String(), GetString(n, ErrorPath))
+	assert.Equal(t, "", GetString(n, "/ctl/z"))
+
+	_, rev := n.Get("/x")
+	assert.Equal(t, Missing, rev)
+	_, rev = n.Get("/d/y")
+	assert.Equal(t, int64(2), rev)
+}
+
+func TestExpandBatch(t *testing.T) {
+	r, _ := emptyDir.apply(1, MustEncodeSet("/x", "a", Clobber))
+	muts := []string{
+		MustEncodeSet("/y", "b", Clobber),
+		MustEncodeSet("/x", "c", 0),
+		MustEncodeDel("/x", Clobber),
+	}
+	m, _ := EncodeBatch(muts)
+	_, e := r.apply(2, m)
+
+	evs := Expand(e)
+	assert.Equal(t, 3, len(evs))
+	assert.Equal(t, Event{2, "/y", "b", 2, muts[0], nil, e.Getter}, evs[0])
+	assert.Equal(t, ErrorPath, evs[1].Path)
+	assert.Equal(t, ErrRevMismatch.String(), evs[1].Body)
+	assert.Equal(t, ErrRevMismatch, evs[1].Err)
+	assert.T(t, evs[2].IsDel())
+	assert.Equal(t, "/x", evs[2].Path)
+}
+
+func TestWatchBatchWrites(t *testing.T) {
+	st := New()
+	defer close(st.Ops)
+	glob := MustCompileGlob("/d/*")
+	w := NewWatch(st, glob)
+	m, _ := EncodeBatch([]string{
+		MustEncodeSet("/d/x", "a", Clobber),
+		MustEncodeSet("/y", "b", Clobber),
+		MustEncodeSet("/d/z", "c", Clobber),
+	})
+	st.Ops <- Op{1, m}
+
+	ev := <-w.C
+	assert.Equal(t, int64(1), ev.Seqn)
+	evs := Writes(glob, ev)
+	assert.Equal(t, 2, len(evs))
+	assert.Equal(t, "/d/x", evs[0].Path)
+	assert.Equal(t, "a", evs[0].Body)
+	assert.Equal(t, "/d/z", evs[1].Path)
+	assert.Equal(t, "c", evs[1].Body)
+}
+
+func TestNodeApplyBatchFeature(t *testing.T) {
+	r, _ := emptyDir.apply(1, MustEncodeSet("/ctl/node/a/feature", "12", Clobber))
+	m, _ := EncodeBatch([]string{MustEncodeSet("/y", "b", Clobber)})
+	_, e := r.apply(2, m)
+	assert.Equal(t, ErrFeatureDisabled, e.Err)
+}
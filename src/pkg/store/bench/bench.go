@@ -0,0 +1,38 @@
+// Package bench holds reproducible benchmarks of package store: apply
+// throughput, watch dispatch, snapshot reads, and Clean. Run them with
+//
+//   gotest -test.bench=.
+//
+// The helpers here build the fixtures the benchmarks share; every
+// fixture is deterministic, so numbers from two trees are comparable.
+package bench
+
+import (
+	"doozer/store"
+	"strconv"
+)
+
+// Returns the path of the i'th file written by Fill.
+func Path(i int) string {
+	return "/bench/" + strconv.Itoa(i/100) + "/" + strconv.Itoa(i%100)
+}
+
+// Applies n sets to st, starting at position from, each to a distinct
+// file in directories of 100, and waits until they have been applied.
+// Returns the last position used.
+func Fill(st *store.Store, from int64, n int) int64 {
+	seqn := from - 1
+	for i := 0; i < n; i++ {
+		seqn++
+		st.Ops <- store.Op{seqn, store.MustEncodeSet(Path(i), "v", store.Clobber)}
+	}
+	Sync(st, seqn)
+	return seqn
+}
+
+// Waits until st has applied position seqn.
+func Sync(st *store.Store, seqn int64) {
+	if ch, err := st.Wait(seqn); err == nil {
+		<-ch
+	}
+}
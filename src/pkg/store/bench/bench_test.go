@@ -0,0 +1,119 @@
+package bench
+
+import (
+	"doozer/store"
+	"testing"
+)
+
+func BenchmarkApplySet(b *testing.B) {
+	b.StopTimer()
+	st := store.New()
+	defer st.Close()
+	mut := store.MustEncodeSet("/x", "a", store.Clobber)
+	b.StartTimer()
+
+	for i := 1; i <= b.N; i++ {
+		st.Ops <- store.Op{int64(i), mut}
+	}
+	Sync(st, int64(b.N))
+}
+
+func BenchmarkApplyFanOut(b *testing.B) {
+	b.StopTimer()
+	st := store.New()
+	defer st.Close()
+	b.StartTimer()
+
+	Fill(st, 1, b.N)
+}
+
+func benchmarkNotify(b *testing.B, watches int) {
+	b.StopTimer()
+	st := store.New()
+	defer st.Close()
+
+	done := make(chan bool)
+	for i := 0; i < watches; i++ {
+		w := store.NewWatch(st, store.Any)
+		go func() {
+			for ev := range w.C {
+				if ev.Seqn == int64(b.N) {
+					w.Stop()
+					done <- true
+					return
+				}
+			}
+		}()
+	}
+	mut := store.MustEncodeSet("/x", "a", store.Clobber)
+	b.StartTimer()
+
+	for i := 1; i <= b.N; i++ {
+		st.Ops <- store.Op{int64(i), mut}
+	}
+	for i := 0; i < watches; i++ {
+		<-done
+	}
+}
+
+func BenchmarkNotify1(b *testing.B)    { benchmarkNotify(b, 1) }
+func BenchmarkNotify10(b *testing.B)   { benchmarkNotify(b, 10) }
+func BenchmarkNotify100(b *testing.B)  { benchmarkNotify(b, 100) }
+func BenchmarkNotify1000(b *testing.B) { benchmarkNotify(b, 1000) }
+
+func BenchmarkSnapGet(b *testing.B) {
+	b.StopTimer()
+	st := store.New()
+	defer st.Close()
+	Fill(st, 1, 10000)
+	_, g := st.Snap()
+	b.StartTimer()
+
+	for i := 0; i < b.N; i++ {
+		g.Get(Path(i % 10000))
+	}
+}
+
+func BenchmarkSnapWalk(b *testing.B) {
+	b.StopTimer()
+	st := store.New()
+	defer st.Close()
+	Fill(st, 1, 1000)
+	_, g := st.Snap()
+	f := func(path, body string, rev int64) bool { return false }
+	b.StartTimer()
+
+	for i := 0; i < b.N; i++ {
+		store.Walk(g, store.Any, f)
+	}
+}
+
+func BenchmarkClean(b *testing.B) {
+	b.StopTimer()
+	st := store.New()
+	defer st.Close()
+	last := Fill(st, 1, b.N)
+	b.StartTimer()
+
+	st.Clean(last)
+	st.Flush() // returns once the clean has been done
+}
+
+func BenchmarkCatchUp(b *testing.B) {
+	b.StopTimer()
+	st := store.New()
+	defer st.Close()
+	last := Fill(st, 1, b.N)
+	b.StartTimer()
+
+	w, err := store.NewWatchFrom(st, store.Any, 1)
+	if err != nil {
+		panic(err)
+	}
+	for ev := range w.C {
+		if ev.Seqn == last {
+			break
+		}
+	}
+	w.Stop()
+}
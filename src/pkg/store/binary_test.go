@@ -0,0 +1,110 @@
+package store
+
+import (
+	"bytes"
+	"github.com/bmizerany/assert"
+	"os"
+	"testing"
+)
+
+func TestEncodeBinary(t *testing.T) {
+	m, err := EncodeBinarySet("/x", "a", Clobber)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "\x01s\xff\xff\xff\xff\xff\xff\xff\xff\x00\x02/xa", m)
+
+	m, err = EncodeBinaryDel("/x", 5)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "\x01d\x00\x00\x00\x00\x00\x00\x00\x05\x00\x02/x", m)
+
+	_, err = EncodeBinarySet("x", "a", Clobber)
+	assert.Equal(t, &BadPathError{"x"}, err)
+}
+
+func TestDecodeBinary(t *testing.T) {
+	body := "b=c:\n\x00"
+	path, v, rev, keep, err := decodeBinary(MustEncodeBinarySet("/x/y", body, 7))
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "/x/y", path)
+	assert.Equal(t, body, v)
+	assert.Equal(t, int64(7), rev)
+	assert.Equal(t, true, keep)
+
+	m, _ := EncodeBinaryDel("/x", Missing)
+	path, v, rev, keep, err = decodeBinary(m)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "/x", path)
+	assert.Equal(t, "", v)
+	assert.Equal(t, Missing, rev)
+	assert.Equal(t, false, keep)
+}
+
+func TestDecodeBinaryBad(t *testing.T) {
+	m := MustEncodeBinarySet("/x", "a", Clobber)
+	for _, bad := range []string{
+		binaryKind,
+		m[:binaryHead-1],
+		m[:binaryHead+1],    // path cut short
+		m[:1] + "x" + m[2:], // unknown op
+		m[:1] + "d" + m[2:], // del with a body
+	} {
+		_, _, _, _, err := decodeBinary(bad)
+		assert.Equalf(t, ErrBadMutation, err, "%q", bad)
+	}
+}
+
+func TestApplyBinary(t *testing.T) {
+	r, e := emptyDir.apply(1, MustEncodeBinarySet("/x", "a", Clobber))
+	assert.Equal(t, nil, e.Err)
+	assert.T(t, e.IsSet())
+	assert.Equal(t, "/x", e.Path)
+	assert.Equal(t, "a", e.Body)
+
+	// The formats mix freely: text after binary, and binary after text.
+	r, e = r.apply(2, MustEncodeSet("/x", "b", 1))
+	assert.Equal(t, nil, e.Err)
+	m, _ := EncodeBinarySet("/x", "c", 1)
+	r, e = r.apply(3, m)
+	assert.Equal(t, ErrRevMismatch, e.Err)
+
+	m, _ = EncodeBinaryDel("/x", 2)
+	r, e = r.apply(4, m)
+	assert.Equal(t, nil, e.Err)
+	assert.T(t, e.IsDel())
+	_, rev := r.Get("/x")
+	assert.Equal(t, Missing, rev)
+}
+
+func TestApplyBinaryErrors(t *testing.T) {
+	r, _ := emptyDir.apply(1, MustEncodeSet("/d/x", "a", Clobber))
+	m, _ := EncodeBinaryDel("/q", Clobber)
+	_, e := r.apply(2, m)
+	assert.Equal(t, os.ENOENT, e.Err)
+
+	_, e = r.apply(2, MustEncodeBinarySet("/d", "a", Clobber))
+	assert.Equal(t, os.EISDIR, e.Err)
+}
+
+func TestApplyBinaryFeatureDisabled(t *testing.T) {
+	g, _ := emptyDir.apply(1, MustEncodeSet("/ctl/node/a/feature", "15", Clobber))
+	_, ev := g.apply(2, MustEncodeBinarySet("/x", "a", Clobber))
+	assert.Equal(t, ErrFeatureDisabled, ev.Err)
+}
+
+func TestDumpReplayMixed(t *testing.T) {
+	st := New()
+	st.Ops <- Op{1, MustEncodeSet("/x", "a", Clobber)}
+	st.Ops <- Op{2, MustEncodeBinarySet("/y", "b\nc", Clobber)}
+	st.Ops <- Op{3, MustEncodeDel("/x", Clobber)}
+	<-st.Seqns
+
+	var b bytes.Buffer
+	_, err := st.Dump(&b, 1)
+	assert.Equal(t, nil, err)
+
+	rs, err := Replay(&b, 0)
+	assert.Equal(t, nil, err)
+	v, _ := rs.Get("/y")
+	assert.Equal(t, []string{"b\nc"}, v)
+	_, rev := rs.Get("/x")
+	assert.Equal(t, Missing, rev)
+}
@@ -0,0 +1,239 @@
+package store
+
+import (
+	"bytes"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Kind prefix of mutations returned by EncodeBulk.
+const bulkKind = "bulk"
+
+var ErrBulkCtl os.Error = &Error{CodeCtl, "bulk write under /ctl"}
+
+// Returns a mutation that applies every one of `muts`, mutations returned
+// by EncodeSet or EncodeDel, at a single seqn. Either all of them take
+// effect or, if any fails, none do and the error is written to ErrorPath.
+//
+// The mutation produces one event rather than one per write: its Path is
+// the closest directory holding every written file, its Body is the
+// number of writes, and it is neither a set nor a del. A watch receives
+// it if its glob matches any of the written paths; Expand recovers the
+// individual writes. Writes under /ctl are refused, since the cluster's
+// own bookkeeping relies on its per-file events.
+//
+// Gated by the cluster feature level; see mutFeatures.
+func EncodeBulk(muts []string) string {
+	b := bytes.NewBufferString(bulkKind + ":")
+	for _, m := range muts {
+		b.WriteString(strconv.Itoa(len(m)))
+		b.WriteString(":")
+		b.WriteString(m)
+	}
+	return b.String()
+}
+
+// One set in a transaction; see EncodeTxn.
+type SetOp struct {
+	Path string
+	Body string
+	Rev  int64
+}
+
+// One del in a transaction; see EncodeTxn.
+type DelOp struct {
+	Path string
+	Rev  int64
+}
+
+// Returns a mutation that makes every one of `sets`, then every one of
+// `dels`, at a single seqn, all or nothing. Each one's Rev is checked as
+// for EncodeSet and EncodeDel, against the file as left by the writes
+// before it; if any check fails, no file changes and the error is
+// written to ErrorPath. The mutation is a bulk mutation, so its event
+// and the restrictions on it are as described for EncodeBulk.
+//
+// If any path is not valid, returns a `BadPathError`.
+func EncodeTxn(sets []SetOp, dels []DelOp) (mutation string, err os.Error) {
+	var muts []string
+	for _, op := range sets {
+		m, err := EncodeSet(op.Path, op.Body, op.Rev)
+		if err != nil {
+			return "", err
+		}
+		muts = append(muts, m)
+	}
+	for _, op := range dels {
+		m, err := EncodeDel(op.Path, op.Rev)
+		if err != nil {
+			return "", err
+		}
+		muts = append(muts, m)
+	}
+	return EncodeBulk(muts), nil
+}
+
+// Groups `muts` into as few bulk mutations as it can, each no longer
+// than `max` bytes unless it holds a single mutation that is longer on
+// its own.
+func PackBulk(muts []string, max int) (bulks []string) {
+	var group []string
+	n := len(bulkKind) + 1
+	for _, m := range muts {
+		w := len(strconv.Itoa(len(m))) + 1 + len(m)
+		if len(group) > 0 && n+w > max {
+			bulks = append(bulks, EncodeBulk(group))
+			group, n = nil, len(bulkKind)+1
+		}
+		group = append(group, m)
+		n += w
+	}
+	if len(group) > 0 {
+		bulks = append(bulks, EncodeBulk(group))
+	}
+	return bulks
+}
+
+// Decodes a bulk or batch mutation into the mutations it holds.
+func decodeBulk(mut string) (muts []string, err os.Error) {
+	s := mut[len(kindOf(mut))+1:]
+	for len(s) > 0 {
+		i := strings.Index(s, ":")
+		if i < 1 {
+			return nil, ErrBadMutation
+		}
+
+		n, err := strconv.Atoi(s[:i])
+		if err != nil || n < 0 || n > len(s)-i-1 {
+			return nil, ErrBadMutation
+		}
+
+		muts = append(muts, s[i+1:i+1+n])
+		s = s[i+1+n:]
+	}
+	return muts, nil
+}
+
+// Returns the longest directory path that contains both `dir` and `path`.
+func commonDir(dir, path string) string {
+	for dir != "/" && !strings.HasPrefix(path, dir+"/") {
+		dir = parent(dir)
+	}
+	return dir
+}
+
+func isCtl(path string) bool {
+	return path == "/ctl" || strings.HasPrefix(path, "/ctl/")
+}
+
+func (n node) applyBulk(seqn int64, mut string, bodies *packer) (rep node, ev Event) {
+	muts, err := decodeBulk(mut)
+
+	dir := ""
+	rep = n
+	for _, m := range muts {
+		if kindOf(m) != "" {
+			err = ErrBadMutation
+			break
+		}
+
+		var e Event
+		rep, e = rep.applyIn(seqn, m, bodies)
+		if e.Err != nil {
+			err = e.Err
+			break
+		}
+		if isCtl(e.Path) {
+			err = ErrBulkCtl
+			break
+		}
+
+		if dir == "" {
+			dir = parent(e.Path)
+		} else {
+			dir = commonDir(dir, e.Path)
+		}
+	}
+
+	if err != nil {
+		rep = n.setp(ErrorPath, err.String(), seqn, seqn, true)
+		return rep, Event{seqn, ErrorPath, err.String(), seqn, mut, err, rep}
+	}
+
+	if dir == "" {
+		dir = "/"
+	}
+	return rep, Event{seqn, dir, strconv.Itoa(len(muts)), nop, mut, nil, rep}
+}
+
+// Reports whether ev stands for more than one write: a bulk write, a
+// batch, a copy of a directory, or a paired set.
+func isBulk(ev Event) bool {
+	return ev.Err == nil && kindOf(ev.Mut) == bulkKind || isBatch(ev) || isCopyDir(ev) || isPaired(ev)
+}
+
+// If `ev` is the event of a bulk mutation, returns one event for each
+// write it made, as if each had been applied on its own at ev.Seqn.
+// Likewise for a copy of a directory, one event for each file copied,
+// and for a batch, one event for each of its mutations (see
+// EncodeBatch), and for a paired set, such as an ephemeral one, its two
+// writes (see encodePaired). Otherwise, returns `ev` alone.
+func Expand(ev Event) []Event {
+	if isCopyDir(ev) {
+		return expandCopy(ev)
+	}
+	if isBatch(ev) {
+		return expandBatch(ev)
+	}
+	if isPaired(ev) {
+		return expandPaired(ev)
+	}
+	if !isBulk(ev) {
+		return []Event{ev}
+	}
+
+	muts, _ := decodeBulk(ev.Mut)
+	evs := make([]Event, len(muts))
+	for i, m := range muts {
+		path, body, _, keep, _ := decode(m)
+		path = foldIn(ev.Getter, path)
+		rev := ev.Seqn
+		if !keep {
+			rev = Missing
+		}
+		evs[i] = Event{ev.Seqn, path, body, rev, m, nil, ev.Getter}
+	}
+	return evs
+}
+
+// Returns the events of Expand(ev) whose paths glob matches, in order:
+// what a watch on glob reports of ev. A store watch receives each event
+// whole, one per seqn, so that it can be applied elsewhere as it is;
+// code that looks at the paths and bodies of the events should go
+// through Writes, so that it sees each write of a bulk, batch or copy
+// on its own.
+func Writes(glob *Glob, ev Event) (evs []Event) {
+	for _, e := range Expand(ev) {
+		if glob.Match(e.Path) {
+			evs = append(evs, e)
+		}
+	}
+	return evs
+}
+
+// Reports whether `glob` matches the path of `ev` or, if `writes`, the
+// result of Expand for a bulk event, is not nil, the path of any of its
+// writes.
+func matchEvent(glob *Glob, ev Event, writes []Event) bool {
+	if writes == nil {
+		return glob.Match(ev.Path)
+	}
+
+	for _, e := range writes {
+		if glob.Match(e.Path) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,135 @@
+package store
+
+import (
+	"github.com/bmizerany/assert"
+	"testing"
+)
+
+func TestBulkRoundTrip(t *testing.T) {
+	muts := []string{MustEncodeSet("/a", "1", Clobber), MustEncodeDel("/b", Clobber)}
+	got, err := decodeBulk(EncodeBulk(muts))
+	assert.Equal(t, nil, err)
+	assert.Equal(t, muts, got)
+}
+
+func TestBulkDecodeBad(t *testing.T) {
+	_, err := decodeBulk("bulk:99:-1:/x")
+	assert.Equal(t, ErrBadMutation, err)
+	_, err = decodeBulk("bulk:x:")
+	assert.Equal(t, ErrBadMutation, err)
+}
+
+func TestPackBulk(t *testing.T) {
+	a := MustEncodeSet("/a", "1", Clobber)
+	big := MustEncodeSet("/b", string(make([]byte, 100)), Clobber)
+	bulks := PackBulk([]string{a, a, big, a}, 30)
+	assert.Equal(t, []string{EncodeBulk([]string{a, a}), EncodeBulk([]string{big}), EncodeBulk([]string{a})}, bulks)
+}
+
+func TestCommonDir(t *testing.T) {
+	assert.Equal(t, "/a/b", commonDir("/a/b", "/a/b/c"))
+	assert.Equal(t, "/a", commonDir("/a/b", "/a/bc"))
+	assert.Equal(t, "/", commonDir("/a", "/x/y"))
+}
+
+func TestNodeApplyBulk(t *testing.T) {
+	m := EncodeBulk([]string{
+		MustEncodeSet("/d/x", "1", Clobber),
+		MustEncodeSet("/d/e/y", "2", Clobber),
+	})
+	n, e := emptyDir.apply(1, m)
+	assert.Equal(t, nil, e.Err)
+	assert.Equal(t, "/d", e.Path)
+	assert.Equal(t, "2", e.Body)
+	assert.T(t, e.IsNop())
+	assert.Equal(t, "1", GetString(n, "/d/x"))
+	assert.Equal(t, "2", GetString(n, "/d/e/y"))
+
+	_, rev := n.Get("/d/x")
+	assert.Equal(t, int64(1), rev)
+}
+
+func TestNodeApplyBulkAllOrNothing(t *testing.T) {
+	r, _ := emptyDir.apply(1, MustEncodeSet("/x", "a", Clobber))
+	m := EncodeBulk([]string{
+		MustEncodeSet("/y", "b", Clobber),
+		MustEncodeSet("/x", "c", 0),
+	})
+	n, e := r.apply(2, m)
+	assert.Equal(t, ErrRevMismatch, e.Err)
+	assert.Equal(t, ErrorPath, e.Path)
+	assert.Equal(t, "", GetString(n, "/y"))
+	assert.Equal(t, "a", GetString(n, "/x"))
+}
+
+func TestNodeApplyBulkCtl(t *testing.T) {
+	m := EncodeBulk([]string{MustEncodeSet("/ctl/x", "a", Clobber)})
+	n, e := emptyDir.apply(1, m)
+	assert.Equal(t, ErrBulkCtl, e.Err)
+	assert.Equal(t, "", GetString(n, "/ctl/x"))
+}
+
+func TestNodeApplyBulkDisabled(t *testing.T) {
+	r, _ := emptyDir.apply(1, MustEncodeSet("/ctl/node/a/feature", "2", Clobber))
+	_, e := r.apply(2, EncodeBulk([]string{MustEncodeSet("/y", "b", Clobber)}))
+	assert.Equal(t, ErrFeatureDisabled, e.Err)
+}
+
+func TestExpand(t *testing.T) {
+	a, b := MustEncodeSet("/d/x", "1", Clobber), MustEncodeDel("/d/y", Clobber)
+	m := EncodeBulk([]string{a, b})
+	_, e := emptyDir.apply(1, m)
+	evs := Expand(e)
+	assert.Equal(t, 2, len(evs))
+	assert.Equal(t, Event{1, "/d/x", "1", 1, a, nil, e.Getter}, evs[0])
+	assert.Equal(t, Event{1, "/d/y", "", Missing, b, nil, e.Getter}, evs[1])
+
+	e = Event{Seqn: 2, Path: "/x", Mut: a}
+	assert.Equal(t, []Event{e}, Expand(e))
+}
+
+func TestStoreWatchBulk(t *testing.T) {
+	st := New()
+	defer st.Close()
+	wt := NewWatch(st, MustCompileGlob("/d/e/*"))
+	other := NewWatch(st, MustCompileGlob("/q"))
+
+	m := EncodeBulk([]string{
+		MustEncodeSet("/d/x", "1", Clobber),
+		MustEncodeSet("/d/e/y", "2", Clobber),
+	})
+	st.Ops <- Op{1, m}
+	st.Ops <- Op{2, MustEncodeSet("/q", "", Clobber)}
+
+	ev := <-wt.C
+	assert.Equal(t, int64(1), ev.Seqn)
+	assert.Equal(t, "/d", ev.Path)
+	assert.Equal(t, int64(2), (<-other.C).Seqn)
+}
+
+func TestEncodeTxn(t *testing.T) {
+	m, err := EncodeTxn([]SetOp{{"/a", "1", Clobber}}, []DelOp{{"/b", 3}})
+	assert.Equal(t, nil, err)
+	assert.Equal(t, EncodeBulk([]string{MustEncodeSet("/a", "1", Clobber), MustEncodeDel("/b", 3)}), m)
+
+	_, err = EncodeTxn([]SetOp{{"a", "1", Clobber}}, nil)
+	assert.NotEqual(t, nil, err)
+}
+
+func TestNodeApplyTxnAllOrNothing(t *testing.T) {
+	r, _ := emptyDir.apply(1, MustEncodeSet("/d/x", "1", Clobber))
+	r, _ = r.apply(2, MustEncodeSet("/d/y", "2", Clobber))
+
+	m, _ := EncodeTxn([]SetOp{{"/d/x", "3", 1}}, []DelOp{{"/d/y", 1}})
+	n, e := r.apply(3, m)
+	assert.Equal(t, ErrRevMismatch, e.Err)
+	assert.Equal(t, "1", GetString(n, "/d/x"))
+	assert.Equal(t, "2", GetString(n, "/d/y"))
+
+	m, _ = EncodeTxn([]SetOp{{"/d/x", "3", 1}}, []DelOp{{"/d/y", 2}})
+	n, e = r.apply(3, m)
+	assert.Equal(t, nil, e.Err)
+	assert.Equal(t, "3", GetString(n, "/d/x"))
+	_, rev := n.Get("/d/y")
+	assert.Equal(t, Missing, rev)
+}
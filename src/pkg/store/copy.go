@@ -0,0 +1,153 @@
+package store
+
+import (
+	"os"
+	"strconv"
+)
+
+// Kind prefix of mutations returned by EncodeCopy.
+const copyKind = "copy"
+
+var ErrCopyCtl os.Error = &Error{CodeCtl, "copy of or into /ctl"}
+
+// Returns a mutation that copies the file or directory at src, with
+// everything under it, to dst, all at one seqn. The rev rules for dst
+// are those of EncodeSet, except that a directory may be copied only
+// to a path where nothing is yet. Every file in the copy gets the seqn
+// of the copy as its rev. Neither src nor dst may be in /ctl or
+// contain it.
+//
+// If either path is not valid, returns a `BadPathError`.
+//
+// The event of a file copy is an ordinary set of dst. The event of a
+// directory copy is like that of a bulk write: its Path is dst, its
+// Body is the number of files copied, and Expand lists them.
+func EncodeCopy(src, dst string, rev int64) (mutation string, err os.Error) {
+	if err = checkPath(src); err != nil {
+		return
+	}
+
+	mutation, err = EncodeSet(dst, src, rev)
+	if err != nil {
+		return
+	}
+
+	return copyKind + ":" + mutation, nil
+}
+
+func touchesCtl(path string) bool {
+	return path == "/" || isCtl(path)
+}
+
+func (n node) applyCopy(seqn int64, mut string) (rep node, ev Event) {
+	dst, src, rev, keep, err := decode(mut[len(copyKind)+1:])
+	dst, src = n.fold(dst), n.fold(src)
+	if err == nil && !keep {
+		err = ErrBadMutation
+	}
+	if err == nil {
+		err = n.checkPathIn(src)
+	}
+	if err == nil {
+		err = n.checkPathIn(dst)
+	}
+	if err == nil && (touchesCtl(src) || touchesCtl(dst)) {
+		err = ErrCopyCtl
+	}
+
+	var m node
+	if err == nil {
+		m, err = n.at(split(src))
+	}
+	if err == nil {
+		err = n.checkParents(dst)
+	}
+	if err == nil {
+		_, curRev := n.Get(dst)
+		switch {
+		case curRev == Dir:
+			err = os.EISDIR
+		case m.Rev == Dir && curRev != Missing:
+			err = os.EEXIST
+		case rev != Clobber && rev < curRev:
+			err = ErrRevMismatch
+		}
+	}
+
+	if err == nil {
+		if m.Rev != Dir {
+			rep = n.setpz(dst, m.V, m.Zip, m.Sum, seqn, seqn, true)
+			if m.Link {
+				rep = rep.link(split(dst))
+			}
+			ev = Event{seqn, dst, m.body(), seqn, mut, nil, rep}
+		} else {
+			m, files := m.restamp(seqn)
+			rep = n.graft(split(dst), m, seqn)
+			ev = Event{seqn, dst, strconv.Itoa(files), nop, mut, nil, rep}
+		}
+		err = checkQuota(n, rep, dst)
+	}
+
+	if err != nil {
+		rep = n.setp(ErrorPath, err.String(), seqn, seqn, true)
+		return rep, Event{seqn, ErrorPath, err.String(), seqn, mut, err, rep}
+	}
+	return rep, ev
+}
+
+// Returns a copy of n in which every file and directory was made at
+// seqn, and the number of files in it.
+func (n node) restamp(seqn int64) (node, int) {
+	n.CRev = seqn
+	if n.Rev != Dir {
+		n.Rev = seqn
+		return n, 1
+	}
+
+	files := 0
+	ds := make(map[string]node, len(n.Ds))
+	for k, m := range n.Ds {
+		var c int
+		ds[k], c = m.restamp(seqn)
+		files += c
+	}
+	n.Ds, n.EntRev, n.TreeRev = ds, seqn, seqn
+	return n, files
+}
+
+// Returns n with m put in place at parts, which must be missing, making
+// any directories on the way.
+func (n node) graft(parts []string, m node, seqn int64) node {
+	if len(parts) == 0 {
+		return m
+	}
+
+	if n.Rev != Dir {
+		n.CRev = seqn
+	}
+	n.Ds = copyMap(n.Ds)
+	old, had := n.Ds[parts[0]]
+	if !had {
+		n.EntRev = seqn
+	}
+	p := old.graft(parts[1:], m, seqn)
+	n.Ds[parts[0]] = p
+	n.reweigh(old, had, p, true, seqn)
+	n.Rev = Dir
+	return n
+}
+
+func isCopyDir(ev Event) bool {
+	return ev.Err == nil && ev.IsNop() && kindOf(ev.Mut) == copyKind
+}
+
+// Returns one event for each file made by the directory copy ev, as if
+// each had been set on its own at ev.Seqn.
+func expandCopy(ev Event) (evs []Event) {
+	walk(ev.Getter, ev.Path, Any, func(path, body string, rev int64) bool {
+		evs = append(evs, Event{ev.Seqn, path, body, rev, MustEncodeSet(path, body, Clobber), nil, ev.Getter})
+		return false
+	})
+	return evs
+}
@@ -0,0 +1,89 @@
+package store
+
+import (
+	"github.com/bmizerany/assert"
+	"os"
+	"testing"
+)
+
+func TestCopyRoundTrip(t *testing.T) {
+	m, err := EncodeCopy("/a", "/b", Missing)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "copy:0:/b=/a", m)
+
+	_, err = EncodeCopy("a", "/b", Missing)
+	assert.Equal(t, &BadPathError{"a"}, err)
+}
+
+func TestNodeApplyCopyFile(t *testing.T) {
+	r, _ := emptyDir.apply(1, MustEncodeSet("/x", "a", Clobber))
+	m, _ := EncodeCopy("/x", "/y", Missing)
+	n, e := r.apply(2, m)
+	assert.Equal(t, Event{2, "/y", "a", 2, m, nil, n}, e)
+	assert.Equal(t, StatInfo{1, 2, 2, 2, BodySum("a"), 0}, StatOf(n, "/y"))
+	assert.Equal(t, []Event{e}, Expand(e))
+}
+
+func TestNodeApplyCopyDir(t *testing.T) {
+	r, _ := emptyDir.apply(1, MustEncodeSet("/d/x", "1", Clobber))
+	r, _ = r.apply(2, MustEncodeSet("/d/e/y", "2", Clobber))
+	m, _ := EncodeCopy("/d", "/b/d", Missing)
+	n, e := r.apply(3, m)
+	assert.Equal(t, nil, e.Err)
+	assert.Equal(t, "/b/d", e.Path)
+	assert.Equal(t, "2", e.Body)
+	assert.T(t, e.IsNop())
+
+	v, rev := n.Get("/b/d/e/y")
+	assert.Equal(t, []string{"2"}, v)
+	assert.Equal(t, int64(3), rev)
+	assert.Equal(t, int64(3), DirRev(n, "/b/d"))
+	assert.Equal(t, TreeStat{4, 2, 3}, StatTree(n, "/b"))
+
+	// The original is untouched.
+	_, rev = n.Get("/d/x")
+	assert.Equal(t, int64(1), rev)
+
+	evs := Expand(e)
+	assert.Equal(t, 2, len(evs))
+	assert.Equal(t, "/b/d/e/y", evs[0].Path)
+	assert.Equal(t, "/b/d/x", evs[1].Path)
+	assert.Equal(t, int64(3), evs[1].Rev)
+}
+
+func TestNodeApplyCopyFails(t *testing.T) {
+	r, _ := emptyDir.apply(1, MustEncodeSet("/d/x", "1", Clobber))
+	r, _ = r.apply(2, MustEncodeSet("/y", "2", Clobber))
+
+	cases := []struct {
+		src, dst string
+		rev      int64
+		err      os.Error
+	}{
+		{"/q", "/z", Missing, os.ENOENT},
+		{"/d", "/y", Clobber, os.EEXIST},
+		{"/y", "/d", Clobber, os.EISDIR},
+		{"/d/x", "/y", Missing, ErrRevMismatch},
+		{"/d/x", "/y/z", Clobber, os.ENOTDIR},
+		{"/d", "/ctl/d", Missing, ErrCopyCtl},
+		{"/ctl", "/c", Missing, ErrCopyCtl},
+		{"/", "/c", Missing, ErrCopyCtl},
+	}
+	for _, c := range cases {
+		m, _ := EncodeCopy(c.src, c.dst, c.rev)
+		n, e := r.apply(3, m)
+		assert.Equal(t, c.err, e.Err, c)
+		assert.Equal(t, ErrorPath, e.Path, c)
+		_, rev := n.Get(c.dst)
+		_, was := r.Get(c.dst)
+		assert.Equal(t, was, rev, c)
+	}
+}
+
+func TestNodeApplyCopyFeature(t *testing.T) {
+	r, _ := emptyDir.apply(1, MustEncodeSet("/ctl/node/a/feature", "8", Clobber))
+	r, _ = r.apply(2, MustEncodeSet("/x", "a", Clobber))
+	m, _ := EncodeCopy("/x", "/y", Missing)
+	_, e := r.apply(3, m)
+	assert.Equal(t, ErrFeatureDisabled, e.Err)
+}
@@ -0,0 +1,54 @@
+package store
+
+import (
+	"os"
+	"strings"
+)
+
+// Kind prefix of mutations returned by EncodeEphemeral.
+const ephKind = "eph"
+
+// Sessions, and the files that tie other files to them; see package
+// lock.
+const (
+	sessDir = "/ctl/sess"
+	linkDir = "/ctl/link"
+)
+
+var (
+	ErrNoSession    os.Error = &Error{CodeNoSession, "session has ended"}
+	ErrEphemeralCtl os.Error = &Error{CodeCtl, "ephemeral file in /ctl"}
+)
+
+// Returns a mutation that sets `path` to `body` as EncodeSet does and,
+// at the same seqn, ties it to session `sess` by setting
+// /ctl/link<path> to `sess`, so that the file is deleted when the
+// session ends (see package lock). Unless /ctl/sess/<sess> exists, the
+// mutation fails with ErrNoSession and neither file changes: a session
+// that has already ended will never clean up after itself. A file in
+// /ctl can't be made ephemeral.
+//
+// The mutation's event is that of a paired set; see encodePaired.
+//
+// If `path` or `sess` is not valid, returns a `BadPathError`.
+//
+// Gated by the cluster feature level; see mutFeatures.
+func EncodeEphemeral(path, body string, rev int64, sess string) (mutation string, err os.Error) {
+	if sess == "" || strings.Contains(sess, "/") {
+		return "", &BadPathError{sessDir + "/" + sess}
+	}
+	if err = checkPath(sessDir + "/" + sess); err != nil {
+		return
+	}
+	return encodePaired(ephKind, sess, path, body, rev)
+}
+
+func (n node) applyEphemeral(seqn int64, mut string, bodies *packer) (rep node, ev Event) {
+	sess, set, err := decodePaired(mut)
+	if err == nil {
+		if _, rev := n.Get(n.fold(sessDir + "/" + sess)); rev <= Missing {
+			err = ErrNoSession
+		}
+	}
+	return n.applyPaired(seqn, mut, set, linkDir, sess, ErrEphemeralCtl, err, bodies)
+}
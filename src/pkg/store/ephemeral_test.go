@@ -0,0 +1,74 @@
+package store
+
+import (
+	"github.com/bmizerany/assert"
+	"testing"
+)
+
+func TestEphemeralRoundTrip(t *testing.T) {
+	m, err := EncodeEphemeral("/a", "1", Missing, "s")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "eph:1:s6:0:/a=1", m)
+
+	sess, set, err := decodePaired(m)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "s", sess)
+	assert.Equal(t, "0:/a=1", set)
+
+	_, err = EncodeEphemeral("a", "1", Missing, "s")
+	assert.Equal(t, &BadPathError{"a"}, err)
+
+	_, err = EncodeEphemeral("/a", "1", Missing, "s/t")
+	assert.Equal(t, &BadPathError{"/ctl/sess/s/t"}, err)
+}
+
+func TestNodeApplyEphemeral(t *testing.T) {
+	n, _ := emptyDir.apply(1, MustEncodeSet("/ctl/sess/s", "9", Missing))
+	m, _ := EncodeEphemeral("/svc/a", "x", Missing, "s")
+	n, e := n.apply(2, m)
+	assert.Equal(t, Event{2, "/", "2", nop, m, nil, n}, e)
+
+	v, rev := n.Get("/svc/a")
+	assert.Equal(t, []string{"x"}, v)
+	assert.Equal(t, int64(2), rev)
+	v, rev = n.Get("/ctl/link/svc/a")
+	assert.Equal(t, []string{"s"}, v)
+	assert.Equal(t, int64(2), rev)
+
+	evs := Expand(e)
+	assert.Equal(t, 2, len(evs))
+	assert.Equal(t, "/svc/a", evs[0].Path)
+	assert.Equal(t, "x", evs[0].Body)
+	assert.Equal(t, "/ctl/link/svc/a", evs[1].Path)
+	assert.Equal(t, "s", evs[1].Body)
+	assert.T(t, evs[1].IsSet())
+}
+
+func TestNodeApplyEphemeralNoSession(t *testing.T) {
+	m, _ := EncodeEphemeral("/svc/a", "x", Missing, "s")
+	n, e := emptyDir.apply(1, m)
+	assert.Equal(t, ErrNoSession, e.Err)
+
+	_, rev := n.Get("/svc/a")
+	assert.Equal(t, Missing, rev)
+	_, rev = n.Get("/ctl/link/svc/a")
+	assert.Equal(t, Missing, rev)
+}
+
+func TestNodeApplyEphemeralRevMismatch(t *testing.T) {
+	n, _ := emptyDir.apply(1, MustEncodeSet("/ctl/sess/s", "9", Missing))
+	n, _ = n.apply(2, MustEncodeSet("/svc/a", "old", Missing))
+	m, _ := EncodeEphemeral("/svc/a", "x", Missing, "s")
+	n, e := n.apply(3, m)
+	assert.Equal(t, ErrRevMismatch, e.Err)
+
+	_, rev := n.Get("/ctl/link/svc/a")
+	assert.Equal(t, Missing, rev)
+}
+
+func TestNodeApplyEphemeralCtl(t *testing.T) {
+	n, _ := emptyDir.apply(1, MustEncodeSet("/ctl/sess/s", "9", Missing))
+	m, _ := EncodeEphemeral("/ctl/x", "x", Missing, "s")
+	_, e := n.apply(2, m)
+	assert.Equal(t, ErrEphemeralCtl, e.Err)
+}
@@ -0,0 +1,97 @@
+package store
+
+import (
+	"time"
+)
+
+// The number of consecutive seqns whose events share an epoch.
+const epochLen = 1024
+
+// An epoch holds the events for epochLen consecutive seqns. The garbage
+// collector then sees one large object per epoch instead of one per
+// event, and Clean releases a whole epoch by dropping it.
+type epoch struct {
+	evs [epochLen]Event
+	at  [epochLen]int64 // when each event was applied
+}
+
+// The events retained for watches that start in the past, grouped by
+// epoch. It is owned by the process goroutine.
+type eventLog struct {
+	epochs map[int64]*epoch
+}
+
+func newEventLog() *eventLog {
+	return &eventLog{make(map[int64]*epoch)}
+}
+
+func (l *eventLog) epoch(seqn int64) *epoch {
+	k := seqn / epochLen
+	e, ok := l.epochs[k]
+	if !ok {
+		e = new(epoch)
+		l.epochs[k] = e
+	}
+	return e
+}
+
+func (l *eventLog) put(ev Event) {
+	e := l.epoch(ev.Seqn)
+	e.evs[ev.Seqn%epochLen] = ev
+	e.at[ev.Seqn%epochLen] = time.Nanoseconds()
+}
+
+// Returns the time the event at seqn was put in the log, or 0 if there
+// is none.
+func (l *eventLog) appliedAt(seqn int64) int64 {
+	if e, ok := l.epochs[seqn/epochLen]; ok {
+		return e.at[seqn%epochLen]
+	}
+	return 0
+}
+
+// Returns the event at seqn, or the zero Event if there is none.
+func (l *eventLog) get(seqn int64) Event {
+	if e, ok := l.epochs[seqn/epochLen]; ok {
+		return e.evs[seqn%epochLen]
+	}
+	return Event{}
+}
+
+// Counts the events in l, and the slots in l before head.
+func (l *eventLog) stats(head int64) (cs CleanStats) {
+	cs.Head = head
+	for k, e := range l.epochs {
+		for i := range e.evs {
+			if ev := &e.evs[i]; ev.Seqn != 0 {
+				cs.Events++
+				cs.Bytes += int64(len(ev.Mut))
+			} else if s := k*epochLen + int64(i); s > 0 && s < head {
+				cs.Dead++
+			}
+		}
+	}
+	return
+}
+
+// Forgets every event at or before seqn. Whole epochs are dropped; in
+// the epoch holding seqn, the cleaned events are zeroed so the trees
+// and mutations they refer to can be collected.
+func (l *eventLog) release(seqn int64) {
+	last := seqn / epochLen
+	if (seqn+1)%epochLen == 0 {
+		last++
+	}
+
+	for k := range l.epochs {
+		if k < last {
+			l.epochs[k] = nil, false
+		}
+	}
+
+	if e, ok := l.epochs[last]; ok {
+		for i := last * epochLen; i <= seqn; i++ {
+			e.evs[i%epochLen] = Event{}
+		}
+	}
+}
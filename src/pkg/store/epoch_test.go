@@ -0,0 +1,42 @@
+package store
+
+import (
+	"github.com/bmizerany/assert"
+	"testing"
+)
+
+func TestEventLogRelease(t *testing.T) {
+	l := newEventLog()
+	for i := int64(1); i <= 3*epochLen; i++ {
+		l.put(Event{Seqn: i})
+	}
+
+	l.release(epochLen + 5)
+	assert.Equal(t, 2, len(l.epochs))
+	assert.Equal(t, Event{}, l.get(5))
+	assert.Equal(t, Event{}, l.get(epochLen+5))
+	assert.Equal(t, int64(epochLen+6), l.get(epochLen+6).Seqn)
+
+	l.release(2*epochLen - 1)
+	assert.Equal(t, 1, len(l.epochs))
+	assert.Equal(t, int64(2*epochLen), l.get(2*epochLen).Seqn)
+}
+
+func TestStoreWatchFromLog(t *testing.T) {
+	st := New()
+	defer st.Close()
+	mut := MustEncodeSet("/x", "a", Clobber)
+	for i := int64(1); i <= epochLen+1; i++ {
+		st.Ops <- Op{i, mut}
+	}
+	sync(st, epochLen+1)
+
+	st.Clean(epochLen - 1)
+	w, err := NewWatchFrom(st, Any, epochLen)
+	assert.Equal(t, nil, err)
+	ev := <-w.C
+	assert.Equal(t, int64(epochLen), ev.Seqn)
+	assert.Equal(t, mut, ev.Mut)
+	assert.Equal(t, "a", ev.Body)
+	w.Stop()
+}
@@ -0,0 +1,130 @@
+package store
+
+import (
+	"os"
+	"strings"
+)
+
+// What kind of thing went wrong, so that callers can branch on an error
+// without matching its text. Servers send the code of an error to
+// clients where the protocol has one; see CodeOf.
+type Code int
+
+const (
+	CodeOther Code = iota
+	CodeTooLate
+	CodeClosed
+	CodeBadMutation
+	CodeRevMismatch
+	CodeBodyMismatch
+	CodeNotNumber
+	CodeBadPath
+	CodeBadValue
+	CodeNoEnt
+	CodeIsDir
+	CodeNotDir
+	CodeExists
+	CodeFeatureDisabled
+	CodeQuotaExceeded
+	CodeTooManyLinks
+	CodeCtl     // a write that may not touch /ctl
+	CodeCorrupt // a log or snapshot that can't be read
+	CodeNoIndex
+	CodeProtected  // a write to a protected path without force
+	CodeReserved   // a client write to a path only the cluster writes
+	CodeOverLimit  // a write over a body or rate limit
+	CodeOverloaded // a request refused while the server sheds load
+	CodeSyntax     // text, such as a manifest, that can't be parsed
+	CodeNoSession
+)
+
+// An error with a Code. The store's own errors, such as ErrTooLate, are
+// *Errors, so they still compare with ==.
+type Error struct {
+	Code Code
+	Msg  string
+}
+
+func (e *Error) String() string {
+	return e.Msg
+}
+
+// Returns the Code of err. Besides *Error, it knows *BadPathError,
+// *BadValueError, the os errors mutations fail with, and any error with
+// an ErrCode method, for errors that need a type of their own; any
+// other error is CodeOther.
+func CodeOf(err os.Error) Code {
+	switch e := err.(type) {
+	case *Error:
+		return e.Code
+	case interface {
+		ErrCode() Code
+	}:
+		return e.ErrCode()
+	case *BadPathError:
+		return CodeBadPath
+	case *BadValueError:
+		return CodeBadValue
+	}
+
+	switch err {
+	case os.ENOENT:
+		return CodeNoEnt
+	case os.EISDIR:
+		return CodeIsDir
+	case os.ENOTDIR:
+		return CodeNotDir
+	case os.EEXIST:
+		return CodeExists
+	}
+	return CodeOther
+}
+
+// Reports whether err is non-nil and has Code c.
+func IsCode(err os.Error, c Code) bool {
+	return err != nil && CodeOf(err) == c
+}
+
+// Every error a mutation can fail with that has a fixed text, so that
+// errorOf can tell it from its text.
+var fixedErrors = []os.Error{
+	ErrBadMutation,
+	ErrRevMismatch,
+	ErrBodyMismatch,
+	ErrNotNumber,
+	ErrFeatureDisabled,
+	ErrQuotaExceeded,
+	ErrTooManyLinks,
+	ErrBulkCtl,
+	ErrCopyCtl,
+	ErrNoSession,
+	ErrEphemeralCtl,
+	ErrExpiringCtl,
+	ErrBodyLimit,
+	os.ENOENT,
+	os.EISDIR,
+	os.ENOTDIR,
+	os.EEXIST,
+}
+
+// Returns the error whose text, as set at ErrorPath, is msg: the one
+// the mutation failed with, where only its text was kept, so that
+// callers can still compare it or take its Code. Text that matches no
+// known error yields a new error of CodeOther.
+func errorOf(msg string) os.Error {
+	for _, err := range fixedErrors {
+		if err.String() == msg {
+			return err
+		}
+	}
+	if strings.HasPrefix(msg, "bad path: ") {
+		return &BadPathError{msg[len("bad path: "):]}
+	}
+	if strings.HasPrefix(msg, "bad value at ") {
+		// paths hold no spaces
+		if i := strings.Index(msg, ": "); i > 0 {
+			return &BadValueError{msg[len("bad value at "):i], msg[i+2:]}
+		}
+	}
+	return os.NewError(msg)
+}
@@ -0,0 +1,41 @@
+package store
+
+import (
+	"github.com/bmizerany/assert"
+	"os"
+	"testing"
+)
+
+type codedError string
+
+func (e codedError) String() string { return string(e) }
+
+func (e codedError) ErrCode() Code { return CodeOverloaded }
+
+func TestCodeOf(t *testing.T) {
+	assert.Equal(t, CodeTooLate, CodeOf(ErrTooLate))
+	assert.Equal(t, CodeRevMismatch, CodeOf(ErrRevMismatch))
+	assert.Equal(t, CodeCorrupt, CodeOf(ErrBadSnapshot))
+	assert.Equal(t, CodeBadPath, CodeOf(&BadPathError{"x"}))
+	assert.Equal(t, CodeBadValue, CodeOf(&BadValueError{"/x", "no"}))
+	assert.Equal(t, CodeNoEnt, CodeOf(os.ENOENT))
+	assert.Equal(t, CodeExists, CodeOf(os.EEXIST))
+	assert.Equal(t, CodeOverloaded, CodeOf(codedError("busy")))
+	assert.Equal(t, CodeOther, CodeOf(os.NewError("rev mismatch")))
+	assert.Equal(t, CodeOther, CodeOf(nil))
+}
+
+func TestIsCode(t *testing.T) {
+	assert.T(t, IsCode(ErrTooLate, CodeTooLate))
+	assert.T(t, !IsCode(ErrTooLate, CodeClosed))
+	assert.T(t, !IsCode(nil, CodeOther))
+}
+
+func TestErrorOf(t *testing.T) {
+	for _, err := range fixedErrors {
+		assert.Equal(t, err, errorOf(err.String()))
+	}
+	assert.Equal(t, &BadPathError{"x/y"}, errorOf((&BadPathError{"x/y"}).String()))
+	assert.Equal(t, &BadValueError{"/x", "a: b"}, errorOf((&BadValueError{"/x", "a: b"}).String()))
+	assert.Equal(t, os.NewError("no good"), errorOf("no good"))
+}
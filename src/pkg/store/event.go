@@ -22,6 +22,22 @@ type Event struct {
 	Getter
 }
 
+// For a set, returns the BodySum of the body it wrote, which StatInfo.Sum
+// then reports for the file. Otherwise, returns 0. If the file in e's
+// tree still holds what e wrote, this is the sum the tree recorded as
+// the set was applied, and costs no pass over the body.
+func (e Event) Sum() uint32 {
+	if !e.IsSet() {
+		return 0
+	}
+	if n, ok := e.Getter.(node); ok {
+		if m, err := n.at(split(n.fold(e.Path))); err == nil && m.wrote(e) {
+			return m.Sum
+		}
+	}
+	return BodySum(e.Body)
+}
+
 func (e Event) Desc() string {
 	switch {
 	case e.IsSet():
@@ -29,3 +29,27 @@ func TestEventIsDummy(t *testing.T) {
 	assert.Equal(t, false, ev.IsSet())
 	assert.Equal(t, false, ev.IsDel())
 }
+
+func TestEventSum(t *testing.T) {
+	ev := Event{Seqn: 1, Path: "/x", Body: "abc", Rev: 1}
+	assert.Equal(t, uint32(0x352441c2), ev.Sum())
+
+	ev = Event{Seqn: 2, Path: "/x", Rev: Missing}
+	assert.Equal(t, uint32(0), ev.Sum())
+}
+
+func TestEventSumFromTree(t *testing.T) {
+	n, ev := emptyDir.apply(1, MustEncodeSet("/x", "abc", Clobber))
+	m := n.Ds["x"]
+	m.Sum = 7 // as if the tree had it; Sum should read it, not make one
+	n.Ds["x"] = m
+	ev.Getter = n
+	assert.Equal(t, uint32(7), ev.Sum())
+
+	// A batch sets /x twice; the tree holds only the second body.
+	b, _ := EncodeBatch([]string{MustEncodeSet("/x", "a", Clobber), MustEncodeSet("/x", "b", Clobber)})
+	_, ev = emptyDir.apply(1, b)
+	evs := Expand(ev)
+	assert.Equal(t, BodySum("a"), evs[0].Sum())
+	assert.Equal(t, BodySum("b"), evs[1].Sum())
+}
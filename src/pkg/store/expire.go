@@ -0,0 +1,45 @@
+package store
+
+import (
+	"os"
+	"strconv"
+)
+
+// Kind prefix of mutations returned by EncodeExpiring.
+const expKind = "exp"
+
+// Expiries of files; see package ttl.
+const ttlDir = "/ctl/ttl"
+
+var ErrExpiringCtl os.Error = &Error{CodeCtl, "expiry of a file in /ctl"}
+
+// Returns a mutation that sets `path` to `body` as EncodeSet does and,
+// at the same seqn, gives it an expiry by setting /ctl/ttl<path> to
+// "<when> <rev>", where rev is the seqn of the set, so that the file is
+// deleted once the peers' clocks pass `when`, in nanoseconds, unless it
+// has been written since (see package ttl). A file in /ctl can't be
+// given an expiry.
+//
+// The mutation's event is that of a paired set; see encodePaired.
+//
+// If `path` is not valid, returns a `BadPathError`.
+//
+// Gated by the cluster feature level; see mutFeatures.
+func EncodeExpiring(path, body string, rev, when int64) (mutation string, err os.Error) {
+	return encodePaired(expKind, strconv.Itoa64(when), path, body, rev)
+}
+
+// Returns the body of the expiry, at when, of a file set at seqn.
+func expiryBody(when string, seqn int64) string {
+	return when + " " + strconv.Itoa64(seqn)
+}
+
+func (n node) applyExpiring(seqn int64, mut string, bodies *packer) (rep node, ev Event) {
+	when, set, err := decodePaired(mut)
+	if err == nil {
+		if _, e := strconv.Atoi64(when); e != nil {
+			err = ErrBadMutation
+		}
+	}
+	return n.applyPaired(seqn, mut, set, ttlDir, expiryBody(when, seqn), ErrExpiringCtl, err, bodies)
+}
@@ -0,0 +1,50 @@
+package store
+
+import (
+	"github.com/bmizerany/assert"
+	"testing"
+)
+
+func TestExpiringRoundTrip(t *testing.T) {
+	m, err := EncodeExpiring("/a", "1", Missing, 500)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "exp:3:5006:0:/a=1", m)
+
+	_, err = EncodeExpiring("a", "1", Missing, 500)
+	assert.Equal(t, &BadPathError{"a"}, err)
+}
+
+func TestNodeApplyExpiring(t *testing.T) {
+	m, _ := EncodeExpiring("/a", "x", Missing, 500)
+	n, e := emptyDir.apply(3, m)
+	assert.Equal(t, Event{3, "/", "2", nop, m, nil, n}, e)
+
+	v, rev := n.Get("/a")
+	assert.Equal(t, []string{"x"}, v)
+	assert.Equal(t, int64(3), rev)
+	v, rev = n.Get("/ctl/ttl/a")
+	assert.Equal(t, []string{"500 3"}, v)
+	assert.Equal(t, int64(3), rev)
+
+	evs := Expand(e)
+	assert.Equal(t, 2, len(evs))
+	assert.Equal(t, "/a", evs[0].Path)
+	assert.Equal(t, "/ctl/ttl/a", evs[1].Path)
+	assert.Equal(t, "500 3", evs[1].Body)
+}
+
+func TestNodeApplyExpiringRevMismatch(t *testing.T) {
+	n, _ := emptyDir.apply(1, MustEncodeSet("/a", "old", Missing))
+	m, _ := EncodeExpiring("/a", "x", Missing, 500)
+	n, e := n.apply(2, m)
+	assert.Equal(t, ErrRevMismatch, e.Err)
+
+	_, rev := n.Get("/ctl/ttl/a")
+	assert.Equal(t, Missing, rev)
+}
+
+func TestNodeApplyExpiringCtl(t *testing.T) {
+	m, _ := EncodeExpiring("/ctl/x", "x", Missing, 500)
+	_, e := emptyDir.apply(1, m)
+	assert.Equal(t, ErrExpiringCtl, e.Err)
+}
@@ -0,0 +1,120 @@
+package store
+
+import (
+	"os"
+	"strconv"
+	"strings"
+)
+
+// The feature level implemented by this version of package store.
+// Bump it, and record the new level in mutFeatures, whenever a new kind
+// of mutation is added.
+const FeatureLevel = 19
+
+// The feature level from which directory quotas are enforced (see
+// QuotaDir). They change what ordinary writes do, so every peer must
+// enforce them, or none.
+const quotaLevel = 10
+
+// Each peer advertises the feature level it supports in
+// /ctl/node/<id>/feature.
+const (
+	nodeDir     = "/ctl/node"
+	featureFile = "feature"
+)
+
+var ErrFeatureDisabled os.Error = &Error{CodeFeatureDisabled, "feature disabled"}
+
+// Minimum cluster feature level required to apply each kind of
+// mutation, keyed by the mutation's kind prefix (see kindOf). Peers
+// refuse a mutation of a listed kind with ErrFeatureDisabled until every
+// peer in the cluster supports it. Kinds not listed here are always
+// enabled.
+var mutFeatures = map[string]int64{
+	dirKind:       2,
+	bulkKind:      3,
+	existsKind:    4,
+	seqKind:       5,
+	bodyKind:      6,
+	appendKind:    7,
+	addKind:       8,
+	copyKind:      9,
+	linkKind:      11,
+	batchKind:     13,
+	mkdirKind:     14,
+	touchKind:     15,
+	binaryKind:    16,
+	ephKind:       17,
+	expKind:       18,
+	appendMaxKind: 19,
+}
+
+// Returns the feature level supported by every peer listed in g: the
+// minimum level advertised under /ctl/node. A peer that advertises no
+// level (because it predates feature levels) counts as level 0. If g
+// lists no peers at all, returns FeatureLevel.
+//
+// Because the result depends only on g, every peer computes the same
+// answer at the same seqn, so new mutations are switched on everywhere
+// at once.
+func ClusterFeatureLevel(g Getter) int64 {
+	if n, ok := g.(node); ok && n.Level > 0 && n.LevelRev == n.statTree(nodeDir).TreeRev {
+		return n.Level - 1
+	}
+
+	nodes := Getdir(g, nodeDir)
+	if len(nodes) == 0 {
+		return FeatureLevel
+	}
+
+	var min int64 = FeatureLevel
+	for _, id := range nodes {
+		// on err, n==0, which is just what we want.
+		n, _ := strconv.Atoi64(GetString(g, nodeDir+"/"+id+"/"+featureFile))
+		if n < min {
+			min = n
+		}
+	}
+	return min
+}
+
+// Returns n, a root, with its cluster feature level kept on it, so that
+// the checks of the mutations applied to it needn't read every peer's
+// feature file again. The level carries over to the trees they make
+// until something under /ctl/node changes, and then it is read again.
+func (n node) withLevel() node {
+	rev := n.statTree(nodeDir).TreeRev
+	if n.Level > 0 && n.LevelRev == rev {
+		return n
+	}
+
+	n.Level = 0
+	n.Level, n.LevelRev = ClusterFeatureLevel(n)+1, rev
+	return n
+}
+
+// Returns the kind prefix of mut, e.g. "nop" for Nop, or "" for an
+// ordinary set or del mutation (which begins with a numeric rev). A
+// mutation in the binary format has its version byte as its kind.
+func kindOf(mut string) string {
+	if len(mut) > 0 && mut[:1] == binaryKind {
+		return binaryKind
+	}
+	i := strings.Index(mut, ":")
+	if i < 1 {
+		return ""
+	}
+	switch c := mut[0]; {
+	case c == '-', '0' <= c && c <= '9':
+		return ""
+	}
+	return mut[:i]
+}
+
+func checkFeature(g Getter, mut string) os.Error {
+	need, ok := mutFeatures[kindOf(mut)]
+	if ok && ClusterFeatureLevel(g) < need {
+		return ErrFeatureDisabled
+	}
+	return nil
+}
@@ -0,0 +1,70 @@
+package store
+
+import (
+	"github.com/bmizerany/assert"
+	"testing"
+)
+
+func TestKindOf(t *testing.T) {
+	assert.Equal(t, "nop", kindOf(Nop))
+	assert.Equal(t, "", kindOf(MustEncodeSet("/x", "a", Clobber)))
+	assert.Equal(t, "", kindOf(MustEncodeSet("/x", "a", 5)))
+	assert.Equal(t, "", kindOf(""))
+	assert.Equal(t, "", kindOf(":x"))
+	assert.Equal(t, binaryKind, kindOf(MustEncodeBinarySet("/x", "a:b", Clobber)))
+}
+
+func TestClusterFeatureLevelNoNodes(t *testing.T) {
+	assert.Equal(t, int64(FeatureLevel), ClusterFeatureLevel(emptyDir))
+}
+
+func TestClusterFeatureLevelMin(t *testing.T) {
+	g := emptyDir
+	g, _ = g.apply(1, MustEncodeSet("/ctl/node/a/feature", "7", Clobber))
+	g, _ = g.apply(2, MustEncodeSet("/ctl/node/b/feature", "0", Clobber))
+	assert.Equal(t, int64(0), ClusterFeatureLevel(g))
+}
+
+func TestClusterFeatureLevelMissing(t *testing.T) {
+	g := emptyDir
+	g, _ = g.apply(1, MustEncodeSet("/ctl/node/a/feature", "7", Clobber))
+	g, _ = g.apply(2, MustEncodeSet("/ctl/node/b/addr", "x", Clobber))
+	assert.Equal(t, int64(0), ClusterFeatureLevel(g))
+}
+
+func TestApplyFeatureDisabled(t *testing.T) {
+	mutFeatures["test"] = FeatureLevel + 1
+	defer func() { mutFeatures["test"] = 0, false }()
+
+	g := emptyDir
+	g, _ = g.apply(1, MustEncodeSet("/ctl/node/a/feature", "1", Clobber))
+	_, ev := g.apply(2, "test:x")
+	assert.Equal(t, ErrFeatureDisabled, ev.Err)
+	assert.Equal(t, ErrorPath, ev.Path)
+}
+
+func TestWithLevel(t *testing.T) {
+	n, _ := emptyDir.apply(1, MustEncodeSet("/ctl/node/a/feature", "7", Clobber))
+	n = n.withLevel()
+	assert.Equal(t, int64(8), n.Level)
+
+	rep, _ := n.apply(2, MustEncodeSet("/x", "a", Clobber))
+	assert.Equal(t, int64(8), rep.Level)
+	assert.Equal(t, int64(7), ClusterFeatureLevel(rep))
+
+	// A level kept from before a change under /ctl/node is not used.
+	rep, _ = rep.apply(3, MustEncodeSet("/ctl/node/a/feature", "3", Clobber))
+	assert.Equal(t, int64(3), ClusterFeatureLevel(rep))
+	assert.Equal(t, int64(4), rep.withLevel().Level)
+}
+
+func TestStoreKeepsLevel(t *testing.T) {
+	st := New()
+	defer close(st.Ops)
+	st.Ops <- Op{1, MustEncodeSet("/ctl/node/a/feature", "7", Clobber)}
+	st.Ops <- Op{2, MustEncodeSet("/x", "a", Clobber)}
+	sync(st, 2)
+
+	_, g := st.Snap()
+	assert.Equal(t, int64(8), g.(node).Level)
+}
@@ -0,0 +1,74 @@
+package store
+
+import (
+	"strings"
+)
+
+// Creates a new, empty data store, like New, that folds the case of
+// paths: /Foo and /foo name the same file. This suits a cluster whose
+// clients front a case-insensitive system. Paths are folded to lower
+// case before they are looked up or written, so Get, Walk and events
+// report the folded path, whatever case the mutation used. Watches on
+// the store match their globs as Glob.Fold does.
+//
+// Paths in /ctl keep their case, since they hold peer and session ids.
+// A write to a path that would fold into /ctl without being spelled
+// that way, such as /CTL/x, fails with a BadPathError, so that nothing
+// reaches /ctl past a check of the unfolded path.
+//
+// Peers fold paths as they apply mutations, so a cluster either folds
+// on every peer or on none.
+func NewFoldCase() *Store {
+	root := emptyDir
+	root.Fold = true
+	return newStore(0, root)
+}
+
+// Reports whether st was made by NewFoldCase.
+func (st *Store) FoldsCase() bool {
+	return st.state.root.Fold
+}
+
+// Returns path as n holds it: folded to lower case if n is the root of
+// a store made by NewFoldCase, unless it is in /ctl, whatever its case.
+func (n node) fold(path string) string {
+	if !n.Fold || isCtlFold(path) {
+		return path
+	}
+	return strings.ToLower(path)
+}
+
+// Reports whether g is a store made by NewFoldCase, or a snapshot or
+// event of one.
+func folds(g Getter) bool {
+	switch t := g.(type) {
+	case node:
+		return t.Fold
+	case Event:
+		return folds(t.Getter)
+	case *Store:
+		return t.FoldsCase()
+	}
+	return false
+}
+
+// Like node.fold, for any Getter.
+func foldIn(g Getter, path string) string {
+	if !folds(g) || isCtlFold(path) {
+		return path
+	}
+	return strings.ToLower(path)
+}
+
+// Reports whether path is in /ctl, ignoring case.
+func isCtlFold(path string) bool {
+	return isCtl(strings.ToLower(path))
+}
+
+// Returns glob, or if g folds paths, glob.Fold().
+func foldGlob(g Getter, glob *Glob) *Glob {
+	if !folds(g) {
+		return glob
+	}
+	return glob.Fold()
+}
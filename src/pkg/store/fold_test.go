@@ -0,0 +1,90 @@
+package store
+
+import (
+	"github.com/bmizerany/assert"
+	"testing"
+)
+
+func TestFoldCase(t *testing.T) {
+	st := NewFoldCase()
+	defer close(st.Ops)
+	assert.T(t, st.FoldsCase())
+	assert.T(t, !New().FoldsCase())
+
+	st.Ops <- Op{1, MustEncodeSet("/Foo/Bar", "a", Clobber)}
+	st.Ops <- Op{2, MustEncodeSet("/foo/bar", "b", 1)}
+	st.Ops <- Op{3, MustEncodeSet("/ctl/node/ABC/x", "c", Clobber)}
+	sync(st, 3)
+
+	assert.Equal(t, "b", GetString(st, "/FOO/bar"))
+	assert.Equal(t, []string{"bar"}, Getdir(st, "/foo"))
+	assert.Equal(t, []string{"ABC"}, Getdir(st, "/ctl/node"))
+	assert.Equal(t, "", GetString(st, "/ctl/node/abc/x"))
+}
+
+func TestFoldCaseEvent(t *testing.T) {
+	st := NewFoldCase()
+	defer close(st.Ops)
+	w := NewWatch(st, MustCompileGlob("/A/*"))
+	defer w.Stop()
+
+	st.Ops <- Op{1, MustEncodeSet("/a/B", "x", Clobber)}
+	ev := <-w.C
+	assert.Equal(t, "/a/b", ev.Path)
+}
+
+func TestFoldCaseWalk(t *testing.T) {
+	n := emptyDir
+	n.Fold = true
+	n, _ = n.apply(1, MustEncodeSet("/X/Y", "a", Clobber))
+
+	var paths []string
+	Walk(n, MustCompileGlob("/x/*"), func(path, _ string, _ int64) bool {
+		paths = append(paths, path)
+		return false
+	})
+	assert.Equal(t, []string{"/x/y"}, paths)
+}
+
+func TestFoldCaseReserved(t *testing.T) {
+	st := NewFoldCase()
+	defer close(st.Ops)
+	assert.Equal(t, nil, st.Reserve("/App"))
+	assert.T(t, st.Reserved("/app/x"))
+	assert.T(t, st.Reserved("/APP"))
+}
+
+func TestGlobFold(t *testing.T) {
+	g := MustCompileGlob("/Foo/*")
+	assert.T(t, !g.Match("/foo/x"))
+
+	f := g.Fold()
+	assert.Equal(t, "/Foo/*", f.Pattern)
+	assert.T(t, f.Match("/foo/x"))
+	assert.T(t, f.Match("/FOO/X"))
+	assert.T(t, !f.Match("/bar/x"))
+	assert.Equal(t, f, f.Fold())
+}
+
+func TestFoldCaseCtlSpelling(t *testing.T) {
+	st := NewFoldCase()
+	defer close(st.Ops)
+	st.Ops <- Op{1, MustEncodeSet("/CTL/x", "a", Clobber)}
+	st.Ops <- Op{2, MustEncodeSet("/Ctl", "a", Clobber)}
+	mkdir, _ := EncodeMkdir("/cTl/d", Missing)
+	st.Ops <- Op{3, mkdir}
+	sync(st, 3)
+
+	for _, p := range []string{"/ctl/x", "/CTL/x", "/ctl/d"} {
+		_, rev := st.Get(p)
+		assert.Equal(t, Missing, rev, p)
+	}
+	assert.Equal(t, "bad path: /cTl/d", GetString(st, ErrorPath))
+
+	// A store that doesn't fold takes /CTL as an ordinary path.
+	st2 := New()
+	defer close(st2.Ops)
+	st2.Ops <- Op{1, MustEncodeSet("/CTL/x", "a", Clobber)}
+	sync(st2, 1)
+	assert.Equal(t, "a", GetString(st2, "/CTL/x"))
+}
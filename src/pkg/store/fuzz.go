@@ -0,0 +1,97 @@
+package store
+
+import (
+	"fmt"
+)
+
+// Entry points for fuzzers. Each takes arbitrary bytes and returns 1 if
+// they were a well-formed mutation, 0 otherwise. They panic only if the
+// store itself would have misbehaved: decode or apply panicked, or apply
+// left the tree in a shape no sequence of mutations should produce.
+
+func FuzzDecode(data []byte) int {
+	path, _, _, _, err := decode(string(data))
+	if err != nil {
+		return 0
+	}
+	if anyPath(path) != nil {
+		panic("decode returned bad path " + path)
+	}
+	return 1
+}
+
+// Seed tree for FuzzApply, with a file, a directory, and a nested file,
+// so that mutations have something to collide with.
+var fuzzRoot = func() node {
+	n := emptyDir
+	n, _ = n.apply(1, MustEncodeSet("/x", "a", Clobber))
+	n, _ = n.apply(2, MustEncodeSet("/d/y", "b", Clobber))
+	n, _ = n.apply(3, MustEncodeSet("/d/e/z", "c", Clobber))
+	return n
+}()
+
+func FuzzApply(data []byte) int {
+	mut := string(data)
+	n, ev := fuzzRoot.apply(4, mut)
+	if err := checkTree(n, "/"); err != "" {
+		panic(fmt.Sprintf("apply %q: %s", mut, err))
+	}
+
+	// Every other file must be untouched.
+	written := map[string]bool{}
+	for _, e := range Expand(ev) {
+		written[e.Path] = true
+	}
+	Walk(fuzzRoot, Any, func(path, body string, rev int64) bool {
+		if written[path] {
+			return false
+		}
+		if v, r := n.Get(path); r != rev || v[0] != body {
+			panic(fmt.Sprintf("apply %q clobbered %s", mut, path))
+		}
+		return false
+	})
+
+	if ev.Err != nil {
+		return 0
+	}
+	return 1
+}
+
+// Returns a description of the first structural problem in n, or "".
+// A directory must have entries (except the root), only a directory
+// may have them, and a directory's totals must match its entries.
+func checkTree(n node, path string) string {
+	if n.Rev != Dir {
+		if len(n.Ds) > 0 {
+			return "file with entries at " + path
+		}
+		if n.Sum != BodySum(n.body()) {
+			return "wrong checksum at " + path
+		}
+		return ""
+	}
+
+	if len(n.Ds) == 0 && path != "/" && !n.Kept {
+		return "empty directory at " + path
+	}
+
+	var desc, bytes int64
+	for _, m := range n.Ds {
+		d, b := m.weight(true)
+		desc, bytes = desc+d, bytes+b
+	}
+	if desc != n.Desc || bytes != n.Bytes {
+		return "wrong totals at " + path
+	}
+
+	if path == "/" {
+		path = ""
+	}
+	for name, m := range n.Ds {
+		if s := checkTree(m, path+"/"+name); s != "" {
+			return s
+		}
+	}
+	return ""
+}
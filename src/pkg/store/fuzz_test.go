@@ -0,0 +1,167 @@
+package store
+
+import (
+	"github.com/bmizerany/assert"
+	"rand"
+	"testing"
+)
+
+var fuzzCorpus = []string{
+	"",
+	":",
+	"=",
+	"nop:",
+	"nop",
+	"-1:",
+	"-1:/",
+	"-1:/=a",
+	"-1://",
+	"-1:/x",
+	"-1:/x/y",
+	"-1:/x/y=a",
+	"-1:/d",
+	"-1:/d=a",
+	"-1:/d/e",
+	"-1:/d/e/z/w",
+	"0:/d/y=a",
+	"-2:/x=a",
+	"-3:/x=a",
+	"99999999999999999999:/x=a",
+	"-1:/ctl/err=a",
+	"x:/x=a",
+	"x:y:z",
+	"1:/x=a=b:c",
+	"\x00:/x",
+	"-1:/\xff",
+	"dir:",
+	"dir:0",
+	"dir:0:",
+	"dir:x:-1:/d/q=a",
+	"dir:0:-1:/d/q=a",
+	"dir:99:-1:/x/q",
+	"dir:0:dir:0:-1:/d/q=a",
+	"bulk:",
+	"bulk:x:",
+	"bulk:99:-1:/x",
+	"bulk:5:-1:/x",
+	"bulk:7:-1:/x=b7:-1:/q=c",
+	"bulk:4:nop:",
+	"bulk:11:-1:/ctl/a=b",
+	"bulk:5:-1:/x9:-1:/x/q=a",
+	"bulk:7:-1:/x=a6:0:/x=b",
+	"bulk:14:bulk:7:-1:/x=a",
+	"batch:",
+	"batch:x:",
+	"batch:99:-1:/x",
+	"batch:7:-1:/x=b6:0:/x=c",
+	"batch:11:-1:/ctl/a=b",
+	"batch:4:nop:",
+	"batch:15:batch:7:-1:/x=a",
+	"mkdir:",
+	"mkdir:0:/q=",
+	"mkdir:0:/q=a",
+	"mkdir:-1:/d=",
+	"mkdir:0:/x/q=",
+	"mkdir:-1:/=",
+	"mkdir:-1:/q",
+	"touch:",
+	"touch:-1:/x",
+	"touch:-1:/d",
+	"touch:-1:/q",
+	"touch:0:/x=a",
+	"\x01",
+	"\x01s",
+	"\x01s\xff\xff\xff\xff\xff\xff\xff\xff\x00\x02/xb",
+	"\x01s\xff\xff\xff\xff\xff\xff\xff\xff\x00\x02/d",
+	"\x01s\x00\x00\x00\x00\x00\x00\x00\x00\x00\x04/q/r",
+	"\x01s\xff\xff\xff\xff\xff\xff\xff\xff\x00\x09/x",
+	"\x01s\xff\xff\xff\xff\xff\xff\xff\xff\x00\x00a",
+	"\x01d\xff\xff\xff\xff\xff\xff\xff\xff\x00\x02/x",
+	"\x01d\xff\xff\xff\xff\xff\xff\xff\xff\x00\x02/xa",
+	"\x01x\xff\xff\xff\xff\xff\xff\xff\xff\x00\x02/x",
+	"dir:0:\x01s\xff\xff\xff\xff\xff\xff\xff\xff\x00\x04/d/q",
+	"bulk:14:\x01d\xff\xff\xff\xff\xff\xff\xff\xff\x00\x02/x",
+	"exists:",
+	"exists:1:-1:/x=b",
+	"exists:1:-1:/q",
+	"exists:0:-1:/x=b",
+	"exists:0:-1:/d",
+	"exists:9:-1:/x",
+	"exists:1:exists:1:-1:/x=b",
+	"seq:",
+	"seq:/q/",
+	"seq:/q/=a",
+	"seq:/x/=a",
+	"seq:/d=a",
+	"seq:-1:/q/=a",
+	"body:",
+	"body:x:-1:/x=b",
+	"body:86f7e437faa5a7fce15d1ddcb9eaeaea377667b8:-1:/x=b",
+	"body:86f7e437faa5a7fce15d1ddcb9eaeaea377667b8:-1:/x",
+	"body:da39a3ee5e6b4b0d3255bfef95601890afd80709:-1:/d=b",
+	"append:",
+	"append:-1:/x=b",
+	"append:-1:/x",
+	"append:-1:/d=b",
+	"append:0:/x=b",
+	"append:-1:/q=",
+	"add:",
+	"add:-1:/n=1",
+	"add:-1:/n=x",
+	"add:-1:/n",
+	"add:-1:/x=1",
+	"add:-1:/d=1",
+	"add:-1:/n=-9223372036854775808",
+	"copy:",
+	"copy:0:/q=/x",
+	"copy:0:/q=/d",
+	"copy:0:/d/e/q=/d",
+	"copy:-1:/x=/d/y",
+	"copy:-1:/x=/d",
+	"copy:-1:/d=/x",
+	"copy:0:/q=/nope",
+	"copy:0:/q=x",
+	"copy:0:/q",
+	"copy:0:/x/q=/d",
+	"copy:0:/ctl/q=/x",
+	"copy:0:/q=/",
+	"link:0:/l=/x",
+	"link:-1:/x=/d",
+	"link:-1:/d=/x",
+	"link:0:/l=x",
+	"link:0:/l",
+	"link:",
+}
+
+func TestFuzzCorpus(t *testing.T) {
+	for _, m := range fuzzCorpus {
+		FuzzDecode([]byte(m))
+		FuzzApply([]byte(m))
+	}
+}
+
+func TestFuzzRandom(t *testing.T) {
+	alphabet := []byte("-019:/=xyzde.\n\x00")
+	r := rand.New(rand.NewSource(1))
+	for i := 0; i < 10000; i++ {
+		b := make([]byte, r.Intn(16))
+		for j := range b {
+			b[j] = alphabet[r.Intn(len(alphabet))]
+		}
+		FuzzDecode(b)
+		FuzzApply(b)
+	}
+}
+
+func TestFuzzApplyWellFormed(t *testing.T) {
+	assert.Equal(t, 1, FuzzApply([]byte("-1:/x=b")))
+	assert.Equal(t, 0, FuzzApply([]byte("-1:/x/y=b")))
+}
+
+func TestNodeDelMissingUnderFile(t *testing.T) {
+	r, _ := emptyDir.apply(1, MustEncodeSet("/x", "a", Clobber))
+	n, e := r.apply(2, MustEncodeDel("/x/y", Clobber))
+	assert.Equal(t, r, n)
+	assert.Equal(t, Missing, e.Rev)
+	assert.Equal(t, nil, e.Err)
+}
@@ -2,6 +2,7 @@ package store
 
 import (
 	"sort"
+	"strings"
 )
 
 type Getter interface {
@@ -40,6 +41,192 @@ func Getdir(g Getter, path string) (entries []string) {
 	return v
 }
 
+// Returns the rev of the directory at `path` in `g`: the seqn at which an
+// entry was last added to or removed from it. Returns 0 if `path` is
+// missing or is not a directory.
+func DirRev(g Getter, path string) int64 {
+	switch t := g.(type) {
+	case node:
+		return t.dirRev(path)
+	case Event:
+		return DirRev(t.Getter, path)
+	case *Store:
+		_, g := t.Snap()
+		return DirRev(g, path)
+	}
+	return 0
+}
+
+// Describes a file or directory, as returned by StatOf.
+//
+// TODO record which session or client made a file, once requests carry
+// any notion of who sent them.
+type StatInfo struct {
+	Len int32 // of a file's body, or a directory's entries
+	Rev int64 // as from Get: Dir for a directory, Missing if absent
+
+	// The seqn at which the file or directory was created, and the one
+	// at which it was last changed: the rev of a file, or for a
+	// directory, the last seqn an entry was added or removed.
+	Created, Modified int64
+
+	// For a file, the BodySum of its body. Zero for a directory.
+	Sum uint32
+
+	// For a missing path, the seqn at which it was deleted, if the store
+	// remembers; see KeepTombstones. Zero otherwise.
+	Deleted int64
+}
+
+// Returns a description of the file or directory at `path` in `g`. If
+// `g` doesn't record more than Stat tells, Created is 0, and Sum is
+// computed from the body.
+func StatOf(g Getter, path string) StatInfo {
+	switch t := g.(type) {
+	case node:
+		return t.statInfo(path)
+	case Event:
+		return StatOf(t.Getter, path)
+	case *Store:
+		ver, g := t.Snap()
+		si := StatOf(g, path)
+		if si.Rev == Missing {
+			if d := t.Deleted(path); d <= ver {
+				si.Deleted = d
+			}
+		}
+		return si
+	}
+
+	ln, rev := g.Stat(path)
+	si := StatInfo{Len: ln, Rev: rev}
+	if rev > Missing {
+		si.Modified = rev
+		si.Sum = BodySum(GetString(g, path))
+	}
+	return si
+}
+
+// Sums up everything under a directory, as returned by StatTree.
+type TreeStat struct {
+	Descendants int64 // files and directories, at any depth
+	Bytes       int64 // in the bodies of those files
+	Rev         int64 // the last seqn at which anything under it changed
+}
+
+// Returns totals for the tree rooted at `path` in `g`. The root itself
+// is not counted among the descendants. If `path` is a file, only its
+// size and rev are counted; if it is missing, the result is zero.
+//
+// For a node, as held by a Store snapshot, this takes constant time:
+// each directory keeps its totals as it changes. Other Getters are
+// walked.
+func StatTree(g Getter, path string) TreeStat {
+	switch t := g.(type) {
+	case node:
+		return t.statTree(path)
+	case Event:
+		return StatTree(t.Getter, path)
+	case *Store:
+		_, g := t.Snap()
+		return StatTree(g, path)
+	}
+
+	var ts TreeStat
+	statTree(g, path, &ts)
+	return ts
+}
+
+func statTree(g Getter, path string, ts *TreeStat) {
+	v, rev := g.Get(path)
+	switch rev {
+	case Missing:
+		return
+	case Dir:
+		if path == "/" {
+			path = ""
+		}
+		for _, ent := range v {
+			ts.Descendants++
+			statTree(g, path+"/"+ent, ts)
+		}
+	default:
+		ts.Bytes += int64(len(v[0]))
+		if rev > ts.Rev {
+			ts.Rev = rev
+		}
+	}
+}
+
+// Returns the body of every file in the tree rooted at `path` in `g`, by
+// path, all as of one state, so that a reader of a config directory
+// needn't make one Get per file and risk seeing some files from before
+// a change and some from after. If `path` is a file, the result holds
+// just it; if it is missing, the result is empty. A link is returned as
+// a file whose body is the path it points to.
+//
+// Given a *Store, this reads a single snapshot of it.
+func GetTree(g Getter, path string) map[string][]byte {
+	switch t := g.(type) {
+	case Event:
+		return GetTree(t.Getter, path)
+	case *Store:
+		_, g := t.Snap()
+		return GetTree(g, path)
+	}
+
+	files := make(map[string][]byte)
+	getTree(g, foldIn(g, path), files)
+	return files
+}
+
+func getTree(g Getter, path string, files map[string][]byte) {
+	v, rev := g.Get(path)
+	switch rev {
+	case Missing:
+		return
+	case Dir:
+		prefix := path
+		if path == "/" {
+			prefix = ""
+		}
+		for _, ent := range v {
+			getTree(g, prefix+"/"+ent, files)
+		}
+	default:
+		files[path] = []byte(v[0])
+	}
+}
+
+// Calls f with the name of each entry in the directory at `path` in `g`,
+// in the order `g.Get` would list them, but without building the list.
+// Stops early if f returns true. Returns the rev of `path`; f is called
+// only if it is Dir.
+//
+// This is for callers, such as the server's GETDIR, that list large
+// directories often and only need to look at each name once.
+func VisitDir(g Getter, path string, f func(name string) (stop bool)) (rev int64) {
+	switch t := g.(type) {
+	case node:
+		return t.visitDir(path, f)
+	case Event:
+		return VisitDir(t.Getter, path, f)
+	case *Store:
+		_, g := t.Snap()
+		return VisitDir(g, path, f)
+	}
+
+	ents, rev := g.Get(path)
+	if rev == Dir {
+		for _, e := range ents {
+			if f(e) {
+				break
+			}
+		}
+	}
+	return rev
+}
+
 type Visitor func(path, body string, rev int64) (stop bool)
 
 func walk(g Getter, path string, glob *Glob, f Visitor) (stopped bool) {
@@ -56,6 +243,12 @@ func walk(g Getter, path string, glob *Glob, f Visitor) (stopped bool) {
 		path = ""
 	}
 
+	// Entries here are one component deeper than path; if that is
+	// deeper than glob goes, nothing under path can match.
+	if d := glob.depth(); d >= 0 && strings.Count(path, "/") >= d {
+		return
+	}
+
 	sort.SortStrings(v)
 	for _, ent := range v {
 		stopped = walk(g, path+"/"+ent, glob, f)
@@ -67,11 +260,34 @@ func walk(g Getter, path string, glob *Glob, f Visitor) (stopped bool) {
 }
 
 // Walk walks the entries in g, calling f for each file that matches glob.
-// Entries are visited in sorted order.
+// Entries are visited in sorted order. Unless glob holds **, Walk goes
+// no deeper into the tree than glob does.
 // If f returns true, Walk will stop visiting entries and return immediately;
 // Walk won't call f again.
 // Walk returns true if f returned true.
+// If g folds case (see NewFoldCase), glob matches as glob.Fold() does.
 func Walk(g Getter, glob *Glob, f Visitor) (stopped bool) {
 	// TODO find the longest non-glob prefix of glob.Pattern and start there
-	return walk(g, "/", glob, f)
+	return walk(g, "/", foldGlob(g, glob), f)
+}
+
+// WalkPage is like Walk, but visits one page of the matching files: it
+// skips the first offset of them, in sorted order, and stops once it has
+// called f for limit more. A negative limit means no limit. As with
+// Walk, a glob without ** also bounds how deep the walk goes.
+// WalkPage returns true if it stopped before the last matching file,
+// because it reached limit or f returned true. A caller paging through
+// a large directory can then ask for the page at offset+limit.
+func WalkPage(g Getter, glob *Glob, offset, limit int, f Visitor) (more bool) {
+	return Walk(g, glob, func(path, body string, rev int64) bool {
+		if offset > 0 {
+			offset--
+			return false
+		}
+		if limit == 0 {
+			return true
+		}
+		limit--
+		return f(path, body, rev)
+	})
 }
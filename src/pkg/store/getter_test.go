@@ -44,6 +44,60 @@ func TestGetdirString(t *testing.T) {
 	assert.Equal(t, []string(nil), Getdir(st, "/x"))
 }
 
+func TestGetTree(t *testing.T) {
+	st := New()
+	st.Ops <- Op{1, MustEncodeSet("/cfg/a", "1", Clobber)}
+	st.Ops <- Op{2, MustEncodeSet("/cfg/d/b", "2", Clobber)}
+	st.Ops <- Op{3, MustEncodeSet("/other", "3", Clobber)}
+	sync(st, 3)
+
+	exp := map[string][]byte{"/cfg/a": []byte("1"), "/cfg/d/b": []byte("2")}
+	assert.Equal(t, exp, GetTree(st, "/cfg"))
+	assert.Equal(t, map[string][]byte{"/cfg/a": []byte("1")}, GetTree(st, "/cfg/a"))
+	assert.Equal(t, map[string][]byte{}, GetTree(st, "/nope"))
+	assert.Equal(t, 3, len(GetTree(st, "/")))
+}
+
+func TestVisitDir(t *testing.T) {
+	st := New()
+	st.Ops <- Op{1, MustEncodeSet("/x/a", "1", Clobber)}
+	st.Ops <- Op{2, MustEncodeSet("/x/b", "2", Clobber)}
+	st.Ops <- Op{3, MustEncodeSet("/x/c", "3", Clobber)}
+	sync(st, 3)
+
+	var got []string
+	rev := VisitDir(st, "/x", func(name string) bool {
+		got = append(got, name)
+		return false
+	})
+	assert.Equal(t, Dir, rev)
+	assert.Equal(t, Getdir(st, "/x"), got)
+}
+
+func TestVisitDirStop(t *testing.T) {
+	st := New()
+	st.Ops <- Op{1, MustEncodeSet("/x/a", "1", Clobber)}
+	st.Ops <- Op{2, MustEncodeSet("/x/b", "2", Clobber)}
+	sync(st, 2)
+
+	n := 0
+	VisitDir(st, "/x", func(string) bool {
+		n++
+		return true
+	})
+	assert.Equal(t, 1, n)
+}
+
+func TestVisitDirNotDir(t *testing.T) {
+	st := New()
+	st.Ops <- Op{1, MustEncodeSet("/x", "a", Clobber)}
+	sync(st, 1)
+
+	f := func(string) bool { panic("called") }
+	assert.Equal(t, int64(1), VisitDir(st, "/x", f))
+	assert.Equal(t, Missing, VisitDir(st, "/y", f))
+}
+
 func TestWalk(t *testing.T) {
 	exp := map[string]string{
 		"/d/x":   "1",
@@ -127,3 +181,82 @@ func TestWalkStop(t *testing.T) {
 	assert.Equal(t, true, b)
 	assert.Equal(t, 1, c)
 }
+
+func TestWalkPage(t *testing.T) {
+	st := New()
+	st.Ops <- Op{1, MustEncodeSet("/d/a", "1", Clobber)}
+	st.Ops <- Op{2, MustEncodeSet("/d/b", "2", Clobber)}
+	st.Ops <- Op{3, MustEncodeSet("/d/c/x", "3", Clobber)}
+	st.Ops <- Op{4, MustEncodeSet("/d/d", "4", Clobber)}
+	st.Ops <- Op{5, MustEncodeSet("/e", "5", Clobber)}
+	sync(st, 5)
+
+	page := func(offset, limit int) (paths []string, more bool) {
+		more = WalkPage(st, MustCompileGlob("/d/**"), offset, limit, func(path, _ string, _ int64) bool {
+			paths = append(paths, path)
+			return false
+		})
+		return paths, more
+	}
+
+	paths, more := page(0, 2)
+	assert.Equal(t, []string{"/d/a", "/d/b"}, paths)
+	assert.Equal(t, true, more)
+
+	paths, more = page(2, 2)
+	assert.Equal(t, []string{"/d/c/x", "/d/d"}, paths)
+	assert.Equal(t, false, more)
+
+	paths, more = page(1, -1)
+	assert.Equal(t, []string{"/d/b", "/d/c/x", "/d/d"}, paths)
+	assert.Equal(t, false, more)
+
+	paths, more = page(4, 2)
+	assert.Equal(t, []string(nil), paths)
+	assert.Equal(t, false, more)
+}
+
+func TestWalkPageStop(t *testing.T) {
+	st := New()
+	st.Ops <- Op{1, MustEncodeSet("/a", "1", Clobber)}
+	st.Ops <- Op{2, MustEncodeSet("/b", "2", Clobber)}
+	sync(st, 2)
+
+	var c int
+	more := WalkPage(st, Any, 0, -1, func(string, string, int64) bool {
+		c++
+		return true
+	})
+	assert.Equal(t, true, more)
+	assert.Equal(t, 1, c)
+}
+
+// A Getter that records the paths it is asked for.
+type recordGetter struct {
+	Getter
+	paths []string
+}
+
+func (g *recordGetter) Get(path string) ([]string, int64) {
+	g.paths = append(g.paths, path)
+	return g.Getter.Get(path)
+}
+
+func TestWalkDepth(t *testing.T) {
+	st := New()
+	st.Ops <- Op{1, MustEncodeSet("/d/a", "1", Clobber)}
+	st.Ops <- Op{2, MustEncodeSet("/d/c/x", "2", Clobber)}
+	sync(st, 2)
+
+	_, g := st.Snap()
+	rg := &recordGetter{Getter: g}
+	var paths []string
+	Walk(rg, MustCompileGlob("/*/*"), func(path, _ string, _ int64) bool {
+		paths = append(paths, path)
+		return false
+	})
+	assert.Equal(t, []string{"/d/a"}, paths)
+	for _, p := range rg.paths {
+		assert.NotEqual(t, "/d/c/x", p)
+	}
+}
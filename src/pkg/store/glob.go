@@ -18,16 +18,15 @@ type Glob struct {
 	Pattern string         // original glob pattern
 	s       string         // translated to regexp pattern
 	r       *regexp.Regexp // compiled regexp
+	fold    bool           // see Fold
 }
 
-var globRe = mustBuildRe(`(` + charPat + `|[\*\?])`)
-
 // Supports unix/ruby-style glob patterns:
 //  - `?` matches a single char in a single path component
 //  - `*` matches zero or more chars in a single path component
 //  - `**` matches zero or more chars in zero or more components
 func translateGlob(pat string) (string, os.Error) {
-	if !globRe.MatchString(pat) {
+	if !goodPath(pat, true) {
 		return "", GlobError(pat)
 	}
 
@@ -38,7 +37,7 @@ func translateGlob(pat string) (string, os.Error) {
 		default:
 			outs[i] = string(c)
 			double = false
-		case '.', '+', '-', '^', '$', '[', ']', '(', ')':
+		case '.', '+', '-', '^', '$', '[', ']', '(', ')', '|', '{', '}', '\\':
 			outs[i] = `\` + string(c)
 			double = false
 		case '?':
@@ -72,7 +71,7 @@ func CompileGlob(pat string) (*Glob, os.Error) {
 		return nil, err
 	}
 
-	return &Glob{pat, s, r}, nil
+	return &Glob{pat, s, r, false}, nil
 }
 
 // MustCompileGlob is like CompileGlob, but it panics if an error occurs,
@@ -85,10 +84,35 @@ func MustCompileGlob(pat string) *Glob {
 	return g
 }
 
+// Returns a Glob for the same pattern that ignores case: it matches
+// path if the lower-case pattern matches the lower-case path. This is
+// how globs match in a store made by NewFoldCase; Walk and the store's
+// watches use it there whether or not they are given it.
+func (g *Glob) Fold() *Glob {
+	if g.fold {
+		return g
+	}
+
+	s, _ := translateGlob(strings.ToLower(g.Pattern))
+	return &Glob{g.Pattern, s, regexp.MustCompile(s), true}
+}
+
 func (g *Glob) Match(path string) bool {
+	if g.fold {
+		path = strings.ToLower(path)
+	}
 	return g.r.MatchString(path)
 }
 
+// Returns how many components a path g matches has, or -1 if g holds
+// ** and so matches paths of any depth.
+func (g *Glob) depth() int {
+	if strings.Contains(g.Pattern, "**") {
+		return -1
+	}
+	return strings.Count(g.Pattern, "/")
+}
+
 type GlobError string
 
 func (e GlobError) String() string {
@@ -0,0 +1,205 @@
+package store
+
+import (
+	"json"
+	"os"
+	"sort"
+)
+
+var ErrNoIndex os.Error = &Error{CodeNoIndex, "no index for glob"}
+
+// Returns the key under which an index files a body. See Index.
+type KeyFunc func(body string) (key string, ok bool)
+
+// Reverse maps from key to path for the files matching a glob, kept by
+// the process goroutine as it applies each mutation. See Index.
+type index struct {
+	glob  *Glob
+	key   KeyFunc
+	paths map[string]string          // path -> key
+	byKey map[string]map[string]bool // key -> paths
+}
+
+type indexOp struct {
+	glob *Glob
+	key  KeyFunc
+	done chan bool
+}
+
+type findQuery struct {
+	glob  *Glob
+	value string
+	ch    chan []string // nil if there is no such index
+}
+
+// Has st keep an index of the files matching glob by the key that key
+// returns for each body, so that FindByValue can say which paths hold a
+// given key without walking the tree. A file for which key returns
+// false, or panics, is left out. If key is nil, the whole body is the
+// key. Registering glob again replaces its index.
+//
+// The index is built from the tree as it is now, and kept up to date as
+// mutations are applied, by the goroutine that applies them, so key
+// must be quick and must not use st. Indexes are local: a peer answers
+// FindByValue from its own.
+//
+// If st is closed, returns ErrClosed.
+func (st *Store) Index(glob *Glob, key KeyFunc) os.Error {
+	if key == nil {
+		key = wholeBody
+	}
+
+	op := indexOp{foldGlob(st, glob), key, make(chan bool, 1)}
+	select {
+	case st.indexCh <- op:
+	case <-st.done:
+		return ErrClosed
+	}
+	<-op.done
+	return nil
+}
+
+// Returns the paths, in order, of the files matching glob whose key is
+// value, in the index registered for glob with Index, as of the latest
+// mutation applied. Service registries use this to find which paths
+// hold an address.
+//
+// If there is no index for glob, returns ErrNoIndex. If st is closed,
+// returns ErrClosed.
+func (st *Store) FindByValue(glob *Glob, value string) ([]string, os.Error) {
+	q := findQuery{foldGlob(st, glob), value, make(chan []string, 1)}
+	select {
+	case st.findCh <- q:
+	case <-st.done:
+		return nil, ErrClosed
+	}
+
+	paths := <-q.ch
+	if paths == nil {
+		return nil, ErrNoIndex
+	}
+	return paths, nil
+}
+
+// Returns a KeyFunc that files a body that is a JSON object by the
+// string in its field, as a registry of services keyed by address
+// needs:
+//
+//	st.Index(MustCompileGlob("/svc/*/*"), JSONKey("addr"))
+//
+// Other bodies are left out.
+func JSONKey(field string) KeyFunc {
+	return func(body string) (string, bool) {
+		var m map[string]interface{}
+		if json.Unmarshal([]byte(body), &m) != nil {
+			return "", false
+		}
+		s, ok := m[field].(string)
+		return s, ok
+	}
+}
+
+func wholeBody(body string) (string, bool) {
+	return body, true
+}
+
+func newIndex(glob *Glob, key KeyFunc, root node) *index {
+	x := &index{
+		glob:  glob,
+		key:   key,
+		paths: make(map[string]string),
+		byKey: make(map[string]map[string]bool),
+	}
+	Walk(root, glob, func(path, body string, _ int64) bool {
+		x.put(path, body)
+		return false
+	})
+	return x
+}
+
+// Records the writes in ev in every index whose glob they match.
+func indexEvent(xs []*index, ev Event) {
+	if len(xs) == 0 {
+		return
+	}
+
+	for _, e := range Expand(ev) {
+		for _, x := range xs {
+			if !x.glob.Match(e.Path) {
+				continue
+			}
+			switch {
+			case e.IsSet():
+				x.put(e.Path, e.Body)
+			case e.IsDel():
+				x.remove(e.Path)
+			}
+		}
+	}
+}
+
+func (x *index) put(path, body string) {
+	x.remove(path)
+
+	k, ok := x.keyOf(body)
+	if !ok {
+		return
+	}
+	x.paths[path] = k
+	if x.byKey[k] == nil {
+		x.byKey[k] = make(map[string]bool)
+	}
+	x.byKey[k][path] = true
+}
+
+func (x *index) remove(path string) {
+	k, ok := x.paths[path]
+	if !ok {
+		return
+	}
+	x.paths[path] = "", false
+	x.byKey[k][path] = false, false
+	if len(x.byKey[k]) == 0 {
+		x.byKey[k] = nil, false
+	}
+}
+
+func (x *index) keyOf(body string) (k string, ok bool) {
+	defer func() {
+		if recover() != nil {
+			k, ok = "", false
+		}
+	}()
+	return x.key(body)
+}
+
+func (x *index) find(value string) []string {
+	paths := make([]string, 0, len(x.byKey[value]))
+	for p := range x.byKey[value] {
+		paths = append(paths, p)
+	}
+	sort.SortStrings(paths)
+	return paths
+}
+
+func (st *Store) addIndex(op indexOp, root node) {
+	for i, x := range st.indexes {
+		if x.glob.Pattern == op.glob.Pattern {
+			st.indexes[i] = newIndex(op.glob, op.key, root)
+			op.done <- true
+			return
+		}
+	}
+	st.indexes = append(st.indexes, newIndex(op.glob, op.key, root))
+	op.done <- true
+}
+
+func (st *Store) findByValue(q findQuery) {
+	for _, x := range st.indexes {
+		if x.glob.Pattern == q.glob.Pattern {
+			q.ch <- x.find(q.value)
+			return
+		}
+	}
+	q.ch <- nil
+}
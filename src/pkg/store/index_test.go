@@ -0,0 +1,94 @@
+package store
+
+import (
+	"github.com/bmizerany/assert"
+	"testing"
+)
+
+func TestIndex(t *testing.T) {
+	st := New()
+	defer close(st.Ops)
+
+	st.Ops <- Op{1, MustEncodeSet("/svc/a", "10.0.0.1", Clobber)}
+	sync(st, 1)
+
+	glob := MustCompileGlob("/svc/*")
+	assert.Equal(t, nil, st.Index(glob, nil))
+
+	st.Ops <- Op{2, MustEncodeSet("/svc/b", "10.0.0.1", Clobber)}
+	st.Ops <- Op{3, MustEncodeSet("/svc/c", "10.0.0.2", Clobber)}
+	st.Ops <- Op{4, MustEncodeSet("/other", "10.0.0.1", Clobber)}
+	sync(st, 4)
+
+	paths, err := st.FindByValue(glob, "10.0.0.1")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, []string{"/svc/a", "/svc/b"}, paths)
+
+	st.Ops <- Op{5, MustEncodeSet("/svc/a", "10.0.0.2", Clobber)}
+	st.Ops <- Op{6, MustEncodeDel("/svc/c", Clobber)}
+	sync(st, 6)
+
+	paths, _ = st.FindByValue(glob, "10.0.0.1")
+	assert.Equal(t, []string{"/svc/b"}, paths)
+	paths, _ = st.FindByValue(glob, "10.0.0.2")
+	assert.Equal(t, []string{"/svc/a"}, paths)
+	paths, _ = st.FindByValue(glob, "10.0.0.3")
+	assert.Equal(t, []string{}, paths)
+}
+
+func TestIndexBatch(t *testing.T) {
+	st := New()
+	defer close(st.Ops)
+
+	glob := MustCompileGlob("/svc/*")
+	st.Index(glob, nil)
+
+	m, _ := EncodeBatch([]string{
+		MustEncodeSet("/svc/a", "x", Clobber),
+		MustEncodeSet("/svc/b", "x", Clobber),
+	})
+	st.Ops <- Op{1, m}
+	sync(st, 1)
+
+	paths, _ := st.FindByValue(glob, "x")
+	assert.Equal(t, []string{"/svc/a", "/svc/b"}, paths)
+}
+
+func TestIndexKey(t *testing.T) {
+	st := New()
+	defer close(st.Ops)
+
+	glob := MustCompileGlob("/svc/*")
+	st.Index(glob, JSONKey("addr"))
+	st.Ops <- Op{1, MustEncodeSet("/svc/a", `{"addr":"x","port":1}`, Clobber)}
+	st.Ops <- Op{2, MustEncodeSet("/svc/b", `not json`, Clobber)}
+	st.Ops <- Op{3, MustEncodeSet("/svc/c", `{"addr":7}`, Clobber)}
+	sync(st, 3)
+
+	paths, _ := st.FindByValue(glob, "x")
+	assert.Equal(t, []string{"/svc/a"}, paths)
+	paths, _ = st.FindByValue(glob, `not json`)
+	assert.Equal(t, []string{}, paths)
+}
+
+func TestIndexKeyPanics(t *testing.T) {
+	st := New()
+	defer close(st.Ops)
+
+	glob := MustCompileGlob("/**")
+	st.Index(glob, func(string) (string, bool) { panic("no") })
+	st.Ops <- Op{1, MustEncodeSet("/x", "a", Clobber)}
+	sync(st, 1)
+
+	paths, err := st.FindByValue(glob, "a")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, []string{}, paths)
+}
+
+func TestIndexMissing(t *testing.T) {
+	st := New()
+	defer close(st.Ops)
+
+	_, err := st.FindByValue(MustCompileGlob("/svc/*"), "x")
+	assert.Equal(t, ErrNoIndex, err)
+}
@@ -0,0 +1,89 @@
+package store
+
+import (
+	"expvar"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// Latencies are counted in buckets by powers of two of microseconds, so
+// bucket i holds latencies shorter than 2**i µs. The last bucket also
+// holds everything longer.
+const latBuckets = 32
+
+// A Latency is a histogram of how long events took to reach a watch:
+// the time from an event's application to the moment the store handed
+// it to the watch's channel. A watch's buffer is small, so once its
+// reader falls behind, this tracks how far behind the reader is.
+//
+// It is safe to read a Latency while the store updates it.
+type Latency struct {
+	counts [latBuckets]int64
+}
+
+// Delivery latency across all watches.
+var deliveryLatency = new(Latency)
+
+func init() {
+	expvar.Publish("store.delivery_latency", deliveryLatency)
+}
+
+func (l *Latency) add(ns int64) {
+	i := 0
+	for us := ns / 1000; us > 0 && i < latBuckets-1; us >>= 1 {
+		i++
+	}
+	atomic.AddInt64(&l.counts[i], 1)
+}
+
+// Returns the number of events counted.
+func (l *Latency) Count() (n int64) {
+	for i := range l.counts {
+		n += atomic.AddInt64(&l.counts[i], 0)
+	}
+	return n
+}
+
+// Returns an upper bound, in ns, on the latency of the fraction q of
+// events delivered fastest; for example, Quantile(.99) is the p99.
+// Returns 0 if no events have been counted.
+func (l *Latency) Quantile(q float64) int64 {
+	var counts [latBuckets]int64
+	var n int64
+	for i := range l.counts {
+		counts[i] = atomic.AddInt64(&l.counts[i], 0)
+		n += counts[i]
+	}
+	if n == 0 {
+		return 0
+	}
+
+	need := int64(q*float64(n) + .5)
+	var seen int64
+	for i, c := range counts {
+		seen += c
+		if seen >= need {
+			return (1 << uint(i)) * 1000
+		}
+	}
+	return (1 << latBuckets) * 1000
+}
+
+// Satisfies expvar.Var.
+func (l *Latency) String() string {
+	return `{"count": ` + strconv.Itoa64(l.Count()) +
+		`, "p50": ` + strconv.Itoa64(l.Quantile(.5)) +
+		`, "p99": ` + strconv.Itoa64(l.Quantile(.99)) + `}`
+}
+
+// Records that n has been handed to its watch.
+func (n notice) delivered() {
+	if n.at == 0 {
+		return // not in the log, so its time is unknown
+	}
+
+	d := time.Nanoseconds() - n.at
+	n.w.lat.add(d)
+	deliveryLatency.add(d)
+}
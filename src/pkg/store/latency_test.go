@@ -0,0 +1,47 @@
+package store
+
+import (
+	"github.com/bmizerany/assert"
+	"testing"
+)
+
+func TestLatencyQuantile(t *testing.T) {
+	l := new(Latency)
+	assert.Equal(t, int64(0), l.Quantile(.5))
+
+	for i := 0; i < 98; i++ {
+		l.add(500) // under 1µs
+	}
+	l.add(3e6) // 3ms
+	l.add(3e6)
+
+	assert.Equal(t, int64(100), l.Count())
+	assert.Equal(t, int64(1000), l.Quantile(.5))
+	assert.Equal(t, int64(4096e3), l.Quantile(.99))
+}
+
+func TestLatencyHuge(t *testing.T) {
+	l := new(Latency)
+	l.add(1 << 62)
+	assert.Equal(t, int64(1), l.counts[latBuckets-1])
+}
+
+func TestLatencyString(t *testing.T) {
+	l := new(Latency)
+	l.add(500)
+	assert.Equal(t, `{"count": 1, "p50": 1000, "p99": 1000}`, l.String())
+}
+
+func TestWatchLatency(t *testing.T) {
+	st := New()
+	defer st.Close()
+	wt := NewWatch(st, Any)
+
+	st.Ops <- Op{1, Nop}
+	st.Ops <- Op{2, Nop}
+	<-wt.C
+	<-wt.C
+
+	assert.Equal(t, int64(2), wt.Latency().Count())
+	assert.NotEqual(t, int64(0), wt.Latency().Quantile(.99))
+}
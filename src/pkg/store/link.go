@@ -0,0 +1,104 @@
+package store
+
+import (
+	"os"
+)
+
+// Kind prefix of mutations returned by EncodeLink.
+const linkKind = "link"
+
+// The most links Follow and Resolve go through before giving up.
+const MaxLinks = 8
+
+var ErrTooManyLinks os.Error = &Error{CodeTooManyLinks, "too many links"}
+
+// Returns a mutation that makes the file at `path` a link to `target`,
+// iff `rev` is greater than or equal to the file's revision at the time
+// of application, as for EncodeSet. A link is a file whose body is the
+// path it points to. Get, Stat and StatOf see the link itself; Follow
+// and Resolve go through it. An ordinary set or del of `path` replaces
+// or removes the link, not its target.
+//
+// If either path is not valid, returns a `BadPathError`.
+//
+// Gated by the cluster feature level; see mutFeatures.
+func EncodeLink(path, target string, rev int64) (mutation string, err os.Error) {
+	if err = checkPath(target); err != nil {
+		return
+	}
+
+	mutation, err = EncodeSet(path, target, rev)
+	if err != nil {
+		return
+	}
+	return linkKind + ":" + mutation, nil
+}
+
+// Returns the path the link at `path` in `g` points to, and true, or
+// false if `path` is not a link. Getters other than a Store, its
+// snapshots and their events hold no links.
+func Readlink(g Getter, path string) (target string, ok bool) {
+	switch t := g.(type) {
+	case node:
+		return t.readlink(path)
+	case Event:
+		return Readlink(t.Getter, path)
+	case *Store:
+		_, g := t.Snap()
+		return Readlink(g, path)
+	}
+	return "", false
+}
+
+// Returns the path that `path` names in `g` once any links are
+// followed: `path` itself if it is not a link. A link to a missing
+// path resolves to that path. If there are more than MaxLinks links in
+// a row, returns ErrTooManyLinks.
+//
+// Only the last component of each path is followed; links don't stand
+// in for the directories above a file.
+func Resolve(g Getter, path string) (string, os.Error) {
+	for i := 0; i <= MaxLinks; i++ {
+		target, ok := Readlink(g, path)
+		if !ok {
+			return path, nil
+		}
+		path = target
+	}
+	return "", ErrTooManyLinks
+}
+
+// Like g.Get, but follows links as Resolve does. If `path` can't be
+// resolved, returns Missing.
+func Follow(g Getter, path string) (values []string, rev int64) {
+	path, err := Resolve(g, path)
+	if err != nil {
+		return []string{""}, Missing
+	}
+	return g.Get(path)
+}
+
+func (n node) readlink(path string) (string, bool) {
+	path = n.fold(path)
+	if err := anyPath(path); err != nil {
+		return "", false
+	}
+
+	m, err := n.at(split(path))
+	if err != nil || !m.Link {
+		return "", false
+	}
+	return m.body(), true
+}
+
+// Returns n with the file at parts, which must exist, marked as a link.
+func (n node) link(parts []string) node {
+	if len(parts) == 0 {
+		n.Link = true
+		return n
+	}
+
+	n.Ds = copyMap(n.Ds)
+	n.Ds[parts[0]] = n.Ds[parts[0]].link(parts[1:])
+	return n
+}
@@ -0,0 +1,87 @@
+package store
+
+import (
+	"github.com/bmizerany/assert"
+	"testing"
+)
+
+func TestLinkRoundTrip(t *testing.T) {
+	m, err := EncodeLink("/a", "/b", Missing)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "link:0:/a=/b", m)
+
+	_, err = EncodeLink("/a", "b", Missing)
+	assert.Equal(t, &BadPathError{"b"}, err)
+}
+
+func TestNodeApplyLink(t *testing.T) {
+	r, _ := emptyDir.apply(1, MustEncodeSet("/m/a", "x", Clobber))
+	m, _ := EncodeLink("/leader", "/m/a", Missing)
+	n, e := r.apply(2, m)
+	assert.Equal(t, Event{2, "/leader", "/m/a", 2, m, nil, n}, e)
+
+	v, rev := n.Get("/leader")
+	assert.Equal(t, []string{"/m/a"}, v)
+	assert.Equal(t, int64(2), rev)
+
+	v, rev = Follow(n, "/leader")
+	assert.Equal(t, []string{"x"}, v)
+	assert.Equal(t, int64(1), rev)
+
+	target, ok := Readlink(n, "/leader")
+	assert.Equal(t, "/m/a", target)
+	assert.T(t, ok)
+
+	_, ok = Readlink(n, "/m/a")
+	assert.T(t, !ok)
+}
+
+func TestNodeSetReplacesLink(t *testing.T) {
+	m, _ := EncodeLink("/l", "/a", Missing)
+	r, _ := emptyDir.apply(1, m)
+	n, _ := r.apply(2, MustEncodeSet("/l", "y", Clobber))
+
+	_, ok := Readlink(n, "/l")
+	assert.T(t, !ok)
+	p, err := Resolve(n, "/l")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "/l", p)
+}
+
+func TestNodeResolveChain(t *testing.T) {
+	m1, _ := EncodeLink("/a", "/b", Clobber)
+	m2, _ := EncodeLink("/b", "/c", Clobber)
+	r, _ := emptyDir.apply(1, m1)
+	r, _ = r.apply(2, m2)
+
+	p, err := Resolve(r, "/a")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "/c", p)
+
+	_, rev := Follow(r, "/a")
+	assert.Equal(t, Missing, rev)
+}
+
+func TestNodeResolveLoop(t *testing.T) {
+	m1, _ := EncodeLink("/a", "/b", Clobber)
+	m2, _ := EncodeLink("/b", "/a", Clobber)
+	r, _ := emptyDir.apply(1, m1)
+	r, _ = r.apply(2, m2)
+
+	_, err := Resolve(r, "/a")
+	assert.Equal(t, ErrTooManyLinks, err)
+
+	_, rev := Follow(r, "/a")
+	assert.Equal(t, Missing, rev)
+}
+
+func TestNodeCopyLink(t *testing.T) {
+	m, _ := EncodeLink("/d/l", "/x", Missing)
+	r, _ := emptyDir.apply(1, m)
+	c, _ := EncodeCopy("/d/l", "/e", Missing)
+	n, _ := r.apply(2, c)
+
+	target, ok := Readlink(n, "/e")
+	assert.Equal(t, "/x", target)
+	assert.T(t, ok)
+}
@@ -0,0 +1,135 @@
+package store
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/hmac"
+	"crypto/subtle"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+)
+
+var (
+	ErrBadLog os.Error = &Error{CodeCorrupt, "bad log"}
+	ErrBadSig os.Error = &Error{CodeCorrupt, "bad log signature"}
+)
+
+// Writes the mutations applied to st from position `from` through its
+// current version to w, one per line, in the form
+//
+//   <seqn> SP <quoted mutation> LF
+//
+// Returns the last position written. If `from` is less than any value
+// passed to st.Clean, Dump will return `ErrTooLate`.
+func (st *Store) Dump(w io.Writer, from int64) (int64, os.Error) {
+	ver, _ := st.Snap()
+	if from > ver {
+		return ver, nil
+	}
+
+	wt, err := st.watchOn(Any, make(chan Event), from, ver+1)
+	if err != nil {
+		return 0, err
+	}
+	defer wt.Stop()
+
+	for n := from; n <= ver; n++ {
+		ev := <-wt.C
+		line := strconv.Itoa64(ev.Seqn) + " " + strconv.Quote(ev.Mut) + "\n"
+		if _, err = io.WriteString(w, line); err != nil {
+			return n - 1, err
+		}
+	}
+	return ver, nil
+}
+
+// Reads a log written by Dump and applies it to a new store, stopping
+// after position `to`. If `to` is less than 1, the entire log is
+// applied. The log must start at position 1 and have no gaps; anything
+// else can't be replayed deterministically and yields `ErrBadLog`.
+func Replay(r io.Reader, to int64) (*Store, os.Error) {
+	st := New()
+	br := bufio.NewReader(r)
+
+	var last int64
+	for to < 1 || last < to {
+		line, err := br.ReadString('\n')
+		if err == os.EOF && line == "" {
+			break
+		} else if err != nil && err != os.EOF {
+			return nil, err
+		}
+
+		parts := strings.Split(strings.TrimRight(line, "\n"), " ", 2)
+		if len(parts) != 2 {
+			return nil, ErrBadLog
+		}
+
+		seqn, err := strconv.Atoi64(parts[0])
+		if err != nil || seqn != last+1 {
+			return nil, ErrBadLog
+		}
+
+		mut, err := strconv.Unquote(parts[1])
+		if err != nil {
+			return nil, ErrBadLog
+		}
+
+		st.Ops <- Op{seqn, mut}
+		last = seqn
+	}
+
+	if last > 0 {
+		ch, err := st.Wait(last)
+		if err != nil {
+			return nil, err
+		}
+		<-ch
+	}
+	return st, nil
+}
+
+// Like Dump, but follows the log with a line
+//
+//   "sig" SP <hex HMAC-SHA256 of the preceding lines> LF
+//
+// keyed by key, so that ReplaySigned can tell whether the log came from
+// a holder of key unchanged.
+func (st *Store) DumpSigned(w io.Writer, from int64, key []byte) (int64, os.Error) {
+	h := hmac.NewSHA256(key)
+	n, err := st.Dump(io.MultiWriter(w, h), from)
+	if err != nil {
+		return n, err
+	}
+	_, err = fmt.Fprintf(w, "sig %x\n", h.Sum())
+	return n, err
+}
+
+// Like Replay, but first checks the signature written by DumpSigned.
+// If it is missing or wasn't made with key, returns ErrBadSig without
+// applying anything.
+func ReplaySigned(r io.Reader, to int64, key []byte) (*Store, os.Error) {
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+
+	i := bytes.LastIndex(bytes.TrimRight(b, "\n"), []byte("\n")) + 1
+	body, sig := b[:i], string(bytes.TrimRight(b[i:], "\n"))
+	if !strings.HasPrefix(sig, "sig ") {
+		return nil, ErrBadSig
+	}
+
+	h := hmac.NewSHA256(key)
+	h.Write(body)
+	exp := fmt.Sprintf("sig %x", h.Sum())
+	if subtle.ConstantTimeCompare([]byte(sig), []byte(exp)) != 1 {
+		return nil, ErrBadSig
+	}
+
+	return Replay(bytes.NewBuffer(body), to)
+}
@@ -0,0 +1,114 @@
+package store
+
+import (
+	"bytes"
+	"github.com/bmizerany/assert"
+	"strings"
+	"testing"
+)
+
+func TestDumpReplay(t *testing.T) {
+	st := New()
+	st.Ops <- Op{1, MustEncodeSet("/x", "a", Clobber)}
+	st.Ops <- Op{2, Nop}
+	st.Ops <- Op{3, MustEncodeSet("/x", "b\nc", Clobber)}
+	st.Ops <- Op{4, MustEncodeDel("/x", Clobber)}
+	<-st.Seqns
+
+	var b bytes.Buffer
+	n, err := st.Dump(&b, 1)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, int64(4), n)
+
+	exp := "1 \"-1:/x=a\"\n2 \"nop:\"\n3 \"-1:/x=b\\nc\"\n4 \"-1:/x\"\n"
+	assert.Equal(t, exp, b.String())
+
+	rs, err := Replay(bytes.NewBufferString(exp), 0)
+	assert.Equal(t, nil, err)
+	ver, _ := rs.Snap()
+	assert.Equal(t, int64(4), ver)
+	_, rev := rs.Get("/x")
+	assert.Equal(t, Missing, rev)
+}
+
+func TestDumpReplayBinary(t *testing.T) {
+	body := "\x00\xff=:\n\"q\""
+	st := New()
+	st.Ops <- Op{1, MustEncodeSet("/x", body, Clobber)}
+	<-st.Seqns
+
+	var b bytes.Buffer
+	_, err := st.Dump(&b, 1)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 1, strings.Count(b.String(), "\n"))
+
+	rs, err := Replay(&b, 0)
+	assert.Equal(t, nil, err)
+	v, _ := rs.Get("/x")
+	assert.Equal(t, []string{body}, v)
+}
+
+func TestReplayTo(t *testing.T) {
+	log := "1 \"-1:/x=a\"\n2 \"nop:\"\n3 \"-1:/x=b\\nc\"\n"
+	rs, err := Replay(bytes.NewBufferString(log), 3)
+	assert.Equal(t, nil, err)
+	v, rev := rs.Get("/x")
+	assert.Equal(t, []string{"b\nc"}, v)
+	assert.Equal(t, int64(3), rev)
+
+	rs, err = Replay(bytes.NewBufferString(log), 1)
+	assert.Equal(t, nil, err)
+	v, _ = rs.Get("/x")
+	assert.Equal(t, []string{"a"}, v)
+}
+
+func TestReplayGap(t *testing.T) {
+	_, err := Replay(bytes.NewBufferString("1 \"nop:\"\n3 \"nop:\"\n"), 0)
+	assert.Equal(t, ErrBadLog, err)
+}
+
+func TestDumpTooLate(t *testing.T) {
+	st := New()
+	st.Ops <- Op{1, Nop}
+	st.Ops <- Op{2, Nop}
+	<-st.Seqns
+	st.Clean(1)
+
+	var b bytes.Buffer
+	_, err := st.Dump(&b, 1)
+	assert.Equal(t, ErrTooLate, err)
+}
+
+func TestDumpSignedReplay(t *testing.T) {
+	st := New()
+	st.Ops <- Op{1, MustEncodeSet("/x", "a", Clobber)}
+	st.Ops <- Op{2, Nop}
+	<-st.Seqns
+
+	var b bytes.Buffer
+	_, err := st.DumpSigned(&b, 1, []byte("k"))
+	assert.Equal(t, nil, err)
+
+	rs, err := ReplaySigned(bytes.NewBuffer(b.Bytes()), 0, []byte("k"))
+	assert.Equal(t, nil, err)
+	v, _ := rs.Get("/x")
+	assert.Equal(t, []string{"a"}, v)
+
+	_, err = ReplaySigned(bytes.NewBuffer(b.Bytes()), 0, []byte("other"))
+	assert.Equal(t, ErrBadSig, err)
+}
+
+func TestReplaySignedTampered(t *testing.T) {
+	st := New()
+	st.Ops <- Op{1, MustEncodeSet("/x", "a", Clobber)}
+	<-st.Seqns
+
+	var b bytes.Buffer
+	st.DumpSigned(&b, 1, []byte("k"))
+	log := strings.Replace(b.String(), "=a", "=b", 1)
+	_, err := ReplaySigned(bytes.NewBufferString(log), 0, []byte("k"))
+	assert.Equal(t, ErrBadSig, err)
+
+	_, err = ReplaySigned(bytes.NewBufferString("1 \"nop:\"\n"), 0, []byte("k"))
+	assert.Equal(t, ErrBadSig, err)
+}
@@ -0,0 +1,91 @@
+package store
+
+import (
+	"os"
+)
+
+// Kind prefix of mutations returned by EncodeMkdir.
+const mkdirKind = "mkdir"
+
+// Returns a mutation that makes an empty directory at `path`, making
+// any missing directories above it as a set would. Unlike a directory
+// made by a write beneath it, this one is kept when its last entry is
+// deleted; a del of `path` itself removes it once it is empty. The
+// directories made on the way to it are ordinary ones.
+//
+// If anything is at `path` already, the mutation fails with os.EEXIST,
+// unless `rev` is Clobber and it is a directory: then that directory is
+// kept from now on, as if it had been made this way.
+//
+// The event of a mkdir has `path` as its Path, an empty Body, and Dir
+// as its Rev.
+//
+// If `path` is not valid, returns a `BadPathError`.
+//
+// Gated by the cluster feature level; see mutFeatures.
+func EncodeMkdir(path string, rev int64) (mutation string, err os.Error) {
+	mutation, err = EncodeSet(path, "", rev)
+	if err != nil {
+		return
+	}
+	return mkdirKind + ":" + mutation, nil
+}
+
+func (n node) applyMkdir(seqn int64, mut string) (rep node, ev Event) {
+	path, body, rev, keep, err := decode(mut[len(mkdirKind)+1:])
+	path = n.fold(path)
+	if err == nil && (!keep || body != "") {
+		err = ErrBadMutation
+	}
+	if err == nil {
+		err = n.checkPathIn(path)
+	}
+	if err == nil {
+		err = n.checkParents(path)
+	}
+	if err == nil {
+		_, curRev := n.Get(path)
+		switch {
+		case curRev == Dir && rev == Clobber:
+			rep = n.markKept(split(path))
+		case curRev != Missing:
+			err = os.EEXIST
+		default:
+			m := emptyDir
+			m.Kept, m.CRev, m.EntRev, m.TreeRev = true, seqn, seqn, seqn
+			rep = n.graft(split(path), m, seqn)
+		}
+	}
+	if err == nil {
+		err = checkQuota(n, rep, path)
+	}
+
+	if err != nil {
+		rep = n.setp(ErrorPath, err.String(), seqn, seqn, true)
+		return rep, Event{seqn, ErrorPath, err.String(), seqn, mut, err, rep}
+	}
+	return rep, Event{seqn, path, "", Dir, mut, nil, rep}
+}
+
+// Returns n with the directory at parts, which must exist, marked as
+// made by EncodeMkdir.
+func (n node) markKept(parts []string) node {
+	if len(parts) == 0 {
+		n.Kept = true
+		return n
+	}
+
+	n.Ds = copyMap(n.Ds)
+	n.Ds[parts[0]] = n.Ds[parts[0]].markKept(parts[1:])
+	return n
+}
+
+// Reports whether path in n is a directory with no entries, other than
+// the root. Only EncodeMkdir makes these, and a del may remove them.
+func (n node) isEmptyDir(path string) bool {
+	if path == "/" {
+		return false
+	}
+	m, err := n.at(split(path))
+	return err == nil && m.Rev == Dir && len(m.Ds) == 0
+}
@@ -0,0 +1,108 @@
+package store
+
+import (
+	"github.com/bmizerany/assert"
+	"os"
+	"testing"
+)
+
+func TestMkdirRoundTrip(t *testing.T) {
+	m, err := EncodeMkdir("/a", Missing)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "mkdir:0:/a=", m)
+
+	_, err = EncodeMkdir("a", Missing)
+	assert.Equal(t, &BadPathError{"a"}, err)
+}
+
+func TestNodeApplyMkdir(t *testing.T) {
+	m, _ := EncodeMkdir("/a/b", Missing)
+	n, e := emptyDir.apply(1, m)
+	assert.Equal(t, Event{1, "/a/b", "", Dir, m, nil, n}, e)
+	assert.T(t, e.IsNop())
+	assert.Equal(t, []string{}, Getdir(n, "/a/b"))
+	assert.Equal(t, []string{"b"}, Getdir(n, "/a"))
+	assert.Equal(t, TreeStat{2, 0, 1}, StatTree(n, "/"))
+	assert.Equal(t, "", checkTree(n, "/"))
+}
+
+func TestNodeMkdirKeptAfterDel(t *testing.T) {
+	m, _ := EncodeMkdir("/d", Missing)
+	n, _ := emptyDir.apply(1, m)
+	n, _ = n.apply(2, MustEncodeSet("/d/x", "1", Clobber))
+	n, e := n.apply(3, MustEncodeDel("/d/x", Clobber))
+	assert.Equal(t, nil, e.Err)
+
+	v, rev := n.Get("/d")
+	assert.Equal(t, []string{}, v)
+	assert.Equal(t, Dir, rev)
+	assert.Equal(t, "", checkTree(n, "/"))
+}
+
+func TestNodeMkdirParentsNotKept(t *testing.T) {
+	m, _ := EncodeMkdir("/a/b", Missing)
+	n, _ := emptyDir.apply(1, m)
+	n, e := n.apply(2, MustEncodeDel("/a/b", Clobber))
+	assert.Equal(t, nil, e.Err)
+	assert.T(t, e.IsDel())
+
+	_, rev := n.Get("/a")
+	assert.Equal(t, Missing, rev)
+	assert.Equal(t, "", checkTree(n, "/"))
+}
+
+func TestNodeDelNonEmptyDir(t *testing.T) {
+	m, _ := EncodeMkdir("/d", Missing)
+	n, _ := emptyDir.apply(1, m)
+	n, _ = n.apply(2, MustEncodeSet("/d/x", "1", Clobber))
+	_, e := n.apply(3, MustEncodeDel("/d", Clobber))
+	assert.Equal(t, os.EISDIR, e.Err)
+
+	_, e = n.apply(3, MustEncodeSet("/d", "a", Clobber))
+	assert.Equal(t, os.EISDIR, e.Err)
+
+	_, e = emptyDir.apply(1, MustEncodeDel("/", Clobber))
+	assert.Equal(t, os.EISDIR, e.Err)
+}
+
+func TestNodeMkdirExists(t *testing.T) {
+	n, _ := emptyDir.apply(1, MustEncodeSet("/d/x", "1", Clobber))
+	n, _ = n.apply(2, MustEncodeSet("/f", "1", Clobber))
+
+	m, _ := EncodeMkdir("/d", Missing)
+	_, e := n.apply(3, m)
+	assert.Equal(t, os.EEXIST, e.Err)
+
+	m, _ = EncodeMkdir("/f", Clobber)
+	_, e = n.apply(3, m)
+	assert.Equal(t, os.EEXIST, e.Err)
+
+	m, _ = EncodeMkdir("/f/g", Clobber)
+	_, e = n.apply(3, m)
+	assert.Equal(t, os.ENOTDIR, e.Err)
+
+	// With Clobber, an existing directory is kept from then on.
+	m, _ = EncodeMkdir("/d", Clobber)
+	n, e = n.apply(3, m)
+	assert.Equal(t, nil, e.Err)
+	n, _ = n.apply(4, MustEncodeDel("/d/x", Clobber))
+	assert.Equal(t, []string{}, Getdir(n, "/d"))
+}
+
+func TestNodeMkdirCopy(t *testing.T) {
+	m, _ := EncodeMkdir("/d/e", Missing)
+	n, _ := emptyDir.apply(1, m)
+	c, _ := EncodeCopy("/d", "/c", Missing)
+	n, e := n.apply(2, c)
+	assert.Equal(t, nil, e.Err)
+	assert.Equal(t, "0", e.Body)
+	assert.Equal(t, []string{}, Getdir(n, "/c/e"))
+	assert.Equal(t, "", checkTree(n, "/"))
+}
+
+func TestNodeApplyMkdirFeature(t *testing.T) {
+	r, _ := emptyDir.apply(1, MustEncodeSet("/ctl/node/a/feature", "13", Clobber))
+	m, _ := EncodeMkdir("/d", Missing)
+	_, e := r.apply(2, m)
+	assert.Equal(t, ErrFeatureDisabled, e.Err)
+}
@@ -8,6 +8,11 @@ var emptyDir = node{V: "", Ds: make(map[string]node), Rev: Dir}
 
 const ErrorPath = "/ctl/err"
 
+// Cluster events are published as writes to files in this directory,
+// one per kind of event, so clients can watch for them. See
+// doc/files.md.
+const EventDir = "/ctl/events"
+
 const Nop = "nop:"
 
 // This structure should be kept immutable.
@@ -15,6 +20,44 @@ type node struct {
 	V   string
 	Rev int64
 	Ds  map[string]node
+
+	// For a directory, the seqn at which an entry was last added or
+	// removed. Zero for a file.
+	EntRev int64
+
+	// The seqn at which the file or directory was created.
+	CRev int64
+
+	// For a directory, totals kept up to date as it changes, so that
+	// StatTree needn't walk it: how many files and directories are
+	// under it, the bytes in those files, and the last seqn at which
+	// anything under it changed. Zero for a file.
+	Desc, Bytes, TreeRev int64
+
+	// Whether the file is a link to the path in V. See EncodeLink.
+	Link bool
+
+	// Set only on the root of a store made by NewFoldCase: whether
+	// paths are folded to lower case before they are looked up or
+	// written. See fold.
+	Fold bool
+
+	// Whether V holds the body compressed, as Store.Compress has large
+	// bodies kept. Read the body with body and its length with size.
+	Zip bool
+
+	// For a directory, whether it was made by EncodeMkdir, and so is
+	// kept when it has no entries.
+	Kept bool
+
+	// For a file, the BodySum of its body as it was set, computed as the
+	// mutation is applied. Zero for a directory.
+	Sum uint32
+
+	// Set only on the root of a store's tree: one more than its
+	// ClusterFeatureLevel, or zero if that is not known yet, and the
+	// TreeRev of /ctl/node it was read at. See withLevel.
+	Level, LevelRev int64
 }
 
 func (n node) String() string {
@@ -31,6 +74,27 @@ func (n node) readdir() []string {
 	return names
 }
 
+func (n node) visitDir(path string, f func(string) bool) int64 {
+	path = n.fold(path)
+	if err := anyPath(path); err != nil {
+		return Missing
+	}
+
+	m, err := n.at(split(path))
+	if err != nil {
+		return Missing
+	}
+
+	if m.Rev == Dir {
+		for name := range m.Ds {
+			if f(name) {
+				break
+			}
+		}
+	}
+	return m.Rev
+}
+
 func (n node) at(parts []string) (node, os.Error) {
 	switch len(parts) {
 	case 0:
@@ -51,17 +115,18 @@ func (n node) get(parts []string) ([]string, int64) {
 	case os.ENOENT:
 		return []string{""}, Missing
 	default:
-		if len(m.Ds) > 0 {
+		if len(m.Ds) > 0 || m.Kept {
 			return m.readdir(), m.Rev
 		} else {
-			return []string{m.V}, m.Rev
+			return []string{m.body()}, m.Rev
 		}
 	}
 	panic("unreachable")
 }
 
 func (n node) Get(path string) ([]string, int64) {
-	if err := checkPath(path); err != nil {
+	path = n.fold(path)
+	if err := anyPath(path); err != nil {
 		return []string{""}, Missing
 	}
 
@@ -77,14 +142,15 @@ func (n node) stat(parts []string) (int32, int64) {
 		if l > 0 {
 			return int32(l), m.Rev
 		} else {
-			return int32(len(m.V)), m.Rev
+			return int32(m.size()), m.Rev
 		}
 	}
 	panic("unreachable")
 }
 
 func (n node) Stat(path string) (int32, int64) {
-	if err := checkPath(path); err != nil {
+	path = n.fold(path)
+	if err := anyPath(path); err != nil {
 		return 0, Missing
 	}
 
@@ -100,29 +166,143 @@ func copyMap(a map[string]node) map[string]node {
 	return b
 }
 
-// Return value is replacement node
-func (n node) set(parts []string, v string, rev int64, keep bool) (node, bool) {
+// Return value is replacement node. sum is the BodySum of the body v
+// holds, which the caller has before it compresses it.
+func (n node) set(parts []string, v string, zip bool, sum uint32, rev, seqn int64, keep bool) (node, bool) {
 	if len(parts) == 0 {
-		return node{v, rev, n.Ds}, keep
+		c := n.CRev
+		if n.Rev == Missing {
+			c = seqn
+		}
+		return node{V: v, Rev: rev, Ds: n.Ds, CRev: c, Zip: zip, Sum: sum}, keep
 	}
 
+	if n.Rev != Dir {
+		n.CRev = seqn
+	}
 	n.Ds = copyMap(n.Ds)
-	p, ok := n.Ds[parts[0]].set(parts[1:], v, rev, keep)
+	old, had := n.Ds[parts[0]]
+	p, ok := old.set(parts[1:], v, zip, sum, rev, seqn, keep)
 	n.Ds[parts[0]] = p, ok
+	if had != ok {
+		n.EntRev = seqn
+	}
+	n.reweigh(old, had, p, ok, seqn)
 	n.Rev = Dir
-	return n, len(n.Ds) > 0
+	return n, len(n.Ds) > 0 || n.Kept
 }
 
-func (n node) setp(k, v string, rev int64, keep bool) node {
-	if err := checkPath(k); err != nil {
+// Returns how much m, if it exists, counts for in its directory's Desc
+// and Bytes.
+func (m node) weight(exists bool) (desc, bytes int64) {
+	switch {
+	case !exists:
+		return 0, 0
+	case m.Rev == Dir:
+		return 1 + m.Desc, m.Bytes
+	}
+	return 1, int64(m.size())
+}
+
+// Updates the totals of n, a directory, for an entry that went from old
+// to m at seqn.
+func (n *node) reweigh(old node, had bool, m node, ok bool, seqn int64) {
+	d0, b0 := old.weight(had)
+	d1, b1 := m.weight(ok)
+	n.Desc += d1 - d0
+	n.Bytes += b1 - b0
+	n.TreeRev = seqn
+}
+
+func (n node) setp(k, v string, rev, seqn int64, keep bool) node {
+	return n.setpz(k, v, false, BodySum(v), rev, seqn, keep)
+}
+
+// Like setp, but v is compressed if zip is set; see node.Zip. sum is
+// the BodySum of the body as it was set.
+func (n node) setpz(k, v string, zip bool, sum uint32, rev, seqn int64, keep bool) node {
+	if err := anyPath(k); err != nil {
 		return n
 	}
 
-	n, _ = n.set(split(k), v, rev, keep)
+	n, _ = n.set(split(k), v, zip, sum, rev, seqn, keep)
 	return n
 }
 
+func (n node) statInfo(path string) (si StatInfo) {
+	path = n.fold(path)
+	if err := anyPath(path); err != nil {
+		si.Rev = Missing
+		return
+	}
+
+	m, err := n.at(split(path))
+	if err != nil {
+		si.Rev = Missing
+		return
+	}
+
+	si.Rev, si.Created = m.Rev, m.CRev
+	if m.Rev == Dir {
+		si.Len, si.Modified = int32(len(m.Ds)), m.EntRev
+	} else {
+		si.Len, si.Modified, si.Sum = int32(m.size()), m.Rev, m.Sum
+	}
+	return
+}
+
+// Returns the totals the node at path keeps for its tree, for StatTree.
+func (n node) statTree(path string) (ts TreeStat) {
+	path = n.fold(path)
+	if err := anyPath(path); err != nil {
+		return
+	}
+
+	m, err := n.at(split(path))
+	if err != nil {
+		return
+	}
+
+	if m.Rev != Dir {
+		return TreeStat{0, int64(m.size()), m.Rev}
+	}
+	return TreeStat{m.Desc, m.Bytes, m.TreeRev}
+}
+
+// Returns the seqn at which an entry was last added to or removed from
+// the directory at path, or 0 if path is not a directory.
+func (n node) dirRev(path string) int64 {
+	path = n.fold(path)
+	m, err := n.at(split(path))
+	if err != nil || m.Rev != Dir {
+		return 0
+	}
+	return m.EntRev
+}
+
+// Returns os.ENOTDIR if a file is in the way of any directory that
+// would have to hold path.
+func (n node) checkParents(path string) os.Error {
+	components := split(path)
+	for i := 0; i < len(components)-1; i++ {
+		_, dirRev := n.get(components[0 : i+1])
+		if dirRev == Missing {
+			break
+		}
+		if dirRev != Dir {
+			return os.ENOTDIR
+		}
+	}
+	return nil
+}
+
 func (n node) apply(seqn int64, mut string) (rep node, ev Event) {
+	return n.applyIn(seqn, mut, nil)
+}
+
+// Like apply, but keeps the body of a set in the form bodies picks (see
+// Store.Compress), if it is not nil.
+func (n node) applyIn(seqn int64, mut string, bodies *packer) (rep node, ev Event) {
 	ev.Seqn, ev.Rev, ev.Mut = seqn, seqn, mut
 	if mut == Nop {
 		ev.Path = "/"
@@ -132,29 +312,55 @@ func (n node) apply(seqn int64, mut string) (rep node, ev Event) {
 		return
 	}
 
+	if kindOf(mut) == bulkKind && checkFeature(n, mut) == nil {
+		return n.applyBulk(seqn, mut, bodies)
+	}
+
+	if kindOf(mut) == copyKind && checkFeature(n, mut) == nil {
+		return n.applyCopy(seqn, mut)
+	}
+
+	if kindOf(mut) == batchKind && checkFeature(n, mut) == nil {
+		return n.applyBatch(seqn, mut, bodies, nil)
+	}
+
+	if kindOf(mut) == mkdirKind && checkFeature(n, mut) == nil {
+		return n.applyMkdir(seqn, mut)
+	}
+
+	if kindOf(mut) == ephKind && checkFeature(n, mut) == nil {
+		return n.applyEphemeral(seqn, mut, bodies)
+	}
+
+	if kindOf(mut) == expKind && checkFeature(n, mut) == nil {
+		return n.applyExpiring(seqn, mut, bodies)
+	}
+
 	var rev int64
 	var keep bool
-	ev.Path, ev.Body, rev, keep, ev.Err = decode(mut)
+	if ev.Err = checkFeature(n, mut); ev.Err == nil {
+		ev.Path, ev.Body, rev, keep, ev.Err = n.decodeCond(seqn, mut)
+		ev.Path = n.fold(ev.Path)
+	}
+
+	if ev.Err == nil {
+		ev.Err = n.checkPathIn(ev.Path)
+	}
+	if ev.Err == nil && kindOf(mut) == linkKind {
+		ev.Err = n.checkPathIn(ev.Body)
+		ev.Body = n.fold(ev.Body)
+	}
 
 	if ev.Err == nil && keep {
-		components := split(ev.Path)
-		for i := 0; i < len(components)-1; i++ {
-			_, dirRev := n.get(components[0 : i+1])
-			if dirRev == Missing {
-				break
-			}
-			if dirRev != Dir {
-				ev.Err = os.ENOTDIR
-				break
-			}
-		}
+		ev.Err = n.checkParents(ev.Path)
 	}
 
+	var curRev int64
 	if ev.Err == nil {
-		_, curRev := n.Get(ev.Path)
+		_, curRev = n.Get(ev.Path)
 		if rev != Clobber && rev < curRev {
 			ev.Err = ErrRevMismatch
-		} else if curRev == Dir {
+		} else if curRev == Dir && (keep || !n.isEmptyDir(ev.Path)) {
 			ev.Err = os.EISDIR
 		}
 	}
@@ -163,11 +369,44 @@ func (n node) apply(seqn int64, mut string) (rep node, ev Event) {
 		ev.Path, ev.Body, rev, keep = ErrorPath, ev.Err.String(), Clobber, true
 	}
 
+	v, zip, sum := ev.Body, false, uint32(0)
 	if !keep {
 		ev.Rev = Missing
+	} else {
+		sum = BodySum(ev.Body)
+	}
+	if keep && ev.Err == nil {
+		// The event keeps the body as it was set.
+		v, zip = bodies.pack(ev.Body)
+	}
+
+	rep = n
+	if keep || curRev != Missing {
+		// Deleting a missing file changes nothing. Walking into the
+		// tree anyway would remove any file that sits where a
+		// parent directory should be.
+		rep = n.setpz(ev.Path, v, zip, sum, ev.Rev, seqn, keep)
 	}
 
-	rep = n.setp(ev.Path, ev.Body, ev.Rev, keep)
+	if ev.Err == nil && kindOf(mut) == linkKind {
+		rep = rep.link(split(ev.Path))
+	}
+	if ev.Err == nil && kindOf(mut) == touchKind {
+		if _, ok := n.readlink(ev.Path); ok {
+			rep = rep.link(split(ev.Path))
+		}
+	}
+
+	if ev.Err == nil && keep {
+		err := checkAppendMax(mut, ev.Body)
+		if err == nil {
+			err = checkQuota(n, rep, ev.Path)
+		}
+		if err != nil {
+			rep = n.setp(ErrorPath, err.String(), seqn, seqn, true)
+			return rep, Event{seqn, ErrorPath, err.String(), seqn, mut, err, rep}
+		}
+	}
 	ev.Getter = rep
 	return
 }
@@ -11,18 +11,18 @@ func TestNodeApplySet(t *testing.T) {
 	p := "/" + k
 	m := MustEncodeSet(p, v, Clobber)
 	n, e := emptyDir.apply(seqn, m)
-	exp := node{"", Dir, map[string]node{k: {v, rev, nil}}}
+	exp := node{"", Dir, map[string]node{k: {v, rev, nil, 0, seqn, 0, 0, 0, false, false, false, false, BodySum(v)}}, seqn, 0, 1, int64(len(v)), seqn, false, false, false, false, 0}
 	assert.Equal(t, exp, n)
 	assert.Equal(t, Event{seqn, p, v, rev, m, nil, n}, e)
 }
 
 func TestNodeApplyDel(t *testing.T) {
 	k, seqn, rev := "x", int64(1), int64(1)
-	r := node{"", Dir, map[string]node{k: {"a", rev, nil}}}
+	r := node{"", Dir, map[string]node{k: {"a", rev, nil, 0, rev, 0, 0, 0, false, false, false, false, BodySum("a")}}, 0, 0, 1, 1, rev, false, false, false, false, 0}
 	p := "/" + k
 	m := MustEncodeDel(p, rev)
 	n, e := r.apply(seqn, m)
-	assert.Equal(t, emptyDir, n)
+	assert.Equal(t, node{"", Dir, map[string]node{}, seqn, 0, 0, 0, seqn, false, false, false, false, 0}, n)
 	assert.Equal(t, Event{seqn, p, "", Missing, m, nil, n}, e)
 }
 
@@ -38,7 +38,7 @@ func TestNodeApplyBadMutation(t *testing.T) {
 	seqn, rev := int64(1), int64(1)
 	m := BadMutations[0]
 	n, e := emptyDir.apply(seqn, m)
-	exp := node{"", Dir, map[string]node{"ctl": {"", Dir, map[string]node{"err": {ErrBadMutation.String(), rev, nil}}}}}
+	exp := node{"", Dir, map[string]node{"ctl": {"", Dir, map[string]node{"err": {ErrBadMutation.String(), rev, nil, 0, seqn, 0, 0, 0, false, false, false, false, BodySum(ErrBadMutation.String())}}, seqn, seqn, 1, int64(len(ErrBadMutation.String())), seqn, false, false, false, false, 0}}, seqn, 0, 2, int64(len(ErrBadMutation.String())), seqn, false, false, false, false, 0}
 	assert.Equal(t, exp, n)
 	assert.Equal(t, Event{seqn, ErrorPath, ErrBadMutation.String(), rev, m, ErrBadMutation, n}, e)
 }
@@ -48,7 +48,7 @@ func TestNodeApplyBadInstruction(t *testing.T) {
 	m := BadInstructions[0]
 	n, e := emptyDir.apply(seqn, m)
 	err := &BadPathError{""}
-	exp := node{"", Dir, map[string]node{"ctl": {"", Dir, map[string]node{"err": {err.String(), rev, nil}}}}}
+	exp := node{"", Dir, map[string]node{"ctl": {"", Dir, map[string]node{"err": {err.String(), rev, nil, 0, seqn, 0, 0, 0, false, false, false, false, BodySum(err.String())}}, seqn, seqn, 1, int64(len(err.String())), seqn, false, false, false, false, 0}}, seqn, 0, 2, int64(len(err.String())), seqn, false, false, false, false, 0}
 	assert.Equal(t, exp, n)
 	assert.Equal(t, Event{seqn, ErrorPath, err.String(), rev, m, err, n}, e)
 }
@@ -61,7 +61,7 @@ func TestNodeApplyRevMismatch(t *testing.T) {
 	m := MustEncodeSet(p, v, -123)
 	n, e := emptyDir.apply(seqn, m)
 
-	exp := node{"", Dir, map[string]node{"ctl": {"", Dir, map[string]node{"err": {ErrRevMismatch.String(), rev, nil}}}}}
+	exp := node{"", Dir, map[string]node{"ctl": {"", Dir, map[string]node{"err": {ErrRevMismatch.String(), rev, nil, 0, seqn, 0, 0, 0, false, false, false, false, BodySum(ErrRevMismatch.String())}}, seqn, seqn, 1, int64(len(ErrRevMismatch.String())), seqn, false, false, false, false, 0}}, seqn, 0, 2, int64(len(ErrRevMismatch.String())), seqn, false, false, false, false, 0}
 	assert.Equal(t, exp, n)
 	assert.Equal(t, Event{seqn, ErrorPath, ErrRevMismatch.String(), rev, m, ErrRevMismatch, n}, e)
 }
@@ -93,3 +93,265 @@ func TestNodeIsADirectory(t *testing.T) {
 	assert.Equal(t, exp, n)
 	assert.Equal(t, Event{2, ErrorPath, os.EISDIR.String(), 2, m, os.EISDIR, n}, e)
 }
+
+func TestNodeDirRev(t *testing.T) {
+	r, _ := emptyDir.apply(1, MustEncodeSet("/d/x", "a", Clobber))
+	assert.Equal(t, int64(1), r.dirRev("/d"))
+	assert.Equal(t, int64(1), r.dirRev("/"))
+
+	// Changing an existing entry leaves the dir rev alone.
+	r, _ = r.apply(2, MustEncodeSet("/d/x", "b", Clobber))
+	assert.Equal(t, int64(1), r.dirRev("/d"))
+
+	r, _ = r.apply(3, MustEncodeSet("/d/y", "b", Clobber))
+	assert.Equal(t, int64(3), r.dirRev("/d"))
+	assert.Equal(t, int64(1), r.dirRev("/"))
+
+	r, _ = r.apply(4, MustEncodeDel("/d/x", Clobber))
+	assert.Equal(t, int64(4), r.dirRev("/d"))
+
+	assert.Equal(t, int64(0), r.dirRev("/d/y"))
+	assert.Equal(t, int64(0), r.dirRev("/missing"))
+}
+
+func TestNodeApplyInDir(t *testing.T) {
+	r, _ := emptyDir.apply(1, MustEncodeSet("/ctl/node/a/feature", "2", Clobber))
+	r, _ = r.apply(2, MustEncodeSet("/d/x", "a", Clobber))
+
+	m := EncodeInDir(2, MustEncodeSet("/d/y", "b", Clobber))
+	n, e := r.apply(3, m)
+	assert.Equal(t, nil, e.Err)
+	assert.Equal(t, "/d/y", e.Path)
+
+	// A sibling was added at 3, so a writer who looked at 2 loses.
+	_, e = n.apply(4, EncodeInDir(2, MustEncodeSet("/d/z", "c", Clobber)))
+	assert.Equal(t, ErrRevMismatch, e.Err)
+
+	_, e = n.apply(4, EncodeInDir(3, MustEncodeDel("/d/x", Clobber)))
+	assert.Equal(t, nil, e.Err)
+	assert.Equal(t, "/d/x", e.Path)
+}
+
+func TestNodeApplyInDirDisabled(t *testing.T) {
+	r, _ := emptyDir.apply(1, MustEncodeSet("/ctl/node/a/feature", "1", Clobber))
+	_, e := r.apply(2, EncodeInDir(0, MustEncodeSet("/d/y", "b", Clobber)))
+	assert.Equal(t, ErrFeatureDisabled, e.Err)
+}
+
+func TestNodeApplyIfExists(t *testing.T) {
+	r, _ := emptyDir.apply(1, MustEncodeSet("/x", "a", Clobber))
+
+	n, e := r.apply(2, EncodeIfExists(MustEncodeSet("/x", "b", Clobber)))
+	assert.Equal(t, nil, e.Err)
+	assert.Equal(t, "b", GetString(n, "/x"))
+
+	_, e = r.apply(2, EncodeIfExists(MustEncodeSet("/y", "b", Clobber)))
+	assert.Equal(t, os.ENOENT, e.Err)
+
+	_, e = r.apply(2, EncodeIfExists(MustEncodeDel("/y", Clobber)))
+	assert.Equal(t, os.ENOENT, e.Err)
+}
+
+func TestNodeApplyIfAbsent(t *testing.T) {
+	r, _ := emptyDir.apply(1, MustEncodeSet("/x", "a", Clobber))
+
+	_, e := r.apply(2, EncodeIfAbsent(MustEncodeSet("/x", "b", Clobber)))
+	assert.Equal(t, os.EEXIST, e.Err)
+
+	n, e := r.apply(2, EncodeIfAbsent(MustEncodeSet("/y", "b", Clobber)))
+	assert.Equal(t, nil, e.Err)
+	assert.Equal(t, "b", GetString(n, "/y"))
+}
+
+func TestNodeApplyIfExistsBad(t *testing.T) {
+	_, e := emptyDir.apply(1, "exists:2:-1:/x=a")
+	assert.Equal(t, ErrBadMutation, e.Err)
+}
+
+func TestNodeApplySequential(t *testing.T) {
+	m, err := EncodeSequential("/q/n-", "a")
+	assert.Equal(t, nil, err)
+
+	r, e := emptyDir.apply(7, m)
+	assert.Equal(t, nil, e.Err)
+	assert.Equal(t, "/q/n-0000000000000000007", e.Path)
+	assert.Equal(t, int64(7), e.Rev)
+	assert.Equal(t, "a", GetString(r, e.Path))
+
+	r, e = r.apply(12, m)
+	assert.Equal(t, "/q/n-0000000000000000012", e.Path)
+	assert.Equal(t, "a", GetString(r, "/q/n-0000000000000000007"))
+	assert.Equal(t, "a", GetString(r, "/q/n-0000000000000000012"))
+}
+
+func TestNodeApplySequentialExists(t *testing.T) {
+	r, _ := emptyDir.apply(1, MustEncodeSet("/q/0000000000000000002", "a", Clobber))
+	_, e := r.apply(2, "seq:/q/=b")
+	assert.Equal(t, ErrRevMismatch, e.Err)
+}
+
+func TestEncodeSequentialBadPath(t *testing.T) {
+	_, err := EncodeSequential("q", "a")
+	assert.NotEqual(t, nil, err)
+}
+
+func TestNodeApplyIfBody(t *testing.T) {
+	r, _ := emptyDir.apply(1, MustEncodeSet("/x", "a", Clobber))
+
+	_, e := r.apply(2, EncodeIfBody("b", MustEncodeSet("/x", "c", Clobber)))
+	assert.Equal(t, ErrBodyMismatch, e.Err)
+
+	n, e := r.apply(2, EncodeIfBody("a", MustEncodeSet("/x", "c", Clobber)))
+	assert.Equal(t, nil, e.Err)
+	assert.Equal(t, "c", GetString(n, "/x"))
+
+	_, e = r.apply(2, EncodeIfBody("", MustEncodeSet("/y", "c", Clobber)))
+	assert.Equal(t, ErrBodyMismatch, e.Err)
+
+	_, e = r.apply(2, EncodeIfBody("a", MustEncodeSet("/x", "c", 0)))
+	assert.Equal(t, ErrRevMismatch, e.Err)
+}
+
+func TestBodyHash(t *testing.T) {
+	assert.Equal(t, "86f7e437faa5a7fce15d1ddcb9eaeaea377667b8", BodyHash("a"))
+}
+
+func TestNodeApplyAppend(t *testing.T) {
+	m, err := EncodeAppend("/x", "b", Clobber)
+	assert.Equal(t, nil, err)
+
+	r, e := emptyDir.apply(1, m)
+	assert.Equal(t, nil, e.Err)
+	assert.Equal(t, "b", GetString(r, "/x"))
+
+	r, e = r.apply(2, m)
+	assert.Equal(t, nil, e.Err)
+	assert.Equal(t, "bb", e.Body)
+	assert.Equal(t, "bb", GetString(r, "/x"))
+
+	m, _ = EncodeAppend("/x", "c", 1)
+	_, e = r.apply(3, m)
+	assert.Equal(t, ErrRevMismatch, e.Err)
+}
+
+func TestNodeApplyAppendBad(t *testing.T) {
+	_, e := emptyDir.apply(1, "append:-1:/x")
+	assert.Equal(t, ErrBadMutation, e.Err)
+}
+
+func TestNodeApplyAppendMax(t *testing.T) {
+	m, err := EncodeAppendMax("/x", "ab", Clobber, 3)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "appendmax:3:append:-1:/x=ab", m)
+
+	r, e := emptyDir.apply(1, m)
+	assert.Equal(t, nil, e.Err)
+	assert.Equal(t, "ab", GetString(r, "/x"))
+
+	r, e = r.apply(2, m)
+	assert.Equal(t, ErrBodyLimit, e.Err)
+	assert.Equal(t, "ab", GetString(r, "/x"))
+	assert.Equal(t, "over limit: body", GetString(r, ErrorPath))
+
+	_, e = emptyDir.apply(1, "appendmax:x:append:-1:/x=ab")
+	assert.NotEqual(t, nil, e.Err)
+}
+
+func TestNodeApplyAdd(t *testing.T) {
+	m, err := EncodeAdd("/n", 5, Clobber)
+	assert.Equal(t, nil, err)
+
+	r, e := emptyDir.apply(1, m)
+	assert.Equal(t, nil, e.Err)
+	assert.Equal(t, "5", e.Body)
+
+	m, _ = EncodeAdd("/n", -7, Clobber)
+	r, e = r.apply(2, m)
+	assert.Equal(t, nil, e.Err)
+	assert.Equal(t, "-2", e.Body)
+	assert.Equal(t, "-2", GetString(r, "/n"))
+}
+
+func TestNodeApplyAddNotNumber(t *testing.T) {
+	r, _ := emptyDir.apply(1, MustEncodeSet("/x", "a", Clobber))
+	m, _ := EncodeAdd("/x", 1, Clobber)
+	_, e := r.apply(2, m)
+	assert.Equal(t, ErrNotNumber, e.Err)
+
+	_, e = r.apply(2, "add:-1:/x=a")
+	assert.Equal(t, ErrBadMutation, e.Err)
+}
+
+func TestNodeApplyTouch(t *testing.T) {
+	m, err := EncodeTouch("/x", Clobber)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "touch:-1:/x", m)
+
+	r, _ := emptyDir.apply(1, MustEncodeSet("/x", "a", Clobber))
+	r, e := r.apply(2, m)
+	assert.Equal(t, Event{2, "/x", "a", 2, m, nil, r}, e)
+	assert.T(t, e.IsSet())
+	assert.Equal(t, StatInfo{1, 2, 1, 2, BodySum("a"), 0}, StatOf(r, "/x"))
+
+	m, _ = EncodeTouch("/x", 1)
+	_, e = r.apply(3, m)
+	assert.Equal(t, ErrRevMismatch, e.Err)
+}
+
+func TestNodeApplyTouchBad(t *testing.T) {
+	m, _ := EncodeTouch("/x", Clobber)
+	_, e := emptyDir.apply(1, m)
+	assert.Equal(t, os.ENOENT, e.Err)
+
+	r, _ := emptyDir.apply(1, MustEncodeSet("/d/x", "a", Clobber))
+	m, _ = EncodeTouch("/d", Clobber)
+	_, e = r.apply(2, m)
+	assert.Equal(t, os.EISDIR, e.Err)
+
+	_, e = r.apply(2, "touch:-1:/d/x=a")
+	assert.Equal(t, ErrBadMutation, e.Err)
+
+	_, err := EncodeTouch("x", Clobber)
+	assert.Equal(t, &BadPathError{"x"}, err)
+}
+
+func TestNodeApplyTouchLink(t *testing.T) {
+	l, _ := EncodeLink("/l", "/x", Clobber)
+	r, _ := emptyDir.apply(1, l)
+	m, _ := EncodeTouch("/l", Clobber)
+	r, e := r.apply(2, m)
+	assert.Equal(t, nil, e.Err)
+
+	target, ok := Readlink(r, "/l")
+	assert.T(t, ok)
+	assert.Equal(t, "/x", target)
+}
+
+func TestNodeStatInfo(t *testing.T) {
+	r, _ := emptyDir.apply(1, MustEncodeSet("/d/x", "ab", Clobber))
+	r, _ = r.apply(2, MustEncodeSet("/d/x", "abc", Clobber))
+	r, _ = r.apply(3, MustEncodeSet("/d/y", "", Clobber))
+
+	assert.Equal(t, StatInfo{3, 2, 1, 2, BodySum("abc"), 0}, StatOf(r, "/d/x"))
+	assert.Equal(t, StatInfo{2, Dir, 1, 3, 0, 0}, StatOf(r, "/d"))
+	assert.Equal(t, StatInfo{0, Missing, 0, 0, 0, 0}, StatOf(r, "/z"))
+
+	r, _ = r.apply(4, MustEncodeDel("/d/x", Clobber))
+	r, _ = r.apply(5, MustEncodeSet("/d/x", "a", Clobber))
+	assert.Equal(t, StatInfo{1, 5, 5, 5, BodySum("a"), 0}, StatOf(r, "/d/x"))
+}
+
+func TestNodeStatTree(t *testing.T) {
+	r, _ := emptyDir.apply(1, MustEncodeSet("/d/x", "ab", Clobber))
+	r, _ = r.apply(2, MustEncodeSet("/d/e/y", "abc", Clobber))
+	r, _ = r.apply(3, MustEncodeSet("/z", "abcd", Clobber))
+
+	assert.Equal(t, TreeStat{3, 5, 2}, StatTree(r, "/d"))
+	assert.Equal(t, TreeStat{5, 9, 3}, StatTree(r, "/"))
+	assert.Equal(t, TreeStat{0, 3, 2}, StatTree(r, "/d/e/y"))
+	assert.Equal(t, TreeStat{}, StatTree(r, "/nope"))
+
+	// A delete counts as a change to the directory it was in.
+	r, _ = r.apply(4, MustEncodeDel("/d/x", Clobber))
+	assert.Equal(t, TreeStat{2, 3, 4}, StatTree(r, "/d"))
+}
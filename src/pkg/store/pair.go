@@ -0,0 +1,89 @@
+package store
+
+import (
+	"os"
+)
+
+// A paired set sets a file and, at the same seqn, a file in /ctl that
+// the cluster keeps about it, at a path made of a directory and the
+// file's own path, so that no one can see one without the other. Its
+// mutation is the kind prefix of the pair, such as ephKind, then an
+// argument and a set made by EncodeSet, in the format of EncodeBulk.
+//
+// The mutation produces one event for both writes, as a bulk mutation
+// does (see EncodeBulk): its Path is "/" and its Body is "2". Expand
+// returns the set of the file, then that of the file about it.
+func encodePaired(kind, arg, path, body string, rev int64) (mutation string, err os.Error) {
+	mutation, err = EncodeSet(path, body, rev)
+	if err != nil {
+		return
+	}
+	return kind + EncodeBulk([]string{arg, mutation})[len(bulkKind):], nil
+}
+
+// Decodes a paired set into its argument and its set.
+func decodePaired(mut string) (arg, set string, err os.Error) {
+	parts, err := decodeBulk(mut)
+	if err == nil && (len(parts) != 2 || kindOf(parts[1]) != "") {
+		err = ErrBadMutation
+	}
+	if err != nil {
+		return "", "", err
+	}
+	return parts[0], parts[1], nil
+}
+
+// Applies the paired set mut: set, then a set of dir plus its path to
+// body. If err is not nil, if set is not a plain set, if it is of a
+// file in /ctl (then the error is ctlErr), or if it fails, mut fails
+// and neither file changes.
+func (n node) applyPaired(seqn int64, mut, set, dir, body string, ctlErr, err os.Error, bodies *packer) (rep node, ev Event) {
+	var path string
+	if err == nil {
+		var keep bool
+		path, _, _, keep, err = decode(set)
+		if err == nil && !keep {
+			err = ErrBadMutation
+		}
+	}
+	if err == nil && isCtl(n.fold(path)) {
+		err = ctlErr
+	}
+	if err == nil {
+		err = n.checkParents(n.fold(dir + path))
+	}
+	if err == nil {
+		rep, ev = n.applyIn(seqn, set, bodies)
+		err = ev.Err
+	}
+
+	if err != nil {
+		rep = n.setp(ErrorPath, err.String(), seqn, seqn, true)
+		return rep, Event{seqn, ErrorPath, err.String(), seqn, mut, err, rep}
+	}
+
+	rep = rep.setp(n.fold(dir+path), body, seqn, seqn, true)
+	return rep, Event{seqn, "/", "2", nop, mut, nil, rep}
+}
+
+func isPaired(ev Event) bool {
+	k := kindOf(ev.Mut)
+	return ev.Err == nil && (k == ephKind || k == expKind)
+}
+
+// Returns the events of the two writes of the paired event ev.
+func expandPaired(ev Event) []Event {
+	arg, set, _ := decodePaired(ev.Mut)
+	dir, body := linkDir, arg
+	if kindOf(ev.Mut) == expKind {
+		dir, body = ttlDir, expiryBody(arg, ev.Seqn)
+	}
+
+	path, v, _, _, _ := decode(set)
+	path = foldIn(ev.Getter, path)
+	about := foldIn(ev.Getter, dir+path)
+	return []Event{
+		Event{ev.Seqn, path, v, ev.Seqn, set, nil, ev.Getter},
+		Event{ev.Seqn, about, body, ev.Seqn, MustEncodeSet(about, body, Clobber), nil, ev.Getter},
+	}
+}
@@ -0,0 +1,106 @@
+package store
+
+import (
+	"os"
+	"strings"
+	"unicode"
+	"utf8"
+)
+
+// Reports whether c may appear in a path component. Peers check the
+// paths in mutations as they apply them, so every peer in a cluster
+// must use the same PathChar; change it only before the store is made,
+// and the same way everywhere.
+//
+// Whatever PathChar says, a component never holds /, =, * or ?,
+// whitespace, or control characters, and is never empty, "." or "..".
+var PathChar = DefaultPathChar
+
+// The feature level from which paths are checked by PathChar. Below it,
+// peers apply mutations under the old rules, which admit only ASCII
+// letters, digits, dot and dash (and "." and ".." components), so that
+// peers of both versions agree on which writes fail.
+const pathLevel = 12
+
+var legacyPathRe = mustBuildRe(`[a-zA-Z0-9.\-]`)
+
+// Admits Unicode letters and digits, and any of . - _ : @.
+func DefaultPathChar(c int) bool {
+	switch {
+	case unicode.IsLetter(c), unicode.IsDigit(c):
+		return true
+	case strings.IndexRune(".-_:@", c) >= 0:
+		return true
+	}
+	return false
+}
+
+func checkPath(k string) os.Error {
+	if !goodPath(k, false) {
+		return &BadPathError{k}
+	}
+	return nil
+}
+
+// Reports whether k is a valid path, or, if glob is set, a valid glob
+// pattern, in which * and ? may appear too.
+func goodPath(k string, glob bool) bool {
+	if k == "/" {
+		return true
+	}
+	if !strings.HasPrefix(k, "/") {
+		return false
+	}
+
+	for _, s := range strings.Split(k[1:], "/", -1) {
+		if s == "" || s == "." || s == ".." {
+			return false
+		}
+		for _, c := range s {
+			if glob && (c == '*' || c == '?') {
+				continue
+			}
+			if !goodChar(c) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func goodChar(c int) bool {
+	switch {
+	case c == utf8.RuneError, c == '/', c == '=', c == '*', c == '?':
+		return false
+	case unicode.IsSpace(c), unicode.IsControl(c):
+		return false
+	}
+	return PathChar(c)
+}
+
+// Like checkPath, but applies the rules in force in n: the old ones if
+// not every peer supports PathChar yet. In a store made by NewFoldCase,
+// a path in /ctl must also be spelled in lower case there.
+func (n node) checkPathIn(k string) os.Error {
+	if n.Fold && isCtlFold(k) && !isCtl(k) {
+		return &BadPathError{k}
+	}
+	if ClusterFeatureLevel(n) < pathLevel {
+		if !legacyPathRe.MatchString(k) {
+			return &BadPathError{k}
+		}
+		return nil
+	}
+	return checkPath(k)
+}
+
+// Reports whether k is valid under either the current or the old path
+// rules. Mutations are decoded with this, and then checked against the
+// rules in force with checkPathIn. Reads of a node use it too, so they
+// find whatever the rules in force let in.
+func anyPath(k string) os.Error {
+	if goodPath(k, false) || legacyPathRe.MatchString(k) {
+		return nil
+	}
+	return &BadPathError{k}
+}
@@ -0,0 +1,35 @@
+package store
+
+import (
+	"github.com/bmizerany/assert"
+	"testing"
+)
+
+func TestPathChar(t *testing.T) {
+	defer func(f func(int) bool) { PathChar = f }(PathChar)
+	PathChar = func(c int) bool { return c == 'a' || c == '+' }
+
+	assert.Equal(t, nil, checkPath("/a+a"))
+	assert.Equal(t, &BadPathError{"/b"}, checkPath("/b"))
+	assert.Equal(t, &BadPathError{"/a="}, checkPath("/a="))
+}
+
+func TestCheckPathInLegacy(t *testing.T) {
+	n, _ := emptyDir.apply(1, MustEncodeSet("/ctl/node/a/feature", "11", Clobber))
+	assert.Equal(t, nil, n.checkPathIn("/x/.."))
+	assert.Equal(t, &BadPathError{"/x_y"}, n.checkPathIn("/x_y"))
+
+	n, _ = n.apply(2, MustEncodeSet("/ctl/node/a/feature", "12", Clobber))
+	assert.Equal(t, &BadPathError{"/x/.."}, n.checkPathIn("/x/.."))
+	assert.Equal(t, nil, n.checkPathIn("/x_y"))
+}
+
+func TestNodeApplyLegacyPath(t *testing.T) {
+	n, _ := emptyDir.apply(1, MustEncodeSet("/ctl/node/a/feature", "11", Clobber))
+	m := MustEncodeSet("/x_y", "a", Clobber)
+	_, ev := n.apply(2, m)
+	assert.Equal(t, &BadPathError{"/x_y"}, ev.Err)
+
+	_, ev = n.apply(2, "-1:/x/..=a")
+	assert.Equal(t, nil, ev.Err)
+}
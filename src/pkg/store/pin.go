@@ -0,0 +1,76 @@
+package store
+
+import (
+	"os"
+)
+
+// A Pin holds back st.Clean so that the state at one seqn stays
+// readable, through NewWait and NewWatchFrom, until it is released.
+type Pin struct {
+	Seqn int64
+	st   *Store
+}
+
+type pinOp struct {
+	seqn int64
+	n    int           // +1 to pin, -1 to release
+	err  chan os.Error // nil for a release
+}
+
+// Pins the state at seqn. Returns ErrTooLate if the state at seqn has
+// already been cleaned, or ErrClosed if st is closed. The pin must be
+// released, or the store's history will grow without bound.
+func (st *Store) Pin(seqn int64) (*Pin, os.Error) {
+	if seqn < 1 {
+		return nil, ErrTooLate
+	}
+
+	op := pinOp{seqn, 1, make(chan os.Error, 1)}
+	select {
+	case st.pinCh <- op:
+	case <-st.done:
+		return nil, ErrClosed
+	}
+
+	if err := <-op.err; err != nil {
+		return nil, err
+	}
+	return &Pin{seqn, st}, nil
+}
+
+// Releases p. Call it once per pin.
+func (p *Pin) Release() {
+	select {
+	case p.st.pinCh <- pinOp{p.Seqn, -1, nil}:
+	case <-p.st.done:
+	}
+}
+
+func (st *Store) pin(op pinOp) {
+	if op.n > 0 && op.seqn < st.head {
+		op.err <- ErrTooLate
+		return
+	}
+
+	n := st.pins[op.seqn] + op.n
+	if n > 0 {
+		st.pins[op.seqn] = n
+	} else {
+		st.pins[op.seqn] = 0, false
+	}
+
+	if op.err != nil {
+		op.err <- nil
+	}
+}
+
+// Returns the greatest seqn not above seqn that can be cleaned without
+// losing the state at any pinned seqn.
+func (st *Store) pinFloor(seqn int64) int64 {
+	for p := range st.pins {
+		if p <= seqn {
+			seqn = p - 1
+		}
+	}
+	return seqn
+}
@@ -0,0 +1,55 @@
+package store
+
+import (
+	"github.com/bmizerany/assert"
+	"testing"
+)
+
+func TestPinHoldsClean(t *testing.T) {
+	st := New()
+	defer close(st.Ops)
+	st.Ops <- Op{1, MustEncodeSet("/x", "a", Clobber)}
+	st.Ops <- Op{2, MustEncodeSet("/x", "b", Clobber)}
+	st.Ops <- Op{3, MustEncodeSet("/x", "c", Clobber)}
+
+	p, err := st.Pin(2)
+	assert.Equal(t, nil, err)
+
+	st.Clean(3)
+	_, err = st.Wait(1)
+	assert.Equal(t, ErrTooLate, err)
+
+	ch, err := st.Wait(2)
+	assert.Equal(t, nil, err)
+	ev := <-ch
+	v, _ := ev.Get("/x")
+	assert.Equal(t, []string{"b"}, v)
+
+	p.Release()
+	st.Clean(3)
+	_, err = st.Wait(3)
+	assert.Equal(t, ErrTooLate, err)
+}
+
+func TestPinTooLate(t *testing.T) {
+	st := New()
+	defer close(st.Ops)
+	st.Ops <- Op{1, Nop}
+	st.Ops <- Op{2, Nop}
+	st.Clean(1)
+
+	_, err := st.Pin(1)
+	assert.Equal(t, ErrTooLate, err)
+
+	p, err := st.Pin(2)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, int64(2), p.Seqn)
+	p.Release()
+}
+
+func TestPinClosed(t *testing.T) {
+	st := New()
+	st.Close()
+	_, err := st.Pin(1)
+	assert.Equal(t, ErrClosed, err)
+}
@@ -0,0 +1,91 @@
+package store
+
+import (
+	"os"
+	"strconv"
+	"strings"
+)
+
+// A file in QuotaDir gives the directory at the rest of its path a
+// quota. Its body is "<entries> <bytes>": the most entries the
+// directory may hold, and the most bytes there may be in the bodies
+// of all the files under it, with 0 for no limit. For example,
+// /ctl/quota/app="100 0" lets /app hold at most 100 entries.
+//
+// A write that would take a directory past its quota fails with
+// ErrQuotaExceeded, unless it doesn't make things any worse: a
+// directory already over its quota can still be written, so long as
+// it doesn't grow. Files in /ctl have no quota.
+const QuotaDir = "/ctl/quota"
+
+var ErrQuotaExceeded os.Error = &Error{CodeQuotaExceeded, "quota exceeded"}
+
+type quota struct {
+	entries, bytes int64
+}
+
+// Returns the quota in body, or false if it isn't well formed.
+func parseQuota(body string) (q quota, ok bool) {
+	f := strings.Fields(body)
+	if len(f) != 2 {
+		return q, false
+	}
+
+	var err os.Error
+	q.entries, err = strconv.Atoi64(f[0])
+	if err != nil || q.entries < 0 {
+		return q, false
+	}
+	q.bytes, err = strconv.Atoi64(f[1])
+	if err != nil || q.bytes < 0 {
+		return q, false
+	}
+	return q, true
+}
+
+// Returns the number of entries in the directory at path in n, or 0.
+func entries(n node, path string) int64 {
+	m, err := n.at(split(path))
+	if err != nil || m.Rev != Dir {
+		return 0
+	}
+	return int64(len(m.Ds))
+}
+
+// Returns ErrQuotaExceeded if a write to path, which took n to rep,
+// made any directory that holds path grow past a quota set in n.
+func checkQuota(n, rep node, path string) os.Error {
+	if isCtl(path) {
+		return nil
+	}
+	if _, err := n.at(split(QuotaDir)); err != nil {
+		return nil
+	}
+	if ClusterFeatureLevel(n) < quotaLevel {
+		return nil
+	}
+
+	parts := split(path)
+	for i := 1; i < len(parts); i++ {
+		dir := "/" + strings.Join(parts[:i], "/")
+		q, ok := parseQuota(GetString(n, QuotaDir+dir))
+		if !ok {
+			continue
+		}
+
+		if q.entries > 0 {
+			was, now := entries(n, dir), entries(rep, dir)
+			if now > q.entries && now > was {
+				return ErrQuotaExceeded
+			}
+		}
+
+		if q.bytes > 0 {
+			was, now := n.statTree(dir).Bytes, rep.statTree(dir).Bytes
+			if now > q.bytes && now > was {
+				return ErrQuotaExceeded
+			}
+		}
+	}
+	return nil
+}
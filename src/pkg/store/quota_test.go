@@ -0,0 +1,79 @@
+package store
+
+import (
+	"github.com/bmizerany/assert"
+	"testing"
+)
+
+func TestParseQuota(t *testing.T) {
+	q, ok := parseQuota("3 100")
+	assert.T(t, ok)
+	assert.Equal(t, quota{3, 100}, q)
+
+	for _, s := range []string{"", "3", "3 x", "-1 0", "1 2 3"} {
+		_, ok = parseQuota(s)
+		assert.T(t, !ok, s)
+	}
+}
+
+func TestQuotaEntries(t *testing.T) {
+	r, _ := emptyDir.apply(1, MustEncodeSet(QuotaDir+"/d", "2 0", Clobber))
+	r, _ = r.apply(2, MustEncodeSet("/d/a", "", Clobber))
+	r, _ = r.apply(3, MustEncodeSet("/d/b/c", "", Clobber))
+
+	n, e := r.apply(4, MustEncodeSet("/d/e", "", Clobber))
+	assert.Equal(t, ErrQuotaExceeded, e.Err)
+	assert.Equal(t, ErrorPath, e.Path)
+	assert.Equal(t, "", GetString(n, "/d/e"))
+	assert.Equal(t, Missing, StatOf(n, "/d/e").Rev)
+
+	// Writing below an entry, or to an existing one, is fine.
+	r, e = r.apply(5, MustEncodeSet("/d/b/f", "", Clobber))
+	assert.Equal(t, nil, e.Err)
+	r, e = r.apply(6, MustEncodeSet("/d/a", "x", Clobber))
+	assert.Equal(t, nil, e.Err)
+}
+
+func TestQuotaBytes(t *testing.T) {
+	r, _ := emptyDir.apply(1, MustEncodeSet(QuotaDir+"/d", "0 4", Clobber))
+	r, _ = r.apply(2, MustEncodeSet("/d/a", "ab", Clobber))
+
+	_, e := r.apply(3, MustEncodeSet("/d/e/b", "abc", Clobber))
+	assert.Equal(t, ErrQuotaExceeded, e.Err)
+
+	r, e = r.apply(4, MustEncodeSet("/d/e/b", "ab", Clobber))
+	assert.Equal(t, nil, e.Err)
+
+	// Lower the quota; shrinking is still allowed, growing isn't.
+	r, _ = r.apply(5, MustEncodeSet(QuotaDir+"/d", "0 2", Clobber))
+	_, e = r.apply(6, MustEncodeSet("/d/a", "abc", Clobber))
+	assert.Equal(t, ErrQuotaExceeded, e.Err)
+	_, e = r.apply(6, MustEncodeSet("/d/a", "a", Clobber))
+	assert.Equal(t, nil, e.Err)
+}
+
+func TestQuotaBulkAndCopy(t *testing.T) {
+	r, _ := emptyDir.apply(1, MustEncodeSet(QuotaDir+"/b", "1 0", Clobber))
+	r, _ = r.apply(2, MustEncodeSet("/d/x", "1", Clobber))
+
+	_, e := r.apply(3, EncodeBulk([]string{
+		MustEncodeSet("/b/x", "1", Clobber),
+		MustEncodeSet("/b/y", "1", Clobber),
+	}))
+	assert.Equal(t, ErrQuotaExceeded, e.Err)
+
+	m, _ := EncodeCopy("/d", "/b/d", Missing)
+	r, e = r.apply(4, m)
+	assert.Equal(t, nil, e.Err)
+	m, _ = EncodeCopy("/d", "/b/e", Missing)
+	_, e = r.apply(5, m)
+	assert.Equal(t, ErrQuotaExceeded, e.Err)
+}
+
+func TestQuotaDisabled(t *testing.T) {
+	r, _ := emptyDir.apply(1, MustEncodeSet("/ctl/node/a/feature", "9", Clobber))
+	r, _ = r.apply(2, MustEncodeSet(QuotaDir+"/d", "1 0", Clobber))
+	r, _ = r.apply(3, MustEncodeSet("/d/a", "", Clobber))
+	_, e := r.apply(4, MustEncodeSet("/d/b", "", Clobber))
+	assert.Equal(t, nil, e.Err)
+}
@@ -0,0 +1,156 @@
+package store
+
+import (
+	"os"
+	"strings"
+)
+
+type reserveOp struct {
+	path string
+	glob *Glob     // for ReserveWith
+	v    Validator // for ReserveWith
+	done chan bool
+}
+
+// Checks a write the store is about to apply, as registered with
+// ReserveWith. ev is the event of the write, as if it had been applied
+// on its own: ev.Getter holds the tree with the write made, so a
+// validator can look at whatever else it needs to. A non-nil result
+// fails the write.
+type Validator func(ev Event) os.Error
+
+type validator struct {
+	glob *Glob
+	v    Validator
+}
+
+// Reserves the subtree at path: clients may not write to it, though the
+// cluster itself still may. The store applies every mutation it is
+// given, whoever proposed it; it is for servers to ask Reserved before
+// proposing a client's write, and refuse it. The cluster's own writes,
+// such as session checkins and TTL expiries, don't go through that
+// check, so they still land.
+//
+// To check writes whoever proposes them, see ReserveWith.
+//
+// If path is not valid, returns a `BadPathError`. If st is closed,
+// returns ErrClosed.
+func (st *Store) Reserve(path string) os.Error {
+	if err := checkPath(path); err != nil {
+		return err
+	}
+
+	op := reserveOp{path: foldIn(st, path), done: make(chan bool, 1)}
+	select {
+	case st.reserveCh <- op:
+	case <-st.done:
+		return ErrClosed
+	}
+	<-op.done
+	return nil
+}
+
+// Reports whether path is in, or is the root of, a subtree reserved by
+// Reserve. In a store made by NewFoldCase, case doesn't matter.
+func (st *Store) Reserved(path string) bool {
+	// As in Snap, read the pointer only once; only the process
+	// goroutine writes it, and never changes what it points to.
+	ps := st.reserved
+	if ps == nil {
+		return false
+	}
+
+	path = foldIn(st, path)
+	for _, p := range *ps {
+		if p == "/" || path == p || strings.HasPrefix(path, p+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// Has st check every write to a path matching glob with v as it
+// applies it. If v returns an error, the mutation fails as a whole, as
+// one with a rev mismatch would: the tree is left as it was, and the
+// error is set at ErrorPath. For a bulk write or a directory copy, v
+// sees each write in it, and one failure fails them all. For a batch
+// (see EncodeBatch), v sees each write in it, and one failure fails
+// only that write, as if it had been applied alone. A panic in v
+// fails the write the same way.
+//
+// Unlike Reserve, this holds for every mutation, whoever proposed it,
+// so validators decide which writes succeed: every peer in a cluster
+// must register the same ones, before its store applies anything. They
+// run in the goroutine that applies mutations, and so must be quick
+// and must not use st.
+//
+// If st is closed, returns ErrClosed.
+func (st *Store) ReserveWith(glob *Glob, v Validator) os.Error {
+	op := reserveOp{glob: foldGlob(st, glob), v: v, done: make(chan bool, 1)}
+	select {
+	case st.reserveCh <- op:
+	case <-st.done:
+		return ErrClosed
+	}
+	<-op.done
+	return nil
+}
+
+// Returns m and e, the result of applying a mutation to n, unless a
+// validator refuses a write in e; then returns n with the error at
+// ErrorPath.
+func (st *Store) validate(n, m node, e Event) (rep node, ev Event) {
+	if len(st.validators) == 0 || e.Err != nil || e.Mut == Nop {
+		return m, e
+	}
+
+	if isBatch(e) {
+		// Apply it again, this time checking each write as it goes.
+		return n.applyBatch(e.Seqn, e.Mut, st.bodies, st.check)
+	}
+
+	for _, w := range Expand(e) {
+		if err := st.check(w); err != nil {
+			rep := n.setp(ErrorPath, err.String(), e.Seqn, e.Seqn, true)
+			return rep, Event{e.Seqn, ErrorPath, err.String(), e.Seqn, e.Mut, err, rep}
+		}
+	}
+	return m, e
+}
+
+// Runs the validators whose globs match w.Path on w, and returns the
+// first error, if any. A panic in one is returned as a PanicError.
+func (st *Store) check(w Event) (err os.Error) {
+	defer func() {
+		if x := recover(); x != nil {
+			err = &PanicError{x}
+		}
+	}()
+
+	for _, r := range st.validators {
+		if r.glob.Match(w.Path) {
+			if err := r.v(w); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (st *Store) reserve(op reserveOp) {
+	if op.v != nil {
+		// Only the process goroutine reads these.
+		st.validators = append(st.validators, validator{op.glob, op.v})
+		op.done <- true
+		return
+	}
+
+	var ps []string
+	if st.reserved != nil {
+		ps = make([]string, len(*st.reserved), len(*st.reserved)+1)
+		copy(ps, *st.reserved)
+	}
+	ps = append(ps, op.path)
+	st.reserved = &ps
+	op.done <- true
+}
@@ -0,0 +1,110 @@
+package store
+
+import (
+	"github.com/bmizerany/assert"
+	"os"
+	"testing"
+)
+
+func TestStoreReserved(t *testing.T) {
+	st := New()
+	defer close(st.Ops)
+	assert.T(t, !st.Reserved("/app/x"))
+
+	assert.Equal(t, nil, st.Reserve("/app"))
+	assert.Equal(t, nil, st.Reserve("/ops"))
+	assert.T(t, st.Reserved("/app"))
+	assert.T(t, st.Reserved("/app/x"))
+	assert.T(t, st.Reserved("/ops/y/z"))
+	assert.T(t, !st.Reserved("/apple"))
+	assert.T(t, !st.Reserved("/"))
+}
+
+func TestStoreReserveRoot(t *testing.T) {
+	st := New()
+	defer close(st.Ops)
+	assert.Equal(t, nil, st.Reserve("/"))
+	assert.T(t, st.Reserved("/x"))
+}
+
+func TestStoreReserveBadPath(t *testing.T) {
+	st := New()
+	defer close(st.Ops)
+	assert.Equal(t, &BadPathError{"x"}, st.Reserve("x"))
+}
+
+func TestStoreReserveWith(t *testing.T) {
+	st := New()
+	defer close(st.Ops)
+	errOdd := os.NewError("odd length")
+	st.ReserveWith(MustCompileGlob("/cfg/**"), func(ev Event) os.Error {
+		if ev.IsSet() && len(ev.Body)%2 == 1 {
+			return errOdd
+		}
+		return nil
+	})
+
+	st.Ops <- Op{1, MustEncodeSet("/cfg/a", "xx", Clobber)}
+	st.Ops <- Op{2, MustEncodeSet("/cfg/b", "x", Clobber)}
+	st.Ops <- Op{3, MustEncodeSet("/other", "x", Clobber)}
+	sync(st, 3)
+
+	assert.Equal(t, "xx", GetString(st, "/cfg/a"))
+	_, rev := st.Get("/cfg/b")
+	assert.Equal(t, Missing, rev)
+	assert.Equal(t, errOdd.String(), GetString(st, ErrorPath))
+	assert.Equal(t, "x", GetString(st, "/other"))
+}
+
+func TestStoreReserveWithBulk(t *testing.T) {
+	st := New()
+	defer close(st.Ops)
+	st.ReserveWith(MustCompileGlob("/ro/*"), func(ev Event) os.Error {
+		return os.EPERM
+	})
+
+	m := EncodeBulk([]string{MustEncodeSet("/a", "1", Clobber), MustEncodeSet("/ro/b", "2", Clobber)})
+	st.Ops <- Op{1, m}
+	sync(st, 1)
+
+	_, rev := st.Get("/a")
+	assert.Equal(t, Missing, rev)
+	assert.Equal(t, os.EPERM.String(), GetString(st, ErrorPath))
+}
+
+func TestStoreReserveWithBatch(t *testing.T) {
+	st := New()
+	defer close(st.Ops)
+	st.ReserveWith(MustCompileGlob("/ro/*"), func(ev Event) os.Error {
+		return os.EPERM
+	})
+
+	m, _ := EncodeBatch([]string{
+		MustEncodeSet("/a", "1", Clobber),
+		MustEncodeSet("/ro/b", "2", Clobber),
+		MustEncodeSet("/c", "3", Clobber),
+	})
+	st.Ops <- Op{1, m}
+	sync(st, 1)
+
+	assert.Equal(t, "1", GetString(st, "/a"))
+	assert.Equal(t, "3", GetString(st, "/c"))
+	_, rev := st.Get("/ro/b")
+	assert.Equal(t, Missing, rev)
+	assert.Equal(t, os.EPERM.String(), GetString(st, ErrorPath))
+}
+
+func TestStoreReserveWithPanic(t *testing.T) {
+	st := New()
+	defer close(st.Ops)
+	st.ReserveWith(Any, func(ev Event) os.Error {
+		panic("boom")
+	})
+
+	st.Ops <- Op{1, MustEncodeSet("/a", "1", Clobber)}
+	sync(st, 1)
+
+	_, rev := st.Get("/a")
+	assert.Equal(t, Missing, rev)
+	assert.Equal(t, (&PanicError{"boom"}).String(), GetString(st, ErrorPath))
+}
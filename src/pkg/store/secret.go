@@ -0,0 +1,45 @@
+package store
+
+// Paths can be marked secret by writing a glob to any file in
+// SecretDir. The body of a secret file is withheld wherever doozer
+// shows the tree to people rather than to programs, such as the web
+// view.
+//
+// TODO restrict reads of secret files over the protocol to authorized
+// clients, once there are identities to authorize. Until then, every
+// client may read them.
+const SecretDir = "/ctl/secret"
+
+// Shown in place of the body of a secret file.
+const Redacted = "(secret)"
+
+// Reports whether path matches any glob in SecretDir in g. Bad globs
+// match nothing. The globs themselves are not secret.
+func IsSecret(g Getter, path string) bool {
+	if path == SecretDir || len(path) > len(SecretDir) && path[:len(SecretDir)+1] == SecretDir+"/" {
+		return false
+	}
+
+	for _, name := range Getdir(g, SecretDir) {
+		glob, err := CompileGlob(GetString(g, SecretDir+"/"+name))
+		if err == nil && glob.Match(path) {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns ev with its body replaced by Redacted, and its mutation
+// dropped, if it set a secret file in g. The mutation of a bulk event
+// is dropped if any of its writes set one.
+func Redact(g Getter, ev Event) Event {
+	for _, e := range Expand(ev) {
+		if e.IsSet() && IsSecret(g, e.Path) {
+			if e.Path == ev.Path {
+				ev.Body = Redacted
+			}
+			ev.Mut = ""
+		}
+	}
+	return ev
+}
@@ -0,0 +1,39 @@
+package store
+
+import (
+	"github.com/bmizerany/assert"
+	"testing"
+)
+
+func TestIsSecret(t *testing.T) {
+	st := New()
+	defer close(st.Ops)
+	st.Ops <- Op{1, MustEncodeSet(SecretDir+"/db", "/db/*/password", Clobber)}
+	st.Ops <- Op{2, MustEncodeSet(SecretDir+"/bad", "[", Clobber)}
+	sync(st, 2)
+
+	assert.T(t, IsSecret(st, "/db/main/password"))
+	assert.T(t, !IsSecret(st, "/db/main/host"))
+	assert.T(t, !IsSecret(st, SecretDir+"/db"))
+}
+
+func TestRedact(t *testing.T) {
+	st := New()
+	defer close(st.Ops)
+	st.Ops <- Op{1, MustEncodeSet(SecretDir+"/k", "/k", Clobber)}
+	sync(st, 1)
+
+	mut := MustEncodeSet("/k", "hunter2", Clobber)
+	ev := Redact(st, Event{2, "/k", "hunter2", 2, mut, nil, nil})
+	assert.Equal(t, Redacted, ev.Body)
+	assert.Equal(t, "", ev.Mut)
+
+	mut = MustEncodeSet("/x", "a", Clobber)
+	ev = Redact(st, Event{2, "/x", "a", 2, mut, nil, nil})
+	assert.Equal(t, "a", ev.Body)
+	assert.Equal(t, mut, ev.Mut)
+
+	mut = EncodeBulk([]string{MustEncodeSet("/k", "hunter2", Clobber)})
+	ev = Redact(st, Event{2, "/", "1", nop, mut, nil, nil})
+	assert.Equal(t, "", ev.Mut)
+}
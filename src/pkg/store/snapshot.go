@@ -0,0 +1,223 @@
+package store
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+var (
+	ErrBadSnapshot  os.Error = &Error{CodeCorrupt, "bad snapshot"}
+	ErrFoldMismatch os.Error = &Error{CodeCorrupt, "snapshot disagrees on folding case"}
+)
+
+// Writes the current state of st to w, in a form from which
+// NewFromSnapshot makes a store in the same state, at the same version,
+// without replaying a log. Returns the version written. The form is
+//
+//	"snapshot" SP <version> SP <1 if st folds case, else 0> LF
+//
+// followed by the root directory. Each directory is a line
+//
+//	"D" SP <created> SP <entry rev> SP <tree rev> SP <1 if made by
+//	mkdir, else 0> SP <number of entries> SP <quoted name> LF
+//
+// followed by its entries, in order of name. Each file is a line
+//
+//	"F" SP <rev> SP <created> SP <1 if a link, else 0> SP <quoted name>
+//	SP <quoted body> LF
+//
+// A snapshot holds no history, nor anything set up by Reserve,
+// ReserveWith, Compress or KeepTombstones.
+func (st *Store) WriteSnapshot(w io.Writer) (ver int64, err os.Error) {
+	ver, g := st.Snap()
+	root := g.(node)
+
+	bw := bufio.NewWriter(w)
+	fmt.Fprintf(bw, "snapshot %d %d\n", ver, bit(root.Fold))
+	writeSnapNode(bw, "", root)
+	return ver, bw.Flush()
+}
+
+// Makes a store from a snapshot written by WriteSnapshot. It is at the
+// snapshot's version: the next mutation applied to it is the one after,
+// and, since it has no history, watches and waits can start no earlier
+// than that. Anything malformed, or a tree no mutations could have
+// made, yields ErrBadSnapshot.
+func NewFromSnapshot(r io.Reader) (*Store, os.Error) {
+	ver, root, err := readSnapshot(r)
+	if err != nil {
+		return nil, err
+	}
+	return newStore(ver, root), nil
+}
+
+// Replaces the contents of st, which must not have applied anything
+// yet, with a snapshot written by WriteSnapshot. As for
+// NewFromSnapshot, st is then at the snapshot's version and has no
+// history before it; mutations already sent on Ops for later versions
+// are applied after it. A peer joining a cluster loads one this way,
+// so it holds exactly what the others do, down to empty directories and
+// links, before it applies its first mutation.
+//
+// Returns ErrBadSnapshot if the snapshot is malformed or st has already
+// applied something, and ErrFoldMismatch if the snapshot's store and st
+// don't agree on folding case.
+func (st *Store) LoadSnapshot(r io.Reader) os.Error {
+	ver, root, err := readSnapshot(r)
+	if err != nil {
+		return err
+	}
+
+	op := loadOp{ver, root, make(chan os.Error, 1)}
+	select {
+	case st.loadCh <- op:
+	case <-st.done:
+		return ErrClosed
+	}
+	return <-op.err
+}
+
+type loadOp struct {
+	ver  int64
+	root node
+	err  chan os.Error
+}
+
+// Installs op's tree, if st is still empty, and returns st's new state.
+// Any index is rebuilt from the new tree.
+func (st *Store) load(op loadOp) *state {
+	switch {
+	case st.state.ver != 0:
+		op.err <- ErrBadSnapshot
+		return st.state
+	case op.root.Fold != st.state.root.Fold:
+		op.err <- ErrFoldMismatch
+		return st.state
+	}
+
+	for i, x := range st.indexes {
+		st.indexes[i] = newIndex(x.glob, x.key, op.root)
+	}
+	st.head = op.ver + 1
+	op.err <- nil
+	return &state{op.ver, op.root}
+}
+
+func readSnapshot(r io.Reader) (ver int64, root node, err os.Error) {
+	br := bufio.NewReader(r)
+	line, err := readSnapLine(br)
+	if err != nil {
+		return 0, node{}, err
+	}
+
+	var fold int
+	n, _ := fmt.Sscanf(line, "snapshot %d %d", &ver, &fold)
+	if n != 2 || ver < 0 {
+		return 0, node{}, ErrBadSnapshot
+	}
+
+	_, root, err = readSnapNode(br)
+	if err != nil {
+		return 0, node{}, err
+	}
+	if root.Rev != Dir || checkTree(root, "/") != "" {
+		return 0, node{}, ErrBadSnapshot
+	}
+	root.Fold = fold == 1
+	return ver, root, nil
+}
+
+func writeSnapNode(w io.Writer, name string, n node) {
+	if n.Rev != Dir {
+		fmt.Fprintf(w, "F %d %d %d %s %s\n", n.Rev, n.CRev, bit(n.Link), strconv.Quote(name), strconv.Quote(n.body()))
+		return
+	}
+
+	fmt.Fprintf(w, "D %d %d %d %d %d %s\n", n.CRev, n.EntRev, n.TreeRev, bit(n.Kept), len(n.Ds), strconv.Quote(name))
+	names := n.readdir()
+	sort.SortStrings(names)
+	for _, k := range names {
+		writeSnapNode(w, k, n.Ds[k])
+	}
+}
+
+func readSnapLine(br *bufio.Reader) (string, os.Error) {
+	line, err := br.ReadString('\n')
+	if err == os.EOF {
+		return "", ErrBadSnapshot
+	} else if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(line, "\n"), nil
+}
+
+// Reads a file or directory, with everything in it, and returns it and
+// its name. Names hold no spaces, so the fields before a body split on
+// them.
+func readSnapNode(br *bufio.Reader) (name string, n node, err os.Error) {
+	line, err := readSnapLine(br)
+	if err != nil {
+		return
+	}
+
+	var bad bool
+	num := func(s string) int64 {
+		x, e := strconv.Atoi64(s)
+		bad = bad || e != nil
+		return x
+	}
+	str := func(s string) string {
+		x, e := strconv.Unquote(s)
+		bad = bad || e != nil
+		return x
+	}
+
+	switch p := strings.Split(line, " ", 7); {
+	case p[0] == "F" && len(p) >= 6:
+		p = strings.Split(line, " ", 6)
+		n = node{Rev: num(p[1]), CRev: num(p[2]), Link: p[3] == "1"}
+		name, n.V = str(p[4]), str(p[5])
+		n.Sum = BodySum(n.V)
+		if n.Rev <= Missing {
+			bad = true
+		}
+	case p[0] == "D" && len(p) == 7:
+		n = node{Rev: Dir, CRev: num(p[1]), EntRev: num(p[2]), Kept: p[4] == "1"}
+		entries := num(p[5])
+		name = str(p[6])
+		if bad || entries < 0 {
+			return "", node{}, ErrBadSnapshot
+		}
+
+		n.Ds = make(map[string]node)
+		for i := int64(0); i < entries; i++ {
+			k, m, err := readSnapNode(br)
+			if err != nil {
+				return "", node{}, err
+			}
+			d, b := m.weight(true)
+			n.Ds[k] = m
+			n.Desc, n.Bytes = n.Desc+d, n.Bytes+b
+		}
+		n.TreeRev = num(p[3])
+	default:
+		bad = true
+	}
+
+	if bad {
+		return "", node{}, ErrBadSnapshot
+	}
+	return name, n, nil
+}
+
+func bit(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,116 @@
+package store
+
+import (
+	"bytes"
+	"github.com/bmizerany/assert"
+	"strings"
+	"testing"
+)
+
+func TestSnapshotRoundTrip(t *testing.T) {
+	st := NewFoldCase()
+	defer close(st.Ops)
+
+	link, _ := EncodeLink("/l", "/a/b", Clobber)
+	mkdir, _ := EncodeMkdir("/e", Missing)
+	st.Ops <- Op{1, MustEncodeSet("/a/b", "x y\n\"z\"", Clobber)}
+	st.Ops <- Op{2, MustEncodeSet("/a/c", "", Clobber)}
+	st.Ops <- Op{3, MustEncodeSet("/a/b", "w", Clobber)}
+	st.Ops <- Op{4, link}
+	st.Ops <- Op{5, mkdir}
+	st.Ops <- Op{6, MustEncodeDel("/a/c", Clobber)}
+	sync(st, 6)
+
+	var buf bytes.Buffer
+	ver, err := st.WriteSnapshot(&buf)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, int64(6), ver)
+
+	st2, err := NewFromSnapshot(&buf)
+	assert.Equal(t, nil, err)
+	defer close(st2.Ops)
+
+	ver2, g2 := st2.Snap()
+	_, g := st.Snap()
+	assert.Equal(t, ver, ver2)
+	assert.Equal(t, g, g2)
+	assert.Equal(t, true, st2.FoldsCase())
+
+	target, ok := Readlink(g2, "/l")
+	assert.Equal(t, "/a/b", target)
+	assert.Equal(t, true, ok)
+	assert.Equal(t, []string{}, Getdir(g2, "/e"))
+	assert.Equal(t, DirRev(g, "/a"), DirRev(g2, "/a"))
+	assert.Equal(t, StatTree(g, "/"), StatTree(g2, "/"))
+}
+
+func TestSnapshotContinues(t *testing.T) {
+	st, err := NewFromSnapshot(strings.NewReader("snapshot 5 0\nD 0 3 3 0 1 \"\"\nF 3 1 0 \"x\" \"a\"\n"))
+	assert.Equal(t, nil, err)
+	defer close(st.Ops)
+
+	_, err = st.Wait(5)
+	assert.Equal(t, ErrTooLate, err)
+
+	st.Ops <- Op{6, MustEncodeSet("/x", "b", 3)}
+	sync(st, 6)
+
+	v, rev := st.Get("/x")
+	assert.Equal(t, []string{"b"}, v)
+	assert.Equal(t, int64(6), rev)
+}
+
+func TestSnapshotBad(t *testing.T) {
+	for _, s := range []string{
+		"",
+		"snapshot 5 0\n",
+		"snap 5 0\nD 0 0 0 0 0 \"\"\n",
+		"snapshot 5 0\nD 0 0 0 0 1 \"\"\n",
+		"snapshot 5 0\nF 1 1 0 \"\" \"a\"\n",
+		"snapshot 5 0\nD 0 0 0 0 1 \"\"\nF 1 1 0 \"x\" a\n",
+		"snapshot 5 0\nD 0 0 0 0 1 \"\"\nF 0 1 0 \"x\" \"a\"\n",
+		"snapshot 5 0\nD 0 0 0 0 1 \"\"\nD 1 1 1 0 0 \"x\"\n",
+		"snapshot 5 0\nD 0 0 0 0 1 \"\"\nQ 1 1 0 \"x\" \"a\"\n",
+	} {
+		st, err := NewFromSnapshot(strings.NewReader(s))
+		assert.Equal(t, ErrBadSnapshot, err, s)
+		assert.Equal(t, (*Store)(nil), st, s)
+	}
+}
+
+func TestLoadSnapshot(t *testing.T) {
+	st := New()
+	defer close(st.Ops)
+
+	// Sent before the snapshot is loaded; applied after it.
+	st.Ops <- Op{6, MustEncodeSet("/x", "b", 3)}
+
+	err := st.LoadSnapshot(strings.NewReader("snapshot 5 0\nD 0 4 4 0 2 \"\"\nD 4 4 4 1 0 \"e\"\nF 3 1 0 \"x\" \"a\"\n"))
+	assert.Equal(t, nil, err)
+	sync(st, 6)
+
+	v, rev := st.Get("/x")
+	assert.Equal(t, []string{"b"}, v)
+	assert.Equal(t, int64(6), rev)
+
+	_, g := st.Snap()
+	assert.Equal(t, []string{}, Getdir(g, "/e"))
+
+	_, err = st.Wait(5)
+	assert.Equal(t, ErrTooLate, err)
+}
+
+func TestLoadSnapshotRefused(t *testing.T) {
+	st := New()
+	defer close(st.Ops)
+	st.Ops <- Op{1, MustEncodeSet("/x", "a", Clobber)}
+	sync(st, 1)
+
+	err := st.LoadSnapshot(strings.NewReader("snapshot 5 0\nD 0 0 0 0 0 \"\"\n"))
+	assert.Equal(t, ErrBadSnapshot, err)
+
+	st2 := NewFoldCase()
+	defer close(st2.Ops)
+	err = st2.LoadSnapshot(strings.NewReader("snapshot 5 0\nD 0 0 0 0 0 \"\"\n"))
+	assert.Equal(t, ErrFoldMismatch, err)
+}
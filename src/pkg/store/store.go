@@ -3,11 +3,16 @@ package store
 import (
 	"container/heap"
 	"container/vector"
+	"crypto/sha1"
+	"doozer/gocount"
+	"fmt"
+	"hash/crc32"
 	"math"
 	"os"
 	"regexp"
 	"strconv"
 	"strings"
+	"time"
 )
 
 // Special values for a revision.
@@ -18,18 +23,18 @@ const (
 	nop
 )
 
-// TODO revisit this when package regexp is more complete (e.g. do Unicode)
-const charPat = `[a-zA-Z0-9.\-]`
-
-var pathRe = mustBuildRe(charPat)
-
 var Any = MustCompileGlob("/**")
 
-var ErrTooLate = os.NewError("too late")
+var (
+	ErrTooLate os.Error = &Error{CodeTooLate, "too late"}
+	ErrClosed  os.Error = &Error{CodeClosed, "store closed"}
+)
 
 var (
-	ErrBadMutation = os.NewError("bad mutation")
-	ErrRevMismatch = os.NewError("rev mismatch")
+	ErrBadMutation  os.Error = &Error{CodeBadMutation, "bad mutation"}
+	ErrRevMismatch  os.Error = &Error{CodeRevMismatch, "rev mismatch"}
+	ErrBodyMismatch os.Error = &Error{CodeBodyMismatch, "body mismatch"}
+	ErrNotNumber    os.Error = &Error{CodeNotNumber, "not a number"}
 )
 
 type BadPathError struct {
@@ -56,10 +61,33 @@ type Store struct {
 	todo    *vector.Vector
 	state   *state
 	head    int64
-	log     map[int64]Event
+	log     *eventLog
 	cleanCh chan int64
+	statsCh chan chan CleanStats
+	cleaned int64 // when history was last discarded, in ns
+	pinCh   chan pinOp
+	pins    map[int64]int // seqn -> number of pins
 	notices []notice
 	flush   chan bool
+	stop    chan bool
+	done    chan bool
+	bodies  *packer
+	zipCh   chan int
+	tombs   tombstones
+	keepCh  chan int64
+	tombCh  chan tombQuery
+
+	reserveCh chan reserveOp
+	reserved  *[]string // see Reserve
+
+	validators []validator // see ReserveWith
+
+	indexCh chan indexOp
+	findCh  chan findQuery
+	indexes []*index // see Index
+
+	backlogCh chan int
+	loadCh    chan loadOp
 }
 
 // Represents an operation to apply to the store at position Seqn.
@@ -89,6 +117,7 @@ type Watch struct {
 	from, to int64
 	shutdown chan bool
 	stopped  bool
+	lat      Latency
 }
 
 
@@ -108,6 +137,13 @@ func (w *Watch) isStopped() bool {
 }
 
 
+// Returns the delivery latency of events sent to wt so far.
+func (wt *Watch) Latency() *Latency {
+	return &wt.lat
+}
+
+// Stops wt. Events already buffered in wt.C may still be received, but
+// no more will be sent.
 func (wt *Watch) Stop() {
 	select {
 	case wt.shutdown <- true:
@@ -115,15 +151,28 @@ func (wt *Watch) Stop() {
 	}
 }
 
+// The number of events a watch made by NewWatchFrom can hold before its
+// reader takes them. The process goroutine fills this buffer in one go,
+// so a watch that is catching up costs one wakeup per batch rather than
+// one per event.
+const watchBuf = 32
+
 type notice struct {
 	w  *Watch
 	ev Event
+	at int64 // when ev was applied
 }
 
 // Creates a new, empty data store. Mutations will be applied in order,
 // starting at number 1 (number 0 can be thought of as the creation of the
 // store).
 func New() *Store {
+	return newStore(0, emptyDir)
+}
+
+// Makes a store whose state starts at version ver, with contents root.
+// It has no events from before ver+1.
+func newStore(ver int64, root node) *Store {
 	ops := make(chan Op)
 	seqns := make(chan int64)
 	watches := make(chan int)
@@ -135,13 +184,31 @@ func New() *Store {
 		watchCh: make(chan *Watch),
 		todo:    new(vector.Vector),
 		watches: []*Watch{},
-		state:   &state{0, emptyDir},
-		log:     map[int64]Event{},
+		state:   &state{ver, root},
+		log:     newEventLog(),
 		cleanCh: make(chan int64),
+		statsCh: make(chan chan CleanStats),
+		pinCh:   make(chan pinOp),
+		pins:    make(map[int64]int),
 		flush:   make(chan bool),
+		stop:    make(chan bool, 1),
+		done:    make(chan bool),
+		bodies:  new(packer),
+		zipCh:   make(chan int),
+		keepCh:  make(chan int64),
+		tombCh:  make(chan tombQuery),
+
+		reserveCh: make(chan reserveOp),
+		indexCh:   make(chan indexOp),
+		findCh:    make(chan findQuery),
+		backlogCh: make(chan int),
+		loadCh:    make(chan loadOp),
+	}
+	if ver > 0 {
+		st.head = ver + 1
 	}
 
-	go st.process(ops, seqns, watches)
+	gocount.Go("store", func() { st.process(ops, seqns, watches) })
 	return st
 }
 
@@ -156,18 +223,15 @@ func join(parts []string) string {
 	return "/" + strings.Join(parts, "/")
 }
 
-func checkPath(k string) os.Error {
-	if !pathRe.MatchString(k) {
-		return &BadPathError{k}
-	}
-	return nil
-}
-
 // Returns a mutation that can be applied to a `Store`. The mutation will set
 // the contents of the file at `path` to `body` iff `rev` is greater than
 // of equal to the file's revision at the time of application, with
 // one exception: if `rev` is Clobber, the file will be set unconditionally.
 //
+// Since a path can't contain '=', everything after the first '=' in the
+// mutation is the body, so `body` may hold any bytes at all, including
+// '=', newlines, and invalid UTF-8. Dump quotes each mutation it writes.
+//
 // If `path` is not valid, returns a `BadPathError`.
 func EncodeSet(path, body string, rev int64) (mutation string, err os.Error) {
 	if err = checkPath(path); err != nil {
@@ -190,6 +254,178 @@ func EncodeDel(path string, rev int64) (mutation string, err os.Error) {
 	return strconv.Itoa64(rev) + ":" + path, nil
 }
 
+// Kind prefix of mutations returned by EncodeInDir.
+const dirKind = "dir"
+
+// Returns a mutation that applies `mut`, a mutation returned by EncodeSet
+// or EncodeDel, only if no entry has been added to or removed from the
+// parent directory of its path since `dirRev`, the directory's rev as
+// reported by DirRev. Otherwise, it fails with ErrRevMismatch. This lets
+// a writer add a child to a directory only if the set of siblings it
+// saw is still current.
+//
+// Gated by the cluster feature level; see mutFeatures.
+func EncodeInDir(dirRev int64, mut string) string {
+	return dirKind + ":" + strconv.Itoa64(dirRev) + ":" + mut
+}
+
+// Kind prefix of mutations returned by EncodeIfExists and EncodeIfAbsent.
+const existsKind = "exists"
+
+// Returns a mutation that applies `mut`, a mutation returned by EncodeSet
+// or EncodeDel, only if its path exists, whatever its rev. Otherwise, it
+// fails with os.ENOENT. This lets a writer replace or delete a file only
+// if it is there, without first reading its rev.
+//
+// Gated by the cluster feature level; see mutFeatures.
+func EncodeIfExists(mut string) string {
+	return existsKind + ":1:" + mut
+}
+
+// Like EncodeIfExists, but applies `mut` only if its path does not
+// exist, failing with os.EEXIST otherwise.
+func EncodeIfAbsent(mut string) string {
+	return existsKind + ":0:" + mut
+}
+
+// Kind prefix of mutations returned by EncodeIfBody.
+const bodyKind = "body"
+
+// Returns the hash of `body` that EncodeIfBodyHash compares: its SHA-1,
+// in hex.
+func BodyHash(body string) string {
+	h := sha1.New()
+	h.Write([]byte(body))
+	return fmt.Sprintf("%x", h.Sum())
+}
+
+// Returns the checksum of `body` that StatInfo.Sum and Event.Sum report:
+// its CRC-32, with the IEEE polynomial. A client can check a body it
+// read against it, or compare it with that of a copy it already has.
+func BodySum(body string) uint32 {
+	return crc32.ChecksumIEEE([]byte(body))
+}
+
+// Returns a mutation that applies `mut`, a mutation returned by EncodeSet
+// or EncodeDel, only if its path is a file whose body is `body`.
+// Otherwise, it fails with ErrBodyMismatch. This lets a writer that
+// knows only the value it expects make an optimistic update.
+//
+// Gated by the cluster feature level; see mutFeatures.
+func EncodeIfBody(body, mut string) string {
+	return EncodeIfBodyHash(BodyHash(body), mut)
+}
+
+// Like EncodeIfBody, but takes the hash of the expected body, as
+// returned by BodyHash.
+func EncodeIfBodyHash(hash, mut string) string {
+	return bodyKind + ":" + hash + ":" + mut
+}
+
+// Kind prefix of mutations returned by EncodeAppend.
+const appendKind = "append"
+
+// Returns a mutation that appends `data` to the file at `path`, or
+// creates it holding `data` if it is missing, iff `rev` is greater than
+// or equal to the file's revision at the time of application, as for
+// EncodeSet. Concurrent appends don't lose each other's data, since
+// each one applies to the body left by the last.
+//
+// If `path` is not valid, returns a `BadPathError`.
+//
+// Gated by the cluster feature level; see mutFeatures.
+func EncodeAppend(path, data string, rev int64) (mutation string, err os.Error) {
+	mutation, err = EncodeSet(path, data, rev)
+	if err != nil {
+		return
+	}
+	return appendKind + ":" + mutation, nil
+}
+
+// Kind prefix of mutations returned by EncodeAppendMax.
+const appendMaxKind = "appendmax"
+
+var ErrBodyLimit os.Error = &Error{CodeOverLimit, "over limit: body"}
+
+// Like EncodeAppend, but the mutation fails with ErrBodyLimit, leaving
+// the file as it was, if the body the append would leave is longer
+// than `max` bytes. The check is made as the mutation is applied,
+// against the body the file has then, so appends made at once can't
+// together go past the limit.
+//
+// Gated by the cluster feature level; see mutFeatures.
+func EncodeAppendMax(path, data string, rev, max int64) (mutation string, err os.Error) {
+	mutation, err = EncodeAppend(path, data, rev)
+	if err != nil {
+		return
+	}
+	return appendMaxKind + ":" + strconv.Itoa64(max) + ":" + mutation, nil
+}
+
+// Kind prefix of mutations returned by EncodeTouch.
+const touchKind = "touch"
+
+// Returns a mutation that sets the file at `path` to the body it already
+// has, iff `rev` is greater than or equal to the file's revision at the
+// time of application, as for EncodeSet. The file gets a new rev, and
+// watches see a set with the unchanged body, so that caches and
+// watchers of it refresh. A link stays a link. If `path` is missing,
+// the mutation fails with os.ENOENT.
+//
+// If `path` is not valid, returns a `BadPathError`.
+//
+// Gated by the cluster feature level; see mutFeatures.
+func EncodeTouch(path string, rev int64) (mutation string, err os.Error) {
+	if err = checkPath(path); err != nil {
+		return
+	}
+	return touchKind + ":" + strconv.Itoa64(rev) + ":" + path, nil
+}
+
+// Kind prefix of mutations returned by EncodeAdd.
+const addKind = "add"
+
+// Returns a mutation that adds `delta` to the integer held, in decimal,
+// by the file at `path`, iff `rev` is greater than or equal to the
+// file's revision at the time of application, as for EncodeSet. A
+// missing or empty file counts as 0. If the file holds anything else,
+// the mutation fails with ErrNotNumber. The event's Body is the sum.
+//
+// If `path` is not valid, returns a `BadPathError`.
+//
+// Gated by the cluster feature level; see mutFeatures.
+func EncodeAdd(path string, delta, rev int64) (mutation string, err os.Error) {
+	mutation, err = EncodeSet(path, strconv.Itoa64(delta), rev)
+	if err != nil {
+		return
+	}
+	return addKind + ":" + mutation, nil
+}
+
+// Kind prefix of mutations returned by EncodeSequential.
+const seqKind = "seq"
+
+// Returns a mutation that creates a new file holding `body` at `prefix`
+// followed by a suffix chosen at application: the mutation's seqn,
+// zero-padded to 19 digits. Each file so created has a greater suffix
+// than any before it, and the names sort in the order the files were
+// created. The path chosen is the Path of the resulting event.
+//
+// If `prefix` followed by a suffix is not a valid path, returns a
+// `BadPathError`.
+//
+// Gated by the cluster feature level; see mutFeatures.
+func EncodeSequential(prefix, body string) (mutation string, err os.Error) {
+	if err = checkPath(seqPath(prefix, 0)); err != nil {
+		return
+	}
+	return seqKind + ":" + prefix + "=" + body, nil
+}
+
+func seqPath(prefix string, seqn int64) string {
+	return fmt.Sprintf("%s%019d", prefix, seqn)
+}
+
 // MustEncodeSet is like EncodeSet but panics if the mutation cannot be
 // encoded. It simplifies safe initialization of global variables holding
 // mutations.
@@ -212,6 +448,256 @@ func MustEncodeDel(path string, rev int64) (mutation string) {
 	return m
 }
 
+// Like decode, but first checks the condition of a mutation wrapped by
+// EncodeInDir, returning ErrRevMismatch if it doesn't hold in n. A
+// mutation returned by EncodeSequential is decoded as a set, at `seqn`,
+// of a file that must not yet exist.
+func (n node) decodeCond(seqn int64, mutation string) (path, v string, rev int64, keep bool, err os.Error) {
+	switch kindOf(mutation) {
+	case existsKind:
+		return n.decodeExists(mutation)
+	case seqKind:
+		return decodeSeq(seqn, mutation)
+	case bodyKind:
+		return n.decodeBody(mutation)
+	case appendKind:
+		return n.decodeAppend(mutation)
+	case appendMaxKind:
+		_, app, e := decodeAppendMax(mutation)
+		if e != nil {
+			err = e
+			return
+		}
+		return n.decodeAppend(app)
+	case addKind:
+		return n.decodeAdd(mutation)
+	case touchKind:
+		return n.decodeTouch(mutation)
+	case linkKind:
+		return decodeLink(mutation)
+	case binaryKind:
+		return decodeBinary(mutation)
+	case dirKind:
+	default:
+		return decode(mutation)
+	}
+
+	parts := strings.Split(mutation, ":", 3)
+	if len(parts) != 3 {
+		err = ErrBadMutation
+		return
+	}
+
+	dirRev, err := strconv.Atoi64(parts[1])
+	if err != nil {
+		return
+	}
+
+	path, v, rev, keep, err = decode(parts[2])
+	if err == nil && dirRev < n.dirRev(parent(path)) {
+		err = ErrRevMismatch
+	}
+	return
+}
+
+// Like decode, but for a mutation wrapped by EncodeIfExists or
+// EncodeIfAbsent, returning os.ENOENT or os.EEXIST if its condition
+// doesn't hold in n.
+func (n node) decodeExists(mutation string) (path, v string, rev int64, keep bool, err os.Error) {
+	parts := strings.Split(mutation, ":", 3)
+	if len(parts) != 3 {
+		err = ErrBadMutation
+		return
+	}
+
+	path, v, rev, keep, err = decode(parts[2])
+	if err != nil {
+		return
+	}
+
+	_, cur := n.Get(path)
+	switch parts[1] {
+	case "1":
+		if cur == Missing {
+			err = os.ENOENT
+		}
+	case "0":
+		if cur != Missing {
+			err = os.EEXIST
+		}
+	default:
+		err = ErrBadMutation
+	}
+	return
+}
+
+// Like decode, but for a mutation wrapped by EncodeIfBody, returning
+// ErrBodyMismatch if its condition doesn't hold in n.
+func (n node) decodeBody(mutation string) (path, v string, rev int64, keep bool, err os.Error) {
+	parts := strings.Split(mutation, ":", 3)
+	if len(parts) != 3 {
+		err = ErrBadMutation
+		return
+	}
+
+	path, v, rev, keep, err = decode(parts[2])
+	if err != nil {
+		return
+	}
+
+	body, cur := n.Get(path)
+	if cur <= Missing || len(body) != 1 || BodyHash(body[0]) != parts[1] {
+		err = ErrBodyMismatch
+	}
+	return
+}
+
+// Decodes a mutation returned by EncodeAppend as a set of its path to
+// the path's body in n followed by the data.
+func (n node) decodeAppend(mutation string) (path, v string, rev int64, keep bool, err os.Error) {
+	path, v, rev, keep, err = decode(mutation[len(appendKind)+1:])
+	if err != nil {
+		return
+	}
+	if !keep {
+		err = ErrBadMutation
+		return
+	}
+
+	if body, cur := n.Get(path); cur > Missing {
+		v = body[0] + v
+	}
+	return
+}
+
+// Returns the limit of a mutation returned by EncodeAppendMax, and the
+// append it limits.
+func decodeAppendMax(mutation string) (max int64, app string, err os.Error) {
+	parts := strings.Split(mutation, ":", 3)
+	if len(parts) != 3 {
+		err = ErrBadMutation
+		return
+	}
+
+	max, err = strconv.Atoi64(parts[1])
+	if err != nil {
+		return
+	}
+	return max, parts[2], nil
+}
+
+// Returns ErrBodyLimit if mut was returned by EncodeAppendMax and body,
+// the one it leaves, is over its limit.
+func checkAppendMax(mut, body string) os.Error {
+	if kindOf(mut) != appendMaxKind {
+		return nil
+	}
+	if max, _, err := decodeAppendMax(mut); err == nil && int64(len(body)) > max {
+		return ErrBodyLimit
+	}
+	return nil
+}
+
+// Decodes a mutation returned by EncodeTouch as a set of its path to
+// the path's body in n.
+func (n node) decodeTouch(mutation string) (path, v string, rev int64, keep bool, err os.Error) {
+	path, _, rev, keep, err = decode(mutation[len(touchKind)+1:])
+	if err != nil {
+		return
+	}
+	if keep {
+		err = ErrBadMutation
+		return
+	}
+
+	body, cur := n.Get(path)
+	switch cur {
+	case Missing:
+		err = os.ENOENT
+	case Dir:
+		err = os.EISDIR
+	default:
+		v = body[0]
+	}
+	return path, v, rev, true, err
+}
+
+// Decodes a mutation returned by EncodeAdd as a set of its path to the
+// sum of the path's number in n and the delta.
+func (n node) decodeAdd(mutation string) (path, v string, rev int64, keep bool, err os.Error) {
+	path, v, rev, keep, err = decode(mutation[len(addKind)+1:])
+	if err != nil {
+		return
+	}
+
+	delta, err := strconv.Atoi64(v)
+	if !keep || err != nil {
+		err = ErrBadMutation
+		return
+	}
+
+	var x int64
+	if body, cur := n.Get(path); cur > Missing && body[0] != "" {
+		x, err = strconv.Atoi64(body[0])
+		if err != nil {
+			err = ErrNotNumber
+			return
+		}
+	}
+	return path, strconv.Itoa64(x + delta), rev, true, nil
+}
+
+// Decodes a mutation returned by EncodeLink as a set of its path to the
+// link's target.
+func decodeLink(mutation string) (path, v string, rev int64, keep bool, err os.Error) {
+	path, v, rev, keep, err = decode(mutation[len(linkKind)+1:])
+	if err == nil && !keep {
+		err = ErrBadMutation
+	}
+	if err == nil {
+		err = anyPath(v)
+	}
+	return
+}
+
+// Decodes a mutation returned by EncodeSequential, applied at `seqn`, as
+// a set that fails with ErrRevMismatch if the chosen path exists.
+func decodeSeq(seqn int64, mutation string) (path, v string, rev int64, keep bool, err os.Error) {
+	kv := strings.Split(mutation[len(seqKind)+1:], "=", 2)
+	if len(kv) != 2 {
+		err = ErrBadMutation
+		return
+	}
+
+	path = seqPath(kv[0], seqn)
+	if err = anyPath(path); err != nil {
+		return
+	}
+	return path, kv[1], Missing, true, nil
+}
+
+func parent(path string) string {
+	i := strings.LastIndex(path, "/")
+	if i < 1 {
+		return "/"
+	}
+	return path[:i]
+}
+
+// Decodes a plain set or del, in either format: one made by EncodeSet,
+// EncodeDel, EncodeBinarySet or EncodeBinaryDel. keep is true for a set.
+// Any other kind of mutation yields ErrBadMutation.
+func DecodeWrite(mutation string) (path, body string, rev int64, keep bool, err os.Error) {
+	switch kindOf(mutation) {
+	case "":
+		return decode(mutation)
+	case binaryKind:
+		return decodeBinary(mutation)
+	}
+	err = ErrBadMutation
+	return
+}
+
 func decode(mutation string) (path, v string, rev int64, keep bool, err os.Error) {
 	cm := strings.Split(mutation, ":", 2)
 
@@ -227,7 +713,7 @@ func decode(mutation string) (path, v string, rev int64, keep bool, err os.Error
 
 	kv := strings.Split(cm[1], "=", 2)
 
-	if err = checkPath(kv[0]); err != nil {
+	if err = anyPath(kv[0]); err != nil {
 		return
 	}
 
@@ -243,6 +729,13 @@ func decode(mutation string) (path, v string, rev int64, keep bool, err os.Error
 func (st *Store) notify(e Event, ws []*Watch) []*Watch {
 	nwatches := make([]*Watch, len(ws))
 
+	at := st.log.appliedAt(e.Seqn)
+
+	var writes []Event
+	if isBulk(e) {
+		writes = Expand(e)
+	}
+
 	i := 0
 	for _, w := range ws {
 		if w.isStopped() {
@@ -263,30 +756,134 @@ func (st *Store) notify(e Event, ws []*Watch) []*Watch {
 			continue
 		}
 
-		if w.glob.Match(e.Path) {
-			st.notices = append(st.notices, notice{w, e})
+		if matchEvent(w.glob, e, writes) {
+			st.notices = append(st.notices, notice{w, e, at})
 		}
 	}
 
 	return nwatches[0:i]
 }
 
+// Hands over as many queued notices as the watch channels will take
+// without blocking. It stops at the first notice that can't be sent, so
+// each watch still sees its events in order.
+func (st *Store) deliver() {
+	for len(st.notices) > 0 {
+		n := st.notices[0]
+		if !n.w.isStopped() {
+			select {
+			case n.w.c <- n.ev:
+				n.delivered()
+			default:
+				return
+			}
+		}
+		st.notices = st.notices[1:]
+	}
+}
+
+// The result of a mutation whose application panicked.
+type PanicError struct {
+	Value interface{}
+}
+
+func (e *PanicError) String() string {
+	return fmt.Sprint("panic: ", e.Value)
+}
+
+// Applies mutations for process. A variable so tests can provoke a
+// panic.
+var applyMut = func(n node, seqn int64, mut string, bodies *packer) (node, Event) {
+	return n.applyIn(seqn, mut, bodies)
+}
+
+// Like n.apply, but if applying mut panics, recovers and records the
+// panic at ErrorPath instead, leaving the rest of the tree as it was.
+// Every peer hits the same panic at the same seqn, so they all record
+// the same error and stay in agreement. The tree returned keeps its
+// cluster feature level; see withLevel.
+func safeApply(n node, seqn int64, mut string, bodies *packer) (rep node, ev Event) {
+	defer func() {
+		if x := recover(); x != nil {
+			err := &PanicError{x}
+			rep = n.setp(ErrorPath, err.String(), seqn, seqn, true)
+			ev = Event{seqn, ErrorPath, err.String(), seqn, mut, err, rep}
+		}
+	}()
+	rep, ev = applyMut(n, seqn, mut, bodies)
+	rep = rep.withLevel()
+	ev.Getter = rep
+	return rep, ev
+}
+
+// Hands each watch its undelivered events, followed by a final event
+// with Err set to ErrClosed if the watch was still open, then closes its
+// channel. Delivery happens in the background, so a watch that is
+// neither read nor stopped can't hold up shutdown.
 func (st *Store) closeWatches() {
+	final := Event{Seqn: st.state.ver, Path: "/", Rev: nop, Err: ErrClosed, Getter: st.state.root}
+
+	pending := map[*Watch][]Event{}
+	var order []*Watch
+	for _, n := range st.notices {
+		if _, ok := pending[n.w]; !ok {
+			order = append(order, n.w)
+		}
+		pending[n.w] = append(pending[n.w], n.ev)
+	}
 	for _, w := range st.watches {
-		close(w.c)
+		if _, ok := pending[w]; !ok {
+			order = append(order, w)
+		}
+		pending[w] = append(pending[w], final)
+	}
+	st.notices, st.watches = nil, nil
+
+	for _, w := range order {
+		w, evs := w, pending[w]
+		gocount.Go("store.watch", func() { w.finish(evs) })
 	}
 }
 
+func (w *Watch) finish(evs []Event) {
+	defer close(w.c)
+	for _, ev := range evs {
+		if w.isStopped() {
+			return
+		}
+
+		select {
+		case w.c <- ev:
+		case <-w.shutdown:
+			return
+		}
+	}
+}
+
+// Stops st. Queued mutations that can't yet be applied are discarded.
+// Every watch receives its remaining events and a final event
+// whose Err is ErrClosed, then its channel is closed; Seqns and Watches
+// are closed too. Close waits for the store's goroutine to exit. It is
+// safe to call more than once, but Ops must not be used after Close.
+func (st *Store) Close() {
+	select {
+	case st.stop <- true:
+	default:
+	}
+	<-st.done
+}
+
 func (st *Store) process(ops <-chan Op, seqns chan<- int64, watches chan<- int) {
+	defer close(st.done)
+	defer close(watches)
+	defer close(seqns)
 	defer st.closeWatches()
 
 	for {
 		var flush bool
 		ver, values := st.state.ver, st.state.root
 
-		for len(st.notices) > 0 && st.notices[0].w.isStopped() {
-			st.notices = st.notices[1:]
-		}
+		st.deliver()
 
 		var nc chan<- Event
 		var ne Event
@@ -311,22 +908,54 @@ func (st *Store) process(ops <-chan Op, seqns chan<- int64, watches chan<- int)
 				ws = []*Watch{}
 			}
 			for ; len(ws) > 0 && n <= ver; n++ {
-				ws = st.notify(st.log[n], ws)
+				ws = st.notify(st.log.get(n), ws)
 			}
 
 			st.watches = append(st.watches, ws...)
 		case seqn := <-st.cleanCh:
-			for ; st.head <= seqn; st.head++ {
-				st.log[st.head] = Event{}, false
+			if seqn > ver {
+				seqn = ver
+			}
+			seqn = st.pinFloor(seqn)
+			if seqn >= st.head {
+				st.log.release(seqn)
+				st.head = seqn + 1
+				st.cleaned = time.Nanoseconds()
 			}
+		case ch := <-st.statsCh:
+			cs := st.log.stats(st.head)
+			cs.LastClean = st.cleaned
+			ch <- cs
+		case op := <-st.pinCh:
+			st.pin(op)
+		case op := <-st.reserveCh:
+			st.reserve(op)
+		case op := <-st.indexCh:
+			st.addIndex(op, values)
+		case q := <-st.findCh:
+			st.findByValue(q)
+		case st.bodies.zipOver = <-st.zipCh:
+			// nothing
+		case n := <-st.keepCh:
+			st.tombs.setKeep(n, ver)
+		case q := <-st.tombCh:
+			q.ch <- st.tombs.deleted(values.fold(q.path))
 		case seqns <- ver:
 			// nothing to do here
 		case watches <- len(st.watches):
 			// nothing to do here
+		case st.backlogCh <- st.todo.Len():
+			// nothing to do here
+		case op := <-st.loadCh:
+			st.state = st.load(op)
+			ver, values = st.state.ver, st.state.root
 		case nc <- ne:
+			st.notices[0].delivered()
 			st.notices = st.notices[1:]
 		case flush = <-st.flush:
 			// nothing
+		case <-st.stop:
+			return
 		}
 
 		var ev Event
@@ -345,33 +974,72 @@ func (st *Store) process(ops <-chan Op, seqns chan<- int64, watches chan<- int)
 				continue
 			}
 
-			values, ev = values.apply(t.Seqn, t.Mut)
+			prev := values
+			values, ev = safeApply(values, t.Seqn, t.Mut, st.bodies)
+			values, ev = st.validate(prev, values, ev)
+			st.tombs.record(prev, ev)
+			indexEvent(st.indexes, ev)
 			st.state = &state{ev.Seqn, values}
 			ver = ev.Seqn
 			if !flush {
-				st.log[ev.Seqn] = ev
+				st.log.put(ev)
 				st.watches = st.notify(ev, st.watches)
 			}
 		}
 
 		// A flush just gets one final event.
 		if flush {
-			st.log[ev.Seqn] = ev
+			st.log.put(ev)
 			st.watches = st.notify(ev, st.watches)
 			st.head = ver + 1
 		}
 	}
 }
 
+// Returns the number of mutations st has been sent that it can't apply
+// yet, because one before them is still missing. A backlog that keeps
+// growing means consensus is learning values faster than gaps are
+// filled. Returns 0 if st is closed.
+func (st *Store) Backlog() int {
+	select {
+	case n := <-st.backlogCh:
+		return n
+	case <-st.done:
+		return 0
+	}
+}
+
 // Returns a point-in-time snapshot of the contents of the store.
 func (st *Store) Snap() (ver int64, g Getter) {
 	// WARNING: Be sure to read the pointer value of st.state only once. If you
 	// need multiple accesses, copy the pointer first.
+	//
+	// Readers only load this pointer and then walk immutable nodes, so
+	// they share cache lines without contending for them; only the
+	// process goroutine writes. Sharding the root by top-level directory
+	// would give each shard its own version, and a snapshot would then
+	// have to read every shard pointer and agree on one ver, which is
+	// the point of having a single state. See bench.BenchmarkSnapGet
+	// before trying it.
 	p := st.state
 
 	return p.ver, p.root
 }
 
+// Returns the body of every file matching `glob`, by path, all from one
+// snapshot, and that snapshot's version. Related files read this way are
+// never torn: a change to several of them in one mutation is seen in
+// full or not at all.
+func (st *Store) GetAll(glob *Glob) (ver int64, files map[string]string) {
+	ver, g := st.Snap()
+	files = make(map[string]string)
+	Walk(g, glob, func(path, body string, _ int64) bool {
+		files[path] = body
+		return false
+	})
+	return ver, files
+}
+
 // Gets the value stored at `path`, if any.
 //
 // If no value is stored at `path`, `rev` will be `Missing` and `value` will be
@@ -391,12 +1059,37 @@ func (st *Store) Stat(path string) (int32, int64) {
 	return g.Stat(path)
 }
 
+// Gets the value stored at `path` as of position `seqn`: what Get would
+// have returned just after the mutation at `seqn` was applied. Results
+// are as for Get. This reads the history st keeps for watches that
+// start in the past, so it reaches back as far as they do. If `seqn`
+// hasn't been applied yet, waits for it.
+//
+// If `seqn` is less than any value passed to st.Clean, returns
+// `ErrTooLate`. If st is closed, returns `ErrClosed`.
+func (st *Store) GetAt(path string, seqn int64) (value []string, rev int64, err os.Error) {
+	ch, err := st.Wait(seqn)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	ev := <-ch
+	if closed(ch) || ev.Err == ErrClosed {
+		return nil, 0, ErrClosed
+	}
+	value, rev = ev.Get(path)
+	return value, rev, nil
+}
+
 
 // Apply all operations in the internal queue, even if there are gaps in the
 // sequence (gaps will be treated as no-ops). This is only useful for
 // bootstrapping a store from a point-in-time snapshot of another store.
 func (st *Store) Flush() {
-	st.flush <- true
+	select {
+	case st.flush <- true:
+	case <-st.done:
+	}
 }
 
 
@@ -408,13 +1101,21 @@ func (st *Store) Watch(glob *Glob) <-chan Event {
 
 // Arranges for w to receive notifications when mutations are applied to st.
 // One event e will be received from w.C for each mutation iff
-// glob.Match(e.Path).
+// glob.Match(e.Path), or for a bulk, batch or directory copy, iff glob
+// matches any of its writes. Such an event comes whole; see Writes.
 //
 // Notifications will not be sent for changes that were made by calling
 // st.Flush.
+//
+// If st is closed, the returned Watch's channel is already closed.
 func NewWatch(st *Store, glob *Glob) *Watch {
 	rev, _ := st.Snap()
 	w, err := NewWatchFrom(st, glob, rev+1)
+	if err == ErrClosed {
+		ch := make(chan Event)
+		close(ch)
+		return &Watch{C: ch, c: ch, glob: glob, shutdown: make(chan bool, 1)}
+	}
 	if err != nil {
 		panic(err)
 	}
@@ -423,15 +1124,16 @@ func NewWatch(st *Store, glob *Glob) *Watch {
 
 // Arranges for w to receive notifications when mutations are applied to st.
 // One event e will be received from w.C for each mutation iff
-// glob.Match(e.Path).
+// glob.Match(e.Path), or for a bulk, batch or directory copy, iff glob
+// matches any of its writes. Such an event comes whole; see Writes.
 //
 // Notifications will not be sent for changes that were made by calling
 // st.Flush.
 //
 // If `from` is less than any value passed to st.Clean, NewWatchFrom
-// will return `ErrTooLate`.
+// will return `ErrTooLate`. If st is closed, it will return `ErrClosed`.
 func NewWatchFrom(st *Store, glob *Glob, from int64) (*Watch, os.Error) {
-	ch := make(chan Event)
+	ch := make(chan Event, watchBuf)
 	return st.watchOn(glob, ch, from, math.MaxInt64)
 }
 
@@ -442,12 +1144,16 @@ func (st *Store) watchOn(glob *Glob, ch chan Event, from, to int64) (*Watch, os.
 	wt := &Watch{
 		C:        ch,
 		c:        ch,
-		glob:     glob,
+		glob:     foldGlob(st, glob),
 		from:     from,
 		to:       to,
 		shutdown: make(chan bool, 1),
 	}
-	st.watchCh <- wt
+	select {
+	case st.watchCh <- wt:
+	case <-st.done:
+		return nil, ErrClosed
+	}
 	head := st.head
 	if head > from {
 		wt.Stop()
@@ -460,36 +1166,63 @@ func (st *Store) watchOn(glob *Glob, ch chan Event, from, to int64) (*Watch, os.
 // change made at position `seqn`.
 //
 // If `seqn` is less than any value passed to st.Clean, Wait will return
-// `ErrTooLate`.
+// `ErrTooLate`. If st is closed, it will return `ErrClosed`.
 func (st *Store) Wait(seqn int64) (<-chan Event, os.Error) {
-	w, err := st.watchOn(Any, make(chan Event, 1), seqn, seqn+1)
+	w, err := NewWait(st, seqn)
 	if err != nil {
 		return nil, err
 	}
 	return w.C, nil
 }
 
+// Like st.Wait, but returns a Watch, so the caller can give up waiting.
+// Stopping the Watch releases the registration without waiting for
+// `seqn` to be applied.
+func NewWait(st *Store, seqn int64) (*Watch, os.Error) {
+	return st.watchOn(Any, make(chan Event, 1), seqn, seqn+1)
+}
+
 // Returns an immutable copy of `st` in which `path` exists as a regular file
 // (not a dir). Waits for `path` to be set, if necessary.
 //
 // Returns nil, nil if the store is closed.
 func (st *Store) SyncPath(path string) (Getter, os.Error) {
-	glob, err := CompileGlob(path)
-	if err != nil {
-		return nil, err
+	return st.SyncPaths(path)
+}
+
+// Like SyncPath, but waits until every one of `patterns`, each a path
+// or a glob, is matched by at least one regular file, and returns an
+// immutable copy of `st` in which they all are at once. A process can
+// use it at startup to wait until each service it depends on has
+// registered:
+//
+//	g, err := st.SyncPaths("/svc/db/*", "/config/app")
+//
+// If a pattern is not a valid glob, returns the error from CompileGlob.
+// Returns nil, nil if the store is closed.
+func (st *Store) SyncPaths(patterns ...string) (Getter, os.Error) {
+	globs := make([]*Glob, len(patterns))
+	for i, p := range patterns {
+		glob, err := CompileGlob(p)
+		if err != nil {
+			return nil, err
+		}
+		globs[i] = foldGlob(st, glob)
 	}
 
-	wt := NewWatch(st, glob)
+	wt := NewWatch(st, Any)
 	defer wt.Stop()
 
 	_, g := st.Snap()
-	_, rev := g.Get(path)
-	if rev != Dir && rev != Missing {
+	if allMatched(g, globs) {
 		return g, nil
 	}
 
 	for ev := range wt.C {
-		if ev.IsSet() {
+		if ev.Err == ErrClosed {
+			break
+		}
+		if setsAny(ev, globs) && allMatched(ev, globs) {
 			return ev, nil
 		}
 	}
@@ -497,6 +1230,73 @@ func (st *Store) SyncPath(path string) (Getter, os.Error) {
 	return nil, nil
 }
 
+// Reports whether each of globs matches a file in g. A glob that is a
+// plain path is looked up rather than walked.
+func allMatched(g Getter, globs []*Glob) bool {
+	for _, glob := range globs {
+		var found bool
+		if strings.IndexAny(glob.Pattern, "*?") < 0 {
+			_, rev := g.Get(glob.Pattern)
+			found = rev != Dir && rev != Missing
+		} else {
+			found = Walk(g, glob, func(string, string, int64) bool {
+				return true
+			})
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// Reports whether ev sets any file matched by one of globs.
+func setsAny(ev Event, globs []*Glob) bool {
+	for _, e := range Expand(ev) {
+		if !e.IsSet() {
+			continue
+		}
+		for _, glob := range globs {
+			if glob.Match(e.Path) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Discards the history st keeps at and before seqn, except what is
+// pinned. A seqn past the last one applied is taken to be that one, so
+// history is never discarded ahead of the mutations it describes.
 func (st *Store) Clean(seqn int64) {
-	st.cleanCh <- seqn
+	select {
+	case st.cleanCh <- seqn:
+	case <-st.done:
+	}
+}
+
+// Describes the history st holds for watches that start in the past.
+type CleanStats struct {
+	Head   int64 // the oldest seqn still kept
+	Events int64 // events kept
+	Bytes  int64 // in the mutations of those events
+
+	// Events discarded by Clean whose epoch can't be released yet,
+	// because it also holds events that are kept.
+	Dead int64
+
+	LastClean int64 // when Clean last discarded anything, in ns, or 0
+}
+
+// Returns the current CleanStats of st. A Clean called before it has
+// taken effect by the time it returns. If st is closed, returns the
+// zero CleanStats.
+func (st *Store) CleanStats() CleanStats {
+	ch := make(chan CleanStats, 1)
+	select {
+	case st.statsCh <- ch:
+		return <-ch
+	case <-st.done:
+	}
+	return CleanStats{}
 }
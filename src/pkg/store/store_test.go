@@ -1,6 +1,7 @@
 package store
 
 import (
+	"doozer/gocount"
 	"github.com/bmizerany/assert"
 	"sort"
 	"testing"
@@ -18,6 +19,8 @@ var SetKVRM = []kvcm{
 	{"/x", "a", Clobber, "-1:/x=a"},
 	{"/x", "a=b", Clobber, "-1:/x=a=b"},
 	{"/x", "a b", Clobber, "-1:/x=a b"},
+	{"/x", "a:\nb", Clobber, "-1:/x=a:\nb"},
+	{"/x", "\x00\xff=", Clobber, "-1:/x=\x00\xff="},
 	{"/", "a", Missing, "0:/=a"},
 	{"/", "a", 123, "123:/=a"},
 }
@@ -36,6 +39,10 @@ var GoodPaths = []string{
 	"/x/y-z",
 	"/x/y.z",
 	"/x/0",
+	"/x_y",
+	"/a:b@c",
+	"/héllo/世界",
+	"/x/.y",
 }
 
 var BadPaths = []string{
@@ -45,6 +52,13 @@ var BadPaths = []string{
 	"/x y",
 	"/x/",
 	"/x//y",
+	"/..",
+	"/x/./y",
+	"/x\ty",
+	"/x\x00",
+	"/x*",
+	"/x?",
+	"/x\xff",
 }
 
 var BadInstructions = []string{
@@ -212,7 +226,26 @@ func TestSnap(t *testing.T) {
 	assert.Equal(t, true, ok)
 
 	exp, _ := emptyDir.apply(1, mut)
-	assert.Equal(t, exp, root)
+	assert.Equal(t, exp.withLevel(), root)
+}
+
+func TestGetAll(t *testing.T) {
+	st := New()
+	defer close(st.Ops)
+	st.Ops <- Op{1, MustEncodeSet("/svc/a", "1", Clobber)}
+	st.Ops <- Op{2, EncodeBulk([]string{
+		MustEncodeSet("/svc/b", "2", Clobber),
+		MustEncodeSet("/svc/c/d", "3", Clobber),
+	})}
+	st.Ops <- Op{3, MustEncodeSet("/other", "4", Clobber)}
+	sync(st, 3)
+
+	ver, files := st.GetAll(MustCompileGlob("/svc/*"))
+	assert.Equal(t, int64(3), ver)
+	assert.Equal(t, map[string]string{"/svc/a": "1", "/svc/b": "2"}, files)
+
+	_, files = st.GetAll(MustCompileGlob("/nope/**"))
+	assert.Equal(t, map[string]string{}, files)
 }
 
 func TestApplyInOrder(t *testing.T) {
@@ -675,6 +708,35 @@ func TestStoreWaitZero(t *testing.T) {
 	assert.Equal(t, (<-chan Event)(nil), ch)
 }
 
+func TestStoreGetAt(t *testing.T) {
+	st := New()
+	defer close(st.Ops)
+
+	st.Ops <- Op{1, MustEncodeSet("/x", "a", Clobber)}
+	st.Ops <- Op{2, MustEncodeSet("/x", "b", Clobber)}
+	st.Ops <- Op{3, MustEncodeDel("/x", Clobber)}
+	sync(st, 3)
+
+	v, rev, err := st.GetAt("/x", 1)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, []string{"a"}, v)
+	assert.Equal(t, int64(1), rev)
+
+	v, rev, err = st.GetAt("/x", 2)
+	assert.Equal(t, []string{"b"}, v)
+	assert.Equal(t, int64(2), rev)
+
+	_, rev, err = st.GetAt("/x", 3)
+	assert.Equal(t, Missing, rev)
+
+	st.Clean(1)
+	_, _, err = st.GetAt("/x", 1)
+	assert.Equal(t, ErrTooLate, err)
+	v, _, err = st.GetAt("/x", 2)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, []string{"b"}, v)
+}
+
 func TestStoreNopEvent(t *testing.T) {
 	st := New()
 	defer close(st.Ops)
@@ -967,6 +1029,38 @@ func TestStoreClean(t *testing.T) {
 	assert.Equal(t, (<-chan Event)(nil), ch)
 }
 
+func TestStoreCleanFuture(t *testing.T) {
+	st := New()
+	defer close(st.Ops)
+	st.Ops <- Op{1, MustEncodeSet("/x", "a", Clobber)}
+
+	st.Clean(5)
+	assert.Equal(t, int64(2), st.CleanStats().Head)
+
+	st.Ops <- Op{2, MustEncodeSet("/x", "b", Clobber)}
+	ch, err := st.Wait(2)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "b", (<-ch).Body)
+}
+
+func TestStoreCleanStats(t *testing.T) {
+	st := New()
+	defer close(st.Ops)
+	mut := MustEncodeSet("/x", "a", Clobber)
+	st.Ops <- Op{1, mut}
+	st.Ops <- Op{2, mut}
+	st.Ops <- Op{3, mut}
+
+	cs := st.CleanStats()
+	assert.Equal(t, CleanStats{Events: 3, Bytes: int64(3 * len(mut))}, cs)
+
+	st.Clean(2)
+	cs = st.CleanStats()
+	assert.T(t, cs.LastClean > 0)
+	cs.LastClean = 0
+	assert.Equal(t, CleanStats{3, 1, int64(len(mut)), 2, 0}, cs)
+}
+
 func TestStoreSeqn(t *testing.T) {
 	st := New()
 	defer close(st.Ops)
@@ -1188,3 +1282,198 @@ func TestWatchIsStopped(t *testing.T) {
 	// it should remember that w has been stopped
 	assert.Equal(t, true, w.isStopped())
 }
+
+func TestStorePanicBecomesError(t *testing.T) {
+	defer func(f func(node, int64, string, *packer) (node, Event)) { applyMut = f }(applyMut)
+	applyMut = func(n node, seqn int64, mut string, bodies *packer) (node, Event) {
+		if mut == "boom" {
+			panic("boom")
+		}
+		return n.applyIn(seqn, mut, bodies)
+	}
+
+	st := New()
+	defer close(st.Ops)
+
+	c, _ := st.Wait(1)
+	st.Ops <- Op{1, "boom"}
+	st.Ops <- Op{2, MustEncodeSet("/x", "b", Clobber)}
+
+	got := <-c
+	assert.Equal(t, ErrorPath, got.Path)
+	assert.Equal(t, "panic: boom", got.Body)
+	assert.Equal(t, "boom", got.Mut)
+	assert.Equal(t, &PanicError{"boom"}, got.Err)
+
+	// The store keeps going.
+	sync(st, 2)
+	v, rev := st.Get("/x")
+	assert.Equal(t, int64(2), rev)
+	assert.Equal(t, []string{"b"}, v)
+}
+
+func TestStoreClose(t *testing.T) {
+	st := New()
+	st.Ops <- Op{1, MustEncodeSet("/x", "a", Clobber)}
+	wt, err := NewWatchFrom(st, Any, 2)
+	assert.Equal(t, nil, err)
+	st.Close()
+
+	ev := <-wt.C
+	assert.Equal(t, ErrClosed, ev.Err)
+	assert.Equal(t, int64(1), ev.Seqn)
+	assert.T(t, ev.IsNop())
+
+	<-wt.C
+	assert.T(t, closed(wt.C))
+
+	<-st.Seqns
+	assert.T(t, closed(st.Seqns))
+	<-st.Watches
+	assert.T(t, closed(st.Watches))
+}
+
+func TestStoreCloseDeliversPending(t *testing.T) {
+	st := New()
+	c, _ := st.Wait(1)
+	st.Ops <- Op{1, MustEncodeSet("/x", "a", Clobber)}
+	st.Close()
+
+	ev := <-c
+	assert.Equal(t, nil, ev.Err)
+	assert.Equal(t, "/x", ev.Path)
+	<-c
+	assert.T(t, closed(c))
+}
+
+func TestStoreCloseTwice(t *testing.T) {
+	st := New()
+	st.Close()
+	st.Close()
+}
+
+func TestStoreAfterClose(t *testing.T) {
+	st := New()
+	st.Close()
+
+	_, err := st.Wait(1)
+	assert.Equal(t, ErrClosed, err)
+
+	_, err = NewWatchFrom(st, Any, 1)
+	assert.Equal(t, ErrClosed, err)
+
+	w := NewWatch(st, Any)
+	<-w.C
+	assert.T(t, closed(w.C))
+
+	// These must not block.
+	st.Clean(1)
+	st.Flush()
+}
+
+func TestStoreCloseStoppedWatch(t *testing.T) {
+	st := New()
+	wt := NewWatch(st, Any)
+	wt.Stop()
+	st.Close()
+
+	<-wt.C
+	assert.T(t, closed(wt.C))
+}
+
+func TestStoreCloseNoLeak(t *testing.T) {
+	stores, watches := gocount.Count("store"), gocount.Count("store.watch")
+
+	st := New()
+	wt := NewWatch(st, Any)
+	stopped := NewWatch(st, Any)
+	st.Ops <- Op{1, Nop}
+	stopped.Stop()
+	st.Close()
+
+	for _ = range wt.C {
+	}
+
+	assert.T(t, gocount.Settle("store", stores, 1e9))
+	assert.T(t, gocount.Settle("store.watch", watches, 1e9))
+}
+
+func TestStoreWatchBatched(t *testing.T) {
+	st := New()
+	defer st.Close()
+	wt := NewWatch(st, Any)
+
+	for i := int64(1); i <= 5; i++ {
+		st.Ops <- Op{i, Nop}
+	}
+	sync(st, 5)
+	<-st.Seqns
+
+	// All five were handed over without anyone reading wt.C.
+	assert.Equal(t, 5, len(wt.C))
+}
+
+func TestSyncPaths(t *testing.T) {
+	st := New()
+	defer close(st.Ops)
+
+	st.Ops <- Op{1, MustEncodeSet("/config/app", "a", Clobber)}
+	sync(st, 1)
+
+	ch := make(chan Getter)
+	go func() {
+		g, err := st.SyncPaths("/config/app", "/svc/db/*")
+		assert.Equal(t, nil, err)
+		ch <- g
+	}()
+
+	for <-st.Watches < 1 {
+	} // make sure SyncPaths gets in there first
+	st.Ops <- Op{2, MustEncodeSet("/svc/web/1", "w", Clobber)}
+	st.Ops <- Op{3, MustEncodeSet("/svc/db/1", "d", Clobber)}
+	st.Ops <- Op{4, MustEncodeSet("/svc/db/1", "e", Clobber)}
+
+	g := <-ch
+	assert.Equal(t, "a", GetString(g, "/config/app"))
+	assert.Equal(t, "d", GetString(g, "/svc/db/1"))
+}
+
+func TestSyncPathsImmediate(t *testing.T) {
+	st := New()
+	defer close(st.Ops)
+
+	st.Ops <- Op{1, MustEncodeSet("/x", "a", Clobber)}
+	st.Ops <- Op{2, MustEncodeSet("/d/y", "b", Clobber)}
+	sync(st, 2)
+
+	g, err := st.SyncPaths("/x", "/d/*")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "b", GetString(g, "/d/y"))
+}
+
+func TestSyncPathsBadGlob(t *testing.T) {
+	st := New()
+	defer close(st.Ops)
+
+	_, err := st.SyncPaths("/x", "x")
+	assert.Equal(t, GlobError("x"), err)
+}
+
+func TestStoreBacklog(t *testing.T) {
+	st := New()
+	defer st.Close()
+
+	st.Ops <- Op{2, Nop}
+	st.Ops <- Op{3, Nop}
+	assert.Equal(t, 2, st.Backlog())
+
+	st.Ops <- Op{1, Nop}
+	assert.Equal(t, 0, st.Backlog())
+	assert.Equal(t, int64(3), <-st.Seqns)
+}
+
+func TestStoreBacklogClosed(t *testing.T) {
+	st := New()
+	st.Close()
+	assert.Equal(t, 0, st.Backlog())
+}
@@ -0,0 +1,103 @@
+package store
+
+// Deleted paths remembered for a while, so that a reader can tell a path
+// that was deleted lately from one that never existed. Owned by the
+// process goroutine.
+type tombstones struct {
+	keep  int64            // seqns to remember a delete for; see KeepTombstones
+	at    map[string]int64 // path -> seqn of its delete
+	order []tomb           // oldest first
+}
+
+type tomb struct {
+	seqn int64
+	path string
+}
+
+type tombQuery struct {
+	path string
+	ch   chan int64
+}
+
+// Has st remember, for `n` seqns after each delete applied from now on,
+// the seqn at which the path was deleted, so that Deleted, and StatOf
+// given st, can report it.
+// A set of the path since forgets its delete. If `n` is zero or less,
+// st forgets every delete, which is the default.
+//
+// Peers answer Deleted from their own settings, so set this the same
+// way on every peer whose answers should agree.
+func (st *Store) KeepTombstones(n int64) {
+	select {
+	case st.keepCh <- n:
+	case <-st.done:
+	}
+}
+
+// Returns the seqn at which `path` was deleted, if that was within the
+// last n seqns, for n as given to KeepTombstones, and `path` hasn't been
+// set since. Otherwise, or if st is closed, returns 0: either the path
+// exists, or it was deleted too long ago for st to remember, or it
+// never existed.
+//
+// Only paths deleted in their own right count. A directory left empty,
+// and so removed, by the delete of its last entry does not.
+func (st *Store) Deleted(path string) (seqn int64) {
+	q := tombQuery{path, make(chan int64, 1)}
+	select {
+	case st.tombCh <- q:
+		return <-q.ch
+	case <-st.done:
+	}
+	return 0
+}
+
+func (ts *tombstones) setKeep(n, ver int64) {
+	ts.keep = n
+	if n <= 0 {
+		ts.at, ts.order = nil, nil
+		return
+	}
+	ts.prune(ver)
+}
+
+// Records the deletes in ev, applied to prev, and forgets those too old
+// to keep.
+func (ts *tombstones) record(prev node, ev Event) {
+	if ts.keep <= 0 {
+		return
+	}
+	if ts.at == nil {
+		ts.at = make(map[string]int64)
+	}
+
+	for _, e := range Expand(ev) {
+		switch {
+		case e.Err != nil:
+			// nothing changed
+		case e.IsDel():
+			if _, rev := prev.Get(e.Path); rev == Missing {
+				continue
+			}
+			ts.at[e.Path] = e.Seqn
+			ts.order = append(ts.order, tomb{e.Seqn, e.Path})
+		case e.IsSet():
+			ts.at[e.Path] = 0, false
+		}
+	}
+	ts.prune(ev.Seqn)
+}
+
+func (ts *tombstones) prune(ver int64) {
+	for len(ts.order) > 0 && ts.order[0].seqn < ver-ts.keep {
+		t := ts.order[0]
+		if ts.at[t.path] == t.seqn {
+			ts.at[t.path] = 0, false
+		}
+		ts.order = ts.order[1:]
+	}
+}
+
+func (ts *tombstones) deleted(path string) int64 {
+	return ts.at[path]
+}
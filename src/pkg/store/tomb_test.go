@@ -0,0 +1,84 @@
+package store
+
+import (
+	"github.com/bmizerany/assert"
+	"testing"
+)
+
+func TestTombstones(t *testing.T) {
+	st := New()
+	defer close(st.Ops)
+	st.KeepTombstones(2)
+
+	st.Ops <- Op{1, MustEncodeSet("/x", "a", Clobber)}
+	st.Ops <- Op{2, MustEncodeDel("/x", Clobber)}
+	st.Ops <- Op{3, MustEncodeDel("/y", Clobber)}
+	sync(st, 3)
+
+	assert.Equal(t, int64(2), st.Deleted("/x"))
+	assert.Equal(t, int64(0), st.Deleted("/y"))
+	assert.Equal(t, int64(0), st.Deleted("/z"))
+
+	st.Ops <- Op{4, Nop}
+	sync(st, 4)
+	assert.Equal(t, int64(2), st.Deleted("/x"))
+
+	st.Ops <- Op{5, Nop}
+	sync(st, 5)
+	assert.Equal(t, int64(0), st.Deleted("/x"))
+}
+
+func TestTombstonesSet(t *testing.T) {
+	st := New()
+	defer close(st.Ops)
+	st.KeepTombstones(10)
+
+	st.Ops <- Op{1, MustEncodeSet("/x", "a", Clobber)}
+	st.Ops <- Op{2, MustEncodeDel("/x", Clobber)}
+	st.Ops <- Op{3, MustEncodeSet("/x", "b", Clobber)}
+	sync(st, 3)
+	assert.Equal(t, int64(0), st.Deleted("/x"))
+}
+
+func TestTombstonesBulk(t *testing.T) {
+	st := New()
+	defer close(st.Ops)
+	st.KeepTombstones(10)
+
+	st.Ops <- Op{1, MustEncodeSet("/d/x", "a", Clobber)}
+	st.Ops <- Op{2, EncodeBulk([]string{MustEncodeDel("/d/x", Clobber)})}
+	sync(st, 2)
+	assert.Equal(t, int64(2), st.Deleted("/d/x"))
+	assert.Equal(t, int64(0), st.Deleted("/d"))
+}
+
+func TestTombstonesOff(t *testing.T) {
+	st := New()
+	defer close(st.Ops)
+
+	st.Ops <- Op{1, MustEncodeSet("/x", "a", Clobber)}
+	st.Ops <- Op{2, MustEncodeDel("/x", Clobber)}
+	sync(st, 2)
+	assert.Equal(t, int64(0), st.Deleted("/x"))
+
+	st.KeepTombstones(10)
+	st.Ops <- Op{3, MustEncodeSet("/x", "a", Clobber)}
+	st.Ops <- Op{4, MustEncodeDel("/x", Clobber)}
+	sync(st, 4)
+	assert.Equal(t, int64(4), st.Deleted("/x"))
+
+	st.KeepTombstones(0)
+	assert.Equal(t, int64(0), st.Deleted("/x"))
+}
+
+func TestStatOfDeleted(t *testing.T) {
+	st := New()
+	defer close(st.Ops)
+	st.KeepTombstones(10)
+
+	st.Ops <- Op{1, MustEncodeSet("/x", "a", Clobber)}
+	st.Ops <- Op{2, MustEncodeDel("/x", Clobber)}
+	sync(st, 2)
+	assert.Equal(t, int64(2), StatOf(st, "/x").Deleted)
+	assert.Equal(t, int64(0), StatOf(st, "/y").Deleted)
+}
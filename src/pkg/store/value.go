@@ -0,0 +1,62 @@
+package store
+
+import (
+	"json"
+	"os"
+	"regexp"
+	"strconv"
+)
+
+// The error with which a check made by CheckValue fails a set.
+type BadValueError struct {
+	Path   string
+	Reason string // why the body was refused
+}
+
+func (e *BadValueError) String() string {
+	return "bad value at " + e.Path + ": " + e.Reason
+}
+
+// Returns a Validator, for ReserveWith, that refuses any set whose body
+// check rejects, failing the mutation with a *BadValueError. Dels, and
+// writes that aren't sets, always pass. Use it to keep fat-fingered
+// writes out of configuration trees:
+//
+//	st.ReserveWith(MustCompileGlob("/config/**"), CheckValue(JSONValue))
+func CheckValue(check func(body string) os.Error) Validator {
+	return func(ev Event) os.Error {
+		if !ev.IsSet() {
+			return nil
+		}
+		if err := check(ev.Body); err != nil {
+			return &BadValueError{ev.Path, err.String()}
+		}
+		return nil
+	}
+}
+
+// A check, for CheckValue, that admits only bodies that are JSON.
+func JSONValue(body string) os.Error {
+	var v interface{}
+	return json.Unmarshal([]byte(body), &v)
+}
+
+// A check, for CheckValue, that admits only bodies that are an integer
+// in decimal, as EncodeAdd uses.
+func IntValue(body string) os.Error {
+	if _, err := strconv.Atoi64(body); err != nil {
+		return ErrNotNumber
+	}
+	return nil
+}
+
+// Returns a check, for CheckValue, that admits only bodies matching
+// re. Anchor re to match whole bodies.
+func RegexpValue(re *regexp.Regexp) func(body string) os.Error {
+	return func(body string) os.Error {
+		if !re.MatchString(body) {
+			return os.NewError("does not match " + re.String())
+		}
+		return nil
+	}
+}
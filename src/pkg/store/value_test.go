@@ -0,0 +1,48 @@
+package store
+
+import (
+	"github.com/bmizerany/assert"
+	"regexp"
+	"testing"
+)
+
+func TestCheckValue(t *testing.T) {
+	v := CheckValue(IntValue)
+	assert.Equal(t, nil, v(Event{Path: "/n", Body: "12", Rev: 1}))
+	assert.Equal(t, nil, v(Event{Path: "/n", Rev: Missing}))
+	assert.Equal(t, nil, v(Event{Path: "/n", Rev: Dir}))
+	assert.Equal(t, &BadValueError{"/n", ErrNotNumber.String()}, v(Event{Path: "/n", Body: "x", Rev: 1}))
+}
+
+func TestJSONValue(t *testing.T) {
+	assert.Equal(t, nil, JSONValue(`{"a": [1, 2]}`))
+	assert.Equal(t, nil, JSONValue(`"s"`))
+	assert.NotEqual(t, nil, JSONValue(`{"a": `))
+	assert.NotEqual(t, nil, JSONValue(``))
+}
+
+func TestRegexpValue(t *testing.T) {
+	check := RegexpValue(regexp.MustCompile(`^[a-z]+$`))
+	assert.Equal(t, nil, check("abc"))
+	assert.NotEqual(t, nil, check("ab1"))
+}
+
+func TestStoreCheckValue(t *testing.T) {
+	st := New()
+	defer close(st.Ops)
+	st.ReserveWith(MustCompileGlob("/cfg/**"), CheckValue(JSONValue))
+	ch, _ := st.Wait(2)
+
+	st.Ops <- Op{1, MustEncodeSet("/cfg/a", `{"x": 1}`, Clobber)}
+	st.Ops <- Op{2, MustEncodeSet("/cfg/a", `{"x": `, Clobber)}
+	st.Ops <- Op{3, MustEncodeDel("/cfg/a", Clobber)}
+	sync(st, 3)
+
+	ev := <-ch
+	_, ok := ev.Err.(*BadValueError)
+	assert.T(t, ok)
+	assert.Equal(t, ErrorPath, ev.Path)
+
+	_, rev := st.Get("/cfg/a")
+	assert.Equal(t, Missing, rev)
+}
@@ -0,0 +1,104 @@
+package store
+
+import (
+	"bytes"
+	"compress/flate"
+	"expvar"
+	"io/ioutil"
+	"strconv"
+	"strings"
+)
+
+var zippedBytes = expvar.NewInt("store.compressed_body_bytes_saved")
+
+// Has st keep the body of each file set from now on compressed, if it
+// is longer than n bytes and compressing it saves space. Reads see the
+// body as it was set, and Stat and StatTree report its full length, so
+// this changes only how much memory the tree takes, and what a read of
+// a large body costs: each one decompresses it. Events carry the body
+// as it was set, too. If n is zero or less, bodies set from now on are
+// kept as they are, which is the default.
+//
+// The setting is local: peers may differ in it, and sets that were
+// already applied stay as they are.
+func (st *Store) Compress(n int) {
+	select {
+	case st.zipCh <- n:
+	case <-st.done:
+	}
+}
+
+// Decides the form in which the tree keeps the bodies of sets. It is
+// owned by the process goroutine.
+type packer struct {
+	zipOver int // see Store.Compress
+}
+
+// Returns the form in which the tree keeps body: compressed, with zip
+// set, if pk is set to compress bodies of its length and it shrinks;
+// otherwise body itself.
+func (pk *packer) pack(body string) (v string, zip bool) {
+	if pk == nil || pk.zipOver <= 0 || len(body) <= pk.zipOver {
+		return body, false
+	}
+
+	z := deflate(body)
+	if len(z) >= len(body) {
+		return body, false
+	}
+	zippedBytes.Add(int64(len(body) - len(z)))
+	return z, true
+}
+
+// Returns s compressed, preceded by its length in decimal and a colon,
+// so that size needn't decompress it.
+func deflate(s string) string {
+	var b bytes.Buffer
+	b.WriteString(strconv.Itoa(len(s)))
+	b.WriteByte(':')
+	w := flate.NewWriter(&b, flate.BestSpeed)
+	w.Write([]byte(s))
+	w.Close()
+	return b.String()
+}
+
+func inflate(z string) string {
+	i := strings.Index(z, ":")
+	p, err := ioutil.ReadAll(flate.NewReader(strings.NewReader(z[i+1:])))
+	if err != nil {
+		// Only deflate made z, so this can't happen.
+		panic(err)
+	}
+	return string(p)
+}
+
+// Returns the body of m, a file, as it was set.
+func (m node) body() string {
+	if !m.Zip {
+		return m.V
+	}
+	return inflate(m.V)
+}
+
+// Reports whether m, a file, holds the body the set e wrote. A file set
+// twice at one seqn, as a batch can, has the later body; for a
+// compressed one, a body of another length tells them apart, and one
+// of the same length is taken to be e's.
+func (m node) wrote(e Event) bool {
+	if m.Rev != e.Rev {
+		return false
+	}
+	if !m.Zip {
+		return m.V == e.Body
+	}
+	return m.size() == len(e.Body)
+}
+
+// Returns the length of the body of m, a file, as it was set.
+func (m node) size() int {
+	if !m.Zip {
+		return len(m.V)
+	}
+	n, _ := strconv.Atoi(m.V[:strings.Index(m.V, ":")])
+	return n
+}
@@ -0,0 +1,104 @@
+package store
+
+import (
+	"github.com/bmizerany/assert"
+	"strings"
+	"testing"
+)
+
+func TestZipPack(t *testing.T) {
+	pk := new(packer)
+	body := strings.Repeat("abc", 100)
+
+	v, zip := pk.pack(body)
+	assert.T(t, !zip)
+	assert.Equal(t, body, v)
+
+	pk.zipOver = 10
+	v, zip = pk.pack(body)
+	assert.T(t, zip)
+	assert.T(t, len(v) < len(body))
+
+	m := node{V: v, Zip: true}
+	assert.Equal(t, body, m.body())
+	assert.Equal(t, len(body), m.size())
+}
+
+func TestZipPackShort(t *testing.T) {
+	pk := new(packer)
+	pk.zipOver = 10
+	v, zip := pk.pack("short")
+	assert.T(t, !zip)
+	assert.Equal(t, "short", v)
+}
+
+func TestZipPackIncompressible(t *testing.T) {
+	pk := new(packer)
+	pk.zipOver = 1
+	v, zip := pk.pack("abcdefghijklmnop")
+	assert.T(t, !zip)
+	assert.Equal(t, "abcdefghijklmnop", v)
+}
+
+func TestZipPackNil(t *testing.T) {
+	var pk *packer
+	v, zip := pk.pack(strings.Repeat("x", 100))
+	assert.T(t, !zip)
+	assert.Equal(t, strings.Repeat("x", 100), v)
+}
+
+func TestZipStore(t *testing.T) {
+	st := New()
+	defer close(st.Ops)
+	st.Compress(100)
+
+	body := strings.Repeat("abcd", 1000)
+	w := NewWatch(st, MustCompileGlob("/**"))
+	defer w.Stop()
+	st.Ops <- Op{1, MustEncodeSet("/a", body, Clobber)}
+	st.Ops <- Op{2, MustEncodeSet("/b", "small", Clobber)}
+	sync(st, 2)
+
+	ev := <-w.C
+	assert.Equal(t, body, ev.Body)
+
+	_, g := st.Snap()
+	root := g.(node)
+	assert.T(t, root.Ds["a"].Zip)
+	assert.T(t, !root.Ds["b"].Zip)
+	assert.Equal(t, body, GetString(st, "/a"))
+
+	ln, rev := st.Stat("/a")
+	assert.Equal(t, int32(len(body)), ln)
+	assert.Equal(t, int64(1), rev)
+	assert.Equal(t, int64(len(body)+len("small")), StatTree(st, "/").Bytes)
+	assert.Equal(t, BodySum(body), StatOf(st, "/a").Sum)
+}
+
+func TestZipStoreOff(t *testing.T) {
+	st := New()
+	defer close(st.Ops)
+	st.Compress(100)
+	st.Compress(0)
+
+	st.Ops <- Op{1, MustEncodeSet("/a", strings.Repeat("abcd", 1000), Clobber)}
+	sync(st, 1)
+	_, g := st.Snap()
+	assert.T(t, !g.(node).Ds["a"].Zip)
+}
+
+func TestZipCopy(t *testing.T) {
+	n := emptyDir
+	body := strings.Repeat("abcd", 1000)
+	v, _ := (&packer{zipOver: 100}).pack(body)
+	n = n.setpz("/a", v, true, BodySum(body), 1, 1, true)
+
+	m, _ := EncodeCopy("/a", "/b", Missing)
+	n, ev := n.apply(2, m)
+	assert.Equal(t, nil, ev.Err)
+	assert.Equal(t, body, ev.Body)
+	assert.T(t, n.Ds["b"].Zip)
+	assert.Equal(t, BodySum(body), n.Ds["b"].Sum)
+	b, _ := n.Get("/b")
+	assert.Equal(t, []string{body}, b)
+}
@@ -0,0 +1,126 @@
+package ttl
+
+import (
+	"doozer/consensus"
+	"doozer/store"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// A file in Dir gives the file at the rest of its path an expiry. Its
+// body is "<when> <rev>", where when is a time in nanoseconds (by the
+// peers' clocks) or "@" followed by a seqn. Once when has passed, the
+// file is deleted if it still has rev, and the expiry with it. For
+// example, /ctl/ttl/x="@500 12" deletes /x at seqn 500 unless /x
+// has been written since rev 12. Files in /ctl are never deleted this
+// way.
+const Dir = "/ctl/ttl"
+
+
+var expiries = store.MustCompileGlob(Dir + "/**")
+
+
+// Checks the delete of an expired file before it is proposed, as a
+// server checks a client's; see server.Server.CheckWrite. The
+// arguments are those of sched.Check. If the error has a Temporary
+// method that reports true, the delete is tried again later.
+type Check func(path, body string, rev int64, keep bool) os.Error
+
+
+// An expiry for a file in /ctl, where the cluster keeps its own state,
+// is dropped: it was written by a client, and clients could otherwise
+// delete the cluster's files through it.
+var ErrCtl = &store.Error{store.CodeCtl, "expiry of a file in /ctl"}
+
+
+type expiry struct {
+	rev    int64 // the file must still have
+	expRev int64 // of the expiry itself
+}
+
+
+// Clean receives nanosecond time values from t. For each time
+// received, Clean deletes every file whose expiry has passed as of that
+// time and the seqn of st, if check allows it, along with the expiry.
+// The expiry is deleted only if it still has the rev Clean read, so an
+// expiry set again in the meantime stays. One for a file in /ctl, or
+// whose delete check refuses for good, is deleted alone.
+//
+// Parameter t can be the output chan of a time.Ticker.
+func Clean(st *store.Store, p consensus.Proposer, t <-chan int64, check Check) {
+	for now := range t {
+		ver, g := st.Snap()
+		for path, x := range expired(g, now, ver) {
+			err := validate(path[len(Dir):], x.rev, check)
+			if isTemporary(err) {
+				continue
+			}
+			if err != nil {
+				log.Printf("ttl: dropping %s: %v", path, err)
+			} else {
+				e := consensus.Del(p, path[len(Dir):], x.rev)
+				if e.Err != nil && e.Err != store.ErrRevMismatch {
+					continue
+				}
+			}
+			consensus.Del(p, path, x.expRev)
+		}
+	}
+}
+
+
+func validate(path string, rev int64, check Check) os.Error {
+	if p := strings.ToLower(path); p == "/ctl" || strings.HasPrefix(p, "/ctl/") {
+		return ErrCtl
+	}
+	return check(path, "", rev, false)
+}
+
+
+func isTemporary(err os.Error) bool {
+	t, ok := err.(interface {
+		Temporary() bool
+	})
+	return ok && t.Temporary()
+}
+
+
+// Returns each expired file's expiry, keyed by the path of the
+// expiry.
+func expired(g store.Getter, now, seqn int64) map[string]expiry {
+	exps := make(map[string]expiry)
+	store.Walk(g, expiries, func(path, body string, expRev int64) bool {
+		if when, rev, ok := parse(body); ok {
+			if strings.HasPrefix(when, "@") {
+				n, err := strconv.Atoi64(when[1:])
+				if err == nil && n <= seqn {
+					exps[path] = expiry{rev, expRev}
+				}
+			} else {
+				n, err := strconv.Atoi64(when)
+				if err == nil && n < now {
+					exps[path] = expiry{rev, expRev}
+				}
+			}
+		}
+		return false
+	})
+	return exps
+}
+
+
+func parse(body string) (when string, rev int64, ok bool) {
+	parts := strings.Fields(body)
+	if len(parts) != 2 {
+		return "", 0, false
+	}
+
+	rev, err := strconv.Atoi64(parts[1])
+	if err != nil {
+		return "", 0, false
+	}
+	return parts[0], rev, true
+}
+
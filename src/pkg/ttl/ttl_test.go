@@ -0,0 +1,87 @@
+package ttl
+
+import (
+	"doozer/store"
+	"doozer/test"
+	"github.com/bmizerany/assert"
+	"os"
+	"strconv"
+	"testing"
+)
+
+func allow(path, body string, rev int64, keep bool) os.Error {
+	return nil
+}
+
+func TestTTLClean(t *testing.T) {
+	st := store.New()
+	defer close(st.Ops)
+	fp := &test.FakeProposer{Store: st}
+	tc := make(chan int64, 1)
+	defer close(tc)
+	go Clean(st, fp, tc, allow)
+
+	ev := fp.Propose([]byte(store.MustEncodeSet("/x", "a", store.Clobber)))
+	fp.Propose([]byte(store.MustEncodeSet(Dir+"/x", "5 "+strconv.Itoa64(ev.Seqn), store.Clobber)))
+
+	ch := st.Watch(store.MustCompileGlob("/x"))
+	tc <- 10
+
+	ev = <-ch
+	assert.T(t, ev.IsDel())
+	assert.Equal(t, "/x", ev.Path)
+}
+
+
+func TestExpired(t *testing.T) {
+	st := store.New()
+	defer close(st.Ops)
+
+	st.Ops <- store.Op{1, store.MustEncodeSet(Dir+"/a", "5 1", 0)}
+	st.Ops <- store.Op{2, store.MustEncodeSet(Dir+"/b", "15 1", 0)}
+	st.Ops <- store.Op{3, store.MustEncodeSet(Dir+"/c", "@3 2", 0)}
+	st.Ops <- store.Op{4, store.MustEncodeSet(Dir+"/d", "@9 2", 0)}
+	st.Ops <- store.Op{5, store.MustEncodeSet(Dir+"/e", "junk", 0)}
+	<-st.Seqns
+
+	exp := map[string]expiry{Dir + "/a": {1, 1}, Dir + "/c": {2, 3}}
+	assert.Equal(t, exp, expired(st, 10, 5))
+}
+
+func TestTTLCleanCtl(t *testing.T) {
+	st := store.New()
+	defer close(st.Ops)
+	fp := &test.FakeProposer{Store: st}
+	tc := make(chan int64, 1)
+	defer close(tc)
+	go Clean(st, fp, tc, allow)
+
+	ev := fp.Propose([]byte(store.MustEncodeSet("/ctl/x", "a", store.Clobber)))
+	fp.Propose([]byte(store.MustEncodeSet(Dir+"/ctl/x", "5 "+strconv.Itoa64(ev.Seqn), store.Clobber)))
+
+	ch := st.Watch(store.MustCompileGlob(Dir + "/**"))
+	tc <- 10
+	ev = <-ch
+	assert.T(t, ev.IsDel())
+	assert.Equal(t, "a", store.GetString(st, "/ctl/x"))
+}
+
+func TestTTLCleanRefused(t *testing.T) {
+	st := store.New()
+	defer close(st.Ops)
+	fp := &test.FakeProposer{Store: st}
+	tc := make(chan int64, 1)
+	defer close(tc)
+	go Clean(st, fp, tc, func(string, string, int64, bool) os.Error {
+		return os.EPERM
+	})
+
+	ev := fp.Propose([]byte(store.MustEncodeSet("/x", "a", store.Clobber)))
+	fp.Propose([]byte(store.MustEncodeSet(Dir+"/x", "5 "+strconv.Itoa64(ev.Seqn), store.Clobber)))
+
+	ch := st.Watch(store.MustCompileGlob(Dir + "/**"))
+	tc <- 10
+	ev = <-ch
+	assert.T(t, ev.IsDel())
+	assert.Equal(t, "a", store.GetString(st, "/x"))
+}
@@ -1,26 +1,47 @@
 package web
 
 import (
+	"doozer/gocount"
+	"doozer/server"
 	"doozer/store"
 	"http"
 	"io"
 	"json"
 	"log"
 	"net"
+	"os"
 	"runtime"
+	"sort"
+	"strconv"
 	"strings"
 	"template"
+	"time"
 	"websocket"
 )
 
 var Store *store.Store
+var Server *server.Server
 var ClusterName, evPrefix string
 
+// Whether /log serves the mutation log. The log holds every body ever
+// written, including those of secret files, which a log can't redact
+// and still be replayed; so it is off unless asked for.
+var ServeLog bool
+
+// If set, the log is signed with this key. See store.DumpSigned.
+var LogKey []byte
+
 var (
 	mainTpl  = template.MustParse(main_html, nil)
 	statsTpl = template.MustParse(stats_html, nil)
 )
 
+// Limits on how long a /wait request is held, in ns.
+const (
+	defaultWaitTimeout = 30e9
+	maxWaitTimeout     = 60e9
+)
+
 type info struct {
 	Path string
 }
@@ -40,6 +61,9 @@ func Serve(listener net.Listener) {
 	evPrefix = "/events" + prefix
 
 	http.Handle("/", http.RedirectHandler("/view/d/"+ClusterName+"/", 307))
+	http.HandleFunc("/health", health)
+	http.HandleFunc("/log", logText)
+	http.HandleFunc("/wait", waitJSON)
 	http.HandleFunc("/stats.html", statsHtml)
 	http.HandleFunc("/view/", viewHtml)
 	http.Handle("/main.js", stringHandler{"application/javascript", main_js})
@@ -49,20 +73,24 @@ func Serve(listener net.Listener) {
 	http.Serve(listener, nil)
 }
 
-func send(ws *websocket.Conn, path string, evs <-chan store.Event) {
+// Sends each write matching glob in the events from evs.
+func send(ws *websocket.Conn, path string, glob *store.Glob, evs <-chan store.Event) {
 	l := len(path) - 1
 	for ev := range evs {
-		ev.Getter = nil // don't marshal the entire snapshot
-		ev.Path = ev.Path[l:]
-		b, err := json.Marshal(ev)
-		if err != nil {
-			log.Println(err)
-			return
-		}
-		_, err = ws.Write(b)
-		if err != nil {
-			log.Println(err)
-			return
+		for _, ev := range store.Writes(glob, ev) {
+			ev = store.Redact(Store, ev)
+			ev.Getter = nil // don't marshal the entire snapshot
+			ev.Path = ev.Path[l:]
+			b, err := json.Marshal(ev)
+			if err != nil {
+				log.Println(err)
+				return
+			}
+			_, err = ws.Write(b)
+			if err != nil {
+				log.Println(err)
+				return
+			}
 		}
 	}
 }
@@ -85,8 +113,8 @@ func evServer(w http.ResponseWriter, r *http.Request) {
 	}()
 
 	websocket.Handler(func(ws *websocket.Conn) {
-		send(ws, path, wevs)
-		send(ws, path, wt.C)
+		send(ws, path, glob, wevs)
+		send(ws, path, glob, wt.C)
 		wt.Stop()
 		ws.Close()
 	}).ServeHTTP(w, r)
@@ -103,9 +131,154 @@ func viewHtml(w http.ResponseWriter, r *http.Request) {
 	mainTpl.Execute(w, x)
 }
 
+type goroutines struct {
+	Name  string
+	Count int64
+}
+
+type stats struct {
+	Alloc, TotalAlloc uint64
+	Goroutines        []goroutines
+}
+
 func statsHtml(w http.ResponseWriter, r *http.Request) {
+	x := stats{Alloc: runtime.MemStats.Alloc, TotalAlloc: runtime.MemStats.TotalAlloc}
+	counts := gocount.Counts()
+	var names []string
+	for name := range counts {
+		names = append(names, name)
+	}
+	sort.SortStrings(names)
+	for _, name := range names {
+		x.Goroutines = append(x.Goroutines, goroutines{name, counts[name]})
+	}
+
 	w.SetHeader("content-type", "text/html")
-	statsTpl.Execute(w, runtime.MemStats)
+	statsTpl.Execute(w, x)
+}
+
+// Responds 200 if the server is fully caught up and accepting
+// mutations, 503 otherwise. The body names the current phase.
+func health(w http.ResponseWriter, r *http.Request) {
+	p := server.Recovering
+	if Server != nil {
+		p = Server.Phase()
+	}
+	w.SetHeader("content-type", "text/plain")
+	if p != server.Serving {
+		w.WriteHeader(503)
+	}
+	io.WriteString(w, p.String()+"\n")
+}
+
+// Writes the decided mutation log, starting at the position given by
+// the from parameter (default 1), in the format read by store.Replay,
+// or store.ReplaySigned if LogKey is set. Responds 403 unless ServeLog
+// is set.
+func logText(w http.ResponseWriter, r *http.Request) {
+	if !ServeLog {
+		w.WriteHeader(403)
+		io.WriteString(w, "log disabled; start with -web-log to serve it\n")
+		return
+	}
+
+	from := int64(1)
+	if s := r.FormValue("from"); s != "" {
+		n, err := strconv.Atoi64(s)
+		if err != nil {
+			w.WriteHeader(400)
+			return
+		}
+		from = n
+	}
+	w.SetHeader("content-type", "text/plain")
+	var err os.Error
+	if LogKey != nil {
+		_, err = Store.DumpSigned(w, from, LogKey)
+	} else {
+		_, err = Store.Dump(w, from)
+	}
+	if err != nil {
+		log.Println(err)
+	}
+}
+
+// The body of a response to /wait.
+type waitResult struct {
+	Rev    int64
+	Events []store.Event
+}
+
+// Long-polls for changes to files matching the glob parameter made
+// after the rev parameter (default the current rev). Responds as soon as there are any, or after
+// the timeout parameter, in seconds (default 30, at most 60), with a
+// JSON object holding the changes made in the earliest revision
+// after rev, and Rev, that revision. If the timeout passes first,
+// Events is empty and Rev is rev, so the client can simply ask again
+// with the Rev it gets back. Responds 410 if rev has been collected.
+func waitJSON(w http.ResponseWriter, r *http.Request) {
+	glob, err := store.CompileGlob(r.FormValue("glob"))
+	if err != nil {
+		w.WriteHeader(400)
+		return
+	}
+
+	rev, _ := Store.Snap()
+	if s := r.FormValue("rev"); s != "" {
+		rev, err = strconv.Atoi64(s)
+		if err != nil {
+			w.WriteHeader(400)
+			return
+		}
+	}
+
+	timeout := int64(defaultWaitTimeout)
+	if s := r.FormValue("timeout"); s != "" {
+		secs, err := strconv.Atof64(s)
+		if err != nil || secs < 0 {
+			w.WriteHeader(400)
+			return
+		}
+		timeout = int64(secs * 1e9)
+	}
+	if timeout > maxWaitTimeout {
+		timeout = maxWaitTimeout
+	}
+
+	wt, err := store.NewWatchFrom(Store, glob, rev+1)
+	if err == store.ErrTooLate {
+		w.WriteHeader(410)
+		return
+	} else if err != nil {
+		w.WriteHeader(503)
+		return
+	}
+	defer wt.Stop()
+
+	res := waitResult{Rev: rev, Events: []store.Event{}}
+	select {
+	case ev := <-wt.C:
+		if closed(wt.C) || ev.Err == store.ErrClosed {
+			w.WriteHeader(503)
+			return
+		}
+		res.Rev = ev.Seqn
+		for _, e := range store.Writes(glob, ev) {
+			e = store.Redact(Store, e)
+			e.Getter = nil // don't marshal the entire snapshot
+			res.Events = append(res.Events, e)
+		}
+	case <-time.After(timeout):
+	}
+
+	b, err := json.Marshal(res)
+	if err != nil {
+		log.Println(err)
+		w.WriteHeader(500)
+		return
+	}
+	w.SetHeader("content-type", "application/json")
+	w.Write(b)
 }
 
 func walk(path string, st *store.Store, ch chan store.Event) {
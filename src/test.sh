@@ -19,7 +19,7 @@ fi
     for pkg in $PKGS
     do
         name=$(echo $pkg | sed 's/\//_/' | tr -d .)
-        echo "it_passes_pkg_$name() { cd pkg/$name; gotest $@; }"
+        echo "it_passes_pkg_$name() { cd pkg/$pkg; gotest $@; }"
     done
 } > all-test.sh
 